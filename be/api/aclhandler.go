@@ -0,0 +1,266 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// ACLEntryInfo godoc
+// @Description Entry of the access control list of an object: a user or a group and its permissions, e.g. "rw-"
+type ACLEntryInfo struct {
+	ID            string `json:"id,omitempty"`
+	ObjectID      string `json:"object_id,omitempty"`
+	PrincipalType string `json:"principal_type"` // user or group
+	PrincipalID   string `json:"principal_id"`
+	PrincipalName string `json:"principal_name,omitempty"`
+	Permissions   string `json:"permissions"`
+	Inherited     bool   `json:"inherited"` // set on a folder above the object
+}
+
+// ACLResponse godoc
+// @Description Access control list of an object, with the entries inherited from the folders above it
+type ACLResponse struct {
+	ObjectID string         `json:"object_id"`
+	Entries  []ACLEntryInfo `json:"entries"`
+}
+
+// ACLRequest godoc
+// @Description The entries of an object, replacing the current ones
+type ACLRequest struct {
+	Entries []ACLEntryInfo `json:"entries"`
+}
+
+// EffectivePermissionsResponse godoc
+// @Description Permissions of a user on an object: from its permissions string and from the ACLs
+type EffectivePermissionsResponse struct {
+	ObjectID    string `json:"object_id"`
+	UserID      string `json:"user_id"`
+	Permissions string `json:"permissions"` // e.g. rw-
+	Unix        string `json:"unix"`
+	ACL         string `json:"acl"`
+	Read        bool   `json:"read"`
+	Write       bool   `json:"write"`
+	Execute     bool   `json:"execute"`
+}
+
+// aclObject returns the object in the path, answering 404 when it does not exist and 403 when it cannot be read
+func aclObject(w http.ResponseWriter, r *http.Request, repo *dblayer.DBRepository) dblayer.DBEntityInterface {
+	objectID := mux.Vars(r)["id"]
+	if len(objectID) == 18 {
+		objectID = strings.ReplaceAll(objectID, "-", "")
+	}
+	object := repo.ObjectByID(objectID, true)
+	if object == nil {
+		RespondSimpleError(w, ErrObjectNotFound, "Object not found", http.StatusNotFound)
+		return nil
+	}
+	if !repo.CheckReadPermission(object) {
+		RespondSimpleError(w, ErrForbidden, "You don't have permission to view this object", http.StatusForbidden)
+		return nil
+	}
+	return object
+}
+
+// principalName returns the login of a user or the name of a group, empty when it does not exist
+func principalName(repo *dblayer.DBRepository, principalType string, principalID string) string {
+	switch principalType {
+	case dblayer.ACLUser:
+		if user := repo.GetEntityByID("users", principalID); user != nil {
+			login, _ := user.GetValue("login").(string)
+			return login
+		}
+	case dblayer.ACLGroup:
+		if group := repo.GetEntityByID("groups", principalID); group != nil {
+			name, _ := group.GetValue("name").(string)
+			return name
+		}
+	}
+	return ""
+}
+
+// respondACL writes the entries that apply to an object
+func respondACL(w http.ResponseWriter, repo *dblayer.DBRepository, object dblayer.DBEntityInterface) {
+	objectID := object.GetValue("id").(string)
+	entries, err := repo.GetEffectiveACL(object)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to read the access control list", http.StatusInternalServerError)
+		return
+	}
+	response := ACLResponse{ObjectID: objectID, Entries: []ACLEntryInfo{}}
+	for _, entry := range entries {
+		info := ACLEntryInfo{
+			ID:            entry.GetValue("id").(string),
+			ObjectID:      entry.GetValue("object_id").(string),
+			PrincipalType: entry.GetValue("principal_type").(string),
+			PrincipalID:   entry.GetValue("principal_id").(string),
+			Permissions:   entry.GetValue("permissions").(string),
+		}
+		info.PrincipalName = principalName(repo, info.PrincipalType, info.PrincipalID)
+		info.Inherited = info.ObjectID != objectID
+		response.Entries = append(response.Entries, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetACLHandler godoc
+// @Summary Get the access control list of an object
+// @Description Returns the entries of the object and, for the other users and groups, the nearest ones of the folders above it
+// @Tags objects
+// @Produce json
+// @Param id path string true "Object ID"
+// @Success 200 {object} ACLResponse
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Object not found"
+// @Security BearerAuth
+// @Router /objects/{id}/acl [get]
+func GetACLHandler(w http.ResponseWriter, r *http.Request) {
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+	object := aclObject(w, r, repo)
+	if object == nil {
+		return
+	}
+	respondACL(w, repo, object)
+}
+
+// UpdateACLHandler godoc
+// @Summary Replace the access control list of an object
+// @Description Replaces the entries of the object. Only its owner and the users with objects.chmod can change them.
+// @Tags objects
+// @Accept json
+// @Produce json
+// @Param id path string true "Object ID"
+// @Param request body ACLRequest true "The entries of the object"
+// @Success 200 {object} ACLResponse
+// @Failure 400 {object} ErrorResponse "Invalid entry"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Object not found"
+// @Security BearerAuth
+// @Router /objects/{id}/acl [put]
+func UpdateACLHandler(w http.ResponseWriter, r *http.Request) {
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+	object := aclObject(w, r, repo)
+	if object == nil {
+		return
+	}
+	if object.GetValue("owner") != principal.UserID && !principal.Can(dblayer.CapabilityObjectsChmod) {
+		RespondSimpleError(w, ErrForbidden, "Only the owner can change the access control list", http.StatusForbidden)
+		return
+	}
+
+	var req ACLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	entries := []map[string]string{}
+	for _, entry := range req.Entries {
+		if entry.PrincipalType != dblayer.ACLUser && entry.PrincipalType != dblayer.ACLGroup {
+			RespondError(w, ErrInvalidField, "principal_type must be user or group", map[string]string{"field": "principal_type"}, http.StatusBadRequest)
+			return
+		}
+		if !dblayer.ValidACLPermissions(entry.Permissions) {
+			RespondError(w, ErrInvalidField, "permissions must be like rwx, r-- or ---", map[string]string{"field": "permissions"}, http.StatusBadRequest)
+			return
+		}
+		if principalName(repo, entry.PrincipalType, entry.PrincipalID) == "" {
+			RespondError(w, ErrInvalidField, "Unknown "+entry.PrincipalType, map[string]string{"field": "principal_id", "principal_id": entry.PrincipalID}, http.StatusBadRequest)
+			return
+		}
+		entries = append(entries, map[string]string{
+			"principal_type": entry.PrincipalType,
+			"principal_id":   entry.PrincipalID,
+			"permissions":    entry.Permissions,
+		})
+	}
+	if _, err := repo.SetACL(object.GetValue("id").(string), entries); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to save the access control list: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondACL(w, repo, object)
+}
+
+// GetEffectivePermissionsHandler godoc
+// @Summary Get the effective permissions of a user on an object
+// @Description Returns what a user can do on the object, from its permissions string and from the ACLs.
+// @Description Without user_id, for the current user; for other users, only the owner of the object and the users with objects.chmod can ask.
+// @Tags objects
+// @Produce json
+// @Param id path string true "Object ID"
+// @Param user_id query string false "User ID"
+// @Success 200 {object} EffectivePermissionsResponse
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Object or user not found"
+// @Security BearerAuth
+// @Router /objects/{id}/permissions [get]
+func GetEffectivePermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+	object := aclObject(w, r, repo)
+	if object == nil {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	userRepo := repo
+	if userID != "" && userID != principal.UserID {
+		if object.GetValue("owner") != principal.UserID && !principal.Can(dblayer.CapabilityObjectsChmod) {
+			RespondSimpleError(w, ErrForbidden, "Only the owner can see the permissions of other users", http.StatusForbidden)
+			return
+		}
+		systemRepo := dblayer.NewSystemRepository("permissions of user "+userID, permissionTables...).WithContext(r.Context())
+		user := systemRepo.GetEntityByID("users", userID)
+		if user == nil {
+			RespondSimpleError(w, ErrObjectNotFound, "User not found", http.StatusNotFound)
+			return
+		}
+		primaryGroupID, _ := user.GetValue("group_id").(string)
+		groupIDs, err := GetUserGroupIDs(systemRepo, userID, primaryGroupID)
+		if err != nil {
+			RespondSimpleError(w, ErrInternalServer, "Failed to read the groups of the user", http.StatusInternalServerError)
+			return
+		}
+		userRepo = dblayer.NewDBRepository(&dblayer.DBContext{
+			UserID:   userID,
+			GroupIDs: groupIDs,
+			Schema:   dblayer.DbSchema,
+		}, dblayer.Factory, dblayer.DbConnection).WithContext(r.Context())
+	} else {
+		userID = principal.UserID
+	}
+
+	unix, acl := userRepo.EffectivePermissions(object)
+	permissions := []byte(unix)
+	for i := range permissions {
+		if acl[i] != '-' {
+			permissions[i] = acl[i]
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EffectivePermissionsResponse{
+		ObjectID:    object.GetValue("id").(string),
+		UserID:      userID,
+		Permissions: string(permissions),
+		Unix:        unix,
+		ACL:         acl,
+		Read:        permissions[0] == 'r',
+		Write:       permissions[1] == 'w',
+		Execute:     permissions[2] == 'x',
+	})
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestACLHandlers
+func TestACLHandlers(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	newUser := func(name string) (dblayer.DBEntityInterface, string) {
+		login := name + Random4digits()
+		user, err := adminRepo.CreateObject("users", map[string]any{
+			"login":    login,
+			"pwd":      "acl-password",
+			"fullname": name,
+		}, map[string]any{})
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		t.Cleanup(func() { adminRepo.Delete(user) })
+		return user, ApiTestDoLogin(t, login, "acl-password")
+	}
+	owner, ownerToken := newUser("aclowner")
+	reader, readerToken := newUser("aclreader")
+	readerID := reader.GetValue("id").(string)
+	ownerRepo := SetupTestRepo(t, owner.GetValue("id").(string), []string{owner.GetValue("group_id").(string)}, AppConfig.TablePrefix)
+
+	call := func(handler http.HandlerFunc, token string, method string, objectID string, query string, payload any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, "/"+query, bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req = mux.SetURLVars(req, map[string]string{"id": objectID})
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	permissionsOf := func(token string, objectID string, query string) EffectivePermissionsResponse {
+		rr := call(GetEffectivePermissionsHandler, token, http.MethodGet, objectID, query, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+		}
+		var response EffectivePermissionsResponse
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return response
+	}
+
+	folder, err := ownerRepo.CreateObject("folders", map[string]any{"name": "ACL shared", "permissions": "rwx------"}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	folderID := folder.GetValue("id").(string)
+	page, err := ownerRepo.CreateObject("pages", map[string]any{"name": "ACL page", "father_id": folderID}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create page: %v", err)
+	}
+	pageID := page.GetValue("id").(string)
+	t.Cleanup(func() {
+		adminRepo.SetACL(folderID, nil)
+		adminRepo.Delete(page)
+		adminRepo.Delete(folder)
+	})
+
+	// 1. Private: the reader cannot see it, nor change its ACL
+	if rr := call(GetACLHandler, readerToken, http.MethodGet, pageID, "", nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+	if response := permissionsOf(ownerToken, pageID, "?user_id="+readerID); response.Read || response.Permissions != "---" {
+		t.Fatalf("Expected no permissions, got %+v", response)
+	}
+
+	// 2. The owner shares the folder with the reader
+	if rr := call(UpdateACLHandler, ownerToken, http.MethodPut, folderID, "", ACLRequest{Entries: []ACLEntryInfo{
+		{PrincipalType: "role", PrincipalID: readerID, Permissions: "r--"},
+	}}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for an invalid principal type, got %v", rr.Code)
+	}
+	if rr := call(UpdateACLHandler, ownerToken, http.MethodPut, folderID, "", ACLRequest{Entries: []ACLEntryInfo{
+		{PrincipalType: dblayer.ACLUser, PrincipalID: "nobody", Permissions: "r--"},
+	}}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for an unknown user, got %v", rr.Code)
+	}
+	rr := call(UpdateACLHandler, ownerToken, http.MethodPut, folderID, "", ACLRequest{Entries: []ACLEntryInfo{
+		{PrincipalType: dblayer.ACLUser, PrincipalID: readerID, Permissions: "r--"},
+	}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// 3. The page inherits the entry of the folder
+	rr = call(GetACLHandler, readerToken, http.MethodGet, pageID, "", nil)
+	var acl ACLResponse
+	json.Unmarshal(rr.Body.Bytes(), &acl)
+	if rr.Code != http.StatusOK || len(acl.Entries) != 1 || !acl.Entries[0].Inherited || acl.Entries[0].ObjectID != folderID ||
+		acl.Entries[0].PrincipalName != reader.GetValue("login") {
+		t.Fatalf("Expected the inherited entry, got %v %s", rr.Code, rr.Body.String())
+	}
+	if response := permissionsOf(readerToken, pageID, ""); !response.Read || response.Write || response.Unix != "---" || response.ACL != "r--" {
+		t.Fatalf("Expected read through the ACL, got %+v", response)
+	}
+	if response := permissionsOf(ownerToken, pageID, "?user_id="+readerID); response.Permissions != "r--" || response.UserID != readerID {
+		t.Fatalf("Expected r-- for the reader, got %+v", response)
+	}
+
+	// 4. Only the owner changes the ACL and sees the permissions of others
+	if rr := call(UpdateACLHandler, readerToken, http.MethodPut, pageID, "", ACLRequest{Entries: []ACLEntryInfo{
+		{PrincipalType: dblayer.ACLUser, PrincipalID: readerID, Permissions: "rwx"},
+	}}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+	if rr := call(GetEffectivePermissionsHandler, readerToken, http.MethodGet, pageID, "?user_id="+owner.GetValue("id").(string), nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"log"
 	"net/http"
 	"rprj/be/dblayer"
-	"strings"
 )
 
 type DashboardResponse struct {
@@ -27,30 +26,22 @@ type DashboardResponse struct {
 // @Produce json
 // @Success 200 {object} DashboardResponse
 // @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
 // @Failure 500 {object} ErrorResponse "Internal server error"
+// @Security BearerAuth
 // @Router /admin/dashboard [get]
 func DashboardHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authorizedRequest(w, r, dblayer.CapabilityDashboardView)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	var response DashboardResponse
 	response.Success = true
 	response.Message = "Dashboard data retrieved successfully"
 
 	// Get user statistics
-	err = userStatistics(repo, &response)
+	err := userStatistics(repo, &response)
 	if err != nil {
 		response.Success = false
 		response.Message = "Failed to get dashboard data"
@@ -2,19 +2,20 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"slices"
 	"strings"
 	"time"
 
 	"rprj/be/dblayer"
+	"rprj/be/mail"
 	"rprj/be/models"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
-// default JWT key; replace with a secure value loaded from your app configuration at startup
+// default JWT key; replace with a secure value loaded from your app configuration at startup.
+// The access and file tokens are signed by jwtKeyring, which starts with it.
 var JWTKey = []byte("change-me-secret")
 
 type PingResponse struct {
@@ -39,10 +40,18 @@ type Credentials struct {
 }
 
 type TokenResponse struct {
-	AccessToken string   `json:"access_token"`
-	ExpiresAt   int64    `json:"expires_at"`
-	UserID      string   `json:"user_id"`
-	Groups      []string `json:"groups"`
+	AccessToken  string   `json:"access_token"`
+	RefreshToken string   `json:"refresh_token,omitempty"`
+	ExpiresAt    int64    `json:"expires_at"`
+	UserID       string   `json:"user_id"`
+	Groups       []string `json:"groups"`
+	Capabilities []string `json:"capabilities"` // of the groups, see Principal.Can
+}
+
+// RefreshRequest godoc
+// @Description Request body to get new tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 /* *** DBFiles *** */
@@ -61,6 +70,12 @@ var TelegramBotID string
 
 func InitAPI(config models.Config) {
 	JWTKey = []byte(config.JWTSecret)
+	if keyring, err := NewJWTKeyring(config.JWTSecret, config.JWTKeys); err != nil {
+		log.Print("JWT keys ignored, only jwt_secret is used: ", err)
+		jwtKeyring, _ = NewJWTKeyring(config.JWTSecret, nil)
+	} else {
+		jwtKeyring = keyring
+	}
 	dbFiles_root_directory = config.RootDirectory
 	dbFiles_dest_directory = config.FilesDirectory
 	GoogleClientID = config.GoogleClientID
@@ -71,19 +86,62 @@ func InitAPI(config models.Config) {
 	GitHubRedirectURL = config.GitHubRedirectURL
 	TelegramBotToken = config.TelegramBotToken
 	TelegramBotID = config.TelegramBotID
+	ollamaAutoDescribe = config.OllamaAutoDescribe
+	ollamaAllowedGroups = config.OllamaAllowedGroups
+	ollamaAllowedModels = config.OllamaModels
+	ollamaSystemPrompt = config.OllamaSystemPrompt
+	ollamaQuota = NewQuota(config.OllamaRequestsPerHour, config.OllamaTokensPerDay)
+	llmFeatureModels = config.LLMModels
+	totpRequiredGroups = config.TOTPRequiredGroups
+	if config.AppName != "" {
+		totpIssuer = config.AppName
+	}
+	var err error
+	if webAuthn, err = NewWebAuthn(config.WebAuthnRPID, totpIssuer, config.WebAuthnOrigins); err != nil {
+		log.Print("WebAuthn disabled: ", err)
+	}
+	NewOIDCProviders(config.OIDCProviders)
+	ldapDirectory = NewLDAPDirectory(config.LDAP)
+	ldapGroupMap = map[string]string{}
+	for dn, name := range config.LDAP.GroupMap {
+		ldapGroupMap[strings.ToLower(dn)] = name
+	}
+
+	registrationEnabled = config.RegistrationEnabled
+	publicURL = config.PublicURL
+	if mailDriver, err = mail.NewDriver(config.Mail); err != nil {
+		log.Print("Mail disabled: ", err)
+		mailDriver = nil
+	}
+	if config.Mail.MaxAttempts > 0 {
+		mailMaxAttempts = config.Mail.MaxAttempts
+	}
+	registrationQuota = NewQuota(config.RegistrationsPerHour, 0)
+	passwordResetQuota = NewQuota(config.PasswordResetsPerHour, 0)
+	trustedProxies = parseTrustedProxies(config.TrustedProxies)
+	auditRetention = defaultAuditRetention
+	if config.AuditRetentionDays > 0 {
+		auditRetention = time.Duration(config.AuditRetentionDays) * 24 * time.Hour
+	}
+	rateLimiter = NewRateLimiter(config.RateLimit)
+	securityPolicy = NewSecurityPolicy(config.Security)
 	log.Print("API initialized with JWT key from config")
 }
 
 // LoginHandler godoc
 // @Summary User login
 // @Description Authenticate user and receive JWT token
+// @Description When the user enabled the second factor, or the policy requires it, the response is a
+// @Description LoginChallengeResponse and the login continues with /login/2fa or /login/webauthn/begin.
+// @Description After too many failed logins the account is locked for a while, even for the right password.
 // @Tags auth
 // @Accept json
 // @Produce json
 // @Param credentials body Credentials true "Login credentials"
-// @Success 200 {object} map[string]interface{} "token and user info"
+// @Success 200 {object} TokenResponse "token and user info"
 // @Failure 400 {object} ErrorResponse "Invalid request"
 // @Failure 401 {object} ErrorResponse "Invalid credentials"
+// @Failure 429 {object} ErrorResponse "Account locked"
 // @Router /login [post]
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var creds Credentials
@@ -92,89 +150,130 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   "-1",           // DANGEROUS!!!! Think of something better here!!!
-		GroupIDs: []string{"-2"}, // Same here!!!
-		Schema:   dblayer.DbSchema,
+	if locked := rateLimiter.LoginLocked(creds.Login); locked > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(locked.Seconds())+1))
+		RespondSimpleError(w, ErrAccountLocked, "Too many failed logins, try again later", http.StatusTooManyRequests)
+		return
 	}
 
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	repo := dblayer.NewSystemRepository("login", passwordLoginTables...)
 
-	user := repo.GetInstanceByTableName("users")
-	if user == nil {
-		RespondSimpleError(w, ErrInternalServer, "Failed to create user instance", http.StatusInternalServerError)
-		return
-	}
-	user.SetValue("login", creds.Login)
-	foundUsers, err := repo.Search(user, false, false, "")
-	if err != nil || len(foundUsers) == 0 {
+	// Users created by OAuth and LDAP have no password
+	if creds.Pwd == "" {
 		RespondSimpleError(w, ErrUnauthorized, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
-	foundUser, ok := foundUsers[0].(*dblayer.DBUser)
-	if !ok {
-		RespondSimpleError(w, ErrUnauthorized, "Invalid credentials", http.StatusUnauthorized)
-		return
+
+	// Users of the directory log in with their LDAP password, the others with the local one
+	var foundUser *dblayer.DBUser
+	viaLDAP := false
+	if ldapDirectory != nil {
+		var err error
+		foundUser, viaLDAP, err = LDAPLogin(dblayer.NewSystemRepository("LDAP login", ldapLoginTables...), ldapDirectory, creds.Login, creds.Pwd)
+		if err != nil {
+			if !errors.Is(err, errLDAPInvalidCredentials) {
+				log.Print("LoginHandler: LDAP login failed: ", err)
+			}
+			rateLimiter.LoginFailed(creds.Login)
+			RespondSimpleError(w, ErrUnauthorized, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
 	}
+	if !viaLDAP {
+		user := repo.GetInstanceByTableName("users")
+		if user == nil {
+			RespondSimpleError(w, ErrInternalServer, "Failed to create user instance", http.StatusInternalServerError)
+			return
+		}
+		user.SetValue("login", creds.Login)
+		foundUsers, err := repo.Search(user, false, false, "")
+		if err != nil || len(foundUsers) == 0 {
+			rateLimiter.LoginFailed(creds.Login)
+			RespondSimpleError(w, ErrUnauthorized, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		var ok bool
+		foundUser, ok = foundUsers[0].(*dblayer.DBUser)
+		if !ok {
+			RespondSimpleError(w, ErrUnauthorized, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
 
-	// Verify password (supports both encrypted and legacy unencrypted passwords)
-	if !foundUser.VerifyPassword(creds.Pwd) {
-		RespondSimpleError(w, ErrUnauthorized, "Invalid credentials", http.StatusUnauthorized)
-		return
+		// Verify password (supports both encrypted and legacy unencrypted passwords)
+		if !foundUser.VerifyPassword(creds.Pwd) {
+			rateLimiter.LoginFailed(creds.Login)
+			RespondSimpleError(w, ErrUnauthorized, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
 	}
 
-	// Get User groups
-	userGroupsInstance := repo.GetInstanceByTableName("users_groups")
-	if userGroupsInstance == nil {
-		RespondSimpleError(w, ErrInternalServer, "Failed to create user-groups instance", http.StatusInternalServerError)
+	// Disabled users are refused, once the password is checked, before the second factor is asked.
+	// The attempt counts as failed, so the lockout keeps applying to a disabled account
+	if err := checkAccountEnabled(repo, foundUser.GetValue("id").(string)); err != nil {
+		rateLimiter.LoginFailed(creds.Login)
+		respondSessionError(w, err)
 		return
 	}
-	userGroupsInstance.SetValue("user_id", foundUser.GetValue("id"))
-	userGroups, err := repo.Search(userGroupsInstance, false, false, "")
+	rateLimiter.LoginSucceeded(creds.Login)
+
+	// Get User groups
+	primaryGroupID, _ := foundUser.GetValue("group_id").(string)
+	group_list, err := GetUserGroupIDs(repo, foundUser.GetValue("id").(string), primaryGroupID)
 	if err != nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to get user groups: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	group_list := []string{}
-	for _, ug := range userGroups {
-		ugEntry := ug
-		group_list = append(group_list, ugEntry.GetValue("group_id").(string))
-	}
 
-	if foundUser.GetValue("group_id") != "" && slices.Index(group_list, foundUser.GetValue("group_id").(string)) < 0 {
-		group_list = append(group_list, foundUser.GetValue("group_id").(string))
+	// Second factor: the tokens are returned by /login/2fa or /login/webauthn/finish
+	if methods := secondFactorMethods(repo, foundUser.GetValue("id").(string)); len(methods) > 0 || totpRequired(group_list) {
+		respondLoginChallenge(w, foundUser.GetValue("id").(string), methods)
+		return
 	}
 
-	// Genera JWT
-	expiration := time.Now().Add(1 * time.Hour)
-	claims := &jwt.MapClaims{
-		"user_id": foundUser.GetValue("id"),
-		"login":   foundUser.GetValue("login"),
-		"groups":  strings.Join(group_list, ","),
-		"exp":     expiration.Unix(),
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(JWTKey)
+	// Genera JWT e refresh token, salvati in tabella oauth_tokens
+	resp, err := StartSession(repo, r, foundUser.GetValue("id").(string), foundUser.GetValue("login").(string), group_list, "password")
 	if err != nil {
-		RespondSimpleError(w, ErrInternalServer, "Could not generate token", http.StatusInternalServerError)
+		respondSessionError(w, err)
 		return
 	}
 
-	// Salva token in tabella oauth_tokens
-	if err := SaveToken(repo, foundUser.GetValue("id").(string), tokenString, expiration.Unix()); err != nil {
-		log.Print("Error saving token:", err)
-		RespondSimpleError(w, ErrInternalServer, "Could not save token", http.StatusInternalServerError)
+	// Risposta al client
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RefreshTokenHandler godoc
+// @Summary Refresh the access token
+// @Description Exchanges a refresh token for a new access token and a new refresh token.
+// @Description Every refresh token can be used only once: replaying an old one revokes the whole session.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body RefreshRequest true "Refresh token"
+// @Success 200 {object} TokenResponse "New tokens"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Invalid, expired or reused refresh token"
+// @Router /token/refresh [post]
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
 		return
 	}
 
-	// Risposta al client
-	resp := TokenResponse{
-		AccessToken: tokenString,
-		ExpiresAt:   expiration.Unix(),
-		UserID:      foundUser.GetValue("id").(string),
-		Groups:      group_list,
+	repo := dblayer.NewSystemRepository("token refresh", refreshTables...)
+
+	resp, err := RefreshTokens(repo, req.RefreshToken)
+	if err != nil {
+		log.Print("RefreshTokenHandler: ", err)
+		if err == errInvalidRefreshToken || err == errRefreshTokenReused {
+			RespondSimpleError(w, ErrInvalidRefreshToken, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		RespondSimpleError(w, ErrInternalServer, "Could not refresh token", http.StatusInternalServerError)
+		return
 	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
@@ -189,30 +288,14 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 // @Security BearerAuth
 // @Router /logout [post]
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	tokenString, err := GetTokenFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Missing or invalid token", http.StatusUnauthorized)
-		return
-	}
-
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
-	log.Printf("Logging out user %s with token %s", claims["user_id"], tokenString)
-
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	log.Printf("Logging out user %s with token %s", principal.UserID, principal.Token)
 
 	// Elimina il token dalla tabella oauth_tokens
-	if err := DeleteToken(repo, tokenString); err != nil {
+	if err := DeleteToken(repo, principal.Token); err != nil {
 		log.Print("Error deleting token:", err)
 		RespondSimpleError(w, ErrInternalServer, "Could not delete token", http.StatusInternalServerError)
 		return
@@ -6,7 +6,13 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func TestLoginHandler(t *testing.T) {
@@ -44,3 +50,143 @@ func TestLoginHandler(t *testing.T) {
 		t.Errorf("access_token mancante nella risposta")
 	}
 }
+
+// go test -v ./api -run TestRefreshTokenHandler
+func TestRefreshTokenHandler(t *testing.T) {
+	login := func() TokenResponse {
+		body, _ := json.Marshal(Credentials{Login: testAdminLogin, Pwd: testAdminPwd})
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		LoginHandler(rr, req)
+		var resp TokenResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.RefreshToken == "" {
+			t.Fatalf("Login failed: %s", rr.Body.String())
+		}
+		return resp
+	}
+	refresh := func(refreshToken string) (*httptest.ResponseRecorder, TokenResponse) {
+		body, _ := json.Marshal(RefreshRequest{RefreshToken: refreshToken})
+		req := httptest.NewRequest(http.MethodPost, "/token/refresh", bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		RefreshTokenHandler(rr, req)
+		var resp TokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr, resp
+	}
+	isValid := func(accessToken string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		rr := httptest.NewRecorder()
+		AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+		return rr.Code == http.StatusOK
+	}
+
+	first := login()
+
+	// 1. Rotation: new tokens, the old access token stops working
+	rr, second := refresh(first.RefreshToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if second.AccessToken == first.AccessToken || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("Expected new tokens")
+	}
+	if !isValid(second.AccessToken) || isValid(first.AccessToken) {
+		t.Fatalf("Expected only the new access token to be valid")
+	}
+	if len(second.Groups) == 0 || second.UserID != first.UserID {
+		t.Fatalf("Unexpected user info: %+v", second)
+	}
+
+	// 2. Replaying the old refresh token revokes the chain
+	rr, _ = refresh(first.RefreshToken)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status Unauthorized on reuse, got %v", rr.Code)
+	}
+	if isValid(second.AccessToken) {
+		t.Fatalf("Expected the chain to be revoked")
+	}
+	rr, _ = refresh(second.RefreshToken)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the last refresh token to be revoked, got %v", rr.Code)
+	}
+
+	// 3. Other sessions are not affected
+	other := login()
+	rr, _ = refresh(other.RefreshToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK for another session, got %v", rr.Code)
+	}
+
+	// 3b. An expired access token is refused, and its refresh token still renews the session
+	expiredLogin := login()
+	expiredToken, err := jwtKeyring.Sign(&jwt.MapClaims{"user_id": expiredLogin.UserID, "exp": time.Now().Add(-time.Minute).Unix(), "jti": randomToken(12)})
+	if err != nil {
+		t.Fatalf("Failed to sign the token: %v", err)
+	}
+	tokenRepo := dblayer.NewSystemRepository("test", tokenTables...)
+	stored := tokenRepo.GetInstanceByTableName("oauth_tokens")
+	stored.SetValue("token_id", expiredLogin.AccessToken)
+	tokenRepo.Delete(stored)
+	if err := SaveToken(tokenRepo, expiredLogin.UserID, expiredToken, hashRefreshToken(expiredLogin.RefreshToken), time.Now().Add(-time.Minute).Unix()); err != nil {
+		t.Fatalf("Failed to save the token: %v", err)
+	}
+	if isValid(expiredToken) {
+		t.Fatalf("Expected the expired access token to be refused")
+	}
+	if rr, _ = refresh(expiredLogin.RefreshToken); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the session renewed after an expired access token, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	// 3c. An access token emptied alone, e.g. by a cleanup, is not a reuse of its refresh token
+	emptiedLogin := login()
+	emptied := tokenRepo.GetInstanceByTableName("oauth_tokens")
+	emptied.SetValue("token_id", emptiedLogin.AccessToken)
+	found, err := tokenRepo.Search(emptied, false, false, "")
+	if err != nil || len(found) != 1 {
+		t.Fatalf("Expected the stored token, got %v %v", found, err)
+	}
+	normalizeDBTimes(found[0], "expires_at", "created_at")
+	found[0].SetValue("access_token", "")
+	if _, err := tokenRepo.Update(found[0]); err != nil {
+		t.Fatalf("Failed to empty the access token: %v", err)
+	}
+	rr, renewed := refresh(emptiedLogin.RefreshToken)
+	if rr.Code != http.StatusOK || !isValid(renewed.AccessToken) {
+		t.Fatalf("Expected the session renewed after an emptied access token, got %v: %s", rr.Code, rr.Body.String())
+	}
+	// The consumed refresh token is still recognized as a replay
+	if rr, _ = refresh(emptiedLogin.RefreshToken); rr.Code != http.StatusUnauthorized || isValid(renewed.AccessToken) {
+		t.Fatalf("Expected the replay to revoke the session, got %v", rr.Code)
+	}
+
+	// 4. Garbage
+	rr, _ = refresh("not-a-token")
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status Unauthorized, got %v", rr.Code)
+	}
+
+	// 5. Concurrent refreshes with the same token: at most one gets new tokens
+	concurrent := login()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rr, _ := refresh(concurrent.RefreshToken); rr.Code == http.StatusOK {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if succeeded > 1 {
+		t.Fatalf("Expected at most one refresh, got %d", succeeded)
+	}
+	if rr, _ := refresh(concurrent.RefreshToken); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status Unauthorized after the concurrent refreshes, got %v", rr.Code)
+	}
+}
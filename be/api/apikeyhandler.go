@@ -0,0 +1,325 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// APIKeyPrefix starts every personal API key, to tell them from the JWTs
+const APIKeyPrefix = "rbk_"
+
+// APIKeyInfo godoc
+// @Description A personal API key of a user, without the key
+type APIKeyInfo struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"` // the beginning of the key, to recognize it
+	ReadOnly   bool     `json:"read_only"`
+	FolderID   string   `json:"folder_id,omitempty"`
+	ClassNames []string `json:"classnames"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt int64    `json:"last_used_at,omitempty"`
+	ExpiresAt  int64    `json:"expires_at,omitempty"`
+}
+
+// CreateAPIKeyRequest godoc
+// @Description A new personal API key: its name and its scope
+type CreateAPIKeyRequest struct {
+	Name       string   `json:"name"`
+	ReadOnly   bool     `json:"read_only"`
+	FolderID   string   `json:"folder_id"`  // only this object and what is below it
+	ClassNames []string `json:"classnames"` // only the objects of these classes, e.g. DBPage
+	ExpiresAt  int64    `json:"expires_at"` // unix time, 0 for a key that does not expire
+}
+
+// CreateAPIKeyResponse godoc
+// @Description The new personal API key: the key is returned only here
+type CreateAPIKeyResponse struct {
+	APIKeyInfo
+	Key string `json:"key"`
+}
+
+var apiKeyTouchedAt = map[string]time.Time{}
+var apiKeyTouchedAtMu sync.Mutex
+
+// hashAPIKey returns what is stored of a key
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyScopeOf returns the scope stored with a key
+func apiKeyScopeOf(apiKey dblayer.DBEntityInterface) *dblayer.AccessScope {
+	scope := &dblayer.AccessScope{Subtree: true, ClassNames: []string{}}
+	scope.ReadOnly = apiKey.GetValue("read_only") == "1"
+	scope.RootID, _ = apiKey.GetValue("folder_id").(string)
+	if classNames, _ := apiKey.GetValue("classnames").(string); classNames != "" {
+		scope.ClassNames = strings.Split(classNames, ",")
+	}
+	return scope
+}
+
+// apiKeyInfoOf returns the description of a key
+func apiKeyInfoOf(apiKey dblayer.DBEntityInterface) APIKeyInfo {
+	scope := apiKeyScopeOf(apiKey)
+	info := APIKeyInfo{ID: apiKey.GetValue("id").(string), ReadOnly: scope.ReadOnly, FolderID: scope.RootID, ClassNames: scope.ClassNames}
+	info.Name, _ = apiKey.GetValue("name").(string)
+	info.Prefix, _ = apiKey.GetValue("key_prefix").(string)
+	if t, ok := parseDBTime(apiKey.GetValue("created_at")); ok {
+		info.CreatedAt = t.Unix()
+	}
+	if t, ok := parseDBTime(apiKey.GetValue("last_used_at")); ok {
+		info.LastUsedAt = t.Unix()
+	}
+	if t, ok := parseDBTime(apiKey.GetValue("expires_at")); ok {
+		info.ExpiresAt = t.Unix()
+	}
+	return info
+}
+
+// resolveAPIKey returns the user of a personal API key, with the scope of the key
+func resolveAPIKey(r *http.Request, key string) (*Principal, error) {
+	repo := dblayer.NewSystemRepository("API key validation", apiKeyTables...).WithContext(r.Context())
+
+	search := repo.GetInstanceByTableName("api_keys")
+	search.SetValue("key_hash", hashAPIKey(key))
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return nil, errUnknownToken
+	}
+	apiKey := results[0]
+	if t, ok := parseDBTime(apiKey.GetValue("expires_at")); ok && t.Before(time.Now()) {
+		return nil, errInvalidToken
+	}
+	userID, _ := apiKey.GetValue("user_id").(string)
+	user := repo.GetEntityByID("users", userID)
+	if user == nil || checkAccountEnabled(repo, userID) != nil {
+		return nil, errUnknownToken
+	}
+	primaryGroupID, _ := user.GetValue("group_id").(string)
+	groupIDs, err := GetUserGroupIDs(repo, userID, primaryGroupID)
+	if err != nil {
+		return nil, errUnknownToken
+	}
+
+	keyID := apiKey.GetValue("id").(string)
+	touchAPIKey(repo, apiKey)
+	principal := &Principal{UserID: userID, GroupIDs: groupIDs, Token: key, APIKeyID: keyID, Scope: apiKeyScopeOf(apiKey)}
+	principal.Login, _ = user.GetValue("login").(string)
+	return principal, nil
+}
+
+// touchAPIKey records that the key is in use, at most every sessionTouchInterval
+func touchAPIKey(repo *dblayer.DBRepository, apiKey dblayer.DBEntityInterface) {
+	keyID := apiKey.GetValue("id").(string)
+	now := time.Now()
+	apiKeyTouchedAtMu.Lock()
+	last, ok := apiKeyTouchedAt[keyID]
+	if ok && now.Sub(last) < sessionTouchInterval {
+		apiKeyTouchedAtMu.Unlock()
+		return
+	}
+	apiKeyTouchedAt[keyID] = now
+	apiKeyTouchedAtMu.Unlock()
+
+	normalizeDBTimes(apiKey, "created_at", "expires_at")
+	apiKey.SetValue("last_used_at", dbTime(now))
+	if _, err := repo.Update(apiKey); err != nil {
+		log.Println("touchAPIKey:", err)
+	}
+}
+
+// CreateAPIKey stores a new key of the user and returns it: it cannot be read again
+func CreateAPIKey(repo *dblayer.DBRepository, userID string, req CreateAPIKeyRequest) (*CreateAPIKeyResponse, error) {
+	key := APIKeyPrefix + randomToken(32)
+	apiKey := repo.GetInstanceByTableName("api_keys")
+	apiKey.SetValue("user_id", userID)
+	apiKey.SetValue("name", req.Name)
+	apiKey.SetValue("key_hash", hashAPIKey(key))
+	apiKey.SetValue("key_prefix", key[:len(APIKeyPrefix)+8])
+	if req.ReadOnly {
+		apiKey.SetValue("read_only", "1")
+	} else {
+		apiKey.SetValue("read_only", "0")
+	}
+	apiKey.SetValue("folder_id", req.FolderID)
+	apiKey.SetValue("classnames", strings.Join(req.ClassNames, ","))
+	if req.ExpiresAt > 0 {
+		apiKey.SetValue("expires_at", dbTime(time.Unix(req.ExpiresAt, 0)))
+	}
+	apiKey.SetValue("created_at", dbTime(time.Now()))
+	created, err := repo.Insert(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	return &CreateAPIKeyResponse{APIKeyInfo: apiKeyInfoOf(created), Key: key}, nil
+}
+
+// getAPIKeys returns the keys of a user, the most recent first
+func getAPIKeys(repo *dblayer.DBRepository, userID string) ([]dblayer.DBEntityInterface, error) {
+	search := repo.GetInstanceByTableName("api_keys")
+	search.SetValue("user_id", userID)
+	return repo.Search(search, false, false, "created_at DESC")
+}
+
+// GetAPIKeysHandler godoc
+// @Summary List the API keys of a user
+// @Description Returns the personal API keys of the user with their scope, expiry and last use, without the keys.
+// @Description Users can see their own keys, the users with users.manage the keys of everybody.
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {array} APIKeyInfo
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/api-keys [get]
+func GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, _, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	apiKeys, err := getAPIKeys(repo, userID)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get the API keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := []APIKeyInfo{}
+	for _, apiKey := range apiKeys {
+		response = append(response, apiKeyInfoOf(apiKey))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateAPIKeyHandler godoc
+// @Summary Create an API key
+// @Description Creates a personal API key, to use as "Authorization: Bearer rbk_..." in scripts and in the CLI.
+// @Description The key acts as the user, restricted by its scope: read only, an object and what is below it, some classes.
+// @Description The key is returned only once. Users can create keys only for themselves.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param request body CreateAPIKeyRequest true "Name and scope of the key"
+// @Success 201 {object} CreateAPIKeyResponse
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/api-keys [post]
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, self, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if !self {
+		RespondSimpleError(w, ErrForbidden, "You can only create your own API keys", http.StatusForbidden)
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		RespondError(w, ErrMissingField, "Field is required", map[string]string{"field": "name"}, http.StatusBadRequest)
+		return
+	}
+	if len(req.Name) > 255 {
+		RespondError(w, ErrInvalidField, "Name too long", map[string]string{"field": "name"}, http.StatusBadRequest)
+		return
+	}
+	if req.FolderID != "" {
+		// The user must see the object the key is limited to
+		userRepo := RepositoryFromRequest(r)
+		folder := userRepo.ObjectByID(req.FolderID, true)
+		if folder == nil || !userRepo.CheckReadPermission(folder) {
+			RespondError(w, ErrInvalidField, "Folder not found", map[string]string{"field": "folder_id"}, http.StatusBadRequest)
+			return
+		}
+	}
+	classNames := []string{}
+	for _, className := range req.ClassNames {
+		dbe := dblayer.Factory.GetInstanceByClassName(className)
+		if className == "DBObject" || dbe == nil || !dbe.IsDBObject() {
+			RespondError(w, ErrInvalidField, "Unknown class "+className, map[string]string{"field": "classnames"}, http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(classNames, className) {
+			classNames = append(classNames, className)
+		}
+	}
+	req.ClassNames = classNames
+	if req.ExpiresAt != 0 && time.Unix(req.ExpiresAt, 0).Before(time.Now()) {
+		RespondError(w, ErrInvalidField, "The expiry must be in the future", map[string]string{"field": "expires_at"}, http.StatusBadRequest)
+		return
+	}
+
+	response, err := CreateAPIKey(repo, userID, req)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to create the API key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("CreateAPIKeyHandler: user %s created the API key %s", userID, response.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteAPIKeyHandler godoc
+// @Summary Revoke an API key
+// @Description Deletes a personal API key: it stops working at once.
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Param keyId path string true "API key ID"
+// @Success 200 {object} map[string]string "message"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "API key not found"
+// @Security BearerAuth
+// @Router /users/{id}/api-keys/{keyId} [delete]
+func DeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, _, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	keyID := mux.Vars(r)["keyId"]
+
+	search := repo.GetInstanceByTableName("api_keys")
+	search.SetValue("id", keyID)
+	search.SetValue("user_id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		RespondSimpleError(w, ErrObjectNotFound, "API key not found", http.StatusNotFound)
+		return
+	}
+	if _, err := repo.Delete(results[0]); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to revoke the API key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	apiKeyTouchedAtMu.Lock()
+	delete(apiKeyTouchedAt, keyID)
+	apiKeyTouchedAtMu.Unlock()
+	log.Printf("DeleteAPIKeyHandler: revoked the API key %s of user %s", keyID, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+}
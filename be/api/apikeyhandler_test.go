@@ -0,0 +1,143 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestAPIKeys
+func TestAPIKeys(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	login := "apikeys" + Random4digits()
+	user, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    login,
+		"pwd":      "apikeys-password",
+		"fullname": "API keys test",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	t.Cleanup(func() { adminRepo.Delete(user) })
+	userID := user.GetValue("id").(string)
+	token := ApiTestDoLogin(t, login, "apikeys-password")
+
+	userRepo := SetupTestRepo(t, userID, []string{user.GetValue("group_id").(string)}, AppConfig.TablePrefix)
+	folder, err := userRepo.CreateObject("folders", map[string]any{"name": "API keys folder"}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	folderID := folder.GetValue("id").(string)
+	newObject := func(tableName string, values map[string]any) dblayer.DBEntityInterface {
+		object, err := userRepo.CreateObject(tableName, values, map[string]any{})
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", tableName, err)
+		}
+		return object
+	}
+	page := newObject("pages", map[string]any{"name": "API keys page", "father_id": folderID})
+	note := newObject("notes", map[string]any{"name": "API keys note", "father_id": folderID})
+	outside := newObject("pages", map[string]any{"name": "API keys outside"})
+	t.Cleanup(func() {
+		adminRepo.Delete(page)
+		adminRepo.Delete(note)
+		adminRepo.Delete(outside)
+		adminRepo.Delete(folder)
+	})
+
+	router := mux.NewRouter()
+	router.Use(AuthMiddleware)
+	router.HandleFunc("/users/{id}/api-keys", GetAPIKeysHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/api-keys", CreateAPIKeyHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/api-keys/{keyId}", DeleteAPIKeyHandler).Methods("DELETE")
+	router.HandleFunc("/objects/{id}", GetObjectHandler).Methods("GET")
+	router.HandleFunc("/objects/{id}", UpdateObjectHandler).Methods("PUT")
+	call := func(method string, path string, token string, payload any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	keysPath := "/users/" + userID + "/api-keys"
+
+	// 1. Validation
+	for _, req := range []CreateAPIKeyRequest{
+		{Name: " "},
+		{Name: "bad class", ClassNames: []string{"DBUser"}},
+		{Name: "bad folder", FolderID: "nofolder"},
+		{Name: "expired", ExpiresAt: time.Now().Add(-time.Hour).Unix()},
+	} {
+		if rr := call(http.MethodPost, keysPath, token, req); rr.Code != http.StatusBadRequest {
+			t.Fatalf("Expected bad request for %q, got %v %s", req.Name, rr.Code, rr.Body.String())
+		}
+	}
+	if rr := call(http.MethodPost, "/users/-1/api-keys", token, CreateAPIKeyRequest{Name: "not mine"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+
+	// 2. A read-only key of the pages of the folder, returned once
+	rr := call(http.MethodPost, keysPath, token, CreateAPIKeyRequest{
+		Name: "backup", ReadOnly: true, FolderID: folderID, ClassNames: []string{"DBPage", "DBFolder"},
+		ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status Created, got %v %s", rr.Code, rr.Body.String())
+	}
+	var created CreateAPIKeyResponse
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if !strings.HasPrefix(created.Key, APIKeyPrefix) || !strings.HasPrefix(created.Key, created.Prefix) || !created.ReadOnly {
+		t.Fatalf("Expected a read-only rbk_ key, got %s", rr.Body.String())
+	}
+	apiKey := created.Key
+
+	// 3. The key acts as the user, within its scope
+	if rr := call(http.MethodGet, "/objects/"+page.GetValue("id").(string), apiKey, nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the page to be readable, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(http.MethodGet, "/objects/"+outside.GetValue("id").(string), apiKey, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected the page outside the folder to be forbidden, got %v", rr.Code)
+	}
+	if rr := call(http.MethodGet, "/objects/"+note.GetValue("id").(string), apiKey, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected the note to be forbidden, got %v", rr.Code)
+	}
+	if rr := call(http.MethodPut, "/objects/"+page.GetValue("id").(string), apiKey, map[string]any{"name": "Changed"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected the read-only key not to write, got %v", rr.Code)
+	}
+	// ...but not for the account
+	if rr := call(http.MethodGet, keysPath, apiKey, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden with an API key, got %v", rr.Code)
+	}
+	if rr := call(http.MethodGet, "/objects/"+page.GetValue("id").(string), APIKeyPrefix+"unknown", nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected an unknown key to be unauthorized, got %v", rr.Code)
+	}
+
+	// 4. Listed without the key, with its last use
+	rr = call(http.MethodGet, keysPath, token, nil)
+	var keys []APIKeyInfo
+	json.Unmarshal(rr.Body.Bytes(), &keys)
+	if rr.Code != http.StatusOK || len(keys) != 1 || keys[0].ID != created.ID || keys[0].LastUsedAt == 0 ||
+		keys[0].FolderID != folderID || strings.Contains(rr.Body.String(), apiKey) {
+		t.Fatalf("Expected the key listed without its value, got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// 5. Revoked, it stops working
+	if rr := call(http.MethodDelete, keysPath+"/"+created.ID, token, nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(http.MethodGet, "/objects/"+page.GetValue("id").(string), apiKey, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the revoked key to be unauthorized, got %v", rr.Code)
+	}
+	if rr := call(http.MethodDelete, keysPath+"/"+created.ID, token, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected not found, got %v", rr.Code)
+	}
+}
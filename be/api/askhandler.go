@@ -0,0 +1,274 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"rprj/be/dblayer"
+)
+
+// Tables searched by the Q&A endpoint, in this order, and the column holding their content
+var askSources = []struct {
+	table  string
+	column string
+}{
+	{"pages", "html"},
+	{"news", "html"},
+	{"notes", "description"},
+}
+
+const askMaxTerms = 8
+
+// Max number of objects read from each table, the most recently modified first, before the permission check
+const askMaxCandidates = 50
+const askMaxSources = 5
+const askMaxSourceChars = 2000
+
+// Words ignored when looking for relevant content
+var askStopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "was": true, "what": true, "who": true, "how": true,
+	"why": true, "when": true, "where": true, "which": true, "with": true, "this": true, "that": true,
+	"does": true, "can": true, "about": true, "from": true, "have": true, "has": true, "you": true,
+	"che": true, "chi": true, "come": true, "cosa": true, "per": true, "con": true, "del": true, "della": true,
+	"dei": true, "delle": true, "sono": true, "una": true, "uno": true, "quando": true, "dove": true, "perché": true,
+}
+
+// AskRequest godoc
+// @Description Request structure for questions about the site content
+type AskRequest struct {
+	Question string `json:"question"`
+}
+
+// AskCitation godoc
+// @Description An object used to answer the question
+type AskCitation struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Classname string `json:"classname"`
+}
+
+// AskResponse godoc
+// @Description Answer with the objects it is based on
+type AskResponse struct {
+	Success   bool          `json:"success"`
+	Answer    string        `json:"answer"`
+	Citations []AskCitation `json:"citations"`
+}
+
+type askSource struct {
+	obj   dblayer.DBEntityInterface
+	text  string
+	score int
+}
+
+// AskHandler godoc
+// @Summary Ask a question about the site content
+// @Description Retrieves the pages, news and notes readable by the current user that are relevant to the question,
+// @Description asks Ollama to answer using only them and returns the answer with the IDs of the cited objects.
+// @Tags ollama
+// @Accept json
+// @Produce json
+// @Param request body AskRequest true "The question"
+// @Success 200 {object} AskResponse "Answer and citations"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 429 {object} ErrorResponse "Quota exceeded"
+// @Failure 503 {object} ErrorResponse "Ollama service not configured"
+// @Security BearerAuth
+// @Router /ollama/ask [post]
+func AskHandler(w http.ResponseWriter, r *http.Request) {
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req AskRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Question = strings.TrimSpace(req.Question)
+	if req.Question == "" {
+		RespondError(w, ErrMissingField, "Missing question", map[string]string{"field": "question"}, http.StatusBadRequest)
+		return
+	}
+
+	if !llmConfigured() {
+		RespondSimpleError(w, ErrServiceUnavailable, "Ollama service not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !ollamaUserAllowed(principal) {
+		RespondSimpleError(w, ErrForbidden, "You are not allowed to use the AI assistant", http.StatusForbidden)
+		return
+	}
+	quotaKeys := []string{"user:" + principal.UserID, "ip:" + clientIP(r)}
+	if retryAfter, err := ollamaQuota.Acquire(quotaKeys); err != nil {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+		RespondSimpleError(w, ErrRateLimited, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	sources := retrieveAskSources(repo, req.Question)
+	log.Printf("AskHandler: user %s, %d sources for question '%s'", principal.UserID, len(sources), req.Question)
+
+	response := AskResponse{Success: true, Citations: []AskCitation{}}
+	if len(sources) == 0 {
+		response.Answer = "I could not find any content about this question."
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	answer, err := CallLLM(LLMFeatureAsk, buildAskPrompt(req.Question, sources))
+	if err != nil {
+		log.Printf("AskHandler: %v", err)
+		RespondSimpleError(w, ErrInternalServer, "Failed to get an answer", http.StatusBadGateway)
+		return
+	}
+	response.Answer = strings.TrimSpace(answer)
+
+	// Cite the sources the model referenced, or all of them if it did not reference any
+	for _, source := range sources {
+		id := source.obj.GetValue("id").(string)
+		if strings.Contains(answer, "["+id+"]") {
+			response.Citations = append(response.Citations, askCitation(source))
+		}
+	}
+	if len(response.Citations) == 0 {
+		for _, source := range sources {
+			response.Citations = append(response.Citations, askCitation(source))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func askCitation(source askSource) AskCitation {
+	name, _ := source.obj.GetValue("name").(string)
+	return AskCitation{
+		ID:        source.obj.GetValue("id").(string),
+		Name:      name,
+		Classname: source.obj.GetTypeName(),
+	}
+}
+
+var askWordRegexp = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// askTerms extracts the significant words of the question
+func askTerms(question string) []string {
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, word := range askWordRegexp.FindAllString(strings.ToLower(question), -1) {
+		if len([]rune(word)) < 3 || askStopwords[word] || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+		if len(terms) == askMaxTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// retrieveAskSources returns the most relevant readable objects, best first.
+// Every candidate goes through CheckReadPermission before being considered.
+func retrieveAskSources(repo *dblayer.DBRepository, question string) []askSource {
+	terms := askTerms(question)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	candidates := []askSource{}
+	for _, source := range askSources {
+		tableName, contentColumn := source.table, source.column
+		search := repo.GetInstanceByTableName(tableName)
+		if search == nil {
+			continue
+		}
+		conditions := []interface{}{}
+		for _, term := range terms {
+			for _, column := range []string{"name", contentColumn} {
+				conditions = append(conditions, map[string]interface{}{
+					column: map[string]interface{}{"$LIKE": "%" + term + "%"},
+				})
+			}
+		}
+		search.SetValue("deleted_date", nil)
+		search.SetMetadata("or", conditions)
+		search.SetMetadata("limit", askMaxCandidates)
+		found, err := repo.Search(search, false, false, "last_modify_date DESC")
+		if err != nil {
+			log.Printf("retrieveAskSources: search on %s failed: %v", tableName, err)
+			continue
+		}
+		for _, obj := range found {
+			if !repo.CheckReadPermission(obj) {
+				continue
+			}
+			name, _ := obj.GetValue("name").(string)
+			content, _ := obj.GetValue(contentColumn).(string)
+			if contentColumn == "html" {
+				content = htmlToText(content)
+			}
+			candidates = append(candidates, askSource{
+				obj:   obj,
+				text:  content,
+				score: askScore(terms, name, content),
+			})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	if len(candidates) > askMaxSources {
+		candidates = candidates[:askMaxSources]
+	}
+	return candidates
+}
+
+// askScore counts the occurrences of the terms, a match in the name is worth more
+func askScore(terms []string, name string, content string) int {
+	name = strings.ToLower(name)
+	content = strings.ToLower(content)
+	score := 0
+	for _, term := range terms {
+		score += 5*strings.Count(name, term) + strings.Count(content, term)
+	}
+	return score
+}
+
+func buildAskPrompt(question string, sources []askSource) string {
+	var prompt strings.Builder
+	prompt.WriteString("Answer the question using only the sources below. ")
+	prompt.WriteString("Cite the sources you use with their id in square brackets, e.g. [0123456789abcdef]. ")
+	prompt.WriteString("If the sources do not contain the answer, say that you don't know. ")
+	prompt.WriteString("Answer in the language of the question.\n\n")
+	for _, source := range sources {
+		text := source.text
+		if runes := []rune(text); len(runes) > askMaxSourceChars {
+			text = string(runes[:askMaxSourceChars])
+		}
+		text = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\n' {
+				return ' '
+			}
+			return r
+		}, text)
+		name, _ := source.obj.GetValue("name").(string)
+		fmt.Fprintf(&prompt, "Source [%s] \"%s\":\n%s\n\n", source.obj.GetValue("id"), name, text)
+	}
+	prompt.WriteString("Question:\n")
+	prompt.WriteString(question)
+	return prompt.String()
+}
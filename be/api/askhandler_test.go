@@ -0,0 +1,77 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// go test -v ./api -run TestAskHandler
+func TestAskHandler(t *testing.T) {
+	// The fake model cites the first source of the prompt
+	sourceRegexp := regexp.MustCompile(`Source \[([0-9a-f]+)\]`)
+	provider := &FakeLLMProvider{Reply: func(prompt string) string {
+		if m := sourceRegexp.FindStringSubmatch(prompt); m != nil {
+			return "It is a blue bird [" + m[1] + "]."
+		}
+		return "I don't know."
+	}}
+	useLLMProvider(t, provider)
+
+	token := ApiTestDoLogin(t, testAdminLogin, testAdminPwd)
+
+	keyword := "zorglub" + Random4digits()
+	repo := SetupTestRepo(t,
+		testUser.GetValue("id").(string),
+		[]string{testUser.GetValue("group_id").(string)},
+		AppConfig.TablePrefix)
+	readable, err := repo.CreateObject("pages", map[string]any{
+		"name": "About the " + keyword,
+		"html": "<p>The " + keyword + " is a blue bird.</p>",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create page: %v", err)
+	}
+	// A private note of somebody else must never reach the model
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	secret, err := adminRepo.CreateObject("notes", map[string]any{
+		"name":        "Secret " + keyword,
+		"description": "The " + keyword + " password is hunter2",
+		"owner":       "-1",
+		"group_id":    "-2",
+		"permissions": "rwx------",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create note: %v", err)
+	}
+
+	body, _ := json.Marshal(AskRequest{Question: "What is the " + keyword + "?"})
+	req := httptest.NewRequest(http.MethodPost, "/ollama/ask", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(AskHandler).ServeHTTP(rr, req)
+	log.Print("AskHandler response body:", rr.Body.String())
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v", rr.Code)
+	}
+
+	var response AskResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response JSON: %v", err)
+	}
+	if len(response.Citations) != 1 || response.Citations[0].ID != readable.GetValue("id") {
+		t.Fatalf("Expected a citation of %v, got %+v", readable.GetValue("id"), response.Citations)
+	}
+	prompts := provider.Prompts()
+	if len(prompts) != 1 {
+		t.Fatalf("Expected one call to the model, got %d", len(prompts))
+	}
+	if strings.Contains(prompts[0], "hunter2") || strings.Contains(prompts[0], secret.GetValue("id").(string)) {
+		t.Fatalf("Unreadable content was sent to the model")
+	}
+}
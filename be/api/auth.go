@@ -1,8 +1,14 @@
 package api
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -24,6 +30,8 @@ func GetTokenFromRequest(r *http.Request) (string, error) {
 	return tokenString, nil
 }
 
+// GetClaimsFromRequest returns the claims of the token of the request, without checking it in oauth_tokens.
+// Handlers use PrincipalFromRequest instead.
 func GetClaimsFromRequest(r *http.Request) (map[string]string, error) {
 
 	tokenString, err := GetTokenFromRequest(r)
@@ -31,22 +39,10 @@ func GetClaimsFromRequest(r *http.Request) (map[string]string, error) {
 		return nil, err
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   "-1",           // DANGEROUS!!!! Think of something better here!!!
-		GroupIDs: []string{"-2"}, // Same here!!!
-		Schema:   dblayer.DbSchema,
-	}
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
-	// Validate the token
+	// Validate the token; an expired one does not end the session, which is renewed with the refresh token
 	claims := jwt.MapClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		return JWTKey, nil
-	})
+	token, err := jwtKeyring.Parse(tokenString, claims)
 	if err != nil || !token.Valid {
-		log.Print("Deleting token from db due to invalidity.")
-		DeleteToken(repo, tokenString)
 		return nil, http.ErrNoCookie
 	}
 
@@ -61,71 +57,36 @@ func GetClaimsFromRequest(r *http.Request) (map[string]string, error) {
 	return result, nil
 }
 
-// Middleware check token JWT
+// Middleware check token JWT: the routes behind it answer 401 without a valid token,
+// the handlers find the caller with PrincipalFromRequest and RepositoryFromRequest
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Read Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		principal, err := resolvePrincipal(r)
+		switch err {
+		case nil:
+			next.ServeHTTP(w, withPrincipal(r, principal))
+		case errMissingAuthorization:
 			RespondSimpleError(w, ErrMissingAuthorization, "Missing Authorization header", http.StatusUnauthorized)
-			return
-		}
-
-		// it must be in the format "Bearer <token>"
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
+		case errInvalidAuthorization:
 			RespondSimpleError(w, ErrInvalidToken, "Invalid Authorization header format", http.StatusUnauthorized)
-			return
-		}
-		tokenString := parts[1]
-		// log.Printf("Token ricevuto: %s\n", tokenString)
-
-		dbContext := &dblayer.DBContext{
-			UserID:   "-1",           // DANGEROUS!!!! Think of something better here!!!
-			GroupIDs: []string{"-2"}, // Same here!!!
-			Schema:   dblayer.DbSchema,
-		}
-		repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-		repo.Verbose = false
-
-		// Valida il token
-		claims := jwt.MapClaims{}
-		token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-			return JWTKey, nil
-		})
-		// log.Printf("Claims: %+v\n", claims)
-		// log.Printf("err: %v\n", err)
-		if err != nil || !token.Valid {
-			RespondSimpleError(w, ErrInvalidToken, "Invalid or expired token", http.StatusUnauthorized)
-			log.Print("Deleting token from db due to invalidity.")
-			DeleteToken(repo, tokenString)
-			return
-		}
-
-		// Retrieve user ID from claims
-		userID := claims["user_id"].(string)
-		// log.Printf("User ID authenticated: %s\n", userID)
-
-		// Retrieve group ids from claims
-		// groupIDs := []string{}
-		// if g, ok := claims["groups"].(string); ok && g != "" {
-		// 	groupIDs = strings.Split(g, ",")
-		// }
-		// log.Printf("Group IDs: %+v\n", groupIDs)
-
-		// Search the token in the database to ensure it's valid
-		if !IsTokenValid(repo, tokenString, userID) {
-			RespondSimpleError(w, ErrInvalidToken, "Token not recognized", http.StatusUnauthorized)
+		case errUnknownToken:
 			log.Print("Token not found in the database")
-			return
+			RespondSimpleError(w, ErrInvalidToken, "Token not recognized", http.StatusUnauthorized)
+		default:
+			log.Print("Deleted invalid token from db.")
+			RespondSimpleError(w, ErrInvalidToken, "Invalid or expired token", http.StatusUnauthorized)
 		}
-
-		// Passa la richiesta all'handler successivo
-		next.ServeHTTP(w, r)
 	})
 }
 
-func SaveToken(repo *dblayer.DBRepository, userID string, tokenString string, expiry int64) error {
+// Lifetime of the tokens issued by IssueTokens
+const AccessTokenDuration = 1 * time.Hour
+const RefreshTokenDuration = 30 * 24 * time.Hour
+
+var errInvalidRefreshToken = fmt.Errorf("invalid or expired refresh token")
+var errRefreshTokenReused = fmt.Errorf("refresh token already used, session revoked")
+
+func SaveToken(repo *dblayer.DBRepository, userID string, tokenString string, refreshTokenHash string, expiry int64) error {
 
 	dbOAuthToken := repo.GetInstanceByTableName("oauth_tokens")
 	if dbOAuthToken == nil {
@@ -135,12 +96,246 @@ func SaveToken(repo *dblayer.DBRepository, userID string, tokenString string, ex
 	dbOAuthToken.SetValue("user_id", userID)
 	dbOAuthToken.SetValue("token_id", tokenString)
 	dbOAuthToken.SetValue("access_token", tokenString)
-	dbOAuthToken.SetValue("expires_at", time.Unix(expiry, 0))
+	if refreshTokenHash != "" {
+		dbOAuthToken.SetValue("refresh_token", refreshTokenHash)
+	}
+	dbOAuthToken.SetValue("expires_at", dbTime(time.Unix(expiry, 0)))
+	dbOAuthToken.SetValue("created_at", dbTime(time.Now()))
 
 	_, err := repo.Insert(dbOAuthToken)
 	return err
 }
 
+// IssueTokens generates a new access token for the user and a new refresh token, and saves them in oauth_tokens.
+// Refresh tokens rotated one from the other form a chain: pass "" to start a new one (login).
+func IssueTokens(repo *dblayer.DBRepository, userID string, login string, groups []string, chain string) (*TokenResponse, error) {
+	if chain == "" {
+		chain = randomToken(12)
+	}
+
+	expiration := time.Now().Add(AccessTokenDuration)
+	claims := &jwt.MapClaims{
+		"user_id": userID,
+		"login":   login,
+		"groups":  strings.Join(groups, ","),
+		"exp":     expiration.Unix(),
+		"jti":     randomToken(12), // two tokens issued in the same second must differ
+	}
+	tokenString, err := jwtKeyring.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	// The refresh token is opaque for the client, only its hash is stored
+	refreshToken := chain + "." + randomToken(32)
+	if err := SaveToken(repo, userID, tokenString, hashRefreshToken(refreshToken), expiration.Unix()); err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken:  tokenString,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiration.Unix(),
+		UserID:       userID,
+		Groups:       groups,
+		Capabilities: capabilitiesOf(repo.Context(), groups),
+	}, nil
+}
+
+// RefreshTokens exchanges a refresh token for a new access token and a new refresh token.
+// A refresh token can be used only once: using it again revokes the whole chain.
+func RefreshTokens(repo *dblayer.DBRepository, refreshToken string) (*TokenResponse, error) {
+	chain, _, ok := strings.Cut(refreshToken, ".")
+	if !ok || chain == "" {
+		return nil, errInvalidRefreshToken
+	}
+
+	search := repo.GetInstanceByTableName("oauth_tokens")
+	if search == nil {
+		return nil, fmt.Errorf("cannot create oauth_tokens instance")
+	}
+	search.SetValue("refresh_token", hashRefreshToken(refreshToken))
+	results, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		// Already rotated: somebody is replaying an old token
+		search.SetValue("refresh_token", dblayer.ConsumedRefreshToken(hashRefreshToken(refreshToken)))
+		if used, err := repo.Search(search, false, false, ""); err == nil && len(used) > 0 {
+			log.Printf("RefreshTokens: reuse of a refresh token of user %s, revoking session %s", used[0].GetValue("user_id"), chain)
+			RevokeSession(repo, chain)
+			return nil, errRefreshTokenReused
+		}
+		return nil, errInvalidRefreshToken
+	}
+	current := results[0]
+	userID, _ := current.GetValue("user_id").(string)
+
+	if createdAt, ok := parseDBTime(current.GetValue("created_at")); !ok || time.Since(createdAt) > RefreshTokenDuration {
+		return nil, errInvalidRefreshToken
+	}
+	// Logged out or revoked: the session is gone. The access token does not matter, it may have expired
+	if !sessionExists(repo, chain) {
+		return nil, errInvalidRefreshToken
+	}
+
+	// Rotate: the old access and refresh tokens stop working. Two requests with the same token both got here,
+	// only one consumes it: the other is a reuse
+	consumed, err := repo.ConsumeRefreshToken(current)
+	if err != nil {
+		return nil, err
+	}
+	if !consumed {
+		log.Printf("RefreshTokens: concurrent reuse of a refresh token of user %s, revoking session %s", userID, chain)
+		RevokeSession(repo, chain)
+		return nil, errRefreshTokenReused
+	}
+
+	user := repo.GetInstanceByTableName("users")
+	user.SetValue("id", userID)
+	users, err := repo.Search(user, false, false, "")
+	if err != nil || len(users) == 0 {
+		return nil, errInvalidRefreshToken
+	}
+	login, _ := users[0].GetValue("login").(string)
+	primaryGroupID, _ := users[0].GetValue("group_id").(string)
+	groups, err := GetUserGroupIDs(repo, userID, primaryGroupID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := IssueTokens(repo, userID, login, groups, chain)
+	if err != nil {
+		return nil, err
+	}
+	if !touchSession(repo, chain, true) {
+		// Revoked meanwhile, e.g. by a concurrent reuse of the same refresh token: so are the new tokens
+		RevokeTokenChain(repo, chain)
+		return nil, errRefreshTokenReused
+	}
+	return tokens, nil
+}
+
+// RevokeTokenChain invalidates all the access and refresh tokens of a chain
+func RevokeTokenChain(repo *dblayer.DBRepository, chain string) {
+	search := repo.GetInstanceByTableName("oauth_tokens")
+	if search == nil {
+		return
+	}
+	search.SetValue("refresh_token", chain+":")
+	results, err := repo.Search(search, true, true, "")
+	if err != nil {
+		log.Println("RevokeTokenChain:", err)
+		return
+	}
+	for _, token := range results {
+		refreshTokenHash, _ := token.GetValue("refresh_token").(string)
+		if !strings.HasPrefix(refreshTokenHash, chain+":") || token.GetValue("access_token") == "" {
+			continue
+		}
+		normalizeDBTimes(token, "expires_at", "created_at")
+		token.SetValue("access_token", "")
+		if _, err := repo.Update(token); err != nil {
+			log.Println("RevokeTokenChain:", err)
+		}
+	}
+}
+
+// RevokeUserTokens logs out a user everywhere: all the sessions and all the tokens stop working
+func RevokeUserTokens(repo *dblayer.DBRepository, userID string) {
+	sessions, err := getSessions(repo, userID)
+	if err != nil {
+		log.Println("RevokeUserTokens:", err)
+	}
+	for _, session := range sessions {
+		RevokeSession(repo, session.GetValue("session_id").(string))
+	}
+	// Tokens issued before sessions were recorded
+	search := repo.GetInstanceByTableName("oauth_tokens")
+	search.SetValue("user_id", userID)
+	tokens, err := repo.Search(search, false, false, "")
+	if err != nil {
+		log.Println("RevokeUserTokens:", err)
+		return
+	}
+	for _, token := range tokens {
+		if token.GetValue("access_token") == "" {
+			continue
+		}
+		normalizeDBTimes(token, "expires_at", "created_at")
+		token.SetValue("access_token", "")
+		if _, err := repo.Update(token); err != nil {
+			log.Println("RevokeUserTokens:", err)
+		}
+	}
+}
+
+// GetUserGroupIDs returns the groups of a user, including the primary one
+func GetUserGroupIDs(repo *dblayer.DBRepository, userID string, primaryGroupID string) ([]string, error) {
+	userGroupsInstance := repo.GetInstanceByTableName("users_groups")
+	if userGroupsInstance == nil {
+		return nil, fmt.Errorf("cannot create users_groups instance")
+	}
+	userGroupsInstance.SetValue("user_id", userID)
+	userGroups, err := repo.Search(userGroupsInstance, false, false, "")
+	if err != nil {
+		return nil, err
+	}
+	groupList := []string{}
+	for _, ug := range userGroups {
+		groupList = append(groupList, ug.GetValue("group_id").(string))
+	}
+	if primaryGroupID != "" && !slices.Contains(groupList, primaryGroupID) {
+		groupList = append(groupList, primaryGroupID)
+	}
+	return groupList, nil
+}
+
+// hashRefreshToken returns the value stored in oauth_tokens.refresh_token: the chain, to find its tokens, and the hash
+func hashRefreshToken(refreshToken string) string {
+	chain, _, _ := strings.Cut(refreshToken, ".")
+	sum := sha256.Sum256([]byte(refreshToken))
+	return chain + ":" + hex.EncodeToString(sum[:])
+}
+
+// randomToken returns n random bytes encoded for URLs
+func randomToken(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// parseDBTime reads a datetime as returned by the different database drivers
+func parseDBTime(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		for _, layout := range []string{"2006-01-02 15:04:05.999999999 -0700 MST", "2006-01-02 15:04:05", time.RFC3339Nano} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// dbTime formats a datetime to be stored, always in UTC
+func dbTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// normalizeDBTimes rewrites the datetimes read from the database in a format all the drivers accept back,
+// to be called before updating an entity found with Search
+func normalizeDBTimes(dbe dblayer.DBEntityInterface, columns ...string) {
+	for _, column := range columns {
+		if t, ok := parseDBTime(dbe.GetValue(column)); ok {
+			dbe.SetValue(column, dbTime(t))
+		}
+	}
+}
+
 func IsTokenValid(repo *dblayer.DBRepository, tokenString string, userID string) bool {
 
 	search := repo.GetInstanceByTableName("oauth_tokens")
@@ -150,15 +345,25 @@ func IsTokenValid(repo *dblayer.DBRepository, tokenString string, userID string)
 	}
 	search.SetValue("token_id", tokenString)
 	search.SetValue("user_id", userID)
+	// Logged out, rotated and revoked tokens have an empty access_token
+	search.SetValue("access_token", tokenString)
 
 	results, err := repo.Search(search, false, false, "")
 	if err != nil {
 		log.Println("Errore verifica token:", err)
 		return false
 	}
-	return len(results) > 0
+	if len(results) == 0 {
+		return false
+	}
+	if refreshTokenHash, _ := results[0].GetValue("refresh_token").(string); refreshTokenHash != "" {
+		touchSession(repo, sessionIDOf(refreshTokenHash), false)
+	}
+	return true
 }
 
+// DeleteToken logs out the session of an access token, for LogoutHandler. An expired or invalid
+// access token must not get here: the session is renewed with its refresh token.
 func DeleteToken(repo *dblayer.DBRepository, tokenString string) error {
 	search := repo.GetInstanceByTableName("oauth_tokens")
 	if search == nil {
@@ -175,11 +380,16 @@ func DeleteToken(repo *dblayer.DBRepository, tokenString string) error {
 		return nil
 	}
 	mytoken := results[0]
+	normalizeDBTimes(mytoken, "expires_at", "created_at")
 	mytoken.SetValue("access_token", "")
 	_, err = repo.Update(mytoken)
 	if err != nil {
 		log.Println("Errore cancellazione token:", err)
 	}
+	// The refresh token of the session must stop working too
+	if refreshTokenHash, _ := mytoken.GetValue("refresh_token").(string); err == nil && refreshTokenHash != "" {
+		RevokeSession(repo, sessionIDOf(refreshTokenHash))
+	}
 
 	// _, err := repo.Delete(search)
 	// if err != nil {
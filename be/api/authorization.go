@@ -0,0 +1,53 @@
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"rprj/be/dblayer"
+)
+
+// Can tells whether the caller has a capability, through one of its groups. The anonymous user has none.
+func (p *Principal) Can(capability string) bool {
+	return slices.Contains(p.Capabilities(), capability)
+}
+
+// Capabilities returns the capabilities of the caller, read once for the life of the principal (usually a request).
+// The API keys and the share links give access to the objects only: they have none.
+func (p *Principal) Capabilities() []string {
+	if p.IsAnonymous() || p.Scope != nil {
+		return []string{}
+	}
+	p.capabilitiesOnce.Do(func() {
+		p.capabilities = capabilitiesOf(context.Background(), p.GroupIDs)
+	})
+	return p.capabilities
+}
+
+// capabilitiesOf returns the capabilities of the groups, none when they cannot be read
+func capabilitiesOf(ctx context.Context, groupIDs []string) []string {
+	repo := dblayer.NewSystemRepository("capabilities of the groups "+strings.Join(groupIDs, ","), capabilityTables...).WithContext(ctx)
+	capabilities, err := repo.GetCapabilities(groupIDs)
+	if err != nil {
+		log.Print("capabilitiesOf: ", err)
+		return []string{}
+	}
+	return capabilities
+}
+
+// authorizedRequest returns the caller of the request and its repository when it has the capability:
+// it answers 401 to the anonymous user and 403 to the others
+func authorizedRequest(w http.ResponseWriter, r *http.Request, capability string) (*Principal, *dblayer.DBRepository, bool) {
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	if !principal.Can(capability) {
+		RespondError(w, ErrForbidden, "You are not allowed to do this", map[string]string{"capability": capability}, http.StatusForbidden)
+		return nil, nil, false
+	}
+	return principal, repo, true
+}
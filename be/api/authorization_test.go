@@ -0,0 +1,188 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestCapabilityHandlers
+func TestCapabilityHandlers(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	group := adminRepo.GetInstanceByTableName("groups")
+	group.SetValue("name", "managers"+Random4digits())
+	managers, err := adminRepo.Insert(group)
+	if err != nil {
+		t.Fatalf("Failed to create group: %v", err)
+	}
+	managersID := managers.GetValue("id").(string)
+	t.Cleanup(func() { adminRepo.Delete(managers) })
+	if _, err := adminRepo.SetGroupCapabilities(managersID, []string{dblayer.CapabilityUsersManage, dblayer.CapabilityDashboardView}); err != nil {
+		t.Fatalf("Failed to set the capabilities: %v", err)
+	}
+
+	newUser := func(name string, groupIDs []string) (dblayer.DBEntityInterface, string) {
+		login := name + Random4digits()
+		user, err := adminRepo.CreateObject("users", map[string]any{
+			"login":    login,
+			"pwd":      "capability-password",
+			"fullname": name,
+		}, map[string]any{"group_ids": groupIDs})
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		t.Cleanup(func() { adminRepo.Delete(user) })
+		return user, login
+	}
+	plain, plainLogin := newUser("plainuser", []string{})
+	manager, managerLogin := newUser("manager", []string{managersID})
+	plainToken := ApiTestDoLogin(t, plainLogin, "capability-password")
+
+	// The capabilities come with the tokens
+	body, _ := json.Marshal(Credentials{Login: managerLogin, Pwd: "capability-password"})
+	loginRR := httptest.NewRecorder()
+	LoginHandler(loginRR, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+	var tokens TokenResponse
+	json.Unmarshal(loginRR.Body.Bytes(), &tokens)
+	if !slices.Equal(tokens.Capabilities, []string{dblayer.CapabilityDashboardView, dblayer.CapabilityUsersManage}) {
+		t.Fatalf("Expected the capabilities of the managers, got %s", loginRR.Body.String())
+	}
+	managerToken := tokens.AccessToken
+
+	call := func(handler http.HandlerFunc, token string, method string, id string, payload any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// 1. Without capabilities
+	if rr := call(DashboardHandler, plainToken, http.MethodGet, "", nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+	if rr := call(CreateUserHandler, plainToken, http.MethodPost, "", map[string]any{"login": "nope" + Random4digits(), "pwd": "nope"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+	if rr := call(CreateGroupHandler, plainToken, http.MethodPost, "", map[string]any{"name": "nope" + Random4digits()}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+	if rr := call(UpdateGroupCapabilitiesHandler, plainToken, http.MethodPut, managersID, GroupCapabilitiesRequest{}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+	if rr := call(SetUserEnabledHandler, plainToken, http.MethodPut, manager.GetValue("id").(string), SetUserEnabledRequest{}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+	// Their own profile, but not their groups
+	plainID := plain.GetValue("id").(string)
+	rr := call(UpdateUserHandler, plainToken, http.MethodPut, plainID, map[string]any{"login": plainLogin, "fullname": "Renamed", "group_ids": []string{managersID}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+	if groupIDs, _ := GetUserGroupIDs(adminRepo, plainID, plain.GetValue("group_id").(string)); slices.Contains(groupIDs, managersID) {
+		t.Fatalf("Expected the groups not to change, got %v", groupIDs)
+	}
+
+	// 2. With users.manage and dashboard.view
+	if rr := call(DashboardHandler, managerToken, http.MethodGet, "", nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+	rr = call(CreateUserHandler, managerToken, http.MethodPost, "", map[string]any{"login": "managed" + Random4digits(), "pwd": "managed-password"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status Created, got %v %s", rr.Code, rr.Body.String())
+	}
+	var created map[string]any
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr := call(DeleteUserHandler, managerToken, http.MethodDelete, created["id"].(string), nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status No Content, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(CreateGroupHandler, managerToken, http.MethodPost, "", map[string]any{"name": "nope" + Random4digits()}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden without groups.manage, got %v", rr.Code)
+	}
+	// A disabled user is logged out and refused, until enabled again
+	if rr := call(SetUserEnabledHandler, managerToken, http.MethodPut, plainID, SetUserEnabledRequest{Enabled: false}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(DashboardHandler, plainToken, http.MethodGet, "", nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the token of the disabled user to be revoked, got %v", rr.Code)
+	}
+	body, _ = json.Marshal(Credentials{Login: plainLogin, Pwd: "capability-password"})
+	loginRR = httptest.NewRecorder()
+	LoginHandler(loginRR, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+	if loginRR.Code != http.StatusForbidden || !strings.Contains(loginRR.Body.String(), ErrUserDisabled) {
+		t.Fatalf("Expected the disabled user to be refused, got %v %s", loginRR.Code, loginRR.Body.String())
+	}
+	if rr := call(SetUserEnabledHandler, managerToken, http.MethodPut, manager.GetValue("id").(string), SetUserEnabledRequest{Enabled: false}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request to disable oneself, got %v", rr.Code)
+	}
+	if rr := call(SetUserEnabledHandler, managerToken, http.MethodPut, plainID, SetUserEnabledRequest{Enabled: true}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+	loginRR = httptest.NewRecorder()
+	LoginHandler(loginRR, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+	json.Unmarshal(loginRR.Body.Bytes(), &tokens)
+	if loginRR.Code != http.StatusOK {
+		t.Fatalf("Expected the enabled user to log in, got %v %s", loginRR.Code, loginRR.Body.String())
+	}
+	plainToken = tokens.AccessToken
+
+	// 3. Capabilities are checked on every request: taken from the group, they are gone
+	if _, err := adminRepo.SetGroupCapabilities(managersID, []string{dblayer.CapabilityDashboardView}); err != nil {
+		t.Fatalf("Failed to set the capabilities: %v", err)
+	}
+	rr = call(GetCapabilitiesHandler, managerToken, http.MethodGet, "", nil)
+	var capabilities CapabilitiesResponse
+	json.Unmarshal(rr.Body.Bytes(), &capabilities)
+	if rr.Code != http.StatusOK || len(capabilities.Capabilities) != len(dblayer.Capabilities) ||
+		!slices.Equal(capabilities.Granted, []string{dblayer.CapabilityDashboardView}) {
+		t.Fatalf("Expected only dashboard.view granted, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(CreateUserHandler, managerToken, http.MethodPost, "", map[string]any{"login": "nope" + Random4digits(), "pwd": "nope"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+
+	// 4. The capabilities of a group
+	rr = call(GetGroupCapabilitiesHandler, plainToken, http.MethodGet, managersID, nil)
+	var groupCapabilities GroupCapabilitiesResponse
+	json.Unmarshal(rr.Body.Bytes(), &groupCapabilities)
+	if rr.Code != http.StatusOK || !slices.Equal(groupCapabilities.Capabilities, []string{dblayer.CapabilityDashboardView}) {
+		t.Fatalf("Expected dashboard.view, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(GetGroupCapabilitiesHandler, plainToken, http.MethodGet, "nogroup", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected not found, got %v", rr.Code)
+	}
+
+	// 5. Who manages the groups gives only the capabilities they have
+	group = adminRepo.GetInstanceByTableName("groups")
+	group.SetValue("name", "groupers"+Random4digits())
+	groupers, err := adminRepo.Insert(group)
+	if err != nil {
+		t.Fatalf("Failed to create group: %v", err)
+	}
+	t.Cleanup(func() { adminRepo.Delete(groupers) })
+	if _, err := adminRepo.SetGroupCapabilities(groupers.GetValue("id").(string), []string{dblayer.CapabilityGroupsManage, dblayer.CapabilityDashboardView}); err != nil {
+		t.Fatalf("Failed to set the capabilities: %v", err)
+	}
+	_, grouperLogin := newUser("grouper", []string{groupers.GetValue("id").(string)})
+	grouperToken := ApiTestDoLogin(t, grouperLogin, "capability-password")
+	if rr := call(UpdateGroupCapabilitiesHandler, grouperToken, http.MethodPut, managersID,
+		GroupCapabilitiesRequest{Capabilities: []string{dblayer.CapabilityDashboardView, dblayer.CapabilityUsersManage}}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden to give users.manage, got %v", rr.Code)
+	}
+	rr = call(UpdateGroupCapabilitiesHandler, grouperToken, http.MethodPut, managersID,
+		GroupCapabilitiesRequest{Capabilities: []string{dblayer.CapabilityDashboardView, dblayer.CapabilityGroupsManage}})
+	json.Unmarshal(rr.Body.Bytes(), &groupCapabilities)
+	if rr.Code != http.StatusOK || !slices.Equal(groupCapabilities.Capabilities, []string{dblayer.CapabilityDashboardView, dblayer.CapabilityGroupsManage}) {
+		t.Fatalf("Expected the capabilities of the caller given, got %v %s", rr.Code, rr.Body.String())
+	}
+}
@@ -19,17 +19,38 @@ type ErrorResponse APIError
 const (
 	ErrUserAlreadyExists    = "USER_ALREADY_EXISTS"
 	ErrUserNotFound         = "USER_NOT_FOUND"
+	ErrUserDisabled         = "USER_DISABLED"
+	ErrEmailNotVerified     = "EMAIL_NOT_VERIFIED"
+	ErrRegistrationDisabled = "REGISTRATION_DISABLED"
+	ErrPasswordTooShort     = "PASSWORD_TOO_SHORT"
 	ErrGroupAlreadyExists   = "GROUP_ALREADY_EXISTS"
 	ErrGroupNotFound        = "GROUP_NOT_FOUND"
 	ErrUnauthorized         = "UNAUTHORIZED"
 	ErrForbidden            = "FORBIDDEN"
 	ErrInvalidRequest       = "INVALID_REQUEST"
 	ErrMissingField         = "MISSING_FIELD"
+	ErrInvalidField         = "INVALID_FIELD"
 	ErrInternalServer       = "INTERNAL_SERVER_ERROR"
 	ErrInvalidToken         = "INVALID_TOKEN"
 	ErrMissingAuthorization = "MISSING_AUTHORIZATION"
+	ErrInvalidRefreshToken  = "INVALID_REFRESH_TOKEN"
+
+	ErrTwoFactorInvalidCode    = "TWO_FACTOR_INVALID_CODE"
+	ErrTwoFactorNotEnabled     = "TWO_FACTOR_NOT_ENABLED"
+	ErrTwoFactorAlreadyEnabled = "TWO_FACTOR_ALREADY_ENABLED"
+	ErrWebAuthnFailed          = "WEBAUTHN_FAILED"
 
 	ErrObjectNotFound = "OBJECT_NOT_FOUND"
+
+	ErrShareNotFound         = "SHARE_NOT_FOUND"
+	ErrShareExpired          = "SHARE_EXPIRED"
+	ErrSharePasswordRequired = "SHARE_PASSWORD_REQUIRED"
+
+	ErrServiceUnavailable = "SERVICE_UNAVAILABLE"
+	ErrInvalidLanguage    = "INVALID_LANGUAGE"
+	ErrTranslationExists  = "TRANSLATION_EXISTS"
+	ErrRateLimited        = "RATE_LIMITED"
+	ErrAccountLocked      = "ACCOUNT_LOCKED"
 )
 
 // RespondError sends a structured error response
@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/json"
 	"net/http"
+	"slices"
 	"strings"
 
 	"rprj/be/dblayer"
@@ -26,21 +27,11 @@ func GetAllGroupsHandler(w http.ResponseWriter, r *http.Request) {
 	searchBy := r.URL.Query().Get("search")
 	orderBy := r.URL.Query().Get("order_by")
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	search := repo.GetInstanceByTableName("groups")
 	if search == nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to create group instance", http.StatusInternalServerError)
@@ -90,21 +81,11 @@ func GetGroupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	group := repo.GetInstanceByTableName("groups")
 	if group == nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to create group instance", http.StatusInternalServerError)
@@ -174,6 +155,7 @@ func GetGroupHandler(w http.ResponseWriter, r *http.Request) {
 // @Success 201 {object} map[string]interface{}
 // @Failure 400 {object} ErrorResponse "Bad Request"
 // @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
 // @Failure 409 {object} ErrorResponse "Group Already Exists"
 // @Failure 500 {object} ErrorResponse "Internal Server Error"
 // @Security BearerAuth
@@ -195,22 +177,11 @@ func CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authorizedRequest(w, r, dblayer.CapabilityGroupsManage)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	// dblayer.InitDBConnection()
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	dbGroup := repo.GetInstanceByTableName("groups")
 	if dbGroup == nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to create group instance", http.StatusInternalServerError)
@@ -252,6 +223,7 @@ func CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
 // @Success 200 {object} map[string]interface{}
 // @Failure 400 {object} ErrorResponse "Bad Request"
 // @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
 // @Failure 404 {object} ErrorResponse "Group Not Found"
 // @Failure 500 {object} ErrorResponse "Internal Server Error"
 // @Security BearerAuth
@@ -280,21 +252,16 @@ func UpdateGroupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
-
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
+	// Users can update their personal group
+	if !principal.Can(dblayer.CapabilityGroupsManage) && id != primaryGroupOf(repo, principal.UserID) {
+		RespondError(w, ErrForbidden, "You are not allowed to do this", map[string]string{"capability": dblayer.CapabilityGroupsManage}, http.StatusForbidden)
+		return
 	}
 
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	group := repo.GetInstanceByTableName("groups")
 	if group == nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to create group instance", http.StatusInternalServerError)
@@ -345,23 +312,11 @@ func DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+	_, repo, ok := authorizedRequest(w, r, dblayer.CapabilityGroupsManage)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	group := repo.GetInstanceByTableName("groups")
 	if group == nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to create group instance", http.StatusInternalServerError)
@@ -369,7 +324,7 @@ func DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	group.SetValue("id", id)
 
-	_, err = repo.Delete(group)
+	_, err := repo.Delete(group)
 	if err != nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to delete group: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -377,3 +332,150 @@ func DeleteGroupHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// primaryGroupOf returns the personal group of a user, empty when the user does not exist
+func primaryGroupOf(repo *dblayer.DBRepository, userID string) string {
+	user := repo.GetEntityByID("users", userID)
+	if user == nil {
+		return ""
+	}
+	groupID, _ := user.GetValue("group_id").(string)
+	return groupID
+}
+
+// CapabilityInfo godoc
+// @Description A capability that can be given to a group, e.g. users.manage
+type CapabilityInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// CapabilitiesResponse godoc
+// @Description The capabilities that can be given to the groups, and those of the caller
+type CapabilitiesResponse struct {
+	Capabilities []CapabilityInfo `json:"capabilities"`
+	Granted      []string         `json:"granted"`
+}
+
+// GroupCapabilitiesRequest godoc
+// @Description The capabilities of a group, replacing the current ones
+type GroupCapabilitiesRequest struct {
+	Capabilities []string `json:"capabilities"`
+}
+
+// GroupCapabilitiesResponse godoc
+// @Description The capabilities of a group
+type GroupCapabilitiesResponse struct {
+	GroupID      string   `json:"group_id"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// GetCapabilitiesHandler godoc
+// @Summary List the capabilities
+// @Description Returns the capabilities that can be given to the groups, and those of the current user
+// @Tags groups
+// @Produce json
+// @Success 200 {object} CapabilitiesResponse
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Security BearerAuth
+// @Router /capabilities [get]
+func GetCapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+	response := CapabilitiesResponse{Capabilities: []CapabilityInfo{}, Granted: principal.Capabilities()}
+	for _, capability := range dblayer.Capabilities {
+		response.Capabilities = append(response.Capabilities, CapabilityInfo{Name: capability.Name, Description: capability.Description})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetGroupCapabilitiesHandler godoc
+// @Summary Get the capabilities of a group
+// @Tags groups
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {object} GroupCapabilitiesResponse
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 404 {object} ErrorResponse "Group Not Found"
+// @Failure 500 {object} ErrorResponse "Internal Server Error"
+// @Security BearerAuth
+// @Router /groups/{id}/capabilities [get]
+func GetGroupCapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+	if repo.GetEntityByID("groups", id) == nil {
+		RespondError(w, ErrGroupNotFound, "Group not found", map[string]string{"id": id}, http.StatusNotFound)
+		return
+	}
+	capabilities, err := repo.GetGroupCapabilities(id)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get the capabilities: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GroupCapabilitiesResponse{GroupID: id, Capabilities: capabilities})
+}
+
+// UpdateGroupCapabilitiesHandler godoc
+// @Summary Replace the capabilities of a group
+// @Description Replaces the capabilities of the group. Only who can manage the groups can change them,
+// @Description giving only the capabilities they have.
+// @Tags groups
+// @Accept json
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param request body GroupCapabilitiesRequest true "The capabilities of the group"
+// @Success 200 {object} GroupCapabilitiesResponse
+// @Failure 400 {object} ErrorResponse "Unknown capability"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Group Not Found"
+// @Failure 500 {object} ErrorResponse "Internal Server Error"
+// @Security BearerAuth
+// @Router /groups/{id}/capabilities [put]
+func UpdateGroupCapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	principal, repo, ok := authorizedRequest(w, r, dblayer.CapabilityGroupsManage)
+	if !ok {
+		return
+	}
+	if repo.GetEntityByID("groups", id) == nil {
+		RespondError(w, ErrGroupNotFound, "Group not found", map[string]string{"id": id}, http.StatusNotFound)
+		return
+	}
+	current, err := repo.GetGroupCapabilities(id)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get the capabilities: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var req GroupCapabilitiesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	for _, capability := range req.Capabilities {
+		if !dblayer.ValidCapability(capability) {
+			RespondError(w, ErrInvalidField, "Unknown capability", map[string]string{"field": "capabilities", "capability": capability}, http.StatusBadRequest)
+			return
+		}
+		// groups.manage is not every capability: only those of the caller can be given
+		if !slices.Contains(current, capability) && !principal.Can(capability) {
+			RespondError(w, ErrForbidden, "Only the capabilities you have can be given", map[string]string{"capability": capability}, http.StatusForbidden)
+			return
+		}
+	}
+	capabilities, err := repo.SetGroupCapabilities(id, req.Capabilities)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to save the capabilities: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GroupCapabilitiesResponse{GroupID: id, Capabilities: capabilities})
+}
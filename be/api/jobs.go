@@ -0,0 +1,154 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// JobProgress godoc
+// @Description Progress of a long running job started by an admin, or of a suggestion asked by a save
+type JobProgress struct {
+	ID         string   `json:"id"`
+	Kind       string   `json:"kind"`
+	Owner      string   `json:"owner"`
+	Status     string   `json:"status"` // running, done, failed
+	Total      int      `json:"total"`
+	Processed  int      `json:"processed"`
+	Updated    int      `json:"updated"`
+	Failed     int      `json:"failed"`
+	Errors     []string `json:"errors,omitempty"`
+	Result     any      `json:"result,omitempty"` // what the job produced, e.g. a DescriptionSuggestion
+	StartedAt  int64    `json:"started_at"`
+	FinishedAt int64    `json:"finished_at,omitempty"`
+}
+
+type BackgroundJob struct {
+	JobProgress
+	mu sync.Mutex
+}
+
+const maxJobErrors = 50
+
+// jobRetention is how long a finished job can still be read
+const jobRetention = time.Hour
+
+var backgroundJobs = map[string]*BackgroundJob{}
+var backgroundJobsMu sync.Mutex
+
+// NewBackgroundJob registers a new running job, forgetting those finished more than jobRetention ago
+func NewBackgroundJob(kind string, owner string) *BackgroundJob {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	job := &BackgroundJob{JobProgress: JobProgress{
+		ID:        hex.EncodeToString(buf),
+		Kind:      kind,
+		Owner:     owner,
+		Status:    "running",
+		StartedAt: time.Now().Unix(),
+	}}
+	backgroundJobsMu.Lock()
+	for id, finished := range backgroundJobs {
+		finished.mu.Lock()
+		expired := finished.FinishedAt > 0 && time.Since(time.Unix(finished.FinishedAt, 0)) > jobRetention
+		finished.mu.Unlock()
+		if expired {
+			delete(backgroundJobs, id)
+		}
+	}
+	backgroundJobs[job.ID] = job
+	backgroundJobsMu.Unlock()
+	return job
+}
+
+func GetBackgroundJob(id string) *BackgroundJob {
+	backgroundJobsMu.Lock()
+	defer backgroundJobsMu.Unlock()
+	return backgroundJobs[id]
+}
+
+func (job *BackgroundJob) AddTotal(n int) {
+	job.mu.Lock()
+	job.Total += n
+	job.mu.Unlock()
+}
+
+// Step records the outcome of one processed item
+func (job *BackgroundJob) Step(updated bool, err error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Processed++
+	if err != nil {
+		job.Failed++
+		if len(job.Errors) < maxJobErrors {
+			job.Errors = append(job.Errors, err.Error())
+		}
+	} else if updated {
+		job.Updated++
+	}
+}
+
+// SetResult records what the job produced
+func (job *BackgroundJob) SetResult(result any) {
+	job.mu.Lock()
+	job.Result = result
+	job.mu.Unlock()
+}
+
+func (job *BackgroundJob) Finish(err error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	job.Status = "done"
+	if err != nil {
+		job.Status = "failed"
+		job.Errors = append(job.Errors, err.Error())
+	}
+	job.FinishedAt = time.Now().Unix()
+}
+
+// Snapshot returns a copy safe to be encoded while the job is running
+func (job *BackgroundJob) Snapshot() JobProgress {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	snapshot := job.JobProgress
+	snapshot.Errors = slices.Clone(job.Errors)
+	return snapshot
+}
+
+// GetJobHandler godoc
+// @Summary Get the progress of a background job
+// @Description Returns the progress of a job. Only the user who started it and the users with jobs.run can see it.
+// @Tags admin
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} JobProgress
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 404 {object} ErrorResponse "Job not found"
+// @Security BearerAuth
+// @Router /admin/jobs/{id} [get]
+func GetJobHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+	job := GetBackgroundJob(mux.Vars(r)["id"])
+	if job == nil {
+		RespondSimpleError(w, ErrObjectNotFound, "Job not found", http.StatusNotFound)
+		return
+	}
+	snapshot := job.Snapshot()
+	if snapshot.Owner != principal.UserID && !principal.Can(dblayer.CapabilityJobsRun) {
+		RespondSimpleError(w, ErrObjectNotFound, "Job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
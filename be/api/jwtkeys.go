@@ -0,0 +1,254 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"rprj/be/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTKeyring signs the access and file tokens with its current key and verifies them with the key of their kid.
+// JWTKey, derived from jwt_secret, still signs the tokens only this server reads (links, second factor).
+type JWTKeyring struct {
+	keys []*jwtKey
+	byID map[string]*jwtKey
+
+	now func() time.Time
+}
+
+type jwtKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   any // nil for a key that only verifies
+	verifyKey any
+	notBefore time.Time
+	notAfter  time.Time // zero = never
+}
+
+// retired tells whether the tokens of the key are refused
+func (k *jwtKey) retired(now time.Time) bool {
+	return !k.notAfter.IsZero() && !now.Before(k.notAfter)
+}
+
+// jwtSecretMinLength is the shortest jwt_secret accepted
+const jwtSecretMinLength = 16
+
+// CheckJWTSecret refuses a missing, default or short jwt_secret: it signs the second-factor challenges,
+// the WebAuthn ceremonies and the registration links even when jwt_keys holds asymmetric keys
+func CheckJWTSecret(secret string) error {
+	switch {
+	case secret == "":
+		return fmt.Errorf("jwt_secret is missing")
+	case secret == "change-me-secret":
+		return fmt.Errorf("jwt_secret is still the default")
+	case len(secret) < jwtSecretMinLength:
+		return fmt.Errorf("jwt_secret must be at least %d characters", jwtSecretMinLength)
+	}
+	return nil
+}
+
+// jwtKeyring is used for the access and file tokens (set by InitAPI)
+var jwtKeyring, _ = NewJWTKeyring(string(JWTKey), nil)
+
+// NewJWTKeyring returns the keyring of jwt_secret and of the configured keys
+func NewJWTKeyring(secret string, configs []models.JWTKeyConfig) (*JWTKeyring, error) {
+	keyring := &JWTKeyring{byID: map[string]*jwtKey{}, now: time.Now}
+	for _, config := range configs {
+		key, err := newJWTKey(config)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", config.ID, err)
+		}
+		if keyring.byID[key.id] != nil {
+			return nil, fmt.Errorf("key %q: duplicate kid", config.ID)
+		}
+		keyring.keys = append(keyring.keys, key)
+		keyring.byID[key.id] = key
+	}
+	// The key of jwt_secret comes first: the configured keys win the ties of not_before
+	if keyring.byID[""] == nil && secret != "" {
+		key := &jwtKey{method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}
+		keyring.keys = append([]*jwtKey{key}, keyring.keys...)
+		keyring.byID[""] = key
+	}
+	if len(keyring.keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return keyring, nil
+}
+
+func newJWTKey(config models.JWTKeyConfig) (*jwtKey, error) {
+	key := &jwtKey{id: config.ID, notBefore: time.Unix(config.NotBefore, 0)}
+	if config.NotAfter > 0 {
+		key.notAfter = time.Unix(config.NotAfter, 0)
+	}
+	readPEM := func(file string) ([]byte, error) {
+		if file == "" {
+			return nil, nil
+		}
+		return os.ReadFile(file)
+	}
+	privatePEM, err := readPEM(config.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	publicPEM, err := readPEM(config.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Algorithm {
+	case "", "HS256":
+		if config.Secret == "" {
+			return nil, fmt.Errorf("missing secret")
+		}
+		key.method = jwt.SigningMethodHS256
+		key.signKey = []byte(config.Secret)
+		key.verifyKey = []byte(config.Secret)
+	case "RS256":
+		key.method = jwt.SigningMethodRS256
+		if privatePEM != nil {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = privateKey
+			key.verifyKey = &privateKey.PublicKey
+		} else if publicPEM != nil {
+			if key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(publicPEM); err != nil {
+				return nil, err
+			}
+		}
+	case "EdDSA":
+		key.method = jwt.SigningMethodEdDSA
+		if privatePEM != nil {
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(privatePEM)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = privateKey
+			key.verifyKey = privateKey.(ed25519.PrivateKey).Public()
+		} else if publicPEM != nil {
+			if key.verifyKey, err = jwt.ParseEdPublicKeyFromPEM(publicPEM); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", config.Algorithm)
+	}
+	if key.verifyKey == nil {
+		return nil, fmt.Errorf("missing private_key_file or public_key_file")
+	}
+	return key, nil
+}
+
+// signingKey returns the key signing now: the last with the latest not_before already passed
+func (k *JWTKeyring) signingKey() *jwtKey {
+	now := k.now()
+	var current *jwtKey
+	for _, key := range k.keys {
+		if key.signKey == nil || now.Before(key.notBefore) || key.retired(now) {
+			continue
+		}
+		if current == nil || !key.notBefore.Before(current.notBefore) {
+			current = key
+		}
+	}
+	return current
+}
+
+// Sign returns the token of the claims signed with the current key, named in the kid header
+func (k *JWTKeyring) Sign(claims jwt.Claims) (string, error) {
+	key := k.signingKey()
+	if key == nil {
+		return "", fmt.Errorf("no signing key")
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	if key.id != "" {
+		token.Header["kid"] = key.id
+	}
+	return token.SignedString(key.signKey)
+}
+
+// Parse verifies a token with the key of its kid, only with the algorithm of the key
+func (k *JWTKeyring) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := k.byID[kid]
+		if key == nil {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("algorithm %s not of key %q", token.Method.Alg(), kid)
+		}
+		if key.retired(k.now()) {
+			return nil, fmt.Errorf("key %q retired", kid)
+		}
+		return key.verifyKey, nil
+	})
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // OKP curve
+	X   string `json:"x,omitempty"`   // OKP public key
+}
+
+type JWKSResponse struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys not retired, also those not yet signing
+func (k *JWTKeyring) JWKS() JWKSResponse {
+	now := k.now()
+	response := JWKSResponse{Keys: []JWK{}}
+	for _, key := range k.keys {
+		if key.retired(now) {
+			continue
+		}
+		jwk := JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch publicKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			// The secrets of HS256 stay here
+			continue
+		}
+		response.Keys = append(response.Keys, jwk)
+	}
+	return response
+}
+
+// JWKSHandler godoc
+// @Summary Public keys of the tokens
+// @Description Returns the RS256 and EdDSA keys verifying the access tokens, by kid, including the scheduled ones.
+// @Description HS256 keys are never published.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} JWKSResponse
+// @Router /.well-known/jwks.json [get]
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(jwtKeyring.JWKS())
+}
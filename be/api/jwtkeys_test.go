@@ -0,0 +1,199 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rprj/be/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// go test -v ./api -run TestJWTKeyring
+func TestJWTKeyring(t *testing.T) {
+	dir := t.TempDir()
+	writePEM := func(name string, blockType string, der []byte) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return file
+	}
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaDER, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	rsaPublicDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	oldPublicDER, _ := x509.MarshalPKIXPublicKey(&oldKey.PublicKey)
+
+	now := time.Now()
+	keyring, err := NewJWTKeyring("legacy-secret", []models.JWTKeyConfig{
+		{ID: "hs-1", Secret: "hs-1-secret", NotBefore: now.Add(-48 * time.Hour).Unix()},
+		{ID: "rsa-1", Algorithm: "RS256", PrivateKeyFile: writePEM("rsa.pem", "PRIVATE KEY", rsaDER), NotBefore: now.Add(-24 * time.Hour).Unix()},
+		{ID: "ed-1", Algorithm: "EdDSA", PrivateKeyFile: writePEM("ed.pem", "PRIVATE KEY", edDER), NotBefore: now.Add(time.Hour).Unix()},
+		{ID: "old", Algorithm: "RS256", PublicKeyFile: writePEM("old.pem", "PUBLIC KEY", oldPublicDER), NotAfter: now.Add(2 * time.Hour).Unix()},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load the keys: %v", err)
+	}
+	keyring.now = func() time.Time { return now }
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"user_id": "-1", "exp": now.Add(time.Hour).Unix()}
+	}
+	expectParse := func(tokenString string, valid bool) {
+		t.Helper()
+		_, err := keyring.Parse(tokenString, jwt.MapClaims{})
+		if (err == nil) != valid {
+			t.Fatalf("Expected valid=%v, got %v", valid, err)
+		}
+	}
+	signWith := func(method jwt.SigningMethod, kid string, key any) string {
+		token := jwt.NewWithClaims(method, claims())
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		tokenString, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		return tokenString
+	}
+
+	// 1. The key with the latest not_before already passed signs
+	rsaToken, err := keyring.Sign(claims())
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	token, _, _ := jwt.NewParser().ParseUnverified(rsaToken, jwt.MapClaims{})
+	if token.Header["kid"] != "rsa-1" || token.Method.Alg() != "RS256" {
+		t.Fatalf("Expected a RS256 token of rsa-1, got %v", token.Header)
+	}
+	expectParse(rsaToken, true)
+
+	// 2. The older keys still verify, the tokens without kid with jwt_secret
+	expectParse(signWith(jwt.SigningMethodHS256, "hs-1", []byte("hs-1-secret")), true)
+	expectParse(signWith(jwt.SigningMethodHS256, "", []byte("legacy-secret")), true)
+	expectParse(signWith(jwt.SigningMethodRS256, "old", oldKey), true)
+	// ...not with another key, algorithm or kid
+	expectParse(signWith(jwt.SigningMethodHS256, "", []byte("other-secret")), false)
+	expectParse(signWith(jwt.SigningMethodHS256, "rsa-1", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaPublicDER})), false)
+	expectParse(signWith(jwt.SigningMethodRS256, "nokey", rsaKey), false)
+
+	// 3. The scheduled key is published before it signs
+	jwks := keyring.JWKS()
+	kids := []string{}
+	for _, jwk := range jwks.Keys {
+		kids = append(kids, jwk.Kid)
+	}
+	if strings.Join(kids, ",") != "rsa-1,ed-1,old" {
+		t.Fatalf("Expected the public keys, got %v", kids)
+	}
+	if n, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].N); jwks.Keys[0].Kty != "RSA" || !bytes.Equal(n, rsaKey.N.Bytes()) || jwks.Keys[0].E != "AQAB" {
+		t.Fatalf("Unexpected RSA key %+v", jwks.Keys[0])
+	}
+	if x, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[1].X); jwks.Keys[1].Crv != "Ed25519" || !bytes.Equal(x, edKey.Public().(ed25519.PublicKey)) {
+		t.Fatalf("Unexpected Ed25519 key %+v", jwks.Keys[1])
+	}
+
+	// 4. After the rollover the new key signs, and the retired one is gone
+	now = now.Add(3 * time.Hour)
+	edToken, _ := keyring.Sign(claims())
+	token, _, _ = jwt.NewParser().ParseUnverified(edToken, jwt.MapClaims{})
+	if token.Header["kid"] != "ed-1" || token.Method.Alg() != "EdDSA" {
+		t.Fatalf("Expected an EdDSA token of ed-1, got %v", token.Header)
+	}
+	expectParse(edToken, true)
+	expectParse(rsaToken, true)
+	expectParse(signWith(jwt.SigningMethodRS256, "old", oldKey), false)
+	if len(keyring.JWKS().Keys) != 2 {
+		t.Fatalf("Expected the retired key not published, got %+v", keyring.JWKS())
+	}
+
+	// 5. Invalid configurations
+	for _, configs := range [][]models.JWTKeyConfig{
+		{{ID: "a", Secret: "x"}, {ID: "a", Secret: "y"}},
+		{{ID: "a"}},
+		{{ID: "a", Algorithm: "RS256"}},
+		{{ID: "a", Algorithm: "none", Secret: "x"}},
+		{{ID: "a", Algorithm: "EdDSA", PrivateKeyFile: filepath.Join(dir, "missing.pem")}},
+	} {
+		if _, err := NewJWTKeyring("legacy-secret", configs); err == nil {
+			t.Fatalf("Expected an error for %+v", configs)
+		}
+	}
+
+	// 6. The server-only tokens need a real jwt_secret, even with asymmetric keys
+	for _, secret := range []string{"", "change-me-secret", "short"} {
+		if CheckJWTSecret(secret) == nil {
+			t.Fatalf("Expected jwt_secret %q refused", secret)
+		}
+	}
+	if err := CheckJWTSecret(AppConfig.JWTSecret); err != nil {
+		t.Fatalf("Expected the jwt_secret of the tests accepted: %v", err)
+	}
+}
+
+// go test -v ./api -run TestJWTKeyringLogin
+func TestJWTKeyringLogin(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	keyFile := filepath.Join(t.TempDir(), "ed.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}), 0600)
+	keyring, err := NewJWTKeyring(AppConfig.JWTSecret, []models.JWTKeyConfig{
+		{ID: "ed-login", Algorithm: "EdDSA", PrivateKeyFile: keyFile},
+	})
+	if err != nil {
+		t.Fatalf("Failed to load the keys: %v", err)
+	}
+	savedKeyring := jwtKeyring
+	jwtKeyring = keyring
+	t.Cleanup(func() { jwtKeyring = savedKeyring })
+
+	// A session started with the new key works like the others
+	body, _ := json.Marshal(Credentials{Login: testAdminLogin, Pwd: testAdminPwd})
+	rr := httptest.NewRecorder()
+	LoginHandler(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+	var resp TokenResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if rr.Code != http.StatusOK || resp.AccessToken == "" {
+		t.Fatalf("Expected the login, got %v %s", rr.Code, rr.Body.String())
+	}
+	token, _, _ := jwt.NewParser().ParseUnverified(resp.AccessToken, jwt.MapClaims{})
+	if token.Header["kid"] != "ed-login" {
+		t.Fatalf("Expected a token of ed-login, got %v", token.Header)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	req.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+	rr = httptest.NewRecorder()
+	AuthMiddleware(http.HandlerFunc(PingHandler)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the token to be accepted, got %v %s", rr.Code, rr.Body.String())
+	}
+
+	// Other services verify it with the published key
+	rr = httptest.NewRecorder()
+	JWKSHandler(rr, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	var jwks JWKSResponse
+	json.Unmarshal(rr.Body.Bytes(), &jwks)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "ed-login" {
+		t.Fatalf("Expected the key of the login, got %s", rr.Body.String())
+	}
+	x, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	if _, err := jwt.Parse(resp.AccessToken, func(*jwt.Token) (any, error) { return ed25519.PublicKey(x), nil }); err != nil {
+		t.Fatalf("Expected the token verified with the JWKS: %v", err)
+	}
+}
@@ -0,0 +1,453 @@
+package api
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"rprj/be/dblayer"
+	"rprj/be/models"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPEntry is a user of the directory
+type LDAPEntry struct {
+	DN       string
+	Login    string
+	Email    string
+	Fullname string
+	Groups   []string // DN of the groups
+}
+
+// LDAPDirectory authenticates and lists the users of a directory
+type LDAPDirectory interface {
+	// Authenticate returns the entry of login when password is right, errLDAPInvalidCredentials otherwise
+	Authenticate(login string, password string) (*LDAPEntry, error)
+	// Users returns all the users matching the user filter
+	Users() ([]LDAPEntry, error)
+}
+
+var errLDAPInvalidCredentials = errors.New("invalid LDAP credentials")
+
+// ldapDirectory is the directory used by LoginHandler, nil when LDAP is disabled (set by InitAPI)
+var ldapDirectory LDAPDirectory
+
+// ldapGroupMap maps the lower case DN of LDAP groups to group names
+var ldapGroupMap = map[string]string{}
+
+// ldapServer is an LDAP or Active Directory server
+type ldapServer struct {
+	config models.LDAPConfig
+}
+
+// NewLDAPDirectory returns the configured directory, nil when the url is empty
+func NewLDAPDirectory(config models.LDAPConfig) LDAPDirectory {
+	if config.URL == "" {
+		return nil
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(&(objectClass=person)(uid=%s))"
+	}
+	if config.LoginAttribute == "" {
+		config.LoginAttribute = "uid"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+	if config.FullnameAttribute == "" {
+		config.FullnameAttribute = "cn"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	return &ldapServer{config: config}
+}
+
+// connect opens a connection bound with the service account
+func (s *ldapServer) connect() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: s.config.InsecureSkipVerify}
+	conn, err := ldap.DialURL(s.config.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(10 * time.Second)
+	if s.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.config.BindDN != "" {
+		if err := conn.Bind(s.config.BindDN, s.config.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("service bind failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (s *ldapServer) attributes() []string {
+	return []string{s.config.LoginAttribute, s.config.EmailAttribute, s.config.FullnameAttribute, s.config.GroupAttribute}
+}
+
+func (s *ldapServer) entry(e *ldap.Entry) LDAPEntry {
+	return LDAPEntry{
+		DN:       e.DN,
+		Login:    e.GetAttributeValue(s.config.LoginAttribute),
+		Email:    e.GetAttributeValue(s.config.EmailAttribute),
+		Fullname: e.GetAttributeValue(s.config.FullnameAttribute),
+		Groups:   e.GetAttributeValues(s.config.GroupAttribute),
+	}
+}
+
+func (s *ldapServer) Authenticate(login string, password string) (*LDAPEntry, error) {
+	// An empty password would be an unauthenticated bind, accepted by many servers
+	if login == "" || password == "" {
+		return nil, errLDAPInvalidCredentials
+	}
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	search := ldap.NewSearchRequest(s.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(s.config.UserFilter, ldap.EscapeFilter(login)), s.attributes(), nil)
+	result, err := conn.Search(search)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, errLDAPInvalidCredentials
+	}
+	entry := s.entry(result.Entries[0])
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errLDAPInvalidCredentials
+		}
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *ldapServer) Users() ([]LDAPEntry, error) {
+	conn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	search := ldap.NewSearchRequest(s.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		strings.ReplaceAll(s.config.UserFilter, "%s", "*"), s.attributes(), nil)
+	result, err := conn.SearchWithPaging(search, 500)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LDAPEntry, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		entries = append(entries, s.entry(e))
+	}
+	return entries, nil
+}
+
+// getUserLDAP returns the LDAP link of a user, nil for local users
+func getUserLDAP(repo *dblayer.DBRepository, userID string) dblayer.DBEntityInterface {
+	search := repo.GetInstanceByTableName("users_ldap")
+	search.SetValue("user_id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return nil
+	}
+	return results[0]
+}
+
+// LDAPLogin authenticates login against the directory. Local users, i.e. existing users
+// not linked to the directory, are not handled: the second result is false and the password
+// must be checked locally. The user is created at the first login, and updated with its groups
+// at every login. Whether the user is enabled is left to the caller, once the password is checked.
+func LDAPLogin(repo *dblayer.DBRepository, directory LDAPDirectory, login string, password string) (*dblayer.DBUser, bool, error) {
+	search := repo.GetInstanceByTableName("users")
+	search.SetValue("login", login)
+	found, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return nil, true, err
+	}
+	var user *dblayer.DBUser
+	var userLDAP dblayer.DBEntityInterface
+	if len(found) > 0 {
+		user = found[0].(*dblayer.DBUser)
+		if userLDAP = getUserLDAP(repo, user.GetValue("id").(string)); userLDAP == nil {
+			return nil, false, nil
+		}
+	}
+
+	entry, err := directory.Authenticate(login, password)
+	if err != nil {
+		return nil, true, err
+	}
+	if entry.Login == "" {
+		entry.Login = login
+	}
+	// The directory may spell the login differently, e.g. in another case
+	if user == nil && entry.Login != login {
+		search := repo.GetInstanceByTableName("users")
+		search.SetValue("login", entry.Login)
+		if found, err = repo.Search(search, false, false, ""); err != nil {
+			return nil, true, err
+		}
+		if len(found) > 0 {
+			user = found[0].(*dblayer.DBUser)
+			if userLDAP = getUserLDAP(repo, user.GetValue("id").(string)); userLDAP == nil {
+				log.Printf("LDAP: %s is a local user, not linked to %s", entry.Login, entry.DN)
+				return nil, true, errLDAPInvalidCredentials
+			}
+		}
+	}
+	if user == nil {
+		if user, err = createLDAPUser(repo, entry); err != nil {
+			return nil, true, err
+		}
+	} else if err := updateLDAPUser(repo, user, userLDAP, entry); err != nil {
+		return nil, true, err
+	}
+	primaryGroupID, _ := user.GetValue("group_id").(string)
+	if err := syncLDAPGroups(repo, user.GetValue("id").(string), primaryGroupID, entry.Groups); err != nil {
+		return nil, true, err
+	}
+	return user, true, nil
+}
+
+// createLDAPUser creates the user of an entry: DBUser.beforeInsert gives it its personal group
+func createLDAPUser(repo *dblayer.DBRepository, entry *LDAPEntry) (*dblayer.DBUser, error) {
+	fullname := entry.Fullname
+	if fullname == "" {
+		fullname = entry.Login
+	}
+	user := repo.GetInstanceByTableName("users")
+	user.SetValue("login", entry.Login)
+	user.SetValue("fullname", fullname)
+	user.SetValue("email", entry.Email)
+	user.SetValue("pwd", "")
+	created, err := repo.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+	userLDAP := repo.GetInstanceByTableName("users_ldap")
+	userLDAP.SetValue("user_id", created.GetValue("id"))
+	userLDAP.SetValue("dn", entry.DN)
+	userLDAP.SetValue("synced_at", dbTime(time.Now()))
+	if _, err := repo.Insert(userLDAP); err != nil {
+		return nil, err
+	}
+	log.Printf("LDAP: created user %s for %s", entry.Login, entry.DN)
+	return created.(*dblayer.DBUser), nil
+}
+
+// updateLDAPUser copies email and full name from the entry
+func updateLDAPUser(repo *dblayer.DBRepository, user *dblayer.DBUser, userLDAP dblayer.DBEntityInterface, entry *LDAPEntry) error {
+	if entry.Fullname != "" && (user.GetValue("fullname") != entry.Fullname || user.GetValue("email") != entry.Email) {
+		update := repo.GetInstanceByTableName("users")
+		update.SetValue("id", user.GetValue("id"))
+		update.SetValue("fullname", entry.Fullname)
+		update.SetValue("email", entry.Email)
+		if _, err := repo.Update(update); err != nil {
+			return err
+		}
+		user.SetValue("fullname", entry.Fullname)
+		user.SetValue("email", entry.Email)
+	}
+	normalizeDBTimes(userLDAP, "synced_at")
+	userLDAP.SetValue("dn", entry.DN)
+	userLDAP.SetValue("synced_at", dbTime(time.Now()))
+	_, err := repo.Update(userLDAP)
+	return err
+}
+
+// syncLDAPGroups adds the user to the groups mapped from its LDAP groups and removes it from
+// the other mapped groups. Groups not in the map are left alone.
+func syncLDAPGroups(repo *dblayer.DBRepository, userID string, primaryGroupID string, ldapGroups []string) error {
+	if len(ldapGroupMap) == 0 {
+		return nil
+	}
+	wanted := map[string]bool{}
+	for _, dn := range ldapGroups {
+		if name, ok := ldapGroupMap[strings.ToLower(dn)]; ok {
+			wanted[name] = true
+		}
+	}
+	current, err := GetUserGroupIDs(repo, userID, primaryGroupID)
+	if err != nil {
+		return err
+	}
+	for _, name := range uniqueGroupNames() {
+		search := repo.GetInstanceByTableName("groups")
+		search.SetValue("name", name)
+		groups, err := repo.Search(search, false, false, "")
+		if err != nil {
+			return err
+		}
+		if len(groups) == 0 {
+			log.Printf("LDAP: group %s of group_map not found", name)
+			continue
+		}
+		groupID := groups[0].GetValue("id").(string)
+		if groupID == primaryGroupID {
+			continue
+		}
+		member := slices.Contains(current, groupID)
+		userGroup := repo.GetInstanceByTableName("users_groups")
+		userGroup.SetValue("user_id", userID)
+		userGroup.SetValue("group_id", groupID)
+		if wanted[name] && !member {
+			_, err = repo.Insert(userGroup)
+		} else if !wanted[name] && member {
+			_, err = repo.Delete(userGroup)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uniqueGroupNames() []string {
+	names := []string{}
+	for _, name := range ldapGroupMap {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// LDAPSyncResult godoc
+// @Description Outcome of a synchronization with the directory
+type LDAPSyncResult struct {
+	Updated  int `json:"updated"`
+	Disabled int `json:"disabled"`
+}
+
+// SyncLDAPUsers updates the linked users from the directory, disables the users whose entry
+// disappeared and logs them out. Users are created only at their first login.
+func SyncLDAPUsers(repo *dblayer.DBRepository, directory LDAPDirectory) (LDAPSyncResult, error) {
+	var result LDAPSyncResult
+	entries, err := directory.Users()
+	if err != nil {
+		return result, err
+	}
+	byLogin := map[string]*LDAPEntry{}
+	for i := range entries {
+		byLogin[strings.ToLower(entries[i].Login)] = &entries[i]
+	}
+
+	links, err := repo.Search(repo.GetInstanceByTableName("users_ldap"), false, false, "")
+	if err != nil {
+		return result, err
+	}
+	// A misconfigured filter must not disable everybody
+	if len(entries) == 0 && len(links) > 0 {
+		return result, fmt.Errorf("the directory returned no users")
+	}
+	for _, userLDAP := range links {
+		userID := userLDAP.GetValue("user_id").(string)
+		search := repo.GetInstanceByTableName("users")
+		search.SetValue("id", userID)
+		users, err := repo.Search(search, false, false, "")
+		if err != nil || len(users) == 0 {
+			continue
+		}
+		user := users[0].(*dblayer.DBUser)
+		enabled, reason := userEnabled(getUserStatus(repo, userID))
+		entry, ok := byLogin[strings.ToLower(user.GetValue("login").(string))]
+		if !ok {
+			if !enabled {
+				continue
+			}
+			if err := setUserEnabled(repo, userID, false, disabledByDirectory); err != nil {
+				return result, err
+			}
+			sessions, _ := getSessions(repo, userID)
+			for _, session := range sessions {
+				RevokeSession(repo, session.GetValue("session_id").(string))
+			}
+			log.Printf("LDAP: disabled user %s", user.GetValue("login"))
+			result.Disabled++
+			continue
+		}
+		if err := updateLDAPUser(repo, user, userLDAP, entry); err != nil {
+			return result, err
+		}
+		// Back in the directory: the users disabled by an admin stay disabled
+		if !enabled && reason == disabledByDirectory {
+			if err := setUserEnabled(repo, userID, true, ""); err != nil {
+				return result, err
+			}
+		}
+		primaryGroupID, _ := user.GetValue("group_id").(string)
+		if err := syncLDAPGroups(repo, userID, primaryGroupID, entry.Groups); err != nil {
+			return result, err
+		}
+		result.Updated++
+	}
+	return result, nil
+}
+
+// StartLDAPSync synchronizes the users with the directory in the background
+func StartLDAPSync(interval time.Duration) {
+	if ldapDirectory == nil || interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(interval)
+			repo := dblayer.NewSystemRepository("LDAP sync", ldapSyncTables...)
+			result, err := SyncLDAPUsers(repo, ldapDirectory)
+			if err != nil {
+				log.Print("LDAP sync failed: ", err)
+				continue
+			}
+			log.Printf("LDAP sync: %d users updated, %d disabled", result.Updated, result.Disabled)
+		}
+	}()
+}
+
+// SyncLDAPHandler godoc
+// @Summary Synchronize the users with the LDAP directory
+// @Description Updates the users linked to the directory and disables the ones removed from it,
+// @Description as the scheduled synchronization does.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} LDAPSyncResult "Outcome"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 502 {object} ErrorResponse "Directory not reachable"
+// @Failure 503 {object} ErrorResponse "LDAP not configured"
+// @Security BearerAuth
+// @Router /admin/ldap/sync [post]
+func SyncLDAPHandler(w http.ResponseWriter, r *http.Request) {
+	_, repo, ok := authorizedRequest(w, r, dblayer.CapabilityDirectorySync)
+	if !ok {
+		return
+	}
+	if ldapDirectory == nil {
+		RespondSimpleError(w, ErrServiceUnavailable, "LDAP not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	result, err := SyncLDAPUsers(repo, ldapDirectory)
+	if err != nil {
+		log.Print("SyncLDAPHandler: ", err)
+		RespondSimpleError(w, ErrServiceUnavailable, "LDAP sync failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"rprj/be/dblayer"
+	"rprj/be/models"
+)
+
+// fakeLDAPDirectory is an in memory directory: entries by login, with their passwords
+type fakeLDAPDirectory struct {
+	entries   map[string]LDAPEntry
+	passwords map[string]string
+}
+
+func (d *fakeLDAPDirectory) Authenticate(login string, password string) (*LDAPEntry, error) {
+	for key, entry := range d.entries {
+		if strings.EqualFold(key, login) && password != "" && d.passwords[key] == password {
+			return &entry, nil
+		}
+	}
+	return nil, errLDAPInvalidCredentials
+}
+
+func (d *fakeLDAPDirectory) Users() ([]LDAPEntry, error) {
+	entries := []LDAPEntry{}
+	for _, entry := range d.entries {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// go test -v ./api -run TestLDAPLogin
+func TestLDAPLogin(t *testing.T) {
+	login := "ldap" + Random4digits()
+	dn := "uid=" + login + ",ou=people,dc=example,dc=com"
+	webmasters := "CN=Webmasters,ou=groups,dc=example,dc=com"
+	directory := &fakeLDAPDirectory{
+		entries: map[string]LDAPEntry{
+			login: {DN: dn, Login: login, Email: login + "@example.com", Fullname: "LDAP User", Groups: []string{webmasters}},
+		},
+		passwords: map[string]string{login: "ldap-secret"},
+	}
+	previousDirectory, previousMap := ldapDirectory, ldapGroupMap
+	ldapDirectory = directory
+	ldapGroupMap = map[string]string{strings.ToLower(webmasters): "Webmaster"}
+	t.Cleanup(func() { ldapDirectory, ldapGroupMap = previousDirectory, previousMap })
+
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	t.Cleanup(func() {
+		search := adminRepo.GetInstanceByTableName("users")
+		search.SetValue("login", login)
+		users, _ := adminRepo.Search(search, false, false, "")
+		for _, user := range users {
+			adminRepo.Delete(user)
+		}
+	})
+	localLogin := "local" + Random4digits()
+	localUser, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    localLogin,
+		"pwd":      "local-secret",
+		"fullname": "Local user",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer adminRepo.Delete(localUser)
+
+	loginWith := func(login string, pwd string) (*httptest.ResponseRecorder, TokenResponse) {
+		body, _ := json.Marshal(Credentials{Login: login, Pwd: pwd})
+		rr := httptest.NewRecorder()
+		LoginHandler(rr, httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body)))
+		var tokens TokenResponse
+		json.Unmarshal(rr.Body.Bytes(), &tokens)
+		return rr, tokens
+	}
+
+	// 1. The first login creates the user, with its personal group and the mapped groups
+	rr, tokens := loginWith(login, "ldap-secret")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the LDAP login to succeed, got %v: %s", rr.Code, rr.Body.String())
+	}
+	user := adminRepo.GetEntityByID("users", tokens.UserID)
+	if user == nil || user.GetValue("fullname") != "LDAP User" || user.GetValue("email") != login+"@example.com" {
+		t.Fatalf("Expected the user created from the entry, got %v", user)
+	}
+	personalGroup := user.GetValue("group_id").(string)
+	if !slices.Contains(tokens.Groups, personalGroup) || !slices.Contains(tokens.Groups, "-6") {
+		t.Fatalf("Expected the personal group and Webmaster, got %v", tokens.Groups)
+	}
+	if rr, _ := loginWith(login, "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong LDAP password to be refused, got %v", rr.Code)
+	}
+	if rr, _ := loginWith(login, ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected an empty password to be refused, got %v", rr.Code)
+	}
+	// The directory is case insensitive: the same user logs in
+	if rr, again := loginWith(strings.ToUpper(login), "ldap-secret"); rr.Code != http.StatusOK || again.UserID != tokens.UserID {
+		t.Fatalf("Expected the same user with another case, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	// 2. Local users keep their password
+	if rr, _ := loginWith(localLogin, "local-secret"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the local login to succeed, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	// 3. Groups follow the directory
+	entry := directory.entries[login]
+	entry.Groups = nil
+	entry.Fullname = "Renamed User"
+	directory.entries[login] = entry
+	_, tokens = loginWith(login, "ldap-secret")
+	if slices.Contains(tokens.Groups, "-6") {
+		t.Fatalf("Expected Webmaster to be removed, got %v", tokens.Groups)
+	}
+	if user := adminRepo.GetEntityByID("users", tokens.UserID); user.GetValue("fullname") != "Renamed User" {
+		t.Fatalf("Expected the full name to be updated, got %v", user.GetValue("fullname"))
+	}
+
+	// 4. The sync disables the users removed from the directory and logs them out
+	delete(directory.entries, login)
+	directory.entries["other"] = LDAPEntry{DN: "uid=other,dc=example,dc=com", Login: "other"}
+	result, err := SyncLDAPUsers(adminRepo, directory)
+	if err != nil || result.Disabled != 1 {
+		t.Fatalf("Expected one user disabled, got %+v %v", result, err)
+	}
+	if _, err := RefreshTokens(adminRepo, tokens.RefreshToken); err == nil {
+		t.Fatalf("Expected the sessions of the disabled user to be revoked")
+	}
+	directory.passwords[login] = "ldap-secret"
+	if rr, _ := loginWith(login, "ldap-secret"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the user removed from the directory to be refused, got %v", rr.Code)
+	}
+	// Other login methods are refused too
+	if _, err := StartSession(adminRepo, httptest.NewRequest(http.MethodPost, "/", nil), tokens.UserID, login, tokens.Groups, "test"); err != errAccountDisabled {
+		t.Fatalf("Expected no session for a disabled user, got %v", err)
+	}
+
+	// 5. An empty answer does not disable everybody
+	if _, err := SyncLDAPUsers(adminRepo, &fakeLDAPDirectory{}); err == nil {
+		t.Fatalf("Expected an empty directory to stop the sync")
+	}
+
+	// 6. Back in the directory, the user is enabled again by the sync, not by a login
+	directory.entries[login] = entry
+	if rr, _ := loginWith(login, "ldap-secret"); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected the disabled user to be refused until the sync, got %v", rr.Code)
+	}
+	// Disabled is told only after the password, and the attempts count for the lockout
+	savedLimiter := rateLimiter
+	t.Cleanup(func() { rateLimiter = savedLimiter })
+	rateLimiter = NewRateLimiter(models.RateLimitConfig{LockoutThreshold: 2, LockoutSeconds: 60})
+	if rr, _ := loginWith(login, "wrong-secret"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong password of a disabled user to be unauthorized, got %v", rr.Code)
+	}
+	loginWith(login, "ldap-secret")
+	if rr, _ := loginWith(login, "ldap-secret"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the disabled user locked, got %v", rr.Code)
+	}
+	rateLimiter = savedLimiter
+	if result, err := SyncLDAPUsers(adminRepo, directory); err != nil || result.Updated != 1 {
+		t.Fatalf("Expected one user updated, got %+v %v", result, err)
+	}
+	if rr, _ := loginWith(login, "ldap-secret"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the user enabled again, got %v: %s", rr.Code, rr.Body.String())
+	}
+	link := adminRepo.GetInstanceByTableName("users_ldap")
+	link.SetValue("user_id", tokens.UserID)
+	if links, _ := adminRepo.Search(link, false, false, ""); len(links) != 1 || links[0].(*dblayer.UserLDAP).GetValue("dn") != dn {
+		t.Fatalf("Expected the LDAP link of the user, got %v", links)
+	}
+}
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Features that can use a different model, see llm_models in the configuration
+const (
+	LLMFeatureChat        = "chat"
+	LLMFeatureDefaultPage = "default_page"
+	LLMFeatureTranslate   = "translate"
+	LLMFeatureSummarize   = "summarize"
+	LLMFeatureAsk         = "ask"
+)
+
+// Model to use for each feature, the default is ollama_model (set by InitAPI)
+var llmFeatureModels map[string]string
+
+type LLMMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// LLMProvider is a chat model backend
+type LLMProvider interface {
+	Name() string
+	// Chat returns the answer and the number of tokens used (prompt + completion).
+	// maxTokens limits the tokens generated, 0 = the model default.
+	// When onToken is not nil the answer is streamed and onToken is called for every piece of it.
+	Chat(ctx context.Context, model string, messages []LLMMessage, maxTokens int, onToken func(string) error) (string, int, error)
+}
+
+// NewLLMProvider builds the provider configured with llm_provider: ollama (default), openai or fake.
+// Returns nil when the provider is not configured.
+func NewLLMProvider(kind string, url string, apiKey string) LLMProvider {
+	switch kind {
+	case "", "ollama":
+		if url == "" {
+			return nil
+		}
+		return &OllamaProvider{URL: url}
+	case "openai":
+		if url == "" {
+			return nil
+		}
+		return &OpenAIProvider{URL: url, APIKey: apiKey}
+	case "fake":
+		return &FakeLLMProvider{}
+	}
+	log.Printf("NewLLMProvider: unknown provider '%s'", kind)
+	return nil
+}
+
+func llmConfigured() bool {
+	return llmProvider != nil && ollamaModel != ""
+}
+
+// llmModel returns the model configured for a feature
+func llmModel(feature string) string {
+	if model := llmFeatureModels[feature]; model != "" {
+		return model
+	}
+	return ollamaModel
+}
+
+// llmPost sends a JSON request and returns the response, or an error when the status is not 200
+func llmPost(ctx context.Context, url string, apiKey string, body any) (*http.Response, error) {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s returned %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// OllamaProvider uses the Ollama chat API, URL is the full endpoint (e.g. http://localhost:11434/api/chat)
+type OllamaProvider struct {
+	URL string
+}
+
+func (p *OllamaProvider) Name() string {
+	return "ollama"
+}
+
+func (p *OllamaProvider) Chat(ctx context.Context, model string, messages []LLMMessage, maxTokens int, onToken func(string) error) (string, int, error) {
+	body := map[string]interface{}{
+		"model":    model,
+		"messages": messages,
+		"stream":   onToken != nil,
+	}
+	if maxTokens > 0 {
+		body["options"] = map[string]int{"num_predict": maxTokens}
+	}
+	resp, err := llmPost(ctx, p.URL, "", body)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	// Parse the response
+	// {"model":"llama3.2:latest","created_at":"2025-11-13T13:17:45.487900903Z","message":{"role":"assistant","content":"I'm an artificial intelligence model known as Llama. Llama stands for \"Large Language Model Meta AI.\""},"done":true,"done_reason":"stop","total_duration":1593273648,"load_duration":103413131,"prompt_eval_count":29,"prompt_eval_duration":132183696,"eval_count":23,"eval_duration":1338392262}
+	// When streaming, one object like this per line: the last one has done=true and the counters.
+	type ollamaChatResponse struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		Done            bool   `json:"done"`
+		Error           string `json:"error"`
+		PromptEvalCount int    `json:"prompt_eval_count"`
+		EvalCount       int    `json:"eval_count"`
+	}
+
+	if onToken == nil {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", 0, err
+		}
+		log.Printf("Ollama response: %s\n", string(body))
+
+		var ollamaResponseSingle ollamaChatResponse
+		if err := json.Unmarshal(body, &ollamaResponseSingle); err == nil && ollamaResponseSingle.Message.Content != "" {
+			return ollamaResponseSingle.Message.Content, ollamaResponseSingle.PromptEvalCount + ollamaResponseSingle.EvalCount, nil
+		}
+		return "", 0, fmt.Errorf("invalid response from Ollama")
+	}
+
+	var content strings.Builder
+	tokens := 0
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chunk ollamaChatResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			return content.String(), tokens, fmt.Errorf("invalid response from Ollama: %v", err)
+		}
+		if chunk.Error != "" {
+			return content.String(), tokens, fmt.Errorf("Ollama error: %s", chunk.Error)
+		}
+		if chunk.Message.Content != "" {
+			content.WriteString(chunk.Message.Content)
+			if err := onToken(chunk.Message.Content); err != nil {
+				// The client went away: stop generating
+				return content.String(), tokens, err
+			}
+		}
+		if chunk.Done {
+			tokens = chunk.PromptEvalCount + chunk.EvalCount
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return content.String(), tokens, err
+	}
+	return content.String(), tokens, nil
+}
+
+// OpenAIProvider uses an OpenAI compatible chat completions API (llama.cpp server, vLLM, ...).
+// URL is the base URL (e.g. http://localhost:8000/v1) or the full chat/completions endpoint.
+type OpenAIProvider struct {
+	URL    string
+	APIKey string
+}
+
+func (p *OpenAIProvider) Name() string {
+	return "openai"
+}
+
+func (p *OpenAIProvider) endpoint() string {
+	if strings.HasSuffix(p.URL, "/chat/completions") {
+		return p.URL
+	}
+	return strings.TrimSuffix(p.URL, "/") + "/chat/completions"
+}
+
+func (p *OpenAIProvider) Chat(ctx context.Context, model string, messages []LLMMessage, maxTokens int, onToken func(string) error) (string, int, error) {
+	body := map[string]interface{}{
+		"model":    model,
+		"messages": messages,
+		"stream":   onToken != nil,
+	}
+	if maxTokens > 0 {
+		body["max_tokens"] = maxTokens
+	}
+	if onToken != nil {
+		// Ask for the usage in the last chunk
+		body["stream_options"] = map[string]bool{"include_usage": true}
+	}
+	resp, err := llmPost(ctx, p.endpoint(), p.APIKey, body)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	// {"id":"chatcmpl-1","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"Hello!"},"finish_reason":"stop"}],"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}}
+	// When streaming, Server-Sent Events with "delta" instead of "message" and a final "data: [DONE]".
+	type openAIChatResponse struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+		Usage *struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+
+	if onToken == nil {
+		var response openAIChatResponse
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return "", 0, fmt.Errorf("invalid response from %s: %v", p.Name(), err)
+		}
+		if len(response.Choices) == 0 || response.Choices[0].Message.Content == "" {
+			return "", 0, fmt.Errorf("invalid response from %s", p.Name())
+		}
+		tokens := 0
+		if response.Usage != nil {
+			tokens = response.Usage.TotalTokens
+		}
+		return response.Choices[0].Message.Content, tokens, nil
+	}
+
+	var content strings.Builder
+	tokens := 0
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var chunk openAIChatResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return content.String(), tokens, fmt.Errorf("invalid response from %s: %v", p.Name(), err)
+		}
+		if chunk.Usage != nil {
+			tokens = chunk.Usage.TotalTokens
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			content.WriteString(choice.Delta.Content)
+			if err := onToken(choice.Delta.Content); err != nil {
+				return content.String(), tokens, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return content.String(), tokens, err
+	}
+	return content.String(), tokens, nil
+}
+
+// FakeLLMProvider answers without any model, for tests and development.
+// By default it answers Prefix followed by the last line of the last message;
+// the answer is streamed word by word and every word counts as a token, maxTokens cuts the answer.
+type FakeLLMProvider struct {
+	Prefix string
+	Reply  func(prompt string) string // overrides the default answer
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+func (p *FakeLLMProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeLLMProvider) Chat(ctx context.Context, model string, messages []LLMMessage, maxTokens int, onToken func(string) error) (string, int, error) {
+	if len(messages) == 0 {
+		return "", 0, fmt.Errorf("no messages")
+	}
+	prompt := messages[len(messages)-1].Content
+	p.mu.Lock()
+	p.prompts = append(p.prompts, prompt)
+	p.mu.Unlock()
+
+	var answer string
+	if p.Reply != nil {
+		answer = p.Reply(prompt)
+	} else {
+		lines := strings.Split(prompt, "\n")
+		answer = p.Prefix + lines[len(lines)-1]
+	}
+	if words := strings.SplitAfter(answer, " "); maxTokens > 0 && len(words) > maxTokens {
+		answer = strings.Join(words[:maxTokens], "")
+	}
+	tokens := len(strings.Fields(prompt)) + len(strings.Fields(answer))
+
+	if onToken != nil {
+		for _, word := range strings.SplitAfter(answer, " ") {
+			if word == "" {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return "", 0, err
+			}
+			if err := onToken(word); err != nil {
+				return answer, tokens, err
+			}
+		}
+	}
+	return answer, tokens, nil
+}
+
+// Prompts returns the prompts received so far
+func (p *FakeLLMProvider) Prompts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.prompts...)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// go test -v ./api -run TestOpenAIProvider
+func TestOpenAIProvider(t *testing.T) {
+	maxTokens := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Model     string `json:"model"`
+			Stream    bool   `json:"stream"`
+			MaxTokens int    `json:"max_tokens"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		maxTokens = req.MaxTokens
+		if !req.Stream {
+			fmt.Fprintf(w, `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hello from %s"}}],"usage":{"total_tokens":12}}`, req.Model)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, word := range []string{"Hello ", "from ", req.Model} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", word)
+		}
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"total_tokens\":7}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	provider := NewLLMProvider("openai", server.URL+"/v1", "secret")
+	messages := []LLMMessage{{Role: "user", Content: "Hi"}}
+
+	answer, tokens, err := provider.Chat(context.Background(), "tiny", messages, 50, nil)
+	if err != nil {
+		t.Fatalf("Chat failed: %v", err)
+	}
+	if answer != "Hello from tiny" || tokens != 12 {
+		t.Fatalf("Unexpected answer '%s' (%d tokens)", answer, tokens)
+	}
+	if maxTokens != 50 {
+		t.Fatalf("Expected max_tokens 50, got %d", maxTokens)
+	}
+
+	var pieces []string
+	answer, tokens, err = provider.Chat(context.Background(), "tiny", messages, 0, func(token string) error {
+		pieces = append(pieces, token)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Streamed chat failed: %v", err)
+	}
+	if answer != "Hello from tiny" || tokens != 7 || len(pieces) != 3 {
+		t.Fatalf("Unexpected streamed answer '%s' (%d tokens, %d pieces)", answer, tokens, len(pieces))
+	}
+
+	// Wrong key
+	provider = NewLLMProvider("openai", server.URL+"/v1/chat/completions", "wrong")
+	if _, _, err := provider.Chat(context.Background(), "tiny", messages, 0, nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Expected an unauthorized error, got %v", err)
+	}
+}
+
+// go test -v ./api -run TestCallLLMFeatureModels
+func TestCallLLMFeatureModels(t *testing.T) {
+	provider := &FakeLLMProvider{}
+	useLLMProvider(t, provider)
+	oldModels := llmFeatureModels
+	llmFeatureModels = map[string]string{LLMFeatureTranslate: "translator"}
+	defer func() { llmFeatureModels = oldModels }()
+
+	if llmModel(LLMFeatureTranslate) != "translator" || llmModel(LLMFeatureAsk) != "fake" {
+		t.Fatalf("Unexpected models %s, %s", llmModel(LLMFeatureTranslate), llmModel(LLMFeatureAsk))
+	}
+	answer, err := CallLLM(LLMFeatureChat, "line one\nline ```html two")
+	if err != nil {
+		t.Fatalf("CallLLM failed: %v", err)
+	}
+	if answer != "line  two" {
+		t.Fatalf("Unexpected answer '%s'", answer)
+	}
+	if len(provider.Prompts()) != 1 {
+		t.Fatalf("Expected one prompt, got %d", len(provider.Prompts()))
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"rprj/be/dblayer"
+	"rprj/be/mail"
+)
+
+// publicURL is the address of the frontend, used in the links sent by email
+var publicURL = ""
+
+// mailDriver delivers the queued messages; nil when no driver is configured
+var mailDriver mail.Driver
+var mailMaxAttempts = mail.DefaultMaxAttempts
+
+// mailQueueWake starts a queue run as soon as a message is queued
+var mailQueueWake = make(chan struct{}, 1)
+
+// sendMail queues an email. Until a mail driver is configured the message is only logged,
+// so that the links can be followed from the server log.
+var sendMail = func(to string, subject string, body string) error {
+	if mailDriver == nil {
+		log.Printf("Mail to %s: %s\n%s", to, subject, body)
+		return nil
+	}
+	repo := dblayer.NewSystemRepository("mail queue", mailQueueTables...)
+	if _, err := mail.Enqueue(repo, mail.Message{To: to, Subject: subject, Body: body}); err != nil {
+		return err
+	}
+	select {
+	case mailQueueWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sendTemplateMail renders a mail template in the language of the user and queues it
+func sendTemplateMail(to string, name string, language string, data any) error {
+	subject, body, err := mail.Render(name, language, data)
+	if err != nil {
+		return err
+	}
+	return sendMail(to, subject, body)
+}
+
+// StartMailQueue sends the queued messages every interval, and as soon as a message is queued
+func StartMailQueue(interval time.Duration) {
+	if mailDriver == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	go func() {
+		for {
+			repo := dblayer.NewSystemRepository("mail queue", mailQueueTables...)
+			sent, failed, err := mail.ProcessQueue(repo, mailDriver, mailMaxAttempts)
+			if err != nil {
+				log.Print("MailQueue: ", err)
+			} else if sent > 0 || failed > 0 {
+				log.Printf("MailQueue: %d messages sent, %d given up", sent, failed)
+			}
+			if _, err := mail.PurgeQueue(repo); err != nil {
+				log.Print("MailQueue: ", err)
+			}
+			select {
+			case <-mailQueueWake:
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
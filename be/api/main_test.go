@@ -174,9 +174,7 @@ func ApiTestDoLogin(t *testing.T, login, pwd string) string {
 
 func ApiTestDecodeAccessToken(t *testing.T, tokenString string) jwt.MapClaims {
 	claims := jwt.MapClaims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
-		return JWTKey, nil
-	})
+	token, err := jwtKeyring.Parse(tokenString, claims)
 	if err != nil || !token.Valid {
 		t.Fatalf("DecodeAccessToken: invalid token: %v", err)
 	}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"rprj/be/dblayer"
+)
+
+// defaultAuditRetention is how long the audit log is kept when audit_retention_days is not set
+const defaultAuditRetention = 365 * 24 * time.Hour
+
+// auditRetention is how long the audit log is kept (set by InitAPI)
+var auditRetention = defaultAuditRetention
+
+// maintenanceTask is a purge of the maintenance loop, run with a system repository of its own tables
+type maintenanceTask struct {
+	name   string
+	tables []string
+	purge  func(repo *dblayer.DBRepository) (int, error)
+}
+
+// maintenanceTasks are run in order at every round; a failed task does not stop the others
+var maintenanceTasks = []maintenanceTask{
+	{"expired sessions and tokens", expiredSessionTables, PurgeExpiredSessions},
+	{"unverified registrations", expiredRegistrationTables, PurgeExpiredRegistrations},
+	{"expired password resets", expiredPasswordResetTables, PurgeExpiredPasswordResets},
+	{"unused rate limits", rateLimitTables, func(repo *dblayer.DBRepository) (int, error) {
+		return repo.PurgeRateLimits(time.Now().Add(-24 * time.Hour))
+	}},
+	{"old audit log entries", auditLogTables, func(repo *dblayer.DBRepository) (int, error) {
+		purged, err := repo.PurgeAuditLog(time.Now().Add(-auditRetention))
+		return int(purged), err
+	}},
+}
+
+// runMaintenance runs every task once
+func runMaintenance() {
+	for _, task := range maintenanceTasks {
+		repo := dblayer.NewSystemRepository("maintenance: "+task.name, task.tables...)
+		purged, err := task.purge(repo)
+		if err != nil {
+			log.Printf("Maintenance: %s: %v", task.name, err)
+		} else if purged > 0 {
+			log.Printf("Maintenance: purged %d %s", purged, task.name)
+		}
+	}
+}
+
+// StartMaintenance runs the purges of the maintenance tasks every interval
+func StartMaintenance(interval time.Duration) {
+	go func() {
+		for {
+			runMaintenance()
+			time.Sleep(interval)
+		}
+	}()
+}
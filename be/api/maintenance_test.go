@@ -0,0 +1,39 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"rprj/be/dblayer"
+)
+
+// go test -v ./api -run TestMaintenanceTasks
+func TestMaintenanceTasks(t *testing.T) {
+	// Every task can do its job with its own tables
+	for _, task := range maintenanceTasks {
+		repo := dblayer.NewSystemRepository("test: "+task.name, task.tables...)
+		if _, err := task.purge(repo); err != nil {
+			t.Fatalf("Expected %s purged, got %v", task.name, err)
+		}
+	}
+
+	// A task out of its tables fails alone
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	reset := adminRepo.GetInstanceByTableName("users_password_resets")
+	reset.SetValue("token_hash", "maintenance"+Random4digits())
+	reset.SetValue("user_id", "-1")
+	reset.SetValue("expires_at", dbTime(time.Now().Add(-time.Hour)))
+	if _, err := adminRepo.Insert(reset); err != nil {
+		t.Fatalf("Failed to create the password reset: %v", err)
+	}
+	savedTasks := maintenanceTasks
+	t.Cleanup(func() { maintenanceTasks = savedTasks })
+	maintenanceTasks = []maintenanceTask{
+		{"out of scope", []string{"audit_log"}, PurgeExpiredSessions},
+		savedTasks[2],
+	}
+	runMaintenance()
+	if found, _ := adminRepo.Search(reset, false, false, ""); len(found) != 0 {
+		t.Fatalf("Expected the expired password reset purged after a failed task")
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"slices"
 	"strings"
 	"time"
 
@@ -33,32 +32,10 @@ func GetNavigationHandler(w http.ResponseWriter, r *http.Request) {
 		objectID = strings.ReplaceAll(objectID, "-", "")
 	}
 
-	claims, err := GetClaimsFromRequest(r)
+	principal, repo := callerOf(r)
 
-	var dbContext dblayer.DBContext
-	if err == nil {
-		// log.Print("GetNavigationHandler: authenticated user:", claims["user_id"])
-		dbContext = dblayer.DBContext{
-			UserID:   claims["user_id"],
-			GroupIDs: strings.Split(claims["groups"], ","),
-			Schema:   dblayer.DbSchema,
-		}
-	} else {
-		dbContext = dblayer.DBContext{
-			UserID:   "-7",           // Anonymous user
-			GroupIDs: []string{"-4"}, // Guests group
-			Schema:   dblayer.DbSchema,
-		}
-	}
-
-	isAdmin := slices.Contains(dbContext.GroupIDs, "-2")
-	ignoreDeleted := true
-	if isAdmin {
-		ignoreDeleted = false
-	}
-
-	repo := dblayer.NewDBRepository(&dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	// The deleted objects are shown only to the users who can see the trash of everyone
+	ignoreDeleted := !principal.Can(dblayer.CapabilityTrashViewAll)
 
 	obj := repo.FullObjectById(objectID, ignoreDeleted)
 	if obj == nil {
@@ -88,8 +65,7 @@ func GetNavigationHandler(w http.ResponseWriter, r *http.Request) {
 			"id":  objectID,
 			"exp": expiration.Unix(),
 		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString(JWTKey)
+		tokenString, err := jwtKeyring.Sign(claims)
 		if err == nil {
 			obj.SetMetadata("download_token", tokenString)
 		}
@@ -124,31 +100,9 @@ func GetChildrenHandler(w http.ResponseWriter, r *http.Request) {
 		folderId = strings.ReplaceAll(folderId, "-", "")
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-
-	var dbContext dblayer.DBContext
-	if err == nil {
-		dbContext = dblayer.DBContext{
-			UserID:   claims["user_id"],
-			GroupIDs: strings.Split(claims["groups"], ","),
-			Schema:   dblayer.DbSchema,
-		}
-	} else {
-		dbContext = dblayer.DBContext{
-			UserID:   "-7",           // Anonymous user
-			GroupIDs: []string{"-4"}, // Guests group
-			Schema:   dblayer.DbSchema,
-		}
-	}
-
-	isAdmin := slices.Contains(dbContext.GroupIDs, "-2")
-	ignoreDeleted := true
-	if isAdmin {
-		ignoreDeleted = false
-	}
+	principal, repo := callerOf(r)
 
-	repo := dblayer.NewDBRepository(&dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	ignoreDeleted := !principal.Can(dblayer.CapabilityTrashViewAll)
 
 	children := repo.GetChildren(folderId, ignoreDeleted)
 
@@ -196,31 +150,9 @@ func GetBreadcrumbHandler(w http.ResponseWriter, r *http.Request) {
 		objectID = strings.ReplaceAll(objectID, "-", "")
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-
-	var dbContext dblayer.DBContext
-	if err == nil {
-		dbContext = dblayer.DBContext{
-			UserID:   claims["user_id"],
-			GroupIDs: strings.Split(claims["groups"], ","),
-			Schema:   dblayer.DbSchema,
-		}
-	} else {
-		dbContext = dblayer.DBContext{
-			UserID:   "-7",           // Anonymous user
-			GroupIDs: []string{"-4"}, // Guests group
-			Schema:   dblayer.DbSchema,
-		}
-	}
-
-	isAdmin := slices.Contains(dbContext.GroupIDs, "-2")
-	ignoreDeleted := true
-	if isAdmin {
-		ignoreDeleted = false
-	}
+	principal, repo := callerOf(r)
 
-	repo := dblayer.NewDBRepository(&dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	ignoreDeleted := !principal.Can(dblayer.CapabilityTrashViewAll)
 
 	breadcrumb := repo.GetBreadcrumb(objectID, ignoreDeleted)
 
@@ -264,25 +196,7 @@ func GetIndexesHandler(w http.ResponseWriter, r *http.Request) {
 		objectID = strings.ReplaceAll(objectID, "-", "")
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-
-	var dbContext dblayer.DBContext
-	if err == nil {
-		dbContext = dblayer.DBContext{
-			UserID:   claims["user_id"],
-			GroupIDs: strings.Split(claims["groups"], ","),
-			Schema:   dblayer.DbSchema,
-		}
-	} else {
-		dbContext = dblayer.DBContext{
-			UserID:   "-7",           // Anonymous user
-			GroupIDs: []string{"-4"}, // Guests group
-			Schema:   dblayer.DbSchema,
-		}
-	}
-
-	repo := dblayer.NewDBRepository(&dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	_, repo := callerOf(r)
 
 	search := repo.GetInstanceByTableName("pages")
 	if search == nil {
@@ -337,14 +251,8 @@ func GetCountryHandler(w http.ResponseWriter, r *http.Request) {
 		countryID = strings.ReplaceAll(countryID, "-", "")
 	}
 
-	dbContext := dblayer.DBContext{
-		UserID:   "-7",           // Anonymous user - countries are public
-		GroupIDs: []string{"-4"}, // Guests group
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(&dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	// Countries are public
+	repo := RepositoryFromRequest(r)
 
 	country := repo.GetEntityByID("countrylist", countryID)
 	if country == nil {
@@ -366,14 +274,8 @@ func GetCountryHandler(w http.ResponseWriter, r *http.Request) {
 //	@Failure 500 {object} ErrorResponse "Internal server error"
 //	@Router /countries [get]
 func GetCountriesHandler(w http.ResponseWriter, r *http.Request) {
-	dbContext := dblayer.DBContext{
-		UserID:   "-7",           // Anonymous user - countries are public
-		GroupIDs: []string{"-4"}, // Guests group
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(&dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	// Countries are public
+	repo := RepositoryFromRequest(r)
 
 	// Get all countries - create empty instance for search
 	countryInstance := repo.GetInstanceByTableName("countrylist")
@@ -415,25 +317,7 @@ func GetCountriesHandler(w http.ResponseWriter, r *http.Request) {
 //	@Failure 400 {object} ErrorResponse "Invalid request"
 //	@Router /nav/search [get]
 func NavigationSearchHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-
-	var dbContext dblayer.DBContext
-	if err == nil {
-		dbContext = dblayer.DBContext{
-			UserID:   claims["user_id"],
-			GroupIDs: strings.Split(claims["groups"], ","),
-			Schema:   dblayer.DbSchema,
-		}
-	} else {
-		dbContext = dblayer.DBContext{
-			UserID:   "-7",           // Anonymous user
-			GroupIDs: []string{"-4"}, // Guests group
-			Schema:   dblayer.DbSchema,
-		}
-	}
-
-	repo := dblayer.NewDBRepository(&dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	_, repo := callerOf(r)
 
 	// classname := "DBObject"
 	namePattern := strings.TrimSpace(r.URL.Query().Get("name"))
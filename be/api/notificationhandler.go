@@ -0,0 +1,553 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"rprj/be/dblayer"
+	"rprj/be/mail"
+
+	"github.com/gorilla/mux"
+)
+
+// NotificationInfo godoc
+// @Description A change to a subscribed object
+type NotificationInfo struct {
+	ID             string `json:"id"`
+	ObjectID       string `json:"object_id"`
+	ObjectName     string `json:"object_name"`
+	SubscriptionID string `json:"subscription_id"` // the subscribed object: the object itself or a folder above it
+	Event          string `json:"event"`           // created, updated or commented
+	ActorID        string `json:"actor_id"`
+	ActorLogin     string `json:"actor_login"`
+	CreatedAt      int64  `json:"created_at"`
+	Read           bool   `json:"read"`
+}
+
+// NotificationList godoc
+// @Description The notifications of the user and how many are unread
+type NotificationList struct {
+	Notifications []NotificationInfo `json:"notifications"`
+	Unread        int                `json:"unread"`
+}
+
+// NotificationPreferences godoc
+// @Description How a user wants to be notified
+type NotificationPreferences struct {
+	InApp       bool   `json:"in_app"`
+	EmailDigest string `json:"email_digest"` // never, daily or weekly
+	Language    string `json:"language"`     // language of the digest: en, it, de or fr
+}
+
+// SubscriptionInfo godoc
+// @Description A subscription to an object or a folder
+type SubscriptionInfo struct {
+	ObjectID   string `json:"object_id"`
+	ObjectName string `json:"object_name"`
+	Classname  string `json:"classname"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+// Notifications returned by default, and at most
+const notificationPageSize = 50
+const notificationMaxPageSize = 200
+
+// How long read notifications are kept
+const notificationRetention = 90 * 24 * time.Hour
+
+var digestPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// userRequest returns the repository of the user of the request
+func userRequest(w http.ResponseWriter, r *http.Request) (*dblayer.DBRepository, string, bool) {
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return nil, "", false
+	}
+	return repo, principal.UserID, true
+}
+
+// getNotificationPreferences returns the preferences of a user, the defaults when never saved
+func getNotificationPreferences(repo *dblayer.DBRepository, userID string) NotificationPreferences {
+	preferences := NotificationPreferences{InApp: true, EmailDigest: "never", Language: mail.Languages[0]}
+	search := repo.GetInstanceByTableName("notification_preferences")
+	search.SetValue("user_id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return preferences
+	}
+	preferences.InApp = fmt.Sprint(results[0].GetValue("in_app")) != "0"
+	if digest, _ := results[0].GetValue("email_digest").(string); digest != "" {
+		preferences.EmailDigest = digest
+	}
+	if language, _ := results[0].GetValue("language").(string); language != "" {
+		preferences.Language = language
+	}
+	return preferences
+}
+
+func toNotificationInfo(repo *dblayer.DBRepository, notification dblayer.DBEntityInterface, logins map[string]string) NotificationInfo {
+	info := NotificationInfo{
+		ID:             notification.GetValue("id").(string),
+		ObjectID:       notification.GetValue("object_id").(string),
+		ObjectName:     notification.GetValue("object_name").(string),
+		SubscriptionID: notification.GetValue("subscription_id").(string),
+		Event:          notification.GetValue("event").(string),
+		ActorID:        notification.GetValue("actor_id").(string),
+	}
+	if createdAt, ok := parseDBTime(notification.GetValue("created_at")); ok {
+		info.CreatedAt = createdAt.Unix()
+	}
+	_, info.Read = parseDBTime(notification.GetValue("read_at"))
+	if _, found := logins[info.ActorID]; !found && info.ActorID != "" {
+		logins[info.ActorID], _ = getLogin(repo, info.ActorID)
+	}
+	info.ActorLogin = logins[info.ActorID]
+	return info
+}
+
+// GetNotificationsHandler godoc
+// @Summary List the notifications
+// @Description Returns the latest notifications of the user, the unread first if requested, and the count of the unread ones.
+// @Description Empty when the user turned off the in-app notifications.
+// @Tags notifications
+// @Produce json
+// @Param unread query bool false "Only the unread notifications"
+// @Param limit query int false "How many notifications, 50 by default"
+// @Success 200 {object} NotificationList
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Security BearerAuth
+// @Router /notifications [get]
+func GetNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, ok := userRequest(w, r)
+	if !ok {
+		return
+	}
+	list := NotificationList{Notifications: []NotificationInfo{}}
+	if !getNotificationPreferences(repo, userID).InApp {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	limit := notificationPageSize
+	if value, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && value > 0 {
+		limit = min(value, notificationMaxPageSize)
+	}
+
+	search := repo.GetInstanceByTableName("notifications")
+	search.SetValue("user_id", userID)
+	search.SetValue("read_at", nil)
+	unread, err := repo.Search(search, false, false, "created_at DESC")
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get notifications: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list.Unread = len(unread)
+	notifications := unread
+	if r.URL.Query().Get("unread") != "true" {
+		search = repo.GetInstanceByTableName("notifications")
+		search.SetValue("user_id", userID)
+		notifications, err = repo.Search(search, false, false, "created_at DESC")
+		if err != nil {
+			RespondSimpleError(w, ErrInternalServer, "Failed to get notifications: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	logins := map[string]string{}
+	for i, notification := range notifications {
+		if i >= limit {
+			break
+		}
+		list.Notifications = append(list.Notifications, toNotificationInfo(repo, notification, logins))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// markNotificationsRead sets read_at of the given unread notifications
+func markNotificationsRead(repo *dblayer.DBRepository, notifications []dblayer.DBEntityInterface) error {
+	now := dbTime(time.Now())
+	for _, notification := range notifications {
+		update := repo.GetInstanceByTableName("notifications")
+		update.SetValue("id", notification.GetValue("id"))
+		update.SetValue("read_at", now)
+		if _, err := repo.Update(update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkNotificationReadHandler godoc
+// @Summary Mark a notification as read
+// @Tags notifications
+// @Produce json
+// @Param id path string true "Notification ID"
+// @Success 200 {object} map[string]string
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 404 {object} ErrorResponse "Notification not found"
+// @Security BearerAuth
+// @Router /notifications/{id}/read [post]
+func MarkNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, ok := userRequest(w, r)
+	if !ok {
+		return
+	}
+	search := repo.GetInstanceByTableName("notifications")
+	search.SetValue("id", mux.Vars(r)["id"])
+	search.SetValue("user_id", userID)
+	notifications, err := repo.Search(search, false, false, "")
+	if err != nil || len(notifications) == 0 {
+		RespondSimpleError(w, ErrObjectNotFound, "Notification not found", http.StatusNotFound)
+		return
+	}
+	if _, read := parseDBTime(notifications[0].GetValue("read_at")); !read {
+		if err := markNotificationsRead(repo, notifications); err != nil {
+			RespondSimpleError(w, ErrInternalServer, "Failed to update notification", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Notification read"})
+}
+
+// MarkAllNotificationsReadHandler godoc
+// @Summary Mark all the notifications as read
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} map[string]interface{}
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Security BearerAuth
+// @Router /notifications/read-all [post]
+func MarkAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, ok := userRequest(w, r)
+	if !ok {
+		return
+	}
+	search := repo.GetInstanceByTableName("notifications")
+	search.SetValue("user_id", userID)
+	search.SetValue("read_at", nil)
+	notifications, err := repo.Search(search, false, false, "")
+	if err == nil {
+		err = markNotificationsRead(repo, notifications)
+	}
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to update notifications", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Notifications read", "read": len(notifications)})
+}
+
+// GetNotificationPreferencesHandler godoc
+// @Summary Get the notification preferences
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} NotificationPreferences
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Security BearerAuth
+// @Router /notifications/preferences [get]
+func GetNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, ok := userRequest(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getNotificationPreferences(repo, userID))
+}
+
+// UpdateNotificationPreferencesHandler godoc
+// @Summary Save the notification preferences
+// @Tags notifications
+// @Accept json
+// @Produce json
+// @Param request body NotificationPreferences true "Preferences"
+// @Success 200 {object} NotificationPreferences
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Security BearerAuth
+// @Router /notifications/preferences [put]
+func UpdateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, ok := userRequest(w, r)
+	if !ok {
+		return
+	}
+	var req NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if req.EmailDigest == "" {
+		req.EmailDigest = "never"
+	}
+	if _, ok := digestPeriods[req.EmailDigest]; !ok && req.EmailDigest != "never" {
+		RespondError(w, ErrInvalidField, "Invalid digest frequency", map[string]string{"field": "email_digest"}, http.StatusBadRequest)
+		return
+	}
+	req.Language = mail.Language(req.Language)
+
+	inApp := 0
+	if req.InApp {
+		inApp = 1
+	}
+	preference := repo.GetInstanceByTableName("notification_preferences")
+	preference.SetValue("user_id", userID)
+	existing, err := repo.Search(preference, false, false, "")
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to save preferences", http.StatusInternalServerError)
+		return
+	}
+	preference.SetValue("in_app", inApp)
+	preference.SetValue("email_digest", req.EmailDigest)
+	preference.SetValue("language", req.Language)
+	if len(existing) == 0 {
+		// The first digest covers what happens from now on
+		preference.SetValue("last_digest_at", dbTime(time.Now()))
+		_, err = repo.Insert(preference)
+	} else {
+		_, err = repo.Update(preference)
+	}
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to save preferences", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
+
+// GetSubscriptionsHandler godoc
+// @Summary List the subscriptions
+// @Description Returns the objects and folders the user is subscribed to, the most recent first.
+// @Tags notifications
+// @Produce json
+// @Success 200 {array} SubscriptionInfo
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Security BearerAuth
+// @Router /subscriptions [get]
+func GetSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, ok := userRequest(w, r)
+	if !ok {
+		return
+	}
+	search := repo.GetInstanceByTableName("subscriptions")
+	search.SetValue("user_id", userID)
+	subscriptions, err := repo.Search(search, false, false, "created_at DESC")
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get subscriptions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := []SubscriptionInfo{}
+	for _, subscription := range subscriptions {
+		info := SubscriptionInfo{ObjectID: subscription.GetValue("object_id").(string)}
+		if createdAt, ok := parseDBTime(subscription.GetValue("created_at")); ok {
+			info.CreatedAt = createdAt.Unix()
+		}
+		// Objects deleted or not readable anymore are listed without name, to be unsubscribed
+		if object := repo.ObjectByID(info.ObjectID, true); object != nil && repo.CheckReadPermission(object) {
+			info.ObjectName, _ = object.GetValue("name").(string)
+			info.Classname, _ = object.GetMetadata("classname").(string)
+		}
+		list = append(list, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GetSubscriptionHandler godoc
+// @Summary Tell whether the user is subscribed to an object
+// @Tags notifications
+// @Produce json
+// @Param objectId path string true "Object ID"
+// @Success 200 {object} map[string]bool
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Security BearerAuth
+// @Router /subscriptions/{objectId} [get]
+func GetSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, ok := userRequest(w, r)
+	if !ok {
+		return
+	}
+	search := repo.GetInstanceByTableName("subscriptions")
+	search.SetValue("user_id", userID)
+	search.SetValue("object_id", mux.Vars(r)["objectId"])
+	subscriptions, err := repo.Search(search, false, false, "")
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get subscription", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"subscribed": len(subscriptions) > 0})
+}
+
+// SubscribeHandler godoc
+// @Summary Subscribe to an object or a folder
+// @Description The user is notified when the object, or the content under the folder, is created, updated or commented.
+// @Tags notifications
+// @Produce json
+// @Param objectId path string true "Object ID"
+// @Success 200 {object} map[string]bool
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 404 {object} ErrorResponse "Object not found"
+// @Security BearerAuth
+// @Router /subscriptions/{objectId} [put]
+func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, ok := userRequest(w, r)
+	if !ok {
+		return
+	}
+	objectID := mux.Vars(r)["objectId"]
+	object := repo.ObjectByID(objectID, true)
+	if object == nil || !repo.CheckReadPermission(object) {
+		RespondSimpleError(w, ErrObjectNotFound, "Object not found", http.StatusNotFound)
+		return
+	}
+	subscription := repo.GetInstanceByTableName("subscriptions")
+	subscription.SetValue("user_id", userID)
+	subscription.SetValue("object_id", objectID)
+	existing, err := repo.Search(subscription, false, false, "")
+	if err == nil && len(existing) == 0 {
+		subscription.SetValue("created_at", dbTime(time.Now()))
+		_, err = repo.Insert(subscription)
+	}
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to subscribe", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"subscribed": true})
+}
+
+// UnsubscribeHandler godoc
+// @Summary Unsubscribe from an object or a folder
+// @Tags notifications
+// @Produce json
+// @Param objectId path string true "Object ID"
+// @Success 200 {object} map[string]bool
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Security BearerAuth
+// @Router /subscriptions/{objectId} [delete]
+func UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, ok := userRequest(w, r)
+	if !ok {
+		return
+	}
+	subscription := repo.GetInstanceByTableName("subscriptions")
+	subscription.SetValue("user_id", userID)
+	subscription.SetValue("object_id", mux.Vars(r)["objectId"])
+	if _, err := repo.Delete(subscription); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to unsubscribe", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"subscribed": false})
+}
+
+// SendNotificationDigests emails the unread notifications not yet emailed to the users
+// whose daily or weekly digest is due
+func SendNotificationDigests(repo *dblayer.DBRepository, now time.Time) (int, error) {
+	sent := 0
+	for frequency, period := range digestPeriods {
+		search := repo.GetInstanceByTableName("notification_preferences")
+		search.SetValue("email_digest", frequency)
+		search.SetValue("last_digest_at", []string{"", dbTime(now.Add(-period))})
+		preferences, err := repo.Search(search, false, false, "")
+		if err != nil {
+			return sent, err
+		}
+		for _, preference := range preferences {
+			userID := preference.GetValue("user_id").(string)
+			update := repo.GetInstanceByTableName("notification_preferences")
+			update.SetValue("user_id", userID)
+			update.SetValue("last_digest_at", dbTime(now))
+			if _, err := repo.Update(update); err != nil {
+				return sent, err
+			}
+
+			search := repo.GetInstanceByTableName("notifications")
+			search.SetValue("user_id", userID)
+			search.SetValue("read_at", nil)
+			search.SetValue("emailed_at", nil)
+			notifications, err := repo.Search(search, false, false, "created_at")
+			if err != nil {
+				return sent, err
+			}
+			user := repo.GetEntityByID("users", userID)
+			email, _ := user.GetValue("email").(string)
+			if len(notifications) == 0 || email == "" {
+				continue
+			}
+			items := []map[string]string{}
+			logins := map[string]string{}
+			for _, notification := range notifications {
+				info := toNotificationInfo(repo, notification, logins)
+				items = append(items, map[string]string{
+					"Name":  info.ObjectName,
+					"Event": info.Event,
+					"Actor": info.ActorLogin,
+					"Link":  strings.TrimRight(publicURL, "/") + "/c/" + info.ObjectID,
+				})
+			}
+			fullname, _ := user.GetValue("fullname").(string)
+			language, _ := preference.GetValue("language").(string)
+			if err := sendTemplateMail(email, "notification_digest", language, map[string]any{
+				"Fullname": fullname,
+				"Items":    items,
+				"Link":     strings.TrimRight(publicURL, "/") + "/notifications",
+			}); err != nil {
+				log.Printf("NotificationDigest: failed to send the digest of user %s: %v", userID, err)
+				continue
+			}
+			for _, notification := range notifications {
+				emailed := repo.GetInstanceByTableName("notifications")
+				emailed.SetValue("id", notification.GetValue("id"))
+				emailed.SetValue("emailed_at", dbTime(now))
+				if _, err := repo.Update(emailed); err != nil {
+					return sent, err
+				}
+			}
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// PurgeReadNotifications deletes the notifications read before notificationRetention
+func PurgeReadNotifications(repo *dblayer.DBRepository) (int, error) {
+	search := repo.GetInstanceByTableName("notifications")
+	search.SetValue("read_at", []string{"", dbTime(time.Now().Add(-notificationRetention))})
+	notifications, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return 0, err
+	}
+	for i, notification := range notifications {
+		if _, err := repo.Delete(notification); err != nil {
+			return i, err
+		}
+	}
+	return len(notifications), nil
+}
+
+// StartNotificationDigest sends the digests and purges the old notifications every interval
+func StartNotificationDigest(interval time.Duration) {
+	go func() {
+		for {
+			repo := dblayer.NewSystemRepository("notification digest", digestTables...)
+			if sent, err := SendNotificationDigests(repo, time.Now()); err != nil {
+				log.Print("NotificationDigest: ", err)
+			} else if sent > 0 {
+				log.Printf("NotificationDigest: %d digests sent", sent)
+			}
+			if _, err := PurgeReadNotifications(repo); err != nil {
+				log.Print("NotificationDigest: ", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
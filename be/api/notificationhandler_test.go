@@ -0,0 +1,201 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestNotifications
+func TestNotifications(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	newUser := func(name string) (dblayer.DBEntityInterface, string) {
+		login := name + Random4digits()
+		user, err := adminRepo.CreateObject("users", map[string]any{
+			"login":    login,
+			"pwd":      "notify-password",
+			"fullname": name,
+			"email":    login + "@example.com",
+		}, map[string]any{})
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		t.Cleanup(func() { adminRepo.Delete(user) })
+		return user, ApiTestDoLogin(t, login, "notify-password")
+	}
+	author, _ := newUser("author")
+	subscriber, subscriberToken := newUser("subscriber")
+	authorID := author.GetValue("id").(string)
+	subscriberID := subscriber.GetValue("id").(string)
+	authorRepo := SetupTestRepo(t, authorID, []string{author.GetValue("group_id").(string)}, AppConfig.TablePrefix)
+
+	call := func(handler http.HandlerFunc, method string, vars map[string]string, payload any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+subscriberToken)
+		if vars != nil {
+			req = mux.SetURLVars(req, vars)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	list := func() NotificationList {
+		rr := call(GetNotificationsHandler, http.MethodGet, nil, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+		}
+		var response NotificationList
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return response
+	}
+	create := func(repo *dblayer.DBRepository, table string, values map[string]any) dblayer.DBEntityInterface {
+		object, err := repo.CreateObject(table, values, map[string]any{})
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", table, err)
+		}
+		t.Cleanup(func() { adminRepo.Delete(object) })
+		return object
+	}
+
+	folder := create(authorRepo, "folders", map[string]any{"name": "Shared", "permissions": "rwxr--r--"})
+	folderID := folder.GetValue("id").(string)
+	private := create(authorRepo, "folders", map[string]any{"name": "Private", "permissions": "rwx------"})
+
+	// 1. Only readable objects can be subscribed
+	if rr := call(SubscribeHandler, http.MethodPut, map[string]string{"objectId": private.GetValue("id").(string)}, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected not found for a private folder, got %v", rr.Code)
+	}
+	if rr := call(SubscribeHandler, http.MethodPut, map[string]string{"objectId": folderID}, nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected subscription, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(GetSubscriptionHandler, http.MethodGet, map[string]string{"objectId": folderID}, nil); !strings.Contains(rr.Body.String(), `"subscribed":true`) {
+		t.Fatalf("Expected subscribed, got %s", rr.Body.String())
+	}
+
+	// 2. Content created under the folder is notified, unless not readable by the subscriber
+	page := create(authorRepo, "pages", map[string]any{"name": "Readable page", "father_id": folderID, "permissions": "rwxr--r--"})
+	pageID := page.GetValue("id").(string)
+	// Children inherit the permissions of the father: a subfolder made private hides its content
+	hidden := create(authorRepo, "folders", map[string]any{"name": "Hidden", "father_id": folderID})
+	hidden.SetValue("permissions", "rwx------")
+	if _, err := authorRepo.Update(hidden); err != nil {
+		t.Fatalf("Failed to update folder: %v", err)
+	}
+	create(authorRepo, "pages", map[string]any{"name": "Hidden page", "father_id": hidden.GetValue("id").(string)})
+	response := list()
+	if response.Unread != 2 || len(response.Notifications) != 2 {
+		t.Fatalf("Expected two notifications, got %+v", response)
+	}
+	var created NotificationInfo
+	for _, notification := range response.Notifications {
+		if notification.ObjectID == pageID {
+			created = notification
+		}
+	}
+	if created.ObjectID != pageID || created.Event != dblayer.NotificationCreated || created.ActorID != authorID || created.SubscriptionID != folderID {
+		t.Fatalf("Unexpected notification %+v", created)
+	}
+
+	// 3. The author of the change is not notified
+	subscriberRepo := SetupTestRepo(t, subscriberID, []string{subscriber.GetValue("group_id").(string)}, AppConfig.TablePrefix)
+	own := create(subscriberRepo, "folders", map[string]any{"name": "Mine"})
+	call(SubscribeHandler, http.MethodPut, map[string]string{"objectId": own.GetValue("id").(string)}, nil)
+	create(subscriberRepo, "pages", map[string]any{"name": "My page", "father_id": own.GetValue("id").(string)})
+	if response = list(); response.Unread != 2 {
+		t.Fatalf("Expected no notification of own changes, got %+v", response)
+	}
+
+	// 4. Changes not yet seen are notified once; a note on a page is a comment
+	for _, name := range []string{"First edit", "Second edit"} {
+		update := authorRepo.GetInstanceByTableName("pages")
+		update.SetValue("id", pageID)
+		update.SetValue("name", name)
+		if _, err := authorRepo.Update(update); err != nil {
+			t.Fatalf("Failed to update page: %v", err)
+		}
+	}
+	create(authorRepo, "notes", map[string]any{"name": "Nice page", "father_id": pageID, "permissions": "rwxr--r--"})
+	response = list()
+	events := map[string]int{}
+	for _, notification := range response.Notifications {
+		events[notification.Event]++
+	}
+	if response.Unread != 4 || events[dblayer.NotificationUpdated] != 1 || events[dblayer.NotificationCommented] != 1 {
+		t.Fatalf("Expected created, updated once and commented, got %+v", response)
+	}
+
+	// 5. Mark read
+	if rr := call(MarkNotificationReadHandler, http.MethodPost, map[string]string{"id": created.ID}, nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+	if response = list(); response.Unread != 3 {
+		t.Fatalf("Expected three unread notifications, got %+v", response)
+	}
+	if rr := call(MarkAllNotificationsReadHandler, http.MethodPost, nil, nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+	if response = list(); response.Unread != 0 || len(response.Notifications) != 4 {
+		t.Fatalf("Expected all notifications read, got %+v", response)
+	}
+
+	// 6. Preferences: no in-app notifications, a daily digest
+	if rr := call(UpdateNotificationPreferencesHandler, http.MethodPut, nil, NotificationPreferences{EmailDigest: "hourly"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request, got %v", rr.Code)
+	}
+	if rr := call(UpdateNotificationPreferencesHandler, http.MethodPut, nil, NotificationPreferences{InApp: false, EmailDigest: "daily", Language: "it"}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+	var preferences NotificationPreferences
+	json.Unmarshal(call(GetNotificationPreferencesHandler, http.MethodGet, nil, nil).Body.Bytes(), &preferences)
+	if preferences.InApp || preferences.EmailDigest != "daily" || preferences.Language != "it" {
+		t.Fatalf("Unexpected preferences %+v", preferences)
+	}
+	update := authorRepo.GetInstanceByTableName("pages")
+	update.SetValue("id", pageID)
+	update.SetValue("name", "Third edit")
+	authorRepo.Update(update)
+	if response = list(); len(response.Notifications) != 0 {
+		t.Fatalf("Expected no in-app notifications, got %+v", response)
+	}
+
+	// 7. The digest is sent once a day with the notifications not yet read
+	previousMail := sendMail
+	var digests []string
+	sendMail = func(to string, subject string, body string) error {
+		if to == subscriber.GetValue("email") {
+			digests = append(digests, subject+"\n"+body)
+		}
+		return nil
+	}
+	t.Cleanup(func() { sendMail = previousMail })
+	if _, err := SendNotificationDigests(adminRepo, time.Now()); err != nil || len(digests) != 0 {
+		t.Fatalf("Expected no digest before a day, got %v %v", digests, err)
+	}
+	if _, err := SendNotificationDigests(adminRepo, time.Now().Add(25*time.Hour)); err != nil || len(digests) != 1 {
+		t.Fatalf("Expected one digest, got %v %v", digests, err)
+	}
+	if !strings.Contains(digests[0], "Third edit: modificato") || !strings.Contains(digests[0], "/c/"+pageID) {
+		t.Fatalf("Unexpected digest %s", digests[0])
+	}
+	SendNotificationDigests(adminRepo, time.Now().Add(50*time.Hour))
+	if len(digests) != 1 {
+		t.Fatalf("Expected the notifications emailed only once, got %v", digests)
+	}
+
+	// 8. Unsubscribe
+	call(UnsubscribeHandler, http.MethodDelete, map[string]string{"objectId": folderID}, nil)
+	var subscriptions []SubscriptionInfo
+	json.Unmarshal(call(GetSubscriptionsHandler, http.MethodGet, nil, nil).Body.Bytes(), &subscriptions)
+	if len(subscriptions) != 1 || subscriptions[0].ObjectName != "Mine" {
+		t.Fatalf("Expected only the own folder, got %+v", subscriptions)
+	}
+}
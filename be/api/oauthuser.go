@@ -0,0 +1,217 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"rprj/be/dblayer"
+)
+
+// OAuthIdentity is the user as described by an external identity provider.
+// Issuer and Subject name the account at the provider and never change; Login, Email and Fullname are only
+// used to create the user. The Email finds an existing user only when the provider verified it.
+type OAuthIdentity struct {
+	Provider      string
+	Issuer        string
+	Subject       string
+	Login         string
+	Email         string
+	EmailVerified bool
+	Fullname      string
+}
+
+// oauthDefaultGroup is the group of the users created at their first OAuth login: Guest
+const oauthDefaultGroup = GuestsGroupID
+
+// provisionOAuthUser finds the user linked to the account of the identity, or the user of its verified email,
+// or creates it, and links it to the account. A user is never found by the login of the provider.
+// It returns the user id and the login of the stored user.
+func provisionOAuthUser(repo *dblayer.DBRepository, identity OAuthIdentity) (string, string, error) {
+	if identity.Issuer == "" || identity.Subject == "" {
+		return "", "", fmt.Errorf("%s identity has no subject", identity.Provider)
+	}
+	if identity.Login == "" {
+		identity.Login = identity.Email
+	}
+	if identity.Login == "" {
+		return "", "", fmt.Errorf("%s identity has neither login nor email", identity.Provider)
+	}
+	now := dbTime(time.Now())
+
+	// 1. The account already linked
+	search := repo.GetInstanceByTableName("users_oauth")
+	search.SetValue("issuer", identity.Issuer)
+	search.SetValue("subject", identity.Subject)
+	links, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return "", "", err
+	}
+	if len(links) == 1 {
+		link := links[0]
+		userID, _ := link.GetValue("user_id").(string)
+		login, _ := getLogin(repo, userID)
+		if login == "" {
+			return "", "", fmt.Errorf("%s identity %s is linked to the missing user %s", identity.Provider, identity.Subject, userID)
+		}
+		normalizeDBTimes(link, "created_at")
+		link.SetValue("last_login_at", now)
+		if _, err := repo.Update(link); err != nil {
+			log.Printf("OAuth: failed to update the link of %s: %v", login, err)
+		}
+		return userID, login, nil
+	}
+
+	// 2. The user of the verified email, 3. a new user
+	userID, login := "", ""
+	if identity.EmailVerified && identity.Email != "" {
+		search := repo.GetInstanceByTableName("users")
+		search.SetValue("email", identity.Email)
+		found, err := repo.Search(search, false, false, "")
+		if err != nil {
+			return "", "", err
+		}
+		// An email not yet confirmed at the registration may belong to somebody else
+		found = slices.DeleteFunc(found, func(user dblayer.DBEntityInterface) bool {
+			registration := getUserRegistration(repo, user.GetValue("id").(string))
+			return registration != nil && !registrationVerified(registration)
+		})
+		if len(found) > 1 {
+			return "", "", fmt.Errorf("multiple users found for %s email %s", identity.Provider, identity.Email)
+		}
+		if len(found) == 1 {
+			userID, _ = found[0].GetValue("id").(string)
+			login, _ = found[0].GetValue("login").(string)
+		}
+	}
+	if userID == "" {
+		if userID, login, err = createOAuthUser(repo, identity); err != nil {
+			return "", "", err
+		}
+	}
+
+	link := repo.GetInstanceByTableName("users_oauth")
+	link.SetValue("issuer", identity.Issuer)
+	link.SetValue("subject", identity.Subject)
+	link.SetValue("user_id", userID)
+	link.SetValue("created_at", now)
+	link.SetValue("last_login_at", now)
+	if _, err := repo.Insert(link); err != nil {
+		return "", "", err
+	}
+	log.Printf("OAuth: linked user %s to %s account %s", login, identity.Provider, identity.Subject)
+	return userID, login, nil
+}
+
+// createOAuthUser creates the user of an identity, with the login of the provider when it is free
+func createOAuthUser(repo *dblayer.DBRepository, identity OAuthIdentity) (string, string, error) {
+	login := ""
+	for i := 1; i <= 100 && login == ""; i++ {
+		candidate := identity.Login
+		if i > 1 {
+			candidate = fmt.Sprintf("%s%d", identity.Login, i)
+		}
+		search := repo.GetInstanceByTableName("users")
+		search.SetValue("login", candidate)
+		found, err := repo.Search(search, false, false, "")
+		if err != nil {
+			return "", "", err
+		}
+		if len(found) == 0 {
+			login = candidate
+		}
+	}
+	if login == "" {
+		return "", "", fmt.Errorf("no free login for %s identity %s", identity.Provider, identity.Login)
+	}
+
+	fullname := identity.Fullname
+	if fullname == "" {
+		fullname = identity.Login
+	}
+	user := repo.GetInstanceByTableName("users")
+	user.SetValue("login", login)
+	user.SetValue("fullname", fullname)
+	// An unverified email would later find this user for whoever verified it
+	if identity.EmailVerified && identity.Email != "" {
+		user.SetValue("email", identity.Email)
+	}
+	user.SetValue("pwd", "")
+	user.SetMetadata("group_ids", []string{oauthDefaultGroup})
+	created, err := repo.Insert(user)
+	if err != nil {
+		return "", "", err
+	}
+	log.Printf("OAuth: created user %s for %s login", login, identity.Provider)
+	return created.GetValue("id").(string), login, nil
+}
+
+// completeOAuthLogin provisions the user of the identity, starts the session and returns
+// the page handing the tokens to the frontend. extra is added to the payload for the frontend.
+func completeOAuthLogin(w http.ResponseWriter, r *http.Request, identity OAuthIdentity, extra map[string]any) {
+	repo := dblayer.NewSystemRepository("OAuth login", oauthLoginTables...)
+
+	userID, login, err := provisionOAuthUser(repo, identity)
+	if err != nil {
+		log.Printf("OAuth %s: %v", identity.Provider, err)
+		RespondSimpleError(w, ErrInternalServer, "Failed to find or create user", http.StatusInternalServerError)
+		return
+	}
+	_, primaryGroupID := getLogin(repo, userID)
+	groupList, err := GetUserGroupIDs(repo, userID, primaryGroupID)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to load user groups", http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := StartSession(repo, r, userID, login, groupList, identity.Provider)
+	if err != nil {
+		respondSessionError(w, err)
+		return
+	}
+
+	payload := map[string]any{
+		"provider":      identity.Provider,
+		"access_token":  tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_at":    tokens.ExpiresAt,
+		"user_id":       userID,
+		"login":         login,
+		"groups":        strings.Join(groupList, ","),
+		"capabilities":  strings.Join(tokens.Capabilities, ","),
+	}
+	for k, v := range extra {
+		payload[k] = v
+	}
+	payloadJSON, _ := json.Marshal(payload)
+
+	// Return an HTML page that either posts message to opener (popup flow)
+	// or writes to localStorage and redirects (same-tab flow). This lets
+	// the frontend handle storing user info consistently.
+	writeHTMLPage(w, func(nonce string) string {
+		return fmt.Sprintf(`<!doctype html><html><head><meta charset="utf-8"></head><body><script nonce="%s">
+        (function(){
+            try {
+                var data = %s;
+                if (window.opener && window.opener !== window) {
+                    window.opener.postMessage(data, "*");
+                    window.close();
+                } else {
+                    localStorage.setItem('token', data.access_token);
+                    localStorage.setItem('refresh_token', data.refresh_token);
+                    localStorage.setItem('expires_at', data.expires_at);
+                    localStorage.setItem('user_id', data.user_id);
+                    if (data.login) localStorage.setItem('username', data.login);
+                    if (data.groups) localStorage.setItem('groups', JSON.stringify(data.groups.split(',')));
+                    localStorage.setItem('capabilities', JSON.stringify(data.capabilities ? data.capabilities.split(',') : []));
+                    window.location.href = '/';
+                }
+            } catch(e) { console.error(e); window.location.href = '/'; }
+        })();
+        </script></body></html>`, nonce, payloadJSON)
+	})
+}
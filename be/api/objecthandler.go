@@ -69,21 +69,11 @@ type ObjectsSearchResponse struct {
 // @Security BearerAuth
 // @Router /objects [post]
 func CreateObjectHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	// Decode request based on Content-Type
 	var requestData map[string]interface{}
 	var metadataValues map[string]interface{}
@@ -192,13 +182,13 @@ func CreateObjectHandler(w http.ResponseWriter, r *http.Request) {
 	delete(requestData, "classname")
 
 	// Set automatic fields
-	requestData["owner"] = dbContext.UserID
-	if len(dbContext.GroupIDs) > 0 {
-		requestData["group_id"] = dbContext.GroupIDs[0]
+	requestData["owner"] = principal.UserID
+	if len(principal.GroupIDs) > 0 {
+		requestData["group_id"] = principal.GroupIDs[0]
 	}
-	requestData["creator"] = dbContext.UserID
+	requestData["creator"] = principal.UserID
 	requestData["creation_date"] = time.Now().Format("2006-01-02 15:04:05")
-	requestData["last_modify"] = dbContext.UserID
+	requestData["last_modify"] = principal.UserID
 	requestData["last_modify_date"] = time.Now().Format("2006-01-02 15:04:05")
 
 	fatherID, _ := requestData["father_id"].(string)
@@ -226,16 +216,25 @@ func CreateObjectHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Convert entity to map
 	resultMap := created.GetAllValues()
+	metadata := map[string]interface{}{
+		"classname": classname,
+	}
+	// The suggested description, if any, is the result of this job
+	if job := suggestDescriptionOnSave(created, principal.UserID); job != nil {
+		metadata["suggestion_job"] = job.ID
+	}
+	// What the sanitizer removed from the description and the html, by column
+	if sanitized := created.GetMetadata("sanitized"); sanitized != nil {
+		metadata["sanitized"] = sanitized
+	}
 
 	// Return created object
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(ObjectResponse{
-		Success: true,
-		Data:    resultMap,
-		Metadata: map[string]interface{}{
-			"classname": classname,
-		},
+		Success:  true,
+		Data:     resultMap,
+		Metadata: metadata,
 	})
 }
 
@@ -253,18 +252,10 @@ func CreateObjectHandler(w http.ResponseWriter, r *http.Request) {
 // @Security BearerAuth
 // @Router /objects/{id} [get]
 func GetObjectHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
 	vars := mux.Vars(r)
 	objectID := vars["id"]
 	if objectID == "" {
@@ -313,21 +304,11 @@ func GetObjectHandler(w http.ResponseWriter, r *http.Request) {
 // @Security BearerAuth
 // @Router /objects/{id} [put]
 func UpdateObjectHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	vars := mux.Vars(r)
 	objectID := vars["id"]
 
@@ -446,19 +427,20 @@ func UpdateObjectHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Set automatic update fields
-	updateValues["last_modify"] = dbContext.UserID
+	updateValues["last_modify"] = principal.UserID
 	updateValues["last_modify_date"] = time.Now().Format("2006-01-02 15:04:05")
 
 	// Remove protected fields that shouldn't be updated via API
 	delete(updateValues, "id")
-	// Rule: You cannot change group_id unless you are in that group
-	if fullObj.GetValue("group_id") != nil && fullObj.GetValue("group_id") != "" && !slices.Contains(dbContext.GroupIDs, fmt.Sprintf("%v", fullObj.GetValue("group_id"))) {
-		log.Printf("UpdateObjectHandler: Removing group_id from updateValues, current=%v, user groups=%v", fullObj.GetValue("group_id"), dbContext.GroupIDs)
+	// Rule: You cannot change group_id unless you are in that group, or can change those of any object
+	canChmod := principal.Can(dblayer.CapabilityObjectsChmod)
+	if !canChmod && fullObj.GetValue("group_id") != nil && fullObj.GetValue("group_id") != "" && !slices.Contains(principal.GroupIDs, fmt.Sprintf("%v", fullObj.GetValue("group_id"))) {
+		log.Printf("UpdateObjectHandler: Removing group_id from updateValues, current=%v, user groups=%v", fullObj.GetValue("group_id"), principal.GroupIDs)
 		delete(updateValues, "group_id")
 	}
 	// Rule: You cannot change owner unless you are that owner
-	if fullObj.GetValue("owner") != nil && fullObj.GetValue("owner") != "" && fmt.Sprintf("%v", fullObj.GetValue("owner")) != dbContext.UserID {
-		log.Printf("UpdateObjectHandler: Removing owner from updateValues, current=%v, user=%v", fullObj.GetValue("owner"), dbContext.UserID)
+	if !canChmod && fullObj.GetValue("owner") != nil && fullObj.GetValue("owner") != "" && fmt.Sprintf("%v", fullObj.GetValue("owner")) != principal.UserID {
+		log.Printf("UpdateObjectHandler: Removing owner from updateValues, current=%v, user=%v", fullObj.GetValue("owner"), principal.UserID)
 		delete(updateValues, "owner")
 	}
 	delete(updateValues, "creator")
@@ -477,16 +459,25 @@ func UpdateObjectHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("UpdateObjectHandler: Updated %s with ID=%s", classname, objectID)
 
 	resultMap := updated.GetAllValues()
+	metadata := map[string]interface{}{
+		"classname": classname,
+	}
+	// The suggested description, if any, is the result of this job
+	if job := suggestDescriptionOnSave(updated, principal.UserID); job != nil {
+		metadata["suggestion_job"] = job.ID
+	}
+	// What the sanitizer removed from the description and the html, by column
+	if sanitized := updated.GetMetadata("sanitized"); sanitized != nil {
+		metadata["sanitized"] = sanitized
+	}
 
 	// Return updated object
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(ObjectResponse{
-		Success: true,
-		Data:    resultMap,
-		Metadata: map[string]interface{}{
-			"classname": classname,
-		},
+		Success:  true,
+		Data:     resultMap,
+		Metadata: metadata,
 	})
 }
 
@@ -505,21 +496,11 @@ func UpdateObjectHandler(w http.ResponseWriter, r *http.Request) {
 // @Security BearerAuth
 // @Router /objects/{id} [delete]
 func DeleteObjectHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	vars := mux.Vars(r)
 	objectID := vars["id"]
 
@@ -594,20 +575,11 @@ func DeleteObjectHandler(w http.ResponseWriter, r *http.Request) {
 // @Security BearerAuth
 // @Router /objects/creatable-types [get]
 func GetCreatableTypesHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-
 	fatherID := r.URL.Query().Get("father_id")
 	if len(fatherID) == 18 {
 		fatherID = strings.ReplaceAll(fatherID, "-", "")
@@ -707,25 +679,8 @@ func GetCreatableTypesHandler(w http.ResponseWriter, r *http.Request) {
 // @Failure 500 {object} ErrorResponse "Internal error"
 // @Router /objects/search [get]
 func SearchObjectsHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-
-	var dbContext dblayer.DBContext
-	if err == nil {
-		dbContext = dblayer.DBContext{
-			UserID:   claims["user_id"],
-			GroupIDs: strings.Split(claims["groups"], ","),
-			Schema:   dblayer.DbSchema,
-		}
-	} else {
-		dbContext = dblayer.DBContext{
-			UserID:   "-7",           // Anonymous user
-			GroupIDs: []string{"-4"}, // Guests group
-			Schema:   dblayer.DbSchema,
-		}
-	}
-
-	repo := dblayer.NewDBRepository(&dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	_, repo := callerOf(r)
+	var err error
 
 	classname := r.URL.Query().Get("classname")
 	if classname == "" {
@@ -986,24 +941,7 @@ func SearchObjectsHandler(w http.ResponseWriter, r *http.Request) {
 // @Failure 500 {object} ErrorResponse "Internal error"
 // @Router /files/{id}/download [get]
 func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-
-	var dbContext dblayer.DBContext
-	if err == nil {
-		dbContext = dblayer.DBContext{
-			UserID:   claims["user_id"],
-			GroupIDs: strings.Split(claims["groups"], ","),
-			Schema:   dblayer.DbSchema,
-		}
-	} else {
-		dbContext = dblayer.DBContext{
-			UserID:   "-7",           // Anonymous user
-			GroupIDs: []string{"-4"}, // Guests group
-			Schema:   dblayer.DbSchema,
-		}
-	}
-
-	repo := dblayer.NewDBRepository(&dbContext, dblayer.Factory, dblayer.DbConnection)
+	_, repo := callerOf(r)
 
 	vars := mux.Vars(r)
 	fileID := vars["id"]
@@ -1025,9 +963,7 @@ func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
 	if tokenString != "" {
 		// IF I have a token, I check it
 		claimsDownload := jwt.MapClaims{}
-		token, err := jwt.ParseWithClaims(tokenString, claimsDownload, func(t *jwt.Token) (interface{}, error) {
-			return JWTKey, nil
-		})
+		token, err := jwtKeyring.Parse(tokenString, claimsDownload)
 		// log.Printf("Claims: %+v\n", claimsDownload)
 		// log.Printf("err: %v\n", err)
 		if err != nil || !token.Valid {
@@ -1127,20 +1063,11 @@ func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
 // @Security BearerAuth
 // @Router /files/preview-tokens [post]
 func GenerateFileTokensHandler(w http.ResponseWriter, r *http.Request) {
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-
 	// Parse request body
 	var requestData FileTokensRequest
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
@@ -1172,7 +1099,7 @@ func GenerateFileTokensHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Check read permission
 		if !repo.CheckReadPermission(entity) {
-			log.Printf("GenerateFileTokensHandler: User %s has no read permission for file %s", dbContext.UserID, fileID)
+			log.Printf("GenerateFileTokensHandler: User %s has no read permission for file %s", principal.UserID, fileID)
 			continue // Skip files user can't access
 		}
 
@@ -1180,19 +1107,18 @@ func GenerateFileTokensHandler(w http.ResponseWriter, r *http.Request) {
 		expirationTime := time.Now().Add(15 * time.Minute)
 		tokenClaims := jwt.MapClaims{
 			"id":      fileID,
-			"user_id": dbContext.UserID,
+			"user_id": principal.UserID,
 			"exp":     expirationTime.Unix(),
 		}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims)
-		tokenString, err := token.SignedString(JWTKey)
+		tokenString, err := jwtKeyring.Sign(tokenClaims)
 		if err != nil {
 			log.Printf("GenerateFileTokensHandler: Failed to generate token for file %s: %v", fileID, err)
 			continue
 		}
 
 		tokens[fileID] = tokenString
-		log.Printf("GenerateFileTokensHandler: Generated token for file %s (user: %s, expires: %s)", fileID, dbContext.UserID, expirationTime.Format(time.RFC3339))
+		log.Printf("GenerateFileTokensHandler: Generated token for file %s (user: %s, expires: %s)", fileID, principal.UserID, expirationTime.Format(time.RFC3339))
 	}
 
 	// Return tokens
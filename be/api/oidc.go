@@ -0,0 +1,408 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"rprj/be/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// OIDCProviderInfo godoc
+// @Description OpenID Connect provider available for the login
+type OIDCProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// oidcDiscovery is the part of the discovery document used by the login
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider is a configured provider with its discovery document and signing keys, loaded on first use
+type oidcProvider struct {
+	config models.OIDCProvider
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+const (
+	oidcStateDuration = 5 * time.Minute
+	// oidcKeysRefresh limits the JWKS downloads when a token is signed with an unknown key
+	oidcKeysRefresh = time.Minute
+)
+
+// oidcProviders by name (set by InitAPI)
+var oidcProviders = map[string]*oidcProvider{}
+var oidcProviderNames []string
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// NewOIDCProviders configures the providers, skipping the incomplete ones
+func NewOIDCProviders(configs []models.OIDCProvider) {
+	oidcProviders = map[string]*oidcProvider{}
+	oidcProviderNames = nil
+	for _, config := range configs {
+		if config.Name == "" || config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+			if config.Name != "" {
+				log.Printf("OIDC provider %s skipped: issuer, client_id and redirect_url are required", config.Name)
+			}
+			continue
+		}
+		if config.DisplayName == "" {
+			config.DisplayName = config.Name
+		}
+		if len(config.Scopes) == 0 {
+			config.Scopes = []string{"openid", "profile", "email"}
+		}
+		if config.LoginClaim == "" {
+			config.LoginClaim = "preferred_username"
+		}
+		if config.EmailClaim == "" {
+			config.EmailClaim = "email"
+		}
+		if config.FullnameClaim == "" {
+			config.FullnameClaim = "name"
+		}
+		config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+		oidcProviders[config.Name] = &oidcProvider{config: config}
+		oidcProviderNames = append(oidcProviderNames, config.Name)
+	}
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover loads the discovery document of the issuer
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var doc oidcDiscovery
+	if err := getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", doc.Issuer, p.config.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete discovery document for %s", p.config.Issuer)
+	}
+	p.discovery = &doc
+	return p.discovery, nil
+}
+
+func (p *oidcProvider) oauth2Config(doc *oidcDiscovery) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Scopes:       p.config.Scopes,
+		Endpoint:     oauth2.Endpoint{AuthURL: doc.AuthorizationEndpoint, TokenURL: doc.TokenEndpoint},
+	}
+}
+
+// jsonWebKey is a key of a JWKS: RSA or EC
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	decode := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	switch k.Kty {
+	case "RSA":
+		if k.N == "" || k.E == "" {
+			return nil, fmt.Errorf("incomplete RSA key %s", k.Kid)
+		}
+		return &rsa.PublicKey{N: decode(k.N), E: int(decode(k.E).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: decode(k.X), Y: decode(k.Y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC key %s", k.Kid)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// signingKey returns the key kid of the provider, downloading the JWKS again when the key is unknown
+func (p *oidcProvider) signingKey(ctx context.Context, doc *oidcDiscovery, kid string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeysRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, doc.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keysFetched = time.Now()
+	p.keys = map[string]any{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("OIDC %s: %v", p.config.Name, err)
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	// A single key may have no kid
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// validateIDToken checks signature, issuer, audience, expiration and nonce of the ID token
+func (p *oidcProvider) validateIDToken(ctx context.Context, doc *oidcDiscovery, idToken string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, doc, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(doc.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims["nonce"] != nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientID {
+		return nil, fmt.Errorf("token issued for %q", azp)
+	}
+	return claims, nil
+}
+
+// claimString returns a string claim; dots reach nested claims, e.g. "attributes.login"
+func claimString(claims map[string]any, name string) string {
+	var value any = claims
+	for _, part := range strings.Split(name, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return ""
+		}
+		value = m[part]
+	}
+	s, _ := value.(string)
+	return s
+}
+
+// identity maps the claims of the ID token to the user
+func (p *oidcProvider) identity(claims jwt.MapClaims) OAuthIdentity {
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	// Only an email the provider says verified can find an existing user
+	verified, _ := claims["email_verified"].(bool)
+	return OAuthIdentity{
+		Provider:      "oidc:" + p.config.Name,
+		Issuer:        issuer,
+		Subject:       subject,
+		Login:         claimString(claims, p.config.LoginClaim),
+		Email:         claimString(claims, p.config.EmailClaim),
+		EmailVerified: verified,
+		Fullname:      claimString(claims, p.config.FullnameClaim),
+	}
+}
+
+func oidcCookieName(provider string) string {
+	return "oidc_" + provider
+}
+
+// GetOIDCProvidersHandler godoc
+// @Summary List OpenID Connect providers
+// @Description Returns the configured OpenID Connect providers, to show their login buttons
+// @Tags oauth
+// @Produce json
+// @Success 200 {array} OIDCProviderInfo
+// @Router /oauth/oidc/providers [get]
+func GetOIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	providers := []OIDCProviderInfo{}
+	for _, name := range oidcProviderNames {
+		providers = append(providers, OIDCProviderInfo{Name: name, DisplayName: oidcProviders[name].config.DisplayName})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
+
+// OIDCStartHandler godoc
+// @Summary Start OpenID Connect login
+// @Description Redirects to the authorization endpoint of the provider, using PKCE and a nonce
+// @Tags oauth
+// @Param provider path string true "Provider name"
+// @Success 302 {string} string "Redirect to the provider"
+// @Failure 404 {object} ErrorResponse "Unknown provider"
+// @Failure 502 {object} ErrorResponse "Provider not reachable"
+// @Router /oauth/oidc/{provider}/start [get]
+func OIDCStartHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := oidcProviders[name]
+	if !ok {
+		RespondSimpleError(w, ErrObjectNotFound, "Unknown OpenID Connect provider", http.StatusNotFound)
+		return
+	}
+	doc, err := provider.discover(r.Context())
+	if err != nil {
+		log.Printf("OIDCStartHandler %s: discovery failed: %v", name, err)
+		RespondSimpleError(w, ErrServiceUnavailable, "OpenID Connect provider not available", http.StatusBadGateway)
+		return
+	}
+
+	state := randomToken(24)
+	nonce := randomToken(24)
+	verifier := oauth2.GenerateVerifier()
+	// state, nonce and PKCE verifier stay in the browser until the callback
+	http.SetCookie(w, flowCookie(r, oidcCookieName(name), state+"."+nonce+"."+verifier, oidcStateDuration))
+	url := provider.oauth2Config(doc).AuthCodeURL(state,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("nonce", nonce),
+	)
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// OIDCCallbackHandler godoc
+// @Summary OpenID Connect callback
+// @Description Exchanges the code, validates the ID token against the JWKS of the provider and issues JWT
+// @Tags oauth
+// @Produce html
+// @Param provider path string true "Provider name"
+// @Success 200 {string} string "HTML page that stores token and redirects"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Invalid ID token"
+// @Failure 404 {object} ErrorResponse "Unknown provider"
+// @Router /oauth/oidc/{provider}/callback [get]
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := oidcProviders[name]
+	if !ok {
+		RespondSimpleError(w, ErrObjectNotFound, "Unknown OpenID Connect provider", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	if errorCode := query.Get("error"); errorCode != "" {
+		log.Printf("OIDCCallbackHandler %s: %s %s", name, errorCode, query.Get("error_description"))
+		RespondSimpleError(w, ErrUnauthorized, "Login refused by the provider", http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookieName(name))
+	if err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Missing oauth state", http.StatusBadRequest)
+		return
+	}
+	// The state can be used once
+	http.SetCookie(w, flowCookie(r, oidcCookieName(name), "", -1))
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(parts[0])) != 1 {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid oauth state", http.StatusBadRequest)
+		return
+	}
+	nonce, verifier := parts[1], parts[2]
+	code := query.Get("code")
+	if code == "" {
+		RespondSimpleError(w, ErrInvalidRequest, "Missing code", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, oidcHTTPClient)
+	doc, err := provider.discover(ctx)
+	if err != nil {
+		log.Printf("OIDCCallbackHandler %s: discovery failed: %v", name, err)
+		RespondSimpleError(w, ErrServiceUnavailable, "OpenID Connect provider not available", http.StatusBadGateway)
+		return
+	}
+	token, err := provider.oauth2Config(doc).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		log.Printf("OIDCCallbackHandler %s: token exchange failed: %v", name, err)
+		RespondSimpleError(w, ErrInternalServer, "Token exchange failed", http.StatusInternalServerError)
+		return
+	}
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		RespondSimpleError(w, ErrInvalidToken, "Missing ID token", http.StatusUnauthorized)
+		return
+	}
+	claims, err := provider.validateIDToken(ctx, doc, idToken, nonce)
+	if err != nil {
+		log.Printf("OIDCCallbackHandler %s: invalid ID token: %v", name, err)
+		RespondSimpleError(w, ErrInvalidToken, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+
+	completeOAuthLogin(w, r, provider.identity(claims), nil)
+}
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"rprj/be/dblayer"
+	"rprj/be/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// fakeOIDCProvider serves discovery, JWKS and token endpoints; the token endpoint checks the PKCE verifier
+type fakeOIDCProvider struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	claims    jwt.MapClaims
+	signWith  *rsa.PrivateKey
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate the key: %v", err)
+	}
+	p := &fakeOIDCProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.server.URL,
+			"authorization_endpoint": p.server.URL + "/auth",
+			"token_endpoint":         p.server.URL + "/token",
+			"jwks_uri":               p.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "test",
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, p.claims)
+		token.Header["kid"] = "test"
+		signWith := p.key
+		if p.signWith != nil {
+			signWith = p.signWith
+		}
+		idToken, _ := token.SignedString(signWith)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "at", "token_type": "Bearer", "expires_in": 300, "id_token": idToken})
+	})
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// go test -v ./api -run TestOIDCLogin
+func TestOIDCLogin(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	NewOIDCProviders([]models.OIDCProvider{{
+		Name:        "test",
+		Issuer:      provider.server.URL,
+		ClientID:    "rprj",
+		RedirectURL: "http://localhost/api/oauth/oidc/test/callback",
+		LoginClaim:  "attributes.uid",
+	}})
+	t.Cleanup(func() { NewOIDCProviders(nil) })
+
+	router := mux.NewRouter()
+	router.HandleFunc("/oauth/oidc/providers", GetOIDCProvidersHandler).Methods("GET")
+	router.HandleFunc("/oauth/oidc/{provider}/start", OIDCStartHandler).Methods("GET")
+	router.HandleFunc("/oauth/oidc/{provider}/callback", OIDCCallbackHandler).Methods("GET")
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/oidc/providers", nil))
+	if !strings.Contains(rr.Body.String(), `"name":"test"`) {
+		t.Fatalf("Expected the provider to be listed, got %s", rr.Body.String())
+	}
+
+	login := "oidc" + Random4digits()
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	t.Cleanup(func() {
+		search := adminRepo.GetInstanceByTableName("users")
+		search.SetValue("login", login)
+		users, _ := adminRepo.Search(search, false, false, "")
+		for _, user := range users {
+			adminRepo.Delete(user)
+		}
+	})
+
+	// login starts the flow and answers the callback as the provider would
+	loginWith := func(claims jwt.MapClaims, tamper func(query url.Values)) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/oidc/test/start", nil))
+		if rr.Code != http.StatusFound {
+			t.Fatalf("Start: expected a redirect, got %v: %s", rr.Code, rr.Body.String())
+		}
+		location, _ := url.Parse(rr.Header().Get("Location"))
+		authQuery := location.Query()
+		if authQuery.Get("code_challenge_method") != "S256" || authQuery.Get("nonce") == "" || authQuery.Get("client_id") != "rprj" {
+			t.Fatalf("Unexpected authorization request %s", location)
+		}
+		provider.challenge = authQuery.Get("code_challenge")
+		provider.claims = jwt.MapClaims{
+			"iss":        provider.server.URL,
+			"aud":        "rprj",
+			"sub":        "1234",
+			"exp":        time.Now().Add(5 * time.Minute).Unix(),
+			"iat":        time.Now().Unix(),
+			"nonce":      authQuery.Get("nonce"),
+			"attributes": map[string]any{"uid": login},
+			"name":       "OIDC Test",
+		}
+		for k, v := range claims {
+			provider.claims[k] = v
+		}
+		callback := url.Values{"state": {authQuery.Get("state")}, "code": {"good-code"}}
+		if tamper != nil {
+			tamper(callback)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/oauth/oidc/test/callback?"+callback.Encode(), nil)
+		for _, cookie := range rr.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// 1. The user is created with the mapped claims
+	rr = loginWith(nil, nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"login":"`+login+`"`) {
+		t.Fatalf("Expected the login to succeed, got %v: %s", rr.Code, rr.Body.String())
+	}
+	search := adminRepo.GetInstanceByTableName("users")
+	search.SetValue("login", login)
+	users, _ := adminRepo.Search(search, false, false, "")
+	if len(users) != 1 || users[0].GetValue("fullname") != "OIDC Test" {
+		t.Fatalf("Expected one user named OIDC Test, got %v", users)
+	}
+	userID := users[0].GetValue("id").(string)
+	groups, _ := GetUserGroupIDs(adminRepo, userID, users[0].GetValue("group_id").(string))
+	if !strings.Contains(strings.Join(groups, ","), oauthDefaultGroup) {
+		t.Fatalf("Expected the new user in the default group, got %v", groups)
+	}
+
+	// 2. The next login finds the same user
+	rr = loginWith(jwt.MapClaims{"name": "Renamed"}, nil)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"user_id":"`+userID+`"`) {
+		t.Fatalf("Expected the same user, got %v: %s", rr.Code, rr.Body.String())
+	}
+
+	// 3. Invalid responses are refused
+	if rr := loginWith(jwt.MapClaims{"nonce": "replayed"}, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong nonce to be refused, got %v", rr.Code)
+	}
+	if rr := loginWith(jwt.MapClaims{"aud": "other-client"}, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong audience to be refused, got %v", rr.Code)
+	}
+	if rr := loginWith(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected an expired token to be refused, got %v", rr.Code)
+	}
+	if rr := loginWith(nil, func(q url.Values) { q.Set("state", "forged") }); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a wrong state to be refused, got %v", rr.Code)
+	}
+	if rr := loginWith(nil, func(q url.Values) { q.Set("code", "stolen-code") }); rr.Code == http.StatusOK {
+		t.Fatalf("Expected a wrong code to be refused")
+	}
+	provider.signWith, _ = rsa.GenerateKey(rand.Reader, 2048)
+	if rr := loginWith(nil, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a forged signature to be refused, got %v", rr.Code)
+	}
+}
+
+// go test -v ./api -run TestProvisionOAuthUser
+func TestProvisionOAuthUser(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	login := "oauth" + Random4digits()
+	email := login + "@example.com"
+	user, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    login,
+		"pwd":      "secret",
+		"fullname": "Existing user",
+		"email":    email,
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer adminRepo.Delete(user)
+
+	issuer := "https://idp" + Random4digits() + ".example.com"
+	identity := func(subject string, login string, email string, verified bool) OAuthIdentity {
+		return OAuthIdentity{Provider: "test", Issuer: issuer, Subject: subject, Login: login, Email: email, EmailVerified: verified}
+	}
+	deleteUser := func(userID string) {
+		created := adminRepo.GetInstanceByTableName("users").(*dblayer.DBUser)
+		created.SetValue("id", userID)
+		adminRepo.Delete(created)
+	}
+
+	// 1. Neither the login nor an unverified email find the existing user
+	userID, storedLogin, err := provisionOAuthUser(adminRepo, identity("sub-1", login, email, false))
+	if err != nil || userID == user.GetValue("id") || storedLogin != login+"2" {
+		t.Fatalf("Expected a new user with a free login, got %v %v %v", userID, storedLogin, err)
+	}
+	if loaded := adminRepo.GetEntityByID("users", userID); loaded.GetValue("email") != nil && loaded.GetValue("email") != "" {
+		t.Fatalf("Expected the unverified email not stored, got %v", loaded.GetValue("email"))
+	}
+	deleteUser(userID)
+
+	// 2. A verified email finds it, whatever the login at the provider, and links the account
+	userID, storedLogin, err = provisionOAuthUser(adminRepo, identity("sub-2", "other"+login, email, true))
+	if err != nil || userID != user.GetValue("id") || storedLogin != login {
+		t.Fatalf("Expected the user found by email, got %v %v %v", userID, storedLogin, err)
+	}
+	// ...and the link finds it afterwards, even with another email
+	userID, _, err = provisionOAuthUser(adminRepo, identity("sub-2", "other"+login, "changed@example.com", false))
+	if err != nil || userID != user.GetValue("id") {
+		t.Fatalf("Expected the user found by its link, got %v %v", userID, err)
+	}
+	// The same subject of another issuer is another account
+	other := identity("sub-2", "other"+login, "", false)
+	other.Issuer += "/other"
+	userID, _, err = provisionOAuthUser(adminRepo, other)
+	if err != nil || userID == user.GetValue("id") {
+		t.Fatalf("Expected another user for another issuer, got %v %v", userID, err)
+	}
+	deleteUser(userID)
+
+	// An unconfirmed registration with the email is ignored
+	newEmail := "new" + email
+	registered, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    "registered" + login,
+		"pwd":      "secret",
+		"fullname": "Registered user",
+		"email":    newEmail,
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer adminRepo.Delete(registered)
+	registration := adminRepo.GetInstanceByTableName("users_registrations")
+	registration.SetValue("user_id", registered.GetValue("id"))
+	registration.SetValue("email", newEmail)
+	if _, err := adminRepo.Insert(registration); err != nil {
+		t.Fatalf("Failed to save the registration: %v", err)
+	}
+
+	// 3. Created, with the email as login
+	userID, storedLogin, err = provisionOAuthUser(adminRepo, identity("sub-3", "", newEmail, true))
+	if err != nil || storedLogin != newEmail || userID == registered.GetValue("id") {
+		t.Fatalf("Expected a new user, got %v %v", storedLogin, err)
+	}
+	deleteUser(userID)
+	if _, _, err := provisionOAuthUser(adminRepo, identity("sub-4", "", "", false)); err == nil {
+		t.Fatalf("Expected an identity without login and email to be refused")
+	}
+	if _, _, err := provisionOAuthUser(adminRepo, identity("", login, email, true)); err == nil {
+		t.Fatalf("Expected an identity without subject to be refused")
+	}
+}
@@ -1,45 +1,48 @@
 package api
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"rprj/be/dblayer"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
-var ollamaURL string
+// Provider of all the AI features and its default model (set by OllamaInit)
+var llmProvider LLMProvider
 var ollamaModel string
 var ollamaAppName string
 
+// When true, objects saved without a description get a suggested one in the response
+var ollamaAutoDescribe bool
+
+// Access rules for the /ollama proxy (set by InitAPI)
+var ollamaAllowedGroups []string
+var ollamaAllowedModels []string
+var ollamaSystemPrompt string
+
 var ollamaFolder *dblayer.DBFolder
 
-func OllamaInit(appName, url, model string) error {
-	ollamaURL = url
+func OllamaInit(appName string, provider LLMProvider, model string) error {
+	llmProvider = provider
 	ollamaModel = model
 	ollamaAppName = appName
 
-	lastDefaultPageResponse = "<h2>Welcome! 👋</h2><p>Please log in to continue using the application.</p>"
+	setLastDefaultPageResponse("<h2>Welcome! 👋</h2><p>Please log in to continue using the application.</p>")
 
-	if ollamaURL != "" && ollamaModel != "" {
+	if llmConfigured() {
 		// go UpdateOllamaDefaultPageResponse("en")
-		log.Printf("Ollama initialized with URL: %s and Model: %s\n", ollamaURL, ollamaModel)
+		log.Printf("LLM initialized with provider: %s and Model: %s\n", llmProvider.Name(), ollamaModel)
 
 		OllamaFolderInit("Ollama Pages")
 
 		// Search for existing pages in the folder and randomly choose one to set lastDefaultPageResponse
-		dbContext := &dblayer.DBContext{
-			UserID:   "-1",           // DANGEROUS!!!! Think of something better here!!!
-			GroupIDs: []string{"-2"}, // Same here!!!
-			Schema:   dblayer.DbSchema,
-		}
-
-		repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-		repo.Verbose = false
+		repo := dblayer.NewSystemRepository("LLM default page", ollamaPageTables...)
 
 		page := repo.GetInstanceByTableName("pages")
 		if page == nil {
@@ -54,7 +57,7 @@ func OllamaInit(appName, url, model string) error {
 		}
 		if len(results) > 1 {
 			selectedPage := results[0].(*dblayer.DBPage)
-			lastDefaultPageResponse = selectedPage.GetValue("html").(string)
+			setLastDefaultPageResponse(selectedPage.GetValue("html").(string))
 			log.Printf("Using existing Ollama default page with ID %s\n", selectedPage.GetValue("id"))
 		}
 
@@ -66,14 +69,7 @@ func OllamaInit(appName, url, model string) error {
 }
 
 func OllamaFolderInit(folderName string) {
-	dbContext := &dblayer.DBContext{
-		UserID:   "-1",           // DANGEROUS!!!! Think of something better here!!!
-		GroupIDs: []string{"-2"}, // Same here!!!
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	repo := dblayer.NewSystemRepository("LLM folder", ollamaPageTables...)
 
 	search := repo.GetInstanceByTableName("folders")
 	if search == nil {
@@ -111,34 +107,55 @@ func OllamaFolderInit(folderName string) {
 
 type OllamaRequest struct {
 	Prompt string `json:"prompt"`
+	Model  string `json:"model,omitempty"`  // must be in ollama_models, default llm_models.chat or ollama_model
+	Stream bool   `json:"stream,omitempty"` // stream the tokens as JSON lines
 }
 type OllamaResponse struct {
 	Response string `json:"response"`
 	Error    string `json:"error,omitempty"`
 }
 
+// OllamaStreamChunk godoc
+// @Description One line of a streamed response: a piece of the answer, or the final summary when done is true
+type OllamaStreamChunk struct {
+	Response string `json:"response,omitempty"`
+	Done     bool   `json:"done,omitempty"`
+	Tokens   int    `json:"tokens,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
 // OllamaHandler godoc
 //
 //		@Summary sends a prompt to Ollama and returns the response
-//		@Description Sends a prompt to the Ollama API and returns the generated response
+//		@Description Sends a prompt to the Ollama API and returns the generated response.
+//		@Description With "stream": true the tokens are sent as JSON lines (application/x-ndjson) as soon as they are generated,
+//		@Description with "Accept: text/event-stream" they are sent as Server-Sent Events.
+//		@Description Access is limited to the configured groups and to per-user/IP request and token quotas.
 //		@Tags ollama
 //		@Accept json
 //		@Produce json
 //		@Param request body OllamaRequest true "Request body containing the prompt"
 //		@Success 200 {object} OllamaResponse "Ollama response"
 //		@Failure 400 {object} OllamaResponse "Invalid request"
+//		@Failure 401 {object} ErrorResponse "Unauthorized"
+//		@Failure 403 {object} ErrorResponse "Forbidden"
+//		@Failure 429 {object} ErrorResponse "Quota exceeded"
 //		@Failure 503 {object} OllamaResponse "Ollama service not configured"
 //	 @Security BearerAuth
 //		@Router /ollama [post]
 func OllamaHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Rule: we DO NOT want unauthenticated access to Ollama
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	principal, _, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("OllamaHandler called by user ID: %s\n", principal.UserID)
+
+	if !ollamaUserAllowed(principal) {
+		RespondSimpleError(w, ErrForbidden, "You are not allowed to use the AI assistant", http.StatusForbidden)
 		return
 	}
-	log.Printf("OllamaHandler called by user ID: %s\n", claims["user_id"])
 
 	var req OllamaRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -146,28 +163,147 @@ func OllamaHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if ollamaURL == "" || ollamaModel == "" {
+	if strings.TrimSpace(req.Prompt) == "" {
+		RespondError(w, ErrMissingField, "Missing prompt", map[string]string{"field": "prompt"}, http.StatusBadRequest)
+		return
+	}
+
+	if !llmConfigured() {
 		res := OllamaResponse{Error: "Ollama service not configured"}
-		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
 		json.NewEncoder(w).Encode(res)
 		return
 	}
 
-	respText, err := CallOllama(req.Prompt)
-	if err != nil {
-		res := OllamaResponse{Error: err.Error()}
+	model := llmModel(LLMFeatureChat)
+	if req.Model != "" && req.Model != model {
+		if !slices.Contains(ollamaAllowedModels, req.Model) {
+			RespondError(w, ErrInvalidRequest, "Model not allowed", map[string]string{"model": req.Model}, http.StatusBadRequest)
+			return
+		}
+		model = req.Model
+	}
+
+	quotaKeys := []string{"user:" + principal.UserID, "ip:" + clientIP(r)}
+	if retryAfter, err := ollamaQuota.Acquire(quotaKeys); err != nil {
+		log.Printf("OllamaHandler: %v for %v", err, quotaKeys)
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+		RespondSimpleError(w, ErrRateLimited, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	// The answer may not go over the tokens left today
+	maxTokens := ollamaQuota.RemainingTokens(quotaKeys)
+
+	messages := []LLMMessage{}
+	if ollamaSystemPrompt != "" {
+		messages = append(messages, LLMMessage{Role: "system", Content: ollamaSystemPrompt})
+	}
+	messages = append(messages, LLMMessage{Role: "user", Content: req.Prompt})
+
+	useSSE := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if !req.Stream && !useSSE {
+		respText, tokens, err := llmProvider.Chat(r.Context(), model, messages, maxTokens, nil)
+		ollamaQuota.AddTokens(quotaKeys, tokens)
+		if err != nil {
+			res := OllamaResponse{Error: err.Error()}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		res := OllamaResponse{Response: ollamaCleanResponse(respText)}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(res)
 		return
 	}
 
-	res := OllamaResponse{Response: respText}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(res)
+	// Streaming
+	flusher, _ := w.(http.Flusher)
+	if useSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx must not buffer the stream
+	w.WriteHeader(http.StatusOK)
+
+	writeChunk := func(event string, chunk OllamaStreamChunk) error {
+		data, _ := json.Marshal(chunk)
+		var err error
+		if useSSE {
+			if event != "" {
+				_, err = fmt.Fprintf(w, "event: %s\n", event)
+			}
+			if err == nil {
+				_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+			}
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", data)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	// Not every model honors the limit: the stream is stopped when the pieces sent reach it
+	streamed := 0
+	_, tokens, err := llmProvider.Chat(r.Context(), model, messages, maxTokens, func(token string) error {
+		if maxTokens > 0 && streamed >= maxTokens {
+			return errTokenQuotaExceeded
+		}
+		streamed++
+		return writeChunk("", OllamaStreamChunk{Response: token})
+	})
+	// An interrupted stream has no usage: the pieces sent are counted instead
+	ollamaQuota.AddTokens(quotaKeys, max(tokens, streamed))
+	if err != nil {
+		log.Printf("OllamaHandler: streaming failed: %v", err)
+		writeChunk("error", OllamaStreamChunk{Error: err.Error()})
+		return
+	}
+	writeChunk("done", OllamaStreamChunk{Done: true, Tokens: tokens})
 }
 
-var lastDefaultPageResponse string
+// ollamaUserAllowed tells if the caller can use the /ollama proxy
+func ollamaUserAllowed(principal *Principal) bool {
+	if len(ollamaAllowedGroups) == 0 || principal.Can(dblayer.CapabilityAssistantUse) {
+		return true
+	}
+	for _, groupID := range principal.GroupIDs {
+		if slices.Contains(ollamaAllowedGroups, groupID) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastDefaultPageResponse is written by the generation of the default page, in the background,
+// and read by the requests
+var (
+	lastDefaultPageResponse   string
+	lastDefaultPageResponseMu sync.RWMutex
+)
+
+func getLastDefaultPageResponse() string {
+	lastDefaultPageResponseMu.RLock()
+	defer lastDefaultPageResponseMu.RUnlock()
+	return lastDefaultPageResponse
+}
+
+func setLastDefaultPageResponse(response string) {
+	lastDefaultPageResponseMu.Lock()
+	defer lastDefaultPageResponseMu.Unlock()
+	lastDefaultPageResponse = response
+}
+
+const defaultPageRefreshInterval = 10 * time.Minute
+
+var defaultPageMu sync.Mutex
+var defaultPageUpdating bool
+var defaultPageUpdatedAt time.Time
 
 // DefaultPageOllamaHandler godoc
 //
@@ -187,27 +323,27 @@ func DefaultPageOllamaHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Print("Requested language tag: ", langParam)
 
-	remote_ip := r.RemoteAddr
-	log.Printf("DefaultPageOllamaHandler called from IP: %s\n", remote_ip)
-	x_forwarded_for := r.Header.Get("X-Forwarded-For")
-	if x_forwarded_for != "" {
-		// remove duplicates in case of multiple proxies
-		ips := strings.Split(x_forwarded_for, ",")
-		log.Print("X-Forwarded-For IPs: ", ips)
-		x_forwarded_for = strings.TrimSpace(ips[0])
-
-		remote_ip = x_forwarded_for
-	}
-	log.Printf("X-Forwarded-For: %s\n", x_forwarded_for)
-	log.Printf("Using IP for logging: %s\n", remote_ip)
+	log.Printf("DefaultPageOllamaHandler called from IP: %s\n", clientIP(r))
 
 	// Just use English for now
 	langParam = "en"
-	go UpdateOllamaDefaultPageResponse(langParam)
+	// This endpoint is public: regenerate the page at most once every defaultPageRefreshInterval
+	defaultPageMu.Lock()
+	if !defaultPageUpdating && time.Since(defaultPageUpdatedAt) > defaultPageRefreshInterval {
+		defaultPageUpdating = true
+		go func() {
+			UpdateOllamaDefaultPageResponse(langParam)
+			defaultPageMu.Lock()
+			defaultPageUpdating = false
+			defaultPageUpdatedAt = time.Now()
+			defaultPageMu.Unlock()
+		}()
+	}
+	defaultPageMu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
-		"response": lastDefaultPageResponse,
+		"response": getLastDefaultPageResponse(),
 	})
 }
 
@@ -219,7 +355,7 @@ var prompts = []string{
 }
 
 func UpdateOllamaDefaultPageResponse(languageTag string) {
-	if ollamaURL == "" || ollamaModel == "" {
+	if !llmConfigured() {
 		log.Print("Ollama not configured, skipping default page response update.")
 		return
 	}
@@ -250,13 +386,13 @@ func UpdateOllamaDefaultPageResponse(languageTag string) {
 
 	log.Print("Prompt: ", prompt)
 
-	respText, err := CallOllama(prompt)
+	respText, err := CallLLM(LLMFeatureDefaultPage, prompt)
 	if err != nil {
 		log.Printf("Error getting default page response from Ollama: %v\n", err)
 		respText = "Welcome to our application!"
 	}
 
-	lastDefaultPageResponse = respText
+	setLastDefaultPageResponse(respText)
 
 	OllamaSavePage(respText)
 }
@@ -267,14 +403,7 @@ func OllamaSavePage(content string) {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   "-1",           // DANGEROUS!!!! Think of something better here!!!
-		GroupIDs: []string{"-2"}, // Same here!!!
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
+	repo := dblayer.NewSystemRepository("LLM default page", ollamaPageTables...)
 
 	page := repo.GetInstanceByTableName("pages")
 	if page == nil {
@@ -284,11 +413,11 @@ func OllamaSavePage(content string) {
 	// Generate title with YYYY.MM.DD prefix
 	titlePrefix := time.Now().Format("2006.01.02 15:04")
 	page.SetValue("name", titlePrefix+" Ollama Default Page")
-	page.SetValue("description", "AI-generated content by Ollama")
+	page.SetValue("description", fmt.Sprintf("AI-generated content by %s (%s)", llmProvider.Name(), llmModel(LLMFeatureDefaultPage)))
 	page.SetValue("html", content)
 	page.SetValue("father_id", ollamaFolder.GetValue("id"))
 	page.SetValue("permissions", "rwxrw-r--") // Tutti possono leggere
-	page.SetValue("group_id", "-6")
+	page.SetValue("group_id", WebmasterGroupID)
 	created, err := repo.Insert(page)
 	if err != nil {
 		log.Printf("Failed to create Ollama default page: %v\n", err)
@@ -298,57 +427,30 @@ func OllamaSavePage(content string) {
 	log.Printf("Created Ollama default page with ID %s\n", createdPage.GetValue("id"))
 }
 
-// CallOllama sends a prompt to the Ollama API and returns the response
-func CallOllama(prompt string) (string, error) {
-	if ollamaURL == "" || ollamaModel == "" {
-		return "", fmt.Errorf("Ollama not configured")
-	}
-
-	requestBody, err := json.Marshal(map[string]interface{}{
-		"model": ollamaModel,
-		"messages": []map[string]string{
-			{
-				"role":    "user",
-				"content": prompt,
-			},
-		},
-		"stream": false,
-	})
-	if err != nil {
-		return "", err
-	}
+// CallLLM sends a prompt to the model configured for the feature and returns the response
+func CallLLM(feature string, prompt string) (string, error) {
+	content, _, err := callLLM(feature, prompt)
+	return content, err
+}
 
-	resp, err := http.Post(fmt.Sprintf("%s", ollamaURL), "application/json", bytes.NewBuffer(requestBody))
-	if err != nil {
-		return "", err
+// callLLM is CallLLM returning the tokens used too
+func callLLM(feature string, prompt string) (string, int, error) {
+	if !llmConfigured() {
+		return "", 0, fmt.Errorf("LLM not configured")
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	content, tokens, err := llmProvider.Chat(context.Background(), llmModel(feature), []LLMMessage{{Role: "user", Content: prompt}}, 0, nil)
 	if err != nil {
-		return "", err
-	}
-
-	log.Printf("Ollama response: %s\n", string(body))
-
-	// Parse the response
-	// {"model":"llama3.2:latest","created_at":"2025-11-13T13:17:45.487900903Z","message":{"role":"assistant","content":"I'm an artificial intelligence model known as Llama. Llama stands for \"Large Language Model Meta AI.\""},"done":true,"done_reason":"stop","total_duration":1593273648,"load_duration":103413131,"prompt_eval_count":29,"prompt_eval_duration":132183696,"eval_count":23,"eval_duration":1338392262}
-
-	var ollamaResponseSingle struct {
-		Message struct {
-			Content string `json:"content"`
-		} `json:"message"`
+		return "", tokens, err
 	}
+	return ollamaCleanResponse(content), tokens, nil
+}
 
-	if err := json.Unmarshal(body, &ollamaResponseSingle); err == nil && ollamaResponseSingle.Message.Content != "" {
-		content := ollamaResponseSingle.Message.Content
-		content = strings.ReplaceAll(content, "```html", "")
-		content = strings.ReplaceAll(content, "```", "")
-		content = strings.ReplaceAll(content, "[app name]", ollamaAppName)
-		content = strings.ReplaceAll(content, "[App Name]", ollamaAppName)
-		return content, nil
-	}
-
-	return "", fmt.Errorf("invalid response from Ollama")
-
+// ollamaCleanResponse removes the markdown fences and fills the app name placeholders
+func ollamaCleanResponse(content string) string {
+	content = strings.ReplaceAll(content, "```html", "")
+	content = strings.ReplaceAll(content, "```", "")
+	content = strings.ReplaceAll(content, "[app name]", ollamaAppName)
+	content = strings.ReplaceAll(content, "[App Name]", ollamaAppName)
+	return content
 }
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLLMProvider replaces the LLM provider for the duration of the test
+func useLLMProvider(t *testing.T, provider LLMProvider) {
+	oldProvider, oldModel := llmProvider, ollamaModel
+	llmProvider, ollamaModel = provider, "fake"
+	t.Cleanup(func() { llmProvider, ollamaModel = oldProvider, oldModel })
+}
+
+// fakeOllamaStreamServer streams back the words of the last prompt, one per line
+func fakeOllamaStreamServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model    string `json:"model"`
+			Stream   bool   `json:"stream"`
+			Messages []struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Messages) == 0 {
+			t.Errorf("fakeOllamaStreamServer: invalid request: %v", err)
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		words := strings.Fields(req.Messages[len(req.Messages)-1].Content)
+		if !req.Stream {
+			json.NewEncoder(w).Encode(map[string]any{
+				"message":           map[string]string{"role": "assistant", "content": strings.Join(words, " ")},
+				"done":              true,
+				"prompt_eval_count": len(words),
+				"eval_count":        len(words),
+			})
+			return
+		}
+		for _, word := range words {
+			json.NewEncoder(w).Encode(map[string]any{
+				"message": map[string]string{"role": "assistant", "content": word + " "},
+				"done":    false,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"message":           map[string]string{"role": "assistant", "content": ""},
+			"done":              true,
+			"prompt_eval_count": len(words),
+			"eval_count":        len(words),
+		})
+	}))
+}
+
+// go test -v ./api -run TestOllamaHandlerStream
+func TestOllamaHandlerStream(t *testing.T) {
+	server := fakeOllamaStreamServer(t)
+	defer server.Close()
+	useLLMProvider(t, &OllamaProvider{URL: server.URL})
+	oldQuota := ollamaQuota
+	ollamaQuota = NewQuota(2, 0)
+	defer func() { ollamaQuota = oldQuota }()
+
+	token := ApiTestDoLogin(t, testAdminLogin, testAdminPwd)
+
+	// 1. Unauthenticated requests are refused
+	req := httptest.NewRequest(http.MethodPost, "/ollama", strings.NewReader(`{"prompt":"hello"}`))
+	rr := httptest.NewRecorder()
+	OllamaHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status Unauthorized, got %v", rr.Code)
+	}
+
+	// 2. Streamed as JSON lines
+	req = httptest.NewRequest(http.MethodPost, "/ollama", strings.NewReader(`{"prompt":"one two three","stream":true}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	OllamaHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Expected application/x-ndjson, got %s", rr.Header().Get("Content-Type"))
+	}
+	var chunks []OllamaStreamChunk
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		var chunk OllamaStreamChunk
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("Expected 3 tokens and the final line, got %d lines", len(chunks))
+	}
+	if chunks[0].Response != "one " || !chunks[3].Done || chunks[3].Tokens != 6 {
+		t.Fatalf("Unexpected stream: %+v", chunks)
+	}
+
+	// 3. Models not in the allowlist are refused
+	req = httptest.NewRequest(http.MethodPost, "/ollama", strings.NewReader(`{"prompt":"hello","model":"other"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	OllamaHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status BadRequest, got %v", rr.Code)
+	}
+
+	// 4. Server-Sent Events
+	req = httptest.NewRequest(http.MethodPost, "/ollama", strings.NewReader(`{"prompt":"hello"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "text/event-stream")
+	rr = httptest.NewRecorder()
+	OllamaHandler(rr, req)
+	if !strings.Contains(rr.Body.String(), `data: {"response":"hello "}`) || !strings.Contains(rr.Body.String(), "event: done") {
+		t.Fatalf("Unexpected SSE body: %s", rr.Body.String())
+	}
+
+	// 5. The third request in the hour is over quota
+	req = httptest.NewRequest(http.MethodPost, "/ollama", strings.NewReader(`{"prompt":"hello"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	OllamaHandler(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status TooManyRequests, got %v", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected a Retry-After header")
+	}
+}
+
+// go test -v ./api -run TestOllamaHandlerTokenBudget
+func TestOllamaHandlerTokenBudget(t *testing.T) {
+	server := fakeOllamaStreamServer(t) // streams the whole answer, whatever num_predict
+	defer server.Close()
+	useLLMProvider(t, &OllamaProvider{URL: server.URL})
+	oldQuota := ollamaQuota
+	ollamaQuota = NewQuota(0, 10)
+	defer func() { ollamaQuota = oldQuota }()
+
+	token := ApiTestDoLogin(t, testAdminLogin, testAdminPwd)
+	ask := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/ollama", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		OllamaHandler(rr, req)
+		return rr
+	}
+
+	// 1. An empty prompt is refused and costs nothing
+	if rr := ask(`{"prompt":"  \n "}`); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status BadRequest for an empty prompt, got %v", rr.Code)
+	}
+
+	// 2. 3 + 3 tokens: 4 left
+	if rr := ask(`{"prompt":"one two three","stream":true}`); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"done":true`) {
+		t.Fatalf("Expected a complete stream, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if remaining := ollamaQuota.RemainingTokens([]string{"ip:192.0.2.1"}); remaining != 4 {
+		t.Fatalf("Expected 4 tokens left, got %d", remaining)
+	}
+
+	// 3. The stream stops when the tokens left are sent
+	rr := ask(`{"prompt":"a b c d e f","stream":true}`)
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 5 || !strings.Contains(lines[4], errTokenQuotaExceeded.Error()) {
+		t.Fatalf("Expected 4 tokens and the quota error, got %s", rr.Body.String())
+	}
+
+	// 4. Nothing left for today
+	if rr := ask(`{"prompt":"hello"}`); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status TooManyRequests, got %v", rr.Code)
+	}
+}
+
+// go test -v ./api -run TestQuota
+func TestQuota(t *testing.T) {
+	now := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	quota := NewQuota(0, 100)
+	quota.now = func() time.Time { return now }
+
+	keys := []string{"user:1", "ip:127.0.0.1"}
+	if _, err := quota.Acquire(keys); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	quota.AddTokens(keys, 150)
+	if _, err := quota.Acquire([]string{"user:2", "ip:127.0.0.1"}); err == nil {
+		t.Fatalf("Expected the IP to be over the token quota")
+	}
+	if _, err := quota.Acquire([]string{"user:2", "ip:10.0.0.1"}); err != nil {
+		t.Fatalf("Unexpected error for another user and IP: %v", err)
+	}
+
+	now = now.Add(25 * time.Hour)
+	if retry, err := quota.Acquire(keys); err != nil {
+		t.Fatalf("Expected the quota to be reset after a day, got %v (retry after %v)", err, retry)
+	}
+
+	// The counters with nothing left are forgotten, those still counting tokens are kept
+	quota.AddTokens([]string{"user:1"}, 10)
+	now = now.Add(2 * time.Hour)
+	quota.Acquire([]string{"ip:10.0.0.2"})
+	if _, ok := quota.counters["user:2"]; ok || len(quota.counters) != 2 || quota.counters["user:1"] == nil {
+		t.Fatalf("Expected only user:1 and the new IP, got %v", quota.counters)
+	}
+}
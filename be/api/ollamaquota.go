@@ -0,0 +1,187 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota limits the requests per hour and the tokens per day of every key (user, IP, account or email address):
+// the Ollama calls, the registrations and the password resets each have their own.
+// Counters are kept in memory: they restart with the server.
+type Quota struct {
+	RequestsPerHour int // 0 = unlimited
+	TokensPerDay    int // 0 = unlimited
+
+	mu        sync.Mutex
+	counters  map[string]*quotaCounter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type quotaCounter struct {
+	hourStart time.Time
+	requests  int
+	dayStart  time.Time
+	tokens    int
+}
+
+// Quota of the Ollama calls (set by InitAPI)
+var ollamaQuota = NewQuota(0, 0)
+
+var errTokenQuotaExceeded = fmt.Errorf("token quota exceeded")
+
+func NewQuota(requestsPerHour int, tokensPerDay int) *Quota {
+	return &Quota{
+		RequestsPerHour: requestsPerHour,
+		TokensPerDay:    tokensPerDay,
+		counters:        map[string]*quotaCounter{},
+		now:             time.Now,
+	}
+}
+
+// counter returns the counter of a key, resetting the expired windows. Must be called with mu held.
+func (q *Quota) counter(key string, now time.Time) *quotaCounter {
+	c, ok := q.counters[key]
+	if !ok {
+		c = &quotaCounter{hourStart: now, dayStart: now}
+		q.counters[key] = c
+	}
+	if now.Sub(c.hourStart) >= time.Hour {
+		c.hourStart = now
+		c.requests = 0
+	}
+	if now.Sub(c.dayStart) >= 24*time.Hour {
+		c.dayStart = now
+		c.tokens = 0
+	}
+	return c
+}
+
+// sweep forgets the counters with nothing left in their windows, at most once an hour: every IP address
+// would stay in memory otherwise. Must be called with mu held.
+func (q *Quota) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < time.Hour {
+		return
+	}
+	q.lastSweep = now
+	for key, c := range q.counters {
+		if now.Sub(c.hourStart) >= time.Hour && (c.tokens == 0 || now.Sub(c.dayStart) >= 24*time.Hour) {
+			delete(q.counters, key)
+		}
+	}
+}
+
+// Acquire counts a new request for all the keys.
+// If any of them is over quota nothing is counted and the time to wait is returned with the error.
+func (q *Quota) Acquire(keys []string) (time.Duration, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	q.sweep(now)
+	for _, key := range keys {
+		c := q.counter(key, now)
+		if q.RequestsPerHour > 0 && c.requests >= q.RequestsPerHour {
+			return c.hourStart.Add(time.Hour).Sub(now), fmt.Errorf("request quota exceeded")
+		}
+		if q.TokensPerDay > 0 && c.tokens >= q.TokensPerDay {
+			return c.dayStart.Add(24 * time.Hour).Sub(now), errTokenQuotaExceeded
+		}
+	}
+	for _, key := range keys {
+		q.counters[key].requests++
+	}
+	return 0, nil
+}
+
+// RemainingTokens returns the tokens left today to the most limited of the keys, 0 if unlimited
+func (q *Quota) RemainingTokens(keys []string) int {
+	if q.TokensPerDay <= 0 {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	remaining := q.TokensPerDay
+	for _, key := range keys {
+		remaining = min(remaining, q.TokensPerDay-q.counter(key, now).tokens)
+	}
+	return max(remaining, 1)
+}
+
+// AddTokens records the tokens used by a request
+func (q *Quota) AddTokens(keys []string, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	for _, key := range keys {
+		q.counter(key, now).tokens += tokens
+	}
+}
+
+// trustedProxies are the proxies whose X-Forwarded-For is trusted (set by InitAPI)
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses the IP addresses and CIDR ranges of trusted_proxies
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Printf("trusted_proxies: invalid %q ignored", proxy)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client: the peer, or behind trusted proxies the last address
+// of X-Forwarded-For that is not one of them. The header of any other peer is ignored: anyone can send it.
+func clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if address == "" {
+			continue
+		}
+		if !isTrustedProxy(address) || i == 0 {
+			return address
+		}
+	}
+	return peer
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"rprj/be/dblayer"
+)
+
+// ForgotPasswordRequest godoc
+// @Description Request of a password reset link
+type ForgotPasswordRequest struct {
+	Login string `json:"login"` // login or email
+}
+
+// ResetPasswordRequest godoc
+// @Description New password with the token of the reset link
+type ResetPasswordRequest struct {
+	Token string `json:"token"`
+	Pwd   string `json:"pwd"`
+}
+
+// How long a reset link can be used
+const PasswordResetTokenDuration = time.Hour
+
+// Reset requests per hour of every IP and account (set by InitAPI)
+var passwordResetQuota = NewQuota(0, 0)
+
+// hashPasswordResetToken returns the value stored in users_password_resets.token_hash
+func hashPasswordResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// findPasswordResetUser returns the user with the given login or email, nil when there is none
+// or when the password is managed elsewhere (LDAP)
+func findPasswordResetUser(repo *dblayer.DBRepository, loginOrEmail string) dblayer.DBEntityInterface {
+	for _, column := range []string{"login", "email"} {
+		search := repo.GetInstanceByTableName("users")
+		search.SetValue(column, loginOrEmail)
+		results, err := repo.Search(search, false, false, "")
+		if err != nil || len(results) != 1 {
+			continue
+		}
+		user := results[0]
+		if email, _ := user.GetValue("email").(string); email == "" {
+			return nil
+		}
+		if getUserLDAP(repo, user.GetValue("id").(string)) != nil {
+			return nil
+		}
+		return user
+	}
+	return nil
+}
+
+// deletePasswordResets deletes the reset links of a user, used or not
+func deletePasswordResets(repo *dblayer.DBRepository, userID string) error {
+	search := repo.GetInstanceByTableName("users_password_resets")
+	search.SetValue("user_id", userID)
+	resets, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return err
+	}
+	for _, reset := range resets {
+		if _, err := repo.Delete(reset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForgotPasswordHandler godoc
+// @Summary Request a password reset
+// @Description Emails a single-use link to reset the password of the account with the given login or email.
+// @Description The answer is always the same, whether the account exists or not.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body ForgotPasswordRequest true "Login or email"
+// @Success 202 {object} map[string]string "Reset email sent if the account exists"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 429 {object} ErrorResponse "Too many requests"
+// @Router /password/forgot [post]
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	req.Login = strings.TrimSpace(req.Login)
+	if req.Login == "" {
+		RespondError(w, ErrMissingField, "Field is required", map[string]string{"field": "login"}, http.StatusBadRequest)
+		return
+	}
+	if retryAfter, err := passwordResetQuota.Acquire([]string{"ip:" + clientIP(r), "account:" + strings.ToLower(req.Login)}); err != nil {
+		log.Printf("ForgotPasswordHandler: %v for %s", err, clientIP(r))
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+		RespondSimpleError(w, ErrRateLimited, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	repo := dblayer.NewSystemRepository("password reset", passwordResetTables...)
+
+	if user := findPasswordResetUser(repo, req.Login); user != nil {
+		if err := sendPasswordReset(repo, r, user); err != nil {
+			// Logged only: the answer must not tell that the account exists
+			log.Print("ForgotPasswordHandler: ", err)
+		}
+	} else {
+		log.Printf("ForgotPasswordHandler: no account for %q", req.Login)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a reset link has been sent to its email"})
+}
+
+// sendPasswordReset replaces the reset links of a user with a new one and emails it
+func sendPasswordReset(repo *dblayer.DBRepository, r *http.Request, user dblayer.DBEntityInterface) error {
+	userID := user.GetValue("id").(string)
+	if err := deletePasswordResets(repo, userID); err != nil {
+		return err
+	}
+	ipAddress := clientIP(r)
+	if len(ipAddress) > 64 {
+		ipAddress = ipAddress[:64]
+	}
+	token := randomToken(32)
+	now := time.Now()
+	reset := repo.GetInstanceByTableName("users_password_resets")
+	reset.SetValue("token_hash", hashPasswordResetToken(token))
+	reset.SetValue("user_id", userID)
+	reset.SetValue("ip_address", ipAddress)
+	reset.SetValue("created_at", dbTime(now))
+	reset.SetValue("expires_at", dbTime(now.Add(PasswordResetTokenDuration)))
+	if _, err := repo.Insert(reset); err != nil {
+		return err
+	}
+
+	fullname, _ := user.GetValue("fullname").(string)
+	return sendTemplateMail(user.GetValue("email").(string), "password_reset", r.Header.Get("Accept-Language"), map[string]any{
+		"Fullname": fullname,
+		"Link":     strings.TrimRight(publicURL, "/") + "/password/reset?token=" + url.QueryEscape(token),
+		"Minutes":  int(PasswordResetTokenDuration.Minutes()),
+	})
+}
+
+// ResetPasswordHandler godoc
+// @Summary Reset the password
+// @Description Sets a new password with the token of a reset link. The link works once,
+// @Description and all the sessions of the user are logged out.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body ResetPasswordRequest true "Token and new password"
+// @Success 200 {object} map[string]string "Password changed"
+// @Failure 400 {object} ErrorResponse "Invalid or expired token, or password too short"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /password/reset [post]
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if len(req.Pwd) < minPasswordLength {
+		RespondError(w, ErrPasswordTooShort, "Password too short", map[string]string{"min": fmt.Sprint(minPasswordLength)}, http.StatusBadRequest)
+		return
+	}
+
+	repo := dblayer.NewSystemRepository("password reset", passwordResetTables...)
+
+	search := repo.GetInstanceByTableName("users_password_resets")
+	search.SetValue("token_hash", hashPasswordResetToken(req.Token))
+	resets, err := repo.Search(search, false, false, "")
+	if err != nil || len(resets) != 1 {
+		RespondSimpleError(w, ErrInvalidToken, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	reset := resets[0]
+	expiresAt, ok := parseDBTime(reset.GetValue("expires_at"))
+	if _, used := parseDBTime(reset.GetValue("used_at")); used || !ok || time.Now().After(expiresAt) {
+		RespondSimpleError(w, ErrInvalidToken, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	userID := reset.GetValue("user_id").(string)
+
+	// Used before the password changes: the same link cannot be replayed even if the update fails.
+	// Of two requests with the same link only one marks it used
+	used, err := repo.UsePasswordReset(reset, dbTime(time.Now()))
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to reset the password", http.StatusInternalServerError)
+		return
+	}
+	if !used {
+		RespondSimpleError(w, ErrInvalidToken, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	user := repo.GetInstanceByTableName("users").(*dblayer.DBUser)
+	user.SetValue("id", userID)
+	if err := user.HashPassword(req.Pwd); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to reset the password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := repo.Update(user); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to reset the password", http.StatusInternalServerError)
+		return
+	}
+	RevokeUserTokens(repo, userID)
+	if err := deletePasswordResets(repo, userID); err != nil {
+		log.Print("ResetPasswordHandler: ", err)
+	}
+	log.Printf("ResetPasswordHandler: password of user %s reset from %s", userID, clientIP(r))
+
+	login, _ := getLogin(repo, userID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed", "login": login})
+}
+
+// PurgeExpiredPasswordResets deletes the reset links that cannot be used anymore
+func PurgeExpiredPasswordResets(repo *dblayer.DBRepository) (int, error) {
+	search := repo.GetInstanceByTableName("users_password_resets")
+	search.SetValue("expires_at", []string{"", dbTime(time.Now())})
+	resets, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return 0, err
+	}
+	for i, reset := range resets {
+		if _, err := repo.Delete(reset); err != nil {
+			return i, err
+		}
+	}
+	return len(resets), nil
+}
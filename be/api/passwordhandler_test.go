@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test -v ./api -run TestPasswordReset
+func TestPasswordReset(t *testing.T) {
+	previousQuota, previousMail := passwordResetQuota, sendMail
+	passwordResetQuota = NewQuota(0, 0)
+	var links []string
+	sendMail = func(to string, subject string, body string) error {
+		for _, line := range strings.Split(body, "\n") {
+			if strings.Contains(line, "/password/reset?token=") {
+				links = append(links, line)
+			}
+		}
+		return nil
+	}
+	t.Cleanup(func() { passwordResetQuota, sendMail = previousQuota, previousMail })
+
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	login := "reset" + Random4digits()
+	email := login + "@example.com"
+	user, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    login,
+		"pwd":      "old-password",
+		"fullname": "Reset user",
+		"email":    email,
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer adminRepo.Delete(user)
+	userID := user.GetValue("id").(string)
+
+	post := func(handler http.HandlerFunc, payload any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body)))
+		return rr
+	}
+	loginWith := func(pwd string) int {
+		return post(LoginHandler, Credentials{Login: login, Pwd: pwd}).Code
+	}
+	tokenOf := func(link string) string {
+		u, _ := url.Parse(strings.TrimSpace(link))
+		return u.Query().Get("token")
+	}
+
+	// A session to be logged out by the reset
+	session, err := StartSession(adminRepo, httptest.NewRequest(http.MethodPost, "/", nil), userID, login, []string{}, "password")
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+
+	// 1. Unknown and known accounts get the same answer
+	unknown := post(ForgotPasswordHandler, ForgotPasswordRequest{Login: "nobody" + login})
+	known := post(ForgotPasswordHandler, ForgotPasswordRequest{Login: email})
+	if unknown.Code != http.StatusAccepted || known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Fatalf("Expected the same answer, got %v %s and %v %s", unknown.Code, unknown.Body.String(), known.Code, known.Body.String())
+	}
+	if len(links) != 1 {
+		t.Fatalf("Expected one reset link, got %v", links)
+	}
+	// The token is stored hashed
+	stored := adminRepo.GetInstanceByTableName("users_password_resets")
+	stored.SetValue("user_id", userID)
+	resets, _ := adminRepo.Search(stored, false, false, "")
+	if len(resets) != 1 || resets[0].GetValue("token_hash") != hashPasswordResetToken(tokenOf(links[0])) {
+		t.Fatalf("Expected the hash of the token, got %v", resets)
+	}
+
+	// 2. A new request replaces the previous link
+	post(ForgotPasswordHandler, ForgotPasswordRequest{Login: login})
+	if len(links) != 2 {
+		t.Fatalf("Expected a second reset link, got %v", links)
+	}
+	if rr := post(ResetPasswordHandler, ResetPasswordRequest{Token: tokenOf(links[0]), Pwd: "new-password"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the replaced link to be refused, got %v", rr.Code)
+	}
+	token := tokenOf(links[1])
+	if rr := post(ResetPasswordHandler, ResetPasswordRequest{Token: token, Pwd: "short"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a short password to be refused, got %v", rr.Code)
+	}
+
+	// 3. The link changes the password and logs out everywhere
+	if rr := post(ResetPasswordHandler, ResetPasswordRequest{Token: token, Pwd: "new-password"}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the password to be reset, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if code := loginWith("old-password"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected the old password to be refused, got %v", code)
+	}
+	if code := loginWith("new-password"); code != http.StatusOK {
+		t.Fatalf("Expected the new password to work, got %v", code)
+	}
+	if IsTokenValid(adminRepo, session.AccessToken, userID) {
+		t.Fatalf("Expected the access token of the old session to be revoked")
+	}
+	if _, err := RefreshTokens(adminRepo, session.RefreshToken); err == nil {
+		t.Fatalf("Expected the refresh token of the old session to be revoked")
+	}
+	// The link works once
+	if rr := post(ResetPasswordHandler, ResetPasswordRequest{Token: token, Pwd: "another-password"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a used link to be refused, got %v", rr.Code)
+	}
+
+	// 4. Expired links are refused and purged
+	post(ForgotPasswordHandler, ForgotPasswordRequest{Login: login})
+	expired := adminRepo.GetInstanceByTableName("users_password_resets")
+	expired.SetValue("token_hash", hashPasswordResetToken(tokenOf(links[2])))
+	expired.SetValue("expires_at", dbTime(time.Now().Add(-time.Minute)))
+	adminRepo.Update(expired)
+	if rr := post(ResetPasswordHandler, ResetPasswordRequest{Token: tokenOf(links[2]), Pwd: "another-password"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an expired link to be refused, got %v", rr.Code)
+	}
+	if purged, err := PurgeExpiredPasswordResets(adminRepo); err != nil || purged < 1 {
+		t.Fatalf("Expected the expired link to be purged, got %v %v", purged, err)
+	}
+
+	// 5. Two requests that both found the link unused: only one uses it
+	post(ForgotPasswordHandler, ForgotPasswordRequest{Login: login})
+	pending := adminRepo.GetInstanceByTableName("users_password_resets")
+	pending.SetValue("token_hash", hashPasswordResetToken(tokenOf(links[3])))
+	found, err := adminRepo.Search(pending, false, false, "")
+	if err != nil || len(found) != 1 {
+		t.Fatalf("Expected the new link, got %v %v", found, err)
+	}
+	if used, err := adminRepo.UsePasswordReset(found[0], dbTime(time.Now())); err != nil || !used {
+		t.Fatalf("Expected the first request to use the link, got %v %v", used, err)
+	}
+	if used, err := adminRepo.UsePasswordReset(found[0], dbTime(time.Now())); err != nil || used {
+		t.Fatalf("Expected the second request to be refused, got %v %v", used, err)
+	}
+	if rr := post(ResetPasswordHandler, ResetPasswordRequest{Token: tokenOf(links[3]), Pwd: "another-password"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a used link to be refused, got %v", rr.Code)
+	}
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"rprj/be/dblayer"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AnonymousUserID and GuestsGroupID are the user and the group of the requests without a valid token
+const AnonymousUserID = "-7"
+const GuestsGroupID = "-4"
+
+// WebmasterGroupID is the group of the pages of the site
+const WebmasterGroupID = "-6"
+
+// Principal is the caller of a request: a logged-in user, or the anonymous user
+type Principal struct {
+	UserID   string
+	Login    string
+	GroupIDs []string
+	Token    string // the access token, the API key or the share link, empty for the anonymous user
+
+	APIKeyID string               // set when the request is authenticated with a personal API key
+	ShareID  string               // set when the request comes through a share link
+	Scope    *dblayer.AccessScope // what the API key or the share link reaches
+
+	capabilitiesOnce sync.Once
+	capabilities     []string // of its groups, loaded by Can
+}
+
+// anonymousPrincipal returns the caller of the requests without a valid token
+func anonymousPrincipal() *Principal {
+	return &Principal{UserID: AnonymousUserID, GroupIDs: []string{GuestsGroupID}}
+}
+
+// IsAnonymous tells whether the request has no valid token
+func (p *Principal) IsAnonymous() bool {
+	return p.Token == ""
+}
+
+// DBContext returns the context of the caller for the repositories
+func (p *Principal) DBContext() *dblayer.DBContext {
+	return &dblayer.DBContext{
+		UserID:   p.UserID,
+		GroupIDs: slices.Clone(p.GroupIDs),
+		Schema:   dblayer.DbSchema,
+		Scope:    p.Scope,
+	}
+}
+
+// IsAPIKey tells whether the request is authenticated with a personal API key
+func (p *Principal) IsAPIKey() bool {
+	return p.APIKeyID != ""
+}
+
+var errMissingAuthorization = errors.New("missing Authorization header")
+var errInvalidAuthorization = errors.New("invalid Authorization header format")
+var errInvalidToken = errors.New("invalid or expired token")
+var errUnknownToken = errors.New("token not recognized")
+
+// resolvePrincipal validates the bearer token of the request, the JWT and its record in oauth_tokens,
+// or the personal API key, and returns the user it was issued to
+func resolvePrincipal(r *http.Request) (*Principal, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, errMissingAuthorization
+	}
+	// it must be in the format "Bearer <token>"
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return nil, errInvalidAuthorization
+	}
+	tokenString := parts[1]
+	if strings.HasPrefix(tokenString, APIKeyPrefix) {
+		return resolveAPIKey(r, tokenString)
+	}
+
+	repo := dblayer.NewSystemRepository("token validation", tokenTables...).WithContext(r.Context())
+
+	claims := jwt.MapClaims{}
+	token, err := jwtKeyring.Parse(tokenString, claims)
+	if err != nil || !token.Valid {
+		// An expired access token is renewed with its refresh token: the session goes on
+		return nil, errInvalidToken
+	}
+	userID, _ := claims["user_id"].(string)
+	if userID == "" {
+		return nil, errInvalidToken
+	}
+
+	// Logged out, rotated and revoked tokens are still valid JWTs
+	if !IsTokenValid(repo, tokenString, userID) {
+		return nil, errUnknownToken
+	}
+
+	principal := &Principal{UserID: userID, Token: tokenString}
+	principal.Login, _ = claims["login"].(string)
+	if groups, _ := claims["groups"].(string); groups != "" {
+		principal.GroupIDs = strings.Split(groups, ",")
+	}
+	return principal, nil
+}
+
+type requestContextKey int
+
+const (
+	principalKey requestContextKey = iota
+	repositoryKey
+)
+
+// withPrincipal stores the caller, and a repository of its own, in the context of the request.
+// The queries of the repository are cancelled when the client disconnects.
+func withPrincipal(r *http.Request, principal *Principal) *http.Request {
+	repo := dblayer.NewDBRepository(principal.DBContext(), dblayer.Factory, dblayer.DbConnection).WithContext(r.Context())
+	repo.Verbose = false
+	ctx := context.WithValue(r.Context(), principalKey, principal)
+	ctx = context.WithValue(ctx, repositoryKey, repo)
+	return r.WithContext(ctx)
+}
+
+// OptionalAuthMiddleware resolves the caller of the public routes: the user of a valid token, the anonymous user otherwise
+func OptionalAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, resolveRequest(r))
+	})
+}
+
+// resolveRequest returns the request with its caller in the context: as it is behind AuthMiddleware
+// and OptionalAuthMiddleware, otherwise validating the token here, the anonymous user when it is missing or not valid
+func resolveRequest(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(principalKey).(*Principal); ok {
+		return r
+	}
+	principal, err := resolvePrincipal(r)
+	if err != nil {
+		principal = anonymousPrincipal()
+	}
+	return withPrincipal(r, principal)
+}
+
+// PrincipalFromRequest returns the caller of the request
+func PrincipalFromRequest(r *http.Request) *Principal {
+	principal, _ := callerOf(r)
+	return principal
+}
+
+// RepositoryFromRequest returns a repository acting as the caller of the request,
+// whose queries are cancelled when the client disconnects
+func RepositoryFromRequest(r *http.Request) *dblayer.DBRepository {
+	_, repo := callerOf(r)
+	return repo
+}
+
+// callerOf returns the caller of the request and its repository
+func callerOf(r *http.Request) (*Principal, *dblayer.DBRepository) {
+	ctx := resolveRequest(r).Context()
+	return ctx.Value(principalKey).(*Principal), ctx.Value(repositoryKey).(*dblayer.DBRepository)
+}
+
+// authenticatedRequest returns the caller of the request and its repository, and answers 401 to the anonymous user
+func authenticatedRequest(w http.ResponseWriter, r *http.Request) (*Principal, *dblayer.DBRepository, bool) {
+	principal, repo := callerOf(r)
+	if principal.IsAnonymous() {
+		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	return principal, repo, true
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// go test -v ./api -run TestPrincipalMiddleware
+func TestPrincipalMiddleware(t *testing.T) {
+	body, _ := json.Marshal(Credentials{Login: testAdminLogin, Pwd: testAdminPwd})
+	loginReq := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+	loginRR := httptest.NewRecorder()
+	LoginHandler(loginRR, loginReq)
+	var tokens TokenResponse
+	if err := json.Unmarshal(loginRR.Body.Bytes(), &tokens); err != nil || tokens.AccessToken == "" {
+		t.Fatalf("Login failed: %s", loginRR.Body.String())
+	}
+
+	// serve returns the caller seen by the handler, nil when the middleware answered
+	serve := func(middleware func(http.Handler) http.Handler, token string) (*Principal, int) {
+		var seen *Principal
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = PrincipalFromRequest(r)
+			if RepositoryFromRequest(r).DbContext.UserID != seen.UserID {
+				t.Errorf("Expected the repository of %s, got %s", seen.UserID, RepositoryFromRequest(r).DbContext.UserID)
+			}
+		})).ServeHTTP(rr, req)
+		return seen, rr.Code
+	}
+
+	principal, _ := serve(OptionalAuthMiddleware, "")
+	if principal == nil || !principal.IsAnonymous() || principal.UserID != AnonymousUserID {
+		t.Fatalf("Expected the anonymous user without a token, got %+v", principal)
+	}
+	principal, code := serve(AuthMiddleware, "")
+	if principal != nil || code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without a token, got %d", code)
+	}
+
+	principal, _ = serve(OptionalAuthMiddleware, tokens.AccessToken)
+	if principal == nil || principal.IsAnonymous() || principal.UserID != testUser.GetValue("id") || principal.Login != testAdminLogin {
+		t.Fatalf("Expected the test user, got %+v", principal)
+	}
+	principal, _ = serve(AuthMiddleware, tokens.AccessToken)
+	if principal == nil || principal.UserID != testUser.GetValue("id") {
+		t.Fatalf("Expected the test user, got %+v", principal)
+	}
+
+	// Handlers not behind a middleware resolve the caller themselves
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	if PrincipalFromRequest(req).UserID != testUser.GetValue("id") {
+		t.Fatal("Expected the test user without the middleware")
+	}
+
+	// The repository is cancelled with the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	repo := RepositoryFromRequest(req.WithContext(ctx))
+	if _, err := repo.Search(repo.GetInstanceByTableName("users"), false, false, ""); err == nil {
+		t.Fatal("Expected the queries of a cancelled request to fail")
+	}
+
+	// After the logout the token, still a valid JWT, is the anonymous user's
+	logoutReq := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	logoutReq.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	logoutRR := httptest.NewRecorder()
+	AuthMiddleware(http.HandlerFunc(LogoutHandler)).ServeHTTP(logoutRR, logoutReq)
+	if logoutRR.Code != http.StatusOK {
+		t.Fatalf("Logout failed: %d %s", logoutRR.Code, logoutRR.Body.String())
+	}
+	principal, _ = serve(OptionalAuthMiddleware, tokens.AccessToken)
+	if principal == nil || !principal.IsAnonymous() {
+		t.Fatalf("Expected the anonymous user after the logout, got %+v", principal)
+	}
+	if _, code := serve(AuthMiddleware, tokens.AccessToken); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 after the logout, got %d", code)
+	}
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rprj/be/dblayer"
+	"rprj/be/models"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RateLimitStore keeps the state of the keys of the rate limits: Update must read, change and write
+// a key atomically, and must not write when update returns a state not Found.
+type RateLimitStore interface {
+	Update(key string, update func(state dblayer.RateLimitState) dblayer.RateLimitState) (dblayer.RateLimitState, error)
+}
+
+// memoryRateLimitStore keeps the keys in memory: they restart with the server and every instance has its own
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	states    map[string]dblayer.RateLimitState
+	lastPurge time.Time
+}
+
+func (s *memoryRateLimitStore) Update(key string, update func(state dblayer.RateLimitState) dblayer.RateLimitState) (dblayer.RateLimitState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	// Keys not used for a day are forgotten, as PurgeRateLimits does for the sql store
+	if now.Sub(s.lastPurge) >= time.Hour {
+		for k, state := range s.states {
+			if now.Sub(state.At) >= 24*time.Hour {
+				delete(s.states, k)
+			}
+		}
+		s.lastPurge = now
+	}
+	state := update(s.states[key])
+	if state.Found {
+		s.states[key] = state
+	}
+	return state, nil
+}
+
+// sqlRateLimitStore keeps the keys in the rate_limits table, shared by the instances using the same DB
+type sqlRateLimitStore struct{}
+
+func (s sqlRateLimitStore) Update(key string, update func(state dblayer.RateLimitState) dblayer.RateLimitState) (dblayer.RateLimitState, error) {
+	return dblayer.NewSystemRepository("rate limits", rateLimitTables...).UpdateRateLimit(key, update)
+}
+
+// RateLimiter limits the requests with token buckets per IP and per user, and locks the accounts
+// after too many failed logins
+type RateLimiter struct {
+	Config models.RateLimitConfig
+	Store  RateLimitStore
+
+	now func() time.Time
+}
+
+// rateLimiter is used by RateLimitMiddleware and LoginHandler (set by InitAPI)
+var rateLimiter = NewRateLimiter(models.RateLimitConfig{})
+
+func NewRateLimiter(config models.RateLimitConfig) *RateLimiter {
+	var store RateLimitStore = &memoryRateLimitStore{states: map[string]dblayer.RateLimitState{}}
+	if config.Store == "sql" {
+		store = sqlRateLimitStore{}
+	} else if config.Store != "" && config.Store != "memory" {
+		log.Printf("RateLimiter: unknown store %q, using memory", config.Store)
+	}
+	return &RateLimiter{Config: config, Store: store, now: time.Now}
+}
+
+// rateLimitResult is the state of a bucket after a request
+type rateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next request is allowed, when not allowed
+}
+
+// budget returns the name and the budget of the endpoint of a path, the name is part of the keys of its buckets
+func (l *RateLimiter) budget(path string) (string, models.RateLimitBudget) {
+	switch {
+	case path == "/login" || strings.HasPrefix(path, "/login/"):
+		return "login", l.Config.Login
+	case strings.HasPrefix(path, "/oauth/"):
+		return "oauth", l.Config.OAuth
+	case path == "/ollama" || strings.HasPrefix(path, "/ollama/"):
+		return "ollama", l.Config.Ollama
+	case strings.HasPrefix(path, "/files/") && strings.HasSuffix(path, "/download"):
+		return "download", l.Config.Download
+	case strings.HasPrefix(path, "/share/") && (l.Config.Share.IP.PerMinute > 0 || l.Config.Share.User.PerMinute > 0):
+		// Every link has its own buckets: the guesses of the password of a link do not spend those of the others
+		token, _, _ := strings.Cut(strings.TrimPrefix(path, "/share/"), "/")
+		return "share:" + hashShareToken(token)[:16], l.Config.Share
+	}
+	return "default", l.Config.Default
+}
+
+// take takes a token from the bucket of a key
+func (l *RateLimiter) take(key string, bucket models.RateLimitBucket) (rateLimitResult, error) {
+	burst := bucket.Burst
+	if burst <= 0 {
+		burst = max(int(math.Ceil(bucket.PerMinute)), 1)
+	}
+	perSecond := bucket.PerMinute / 60
+	now := l.now()
+	result := rateLimitResult{Limit: burst}
+	state, err := l.Store.Update(key, func(state dblayer.RateLimitState) dblayer.RateLimitState {
+		if !state.Found {
+			state = dblayer.RateLimitState{Tokens: float64(burst), Found: true}
+		} else if elapsed := now.Sub(state.At).Seconds(); elapsed > 0 {
+			state.Tokens = math.Min(float64(burst), state.Tokens+elapsed*perSecond)
+		}
+		state.At = now
+		result.Allowed = state.Tokens >= 1
+		if result.Allowed {
+			state.Tokens--
+		}
+		return state
+	})
+	if err != nil {
+		return result, err
+	}
+	result.Remaining = int(state.Tokens)
+	result.Reset = time.Duration((float64(burst) - state.Tokens) / perSecond * float64(time.Second))
+	if !result.Allowed {
+		result.RetryAfter = time.Duration((1 - state.Tokens) / perSecond * float64(time.Second))
+	}
+	return result, nil
+}
+
+// rateLimitUser returns the user of the token of a request, without looking it up in the DB:
+// an expired or revoked token only costs the bucket of someone who already had it.
+// API keys are counted by key.
+func rateLimitUser(r *http.Request) string {
+	tokenString, err := GetTokenFromRequest(r)
+	if err != nil || tokenString == "" {
+		return ""
+	}
+	if strings.HasPrefix(tokenString, APIKeyPrefix) {
+		return "key:" + hashAPIKey(tokenString)[:16]
+	}
+	claims := jwt.MapClaims{}
+	token, err := jwtKeyring.Parse(tokenString, claims)
+	if err != nil || !token.Valid {
+		return ""
+	}
+	userID, _ := claims["user_id"].(string)
+	return userID
+}
+
+// RateLimitMiddleware limits the requests of every IP and of every user with the budget of the endpoint.
+// The X-RateLimit-* headers describe the most restrictive of the buckets.
+func RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := rateLimiter
+		name, budget := limiter.budget(r.URL.Path)
+		var worst *rateLimitResult
+		check := func(key string, bucket models.RateLimitBucket) {
+			if bucket.PerMinute <= 0 {
+				return
+			}
+			result, err := limiter.take(key, bucket)
+			if err != nil {
+				// A failing store does not stop the API
+				log.Print("RateLimitMiddleware: ", err)
+				return
+			}
+			if worst == nil || (worst.Allowed && !result.Allowed) || (worst.Allowed == result.Allowed && result.Remaining < worst.Remaining) {
+				worst = &result
+			}
+		}
+		check("ip:"+name+":"+clientIP(r), budget.IP)
+		if budget.User.PerMinute > 0 {
+			if user := rateLimitUser(r); user != "" {
+				check("user:"+name+":"+user, budget.User)
+			}
+		}
+		if worst != nil {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(worst.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(worst.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(worst.Reset.Seconds()))))
+			if !worst.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(worst.RetryAfter.Seconds())+1))
+				RespondSimpleError(w, ErrRateLimited, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/* *** Lockout of the accounts *** */
+
+func lockoutKey(login string) string {
+	return "lockout:" + strings.ToLower(strings.TrimSpace(login))
+}
+
+// LoginLocked returns how long the account is still locked, 0 when it is not
+func (l *RateLimiter) LoginLocked(login string) time.Duration {
+	if l.Config.LockoutThreshold <= 0 || login == "" {
+		return 0
+	}
+	state, err := l.Store.Update(lockoutKey(login), func(state dblayer.RateLimitState) dblayer.RateLimitState {
+		return state
+	})
+	if err != nil {
+		log.Print("LoginLocked: ", err)
+		return 0
+	}
+	if state.Count < l.Config.LockoutThreshold {
+		return 0
+	}
+	return max(state.At.Sub(l.now()), 0)
+}
+
+// LoginFailed counts a failed login of the account, locking it from the LockoutThreshold-th failure:
+// for LockoutSeconds, doubled at every further failure up to LockoutMaxSeconds
+func (l *RateLimiter) LoginFailed(login string) {
+	if l.Config.LockoutThreshold <= 0 || login == "" {
+		return
+	}
+	lockout := time.Duration(max(l.Config.LockoutSeconds, 1)) * time.Second
+	maxLockout := time.Duration(l.Config.LockoutMaxSeconds) * time.Second
+	if maxLockout <= 0 {
+		maxLockout = 24 * time.Hour
+	}
+	now := l.now()
+	_, err := l.Store.Update(lockoutKey(login), func(state dblayer.RateLimitState) dblayer.RateLimitState {
+		state.Found = true
+		state.Count++
+		state.At = now
+		if state.Count >= l.Config.LockoutThreshold {
+			d := lockout
+			for i := l.Config.LockoutThreshold; i < state.Count && d < maxLockout; i++ {
+				d *= 2
+			}
+			state.At = now.Add(min(d, maxLockout))
+		}
+		return state
+	})
+	if err != nil {
+		log.Print("LoginFailed: ", err)
+	}
+}
+
+// LoginSucceeded forgets the failed logins of the account
+func (l *RateLimiter) LoginSucceeded(login string) {
+	if l.Config.LockoutThreshold <= 0 || login == "" {
+		return
+	}
+	now := l.now()
+	_, err := l.Store.Update(lockoutKey(login), func(state dblayer.RateLimitState) dblayer.RateLimitState {
+		if !state.Found {
+			return state
+		}
+		return dblayer.RateLimitState{At: now, Found: true}
+	})
+	if err != nil {
+		log.Print("LoginSucceeded: ", err)
+	}
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"rprj/be/dblayer"
+	"rprj/be/models"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestRateLimits
+func TestRateLimits(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	login := "ratelimit" + Random4digits()
+	user, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    login,
+		"pwd":      "ratelimit-password",
+		"fullname": "Rate limit test",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	t.Cleanup(func() { adminRepo.Delete(user) })
+	token := ApiTestDoLogin(t, login, "ratelimit-password")
+
+	savedLimiter := rateLimiter
+	t.Cleanup(func() { rateLimiter = savedLimiter })
+
+	for _, store := range []string{"memory", "sql"} {
+		t.Run(store, func(t *testing.T) {
+			limiter := NewRateLimiter(models.RateLimitConfig{
+				Store:             store,
+				Default:           models.RateLimitBudget{User: models.RateLimitBucket{PerMinute: 60, Burst: 1}},
+				Login:             models.RateLimitBudget{IP: models.RateLimitBucket{PerMinute: 6, Burst: 2}},
+				Share:             models.RateLimitBudget{IP: models.RateLimitBucket{PerMinute: 6, Burst: 1}},
+				LockoutThreshold:  3,
+				LockoutSeconds:    60,
+				LockoutMaxSeconds: 100,
+			})
+			// The sql store keeps the times in milliseconds
+			now := time.Now().Truncate(time.Millisecond)
+			limiter.now = func() time.Time { return now }
+			rateLimiter = limiter
+
+			router := mux.NewRouter()
+			router.Use(RateLimitMiddleware)
+			router.HandleFunc("/login", LoginHandler).Methods("POST")
+			router.HandleFunc("/ping", PingHandler).Methods("GET")
+			router.HandleFunc("/share/{token}", PingHandler).Methods("GET")
+			ip := "192.0.2." + Random4digits()
+			ips := 0
+			call := func(method string, path string, ip string, token string, payload any) *httptest.ResponseRecorder {
+				body, _ := json.Marshal(payload)
+				req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+				req.RemoteAddr = ip + ":1234"
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				return rr
+			}
+			// Every login from another IP, to count only the failures of the account
+			loginAs := func(pwd string) *httptest.ResponseRecorder {
+				ips++
+				return call(http.MethodPost, "/login", ip+"."+strconv.Itoa(ips), "", Credentials{Login: login, Pwd: pwd})
+			}
+			expectCode := func(rr *httptest.ResponseRecorder, status int, code string) {
+				t.Helper()
+				var apiErr APIError
+				json.Unmarshal(rr.Body.Bytes(), &apiErr)
+				if rr.Code != status || apiErr.Code != code {
+					t.Fatalf("Expected %v %s, got %v %s", status, code, rr.Code, rr.Body.String())
+				}
+			}
+
+			// 1. The bucket of the IP for the logins: 2 at once, then one every 10 seconds
+			nobody := Credentials{Login: "nobody" + Random4digits(), Pwd: "wrong"}
+			for remaining := 1; remaining >= 0; remaining-- {
+				rr := call(http.MethodPost, "/login", ip, "", nobody)
+				expectCode(rr, http.StatusUnauthorized, ErrUnauthorized)
+				if rr.Header().Get("X-RateLimit-Limit") != "2" || rr.Header().Get("X-RateLimit-Remaining") != strconv.Itoa(remaining) {
+					t.Fatalf("Unexpected headers %v", rr.Header())
+				}
+			}
+			rr := call(http.MethodPost, "/login", ip, "", nobody)
+			expectCode(rr, http.StatusTooManyRequests, ErrRateLimited)
+			if rr.Header().Get("Retry-After") == "" || rr.Header().Get("X-RateLimit-Reset") != "20" {
+				t.Fatalf("Unexpected headers %v", rr.Header())
+			}
+			now = now.Add(10 * time.Second)
+			expectCode(call(http.MethodPost, "/login", ip, "", nobody), http.StatusUnauthorized, ErrUnauthorized)
+
+			// 2. The account is locked at the third failure, for longer at every further one
+			expectCode(loginAs("wrong"), http.StatusUnauthorized, ErrUnauthorized)
+			expectCode(loginAs("wrong"), http.StatusUnauthorized, ErrUnauthorized)
+			expectCode(loginAs("wrong"), http.StatusUnauthorized, ErrUnauthorized)
+			rr = loginAs("ratelimit-password")
+			expectCode(rr, http.StatusTooManyRequests, ErrAccountLocked)
+			if rr.Header().Get("Retry-After") != "61" {
+				t.Fatalf("Expected to wait 60 seconds, got %v", rr.Header().Get("Retry-After"))
+			}
+			now = now.Add(61 * time.Second)
+			expectCode(loginAs("wrong"), http.StatusUnauthorized, ErrUnauthorized)
+			if locked := limiter.LoginLocked(login); locked != 100*time.Second {
+				t.Fatalf("Expected a lockout of 100 seconds (doubled, at most the maximum), got %v", locked)
+			}
+			now = now.Add(101 * time.Second)
+			if rr := loginAs("ratelimit-password"); rr.Code != http.StatusOK {
+				t.Fatalf("Expected the login after the lockout, got %v %s", rr.Code, rr.Body.String())
+			}
+			expectCode(loginAs("wrong"), http.StatusUnauthorized, ErrUnauthorized)
+			if locked := limiter.LoginLocked(login); locked != 0 {
+				t.Fatalf("Expected the failures forgotten after the login, got %v", locked)
+			}
+			limiter.LoginSucceeded(login)
+
+			// 3. The bucket of the user, anonymous requests are not counted
+			rr = call(http.MethodGet, "/ping", ip, token, nil)
+			if rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Remaining") != "0" {
+				t.Fatalf("Expected the ping with the headers, got %v %v", rr.Code, rr.Header())
+			}
+			expectCode(call(http.MethodGet, "/ping", "198.51.100.1", token, nil), http.StatusTooManyRequests, ErrRateLimited)
+			if rr := call(http.MethodGet, "/ping", ip, "", nil); rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Limit") != "" {
+				t.Fatalf("Expected the anonymous ping without limits, got %v %v", rr.Code, rr.Header())
+			}
+			now = now.Add(time.Second)
+			if rr := call(http.MethodGet, "/ping", ip, token, nil); rr.Code != http.StatusOK {
+				t.Fatalf("Expected the ping after a second, got %v", rr.Code)
+			}
+
+			// 4. Every share link has its own bucket for every IP
+			if rr := call(http.MethodGet, "/share/first", ip, "", nil); rr.Code != http.StatusOK {
+				t.Fatalf("Expected the first visit of the link, got %v", rr.Code)
+			}
+			expectCode(call(http.MethodGet, "/share/first", ip, "", nil), http.StatusTooManyRequests, ErrRateLimited)
+			if rr := call(http.MethodGet, "/share/second", ip, "", nil); rr.Code != http.StatusOK {
+				t.Fatalf("Expected another link not limited, got %v", rr.Code)
+			}
+			if rr := call(http.MethodGet, "/share/first", "198.51.100.2", "", nil); rr.Code != http.StatusOK {
+				t.Fatalf("Expected the link not limited for another IP, got %v", rr.Code)
+			}
+		})
+	}
+
+	// Concurrent requests on the same key of the sql store lose no update
+	limiter := NewRateLimiter(models.RateLimitConfig{Store: "sql", LockoutThreshold: 1000, LockoutSeconds: 1})
+	concurrentLogin := "concurrent" + Random4digits()
+	var wg sync.WaitGroup
+	var written atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// SQLite may answer "table is locked": only the updates that got no error count
+			_, err := limiter.Store.Update(lockoutKey(concurrentLogin), func(state dblayer.RateLimitState) dblayer.RateLimitState {
+				state.Found = true
+				state.Count++
+				return state
+			})
+			if err == nil {
+				written.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	state, err := limiter.Store.Update(lockoutKey(concurrentLogin), func(state dblayer.RateLimitState) dblayer.RateLimitState { return state })
+	if err != nil || written.Load() == 0 || state.Count != int(written.Load()) {
+		t.Fatalf("Expected %d failures, got %d %v", written.Load(), state.Count, err)
+	}
+
+	// The keys of the sql store are purged by the maintenance loop
+	repo := dblayer.NewSystemRepository("test", rateLimitTables...)
+	if purged, err := repo.PurgeRateLimits(time.Now().Add(time.Minute)); err != nil || purged == 0 {
+		t.Fatalf("Expected the rate limits purged, got %d %v", purged, err)
+	}
+}
+
+// go test -v ./api -run TestClientIP
+func TestClientIP(t *testing.T) {
+	savedProxies := trustedProxies
+	t.Cleanup(func() { trustedProxies = savedProxies })
+	trustedProxies = parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "bad"})
+	clientIPOf := func(remoteAddr string, forwardedFor ...string) string {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		req.RemoteAddr = remoteAddr
+		for _, header := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		return clientIP(req)
+	}
+	for _, c := range []struct {
+		ip       string
+		expected string
+	}{
+		// Another peer cannot choose its address
+		{clientIPOf("203.0.113.7:1234", "198.51.100.1"), "203.0.113.7"},
+		// Behind the proxies, the last address they did not add
+		{clientIPOf("10.1.1.1:1234", "198.51.100.1"), "198.51.100.1"},
+		{clientIPOf("192.0.2.1:1234", "6.6.6.6, 198.51.100.1, 10.2.2.2"), "198.51.100.1"},
+		{clientIPOf("10.1.1.1:1234", "6.6.6.6", "198.51.100.2"), "198.51.100.2"},
+		{clientIPOf("10.1.1.1:1234", "10.3.3.3, 10.2.2.2"), "10.3.3.3"},
+		{clientIPOf("10.1.1.1:1234"), "10.1.1.1"},
+	} {
+		if c.ip != c.expected {
+			t.Fatalf("Expected %s, got %s", c.expected, c.ip)
+		}
+	}
+}
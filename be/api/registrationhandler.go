@@ -0,0 +1,311 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RegisterRequest godoc
+// @Description Self-service registration of a new user
+type RegisterRequest struct {
+	Login    string `json:"login"`
+	Pwd      string `json:"pwd"`
+	Fullname string `json:"fullname"`
+	Email    string `json:"email"`
+	Website  string `json:"website"` // honeypot: hidden in the form, only bots fill it
+}
+
+// VerifyRegistrationRequest godoc
+// @Description The token of the link sent by email
+type VerifyRegistrationRequest struct {
+	Token string `json:"token"`
+}
+
+// How long the verification link is valid: after that the unverified user is deleted
+const RegistrationTokenDuration = 24 * time.Hour
+
+// registrationDefaultGroup is the group of the registered users: Guest
+const registrationDefaultGroup = GuestsGroupID
+
+const minPasswordLength = 8
+
+var registrationEnabled = false
+
+// Registrations per hour of every IP and email address (set by InitAPI)
+var registrationQuota = NewQuota(0, 0)
+
+var registrationLoginPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{2,63}$`)
+
+var errEmailNotVerified = errors.New("email not verified")
+
+// registrationKey signs the verification links: a token of another kind cannot be used as a link
+func registrationKey() []byte {
+	return append([]byte("register:"), JWTKey...)
+}
+
+// getUserRegistration returns the registration of a user, nil for the users created otherwise
+func getUserRegistration(repo *dblayer.DBRepository, userID string) *dblayer.UserRegistration {
+	search := repo.GetInstanceByTableName("users_registrations")
+	search.SetValue("user_id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return nil
+	}
+	return results[0].(*dblayer.UserRegistration)
+}
+
+// registrationVerified tells whether the email of a registration has been confirmed
+func registrationVerified(registration *dblayer.UserRegistration) bool {
+	_, ok := parseDBTime(registration.GetValue("verified_at"))
+	return ok
+}
+
+// newRegistrationToken signs the verification link of a user
+func newRegistrationToken(userID string, email string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":   userID,
+		"email": email,
+		"exp":   time.Now().Add(RegistrationTokenDuration).Unix(),
+	})
+	return token.SignedString(registrationKey())
+}
+
+// parseRegistrationToken returns the user and the email of a verification link
+func parseRegistrationToken(tokenString string) (string, string, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return registrationKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", "", err
+	}
+	userID, _ := claims["sub"].(string)
+	email, _ := claims["email"].(string)
+	if userID == "" || email == "" {
+		return "", "", fmt.Errorf("incomplete registration token")
+	}
+	return userID, email, nil
+}
+
+// RegisterHandler godoc
+// @Summary Register a new user
+// @Description Creates a disabled user in the Guest group and sends the verification link to its email.
+// @Description The answer is the same when the login or the email are already taken, not to disclose who has an account.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body RegisterRequest true "New user"
+// @Success 202 {object} map[string]string "Verification email sent"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 404 {object} ErrorResponse "Registration disabled"
+// @Failure 429 {object} ErrorResponse "Too many registrations"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /register [post]
+func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if !registrationEnabled {
+		RespondSimpleError(w, ErrRegistrationDisabled, "Registration disabled", http.StatusNotFound)
+		return
+	}
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	req.Login = strings.TrimSpace(req.Login)
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+
+	accepted := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Check your email to complete the registration"})
+	}
+	// Bots get the answer of a successful registration
+	if req.Website != "" {
+		log.Printf("RegisterHandler: honeypot filled from %s", clientIP(r))
+		accepted()
+		return
+	}
+
+	if !registrationLoginPattern.MatchString(req.Login) {
+		RespondError(w, ErrInvalidField, "Invalid login", map[string]string{"field": "login"}, http.StatusBadRequest)
+		return
+	}
+	if address, err := mail.ParseAddress(req.Email); err != nil || address.Address != req.Email {
+		RespondError(w, ErrInvalidField, "Invalid email", map[string]string{"field": "email"}, http.StatusBadRequest)
+		return
+	}
+	if len(req.Pwd) < minPasswordLength {
+		RespondError(w, ErrPasswordTooShort, "Password too short", map[string]string{"min": fmt.Sprint(minPasswordLength)}, http.StatusBadRequest)
+		return
+	}
+
+	if retryAfter, err := registrationQuota.Acquire([]string{"ip:" + clientIP(r), "email:" + req.Email}); err != nil {
+		log.Printf("RegisterHandler: %v for %s", err, clientIP(r))
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+		RespondSimpleError(w, ErrRateLimited, "Too many registrations", http.StatusTooManyRequests)
+		return
+	}
+
+	repo := dblayer.NewSystemRepository("registration", registrationTables...)
+
+	search := repo.GetInstanceByTableName("users")
+	search.SetValue("login", req.Login)
+	if found, err := repo.Search(search, false, false, ""); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to search users", http.StatusInternalServerError)
+		return
+	} else if len(found) > 0 {
+		log.Printf("RegisterHandler: login %s registered again from %s", req.Login, clientIP(r))
+		accepted()
+		return
+	}
+	search = repo.GetInstanceByTableName("users")
+	search.SetValue("email", req.Email)
+	if found, err := repo.Search(search, false, false, ""); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to search users", http.StatusInternalServerError)
+		return
+	} else if len(found) > 0 {
+		log.Printf("RegisterHandler: email of user %s registered again", found[0].GetValue("login"))
+		accepted()
+		return
+	}
+
+	fullname := strings.TrimSpace(req.Fullname)
+	if fullname == "" {
+		fullname = req.Login
+	}
+	ipAddress := clientIP(r)
+	if len(ipAddress) > 64 {
+		ipAddress = ipAddress[:64]
+	}
+	user := repo.GetInstanceByTableName("users")
+	user.SetValue("login", req.Login)
+	user.SetValue("pwd", req.Pwd)
+	user.SetValue("fullname", fullname)
+	user.SetValue("email", req.Email)
+	user.SetMetadata("group_ids", []string{registrationDefaultGroup})
+	registration := repo.GetInstanceByTableName("users_registrations")
+	registration.SetValue("email", req.Email)
+	registration.SetValue("ip_address", ipAddress)
+	registration.SetValue("created_at", dbTime(time.Now()))
+	// Disabled from the start, until the email is verified
+	status := newUserStatus(repo, "", false, disabledByRegistration)
+	created, err := repo.InsertRegisteredUser(user, registration, status)
+	if err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			log.Printf("RegisterHandler: login %s registered concurrently from %s", req.Login, ipAddress)
+			accepted()
+		} else {
+			RespondSimpleError(w, ErrInternalServer, "Failed to create user", http.StatusInternalServerError)
+		}
+		return
+	}
+	userID := created.GetValue("id").(string)
+
+	token, err := newRegistrationToken(userID, req.Email)
+	if err == nil {
+		err = sendTemplateMail(req.Email, "registration_verify", r.Header.Get("Accept-Language"), map[string]any{
+			"Fullname": fullname,
+			"Link":     strings.TrimRight(publicURL, "/") + "/register/verify?token=" + url.QueryEscape(token),
+			"Hours":    int(RegistrationTokenDuration.Hours()),
+		})
+	}
+	if err != nil {
+		log.Print("RegisterHandler: failed to send the verification email: ", err)
+		repo.Delete(created)
+		RespondSimpleError(w, ErrInternalServer, "Failed to send the verification email", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("RegisterHandler: registered user %s from %s", req.Login, ipAddress)
+	accepted()
+}
+
+// VerifyRegistrationHandler godoc
+// @Summary Confirm the email of a registration
+// @Description Enables the user of the verification link. Confirming twice is not an error.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body VerifyRegistrationRequest true "Token of the link"
+// @Success 200 {object} map[string]string "Registration confirmed"
+// @Failure 400 {object} ErrorResponse "Invalid or expired token"
+// @Failure 500 {object} ErrorResponse "Internal server error"
+// @Router /register/verify [post]
+func VerifyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	var req VerifyRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	userID, email, err := parseRegistrationToken(req.Token)
+	if err != nil {
+		RespondSimpleError(w, ErrInvalidToken, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+
+	repo := dblayer.NewSystemRepository("registration", registrationTables...)
+
+	registration := getUserRegistration(repo, userID)
+	if registration == nil || registration.GetValue("email") != email {
+		RespondSimpleError(w, ErrInvalidToken, "Invalid or expired link", http.StatusBadRequest)
+		return
+	}
+	if !registrationVerified(registration) {
+		update := repo.GetInstanceByTableName("users_registrations")
+		update.SetValue("user_id", userID)
+		update.SetValue("verified_at", dbTime(time.Now()))
+		if _, err := repo.Update(update); err != nil {
+			RespondSimpleError(w, ErrInternalServer, "Failed to confirm the registration", http.StatusInternalServerError)
+			return
+		}
+	}
+	// A user disabled meanwhile by an admin stays disabled
+	if enabled, reason := userEnabled(getUserStatus(repo, userID)); !enabled && reason == disabledByRegistration {
+		if err := setUserEnabled(repo, userID, true, ""); err != nil {
+			RespondSimpleError(w, ErrInternalServer, "Failed to confirm the registration", http.StatusInternalServerError)
+			return
+		}
+	}
+	login, _ := getLogin(repo, userID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Registration confirmed", "login": login})
+}
+
+// PurgeExpiredRegistrations deletes the users that did not confirm their email in time, unless enabled by an admin
+func PurgeExpiredRegistrations(repo *dblayer.DBRepository) (int, error) {
+	search := repo.GetInstanceByTableName("users_registrations")
+	search.SetValue("created_at", []string{"", dbTime(time.Now().Add(-RegistrationTokenDuration))})
+	registrations, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, registration := range registrations {
+		if registrationVerified(registration.(*dblayer.UserRegistration)) {
+			continue
+		}
+		// Enabled by an admin without the link
+		userID := registration.GetValue("user_id").(string)
+		if enabled, _ := userEnabled(getUserStatus(repo, userID)); enabled {
+			continue
+		}
+		user := repo.GetInstanceByTableName("users")
+		user.SetValue("id", userID)
+		if _, err := repo.Delete(user); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test -v ./api -run TestRegistration
+func TestRegistration(t *testing.T) {
+	previousEnabled, previousQuota, previousMail := registrationEnabled, registrationQuota, sendMail
+	registrationEnabled = true
+	registrationQuota = NewQuota(3, 0)
+	var links []string
+	sendMail = func(to string, subject string, body string) error {
+		for _, line := range strings.Split(body, "\n") {
+			if strings.Contains(line, "/register/verify?token=") {
+				links = append(links, line)
+			}
+		}
+		return nil
+	}
+	t.Cleanup(func() {
+		registrationEnabled, registrationQuota, sendMail = previousEnabled, previousQuota, previousMail
+	})
+
+	login := "reg" + Random4digits()
+	email := login + "@example.com"
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	t.Cleanup(func() {
+		search := adminRepo.GetInstanceByTableName("users")
+		search.SetValue("login", login)
+		users, _ := adminRepo.Search(search, false, false, "")
+		for _, user := range users {
+			adminRepo.Delete(user)
+		}
+	})
+
+	post := func(handler http.HandlerFunc, path string, payload any, ip string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(body))
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	loginWith := func(pwd string) *httptest.ResponseRecorder {
+		return post(LoginHandler, "/login", Credentials{Login: login, Pwd: pwd}, "192.0.2.1")
+	}
+
+	// 1. Invalid requests
+	if rr := post(RegisterHandler, "/register", RegisterRequest{Login: login, Email: "not an email", Pwd: "long-enough"}, "192.0.2.1"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid email to be refused, got %v", rr.Code)
+	}
+	if rr := post(RegisterHandler, "/register", RegisterRequest{Login: login, Email: email, Pwd: "short"}, "192.0.2.1"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a short password to be refused, got %v", rr.Code)
+	}
+	// The honeypot looks like a success and creates nothing
+	if rr := post(RegisterHandler, "/register", RegisterRequest{Login: login, Email: email, Pwd: "long-enough", Website: "http://spam"}, "192.0.2.2"); rr.Code != http.StatusAccepted || len(links) != 0 {
+		t.Fatalf("Expected the honeypot to be ignored, got %v %v", rr.Code, links)
+	}
+
+	// 2. The user is created disabled, in Guest, and receives the link
+	if rr := post(RegisterHandler, "/register", RegisterRequest{Login: login, Email: email, Pwd: "long-enough", Fullname: "New User"}, "192.0.2.3"); rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected the registration to be accepted, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if len(links) != 1 {
+		t.Fatalf("Expected one verification link, got %v", links)
+	}
+	search := adminRepo.GetInstanceByTableName("users")
+	search.SetValue("login", login)
+	users, _ := adminRepo.Search(search, false, false, "")
+	if len(users) != 1 || users[0].GetValue("email") != email {
+		t.Fatalf("Expected the registered user, got %v", users)
+	}
+	userID := users[0].GetValue("id").(string)
+	groups, _ := GetUserGroupIDs(adminRepo, userID, users[0].GetValue("group_id").(string))
+	if !slices.Contains(groups, registrationDefaultGroup) || !slices.Contains(groups, users[0].GetValue("group_id").(string)) {
+		t.Fatalf("Expected the personal group and Guest, got %v", groups)
+	}
+	if rr := loginWith("long-enough"); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), ErrEmailNotVerified) {
+		t.Fatalf("Expected the unverified user to be refused, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := loginWith("wrong-password"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong password to be refused first, got %v", rr.Code)
+	}
+
+	// 3. Taken login and email
+	if rr := post(RegisterHandler, "/register", RegisterRequest{Login: login, Email: "other" + email, Pwd: "long-enough"}, "192.0.2.4"); rr.Code != http.StatusAccepted || len(links) != 1 {
+		t.Fatalf("Expected a taken login to look accepted and send nothing, got %v %v", rr.Code, links)
+	}
+	if rr := post(RegisterHandler, "/register", RegisterRequest{Login: "x" + login, Email: email, Pwd: "long-enough"}, "192.0.2.5"); rr.Code != http.StatusAccepted || len(links) != 1 {
+		t.Fatalf("Expected a taken email to look accepted and send nothing, got %v %v", rr.Code, links)
+	}
+
+	// 4. Too many registrations from one address
+	for _, prefix := range []string{"a", "b", "c"} {
+		post(RegisterHandler, "/register", RegisterRequest{Login: login, Email: prefix + email, Pwd: "long-enough"}, "192.0.2.6")
+	}
+	if rr := post(RegisterHandler, "/register", RegisterRequest{Login: login, Email: "d" + email, Pwd: "long-enough"}, "192.0.2.6"); rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected the quota of the address to be enforced, got %v", rr.Code)
+	}
+
+	// 5. Forged and expired links are refused
+	link, _ := url.Parse(strings.TrimSpace(links[0]))
+	token := link.Query().Get("token")
+	if rr := post(VerifyRegistrationHandler, "/register/verify", VerifyRegistrationRequest{Token: token + "x"}, "192.0.2.1"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a forged token to be refused, got %v", rr.Code)
+	}
+	accessToken, _ := IssueTokens(adminRepo, userID, login, groups, "")
+	if rr := post(VerifyRegistrationHandler, "/register/verify", VerifyRegistrationRequest{Token: accessToken.AccessToken}, "192.0.2.1"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an access token to be refused as a link, got %v", rr.Code)
+	}
+
+	// 6. The link enables the user
+	if rr := post(VerifyRegistrationHandler, "/register/verify", VerifyRegistrationRequest{Token: token}, "192.0.2.1"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the link to confirm the registration, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := post(VerifyRegistrationHandler, "/register/verify", VerifyRegistrationRequest{Token: token}, "192.0.2.1"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected a second confirmation to succeed, got %v", rr.Code)
+	}
+	if rr := loginWith("long-enough"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the verified user to log in, got %v: %s", rr.Code, rr.Body.String())
+	}
+	// Verified users are not purged
+	registration := adminRepo.GetInstanceByTableName("users_registrations")
+	registration.SetValue("user_id", userID)
+	registration.SetValue("created_at", dbTime(time.Now().Add(-2*RegistrationTokenDuration)))
+	adminRepo.Update(registration)
+	PurgeExpiredRegistrations(adminRepo)
+	if adminRepo.GetEntityByID("users", userID) == nil {
+		t.Fatalf("Expected the verified user to be kept")
+	}
+}
+
+// go test -v ./api -run TestPurgeExpiredRegistrations
+func TestPurgeExpiredRegistrations(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	user, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    "stale" + Random4digits(),
+		"pwd":      "long-enough",
+		"fullname": "Stale registration",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer adminRepo.Delete(user)
+	userID := user.GetValue("id").(string)
+
+	registration := adminRepo.GetInstanceByTableName("users_registrations")
+	registration.SetValue("user_id", userID)
+	registration.SetValue("email", "stale@example.com")
+	registration.SetValue("created_at", dbTime(time.Now().Add(-2*RegistrationTokenDuration)))
+	if _, err := adminRepo.Insert(registration); err != nil {
+		t.Fatalf("Failed to create registration: %v", err)
+	}
+	// Enabled by an admin, the user is kept
+	if err := setUserEnabled(adminRepo, userID, true, ""); err != nil {
+		t.Fatalf("Failed to enable the user: %v", err)
+	}
+	if _, err := PurgeExpiredRegistrations(adminRepo); err != nil || adminRepo.GetEntityByID("users", userID) == nil {
+		t.Fatalf("Expected the user enabled by an admin to be kept: %v", err)
+	}
+	if err := setUserEnabled(adminRepo, userID, false, disabledByRegistration); err != nil {
+		t.Fatalf("Failed to disable the user: %v", err)
+	}
+	if _, err := PurgeExpiredRegistrations(adminRepo); err != nil {
+		t.Fatalf("Failed to purge: %v", err)
+	}
+	if adminRepo.GetEntityByID("users", userID) != nil {
+		t.Fatalf("Expected the unverified user to be deleted")
+	}
+}
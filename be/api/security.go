@@ -0,0 +1,174 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"rprj/be/models"
+)
+
+// Defaults of the security headers, see models.SecurityConfig
+var (
+	defaultAllowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	defaultAllowedHeaders = []string{"Authorization", "Content-Type", "Accept-Language", "X-Share-Password", "X-Share-Visit"}
+	// Headers the scripts of the allowed origins can read
+	corsExposedHeaders = []string{"Content-Disposition", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "X-Share-Visit"}
+	// The API answers JSON and files: nothing to run, nothing to frame
+	defaultContentSecurityPolicy     = "default-src 'none'; frame-ancestors 'none'; sandbox"
+	defaultHTMLContentSecurityPolicy = "default-src 'none'; script-src 'nonce-{nonce}'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+)
+
+// SecurityPolicy adds the security headers to the responses and answers the CORS preflights
+type SecurityPolicy struct {
+	Config models.SecurityConfig
+
+	anyOrigin bool
+	origins   map[string]bool
+}
+
+// securityPolicy is used by SecurityMiddleware (set by InitAPI)
+var securityPolicy = NewSecurityPolicy(models.SecurityConfig{})
+
+func NewSecurityPolicy(config models.SecurityConfig) *SecurityPolicy {
+	if len(config.AllowedMethods) == 0 {
+		config.AllowedMethods = defaultAllowedMethods
+	}
+	if len(config.AllowedHeaders) == 0 {
+		config.AllowedHeaders = defaultAllowedHeaders
+	}
+	if config.CORSMaxAgeSeconds <= 0 {
+		config.CORSMaxAgeSeconds = 600
+	}
+	if config.ContentSecurityPolicy == "" {
+		config.ContentSecurityPolicy = defaultContentSecurityPolicy
+	}
+	if config.HTMLContentSecurityPolicy == "" {
+		config.HTMLContentSecurityPolicy = defaultHTMLContentSecurityPolicy
+	}
+	if config.ReferrerPolicy == "" {
+		config.ReferrerPolicy = "no-referrer"
+	}
+	if config.FrameOptions == "" {
+		config.FrameOptions = "DENY"
+	}
+	policy := &SecurityPolicy{Config: config, origins: map[string]bool{}}
+	for _, origin := range config.AllowedOrigins {
+		if origin == "*" {
+			policy.anyOrigin = true
+		}
+		policy.origins[strings.TrimRight(origin, "/")] = true
+	}
+	return policy
+}
+
+// isHTTPS tells whether the client is on https, directly or behind a proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// SecurityMiddleware sets the security headers of every response and answers the CORS preflights.
+// It wraps the router: the preflights (OPTIONS) match no route.
+func SecurityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := securityPolicy
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", policy.Config.FrameOptions)
+		header.Set("Referrer-Policy", policy.Config.ReferrerPolicy)
+		header.Set("Content-Security-Policy", policy.Config.ContentSecurityPolicy)
+		if policy.Config.HSTSSeconds > 0 && isHTTPS(r) {
+			hsts := "max-age=" + strconv.Itoa(policy.Config.HSTSSeconds)
+			if policy.Config.HSTSIncludeSubdomains {
+				hsts += "; includeSubDomains"
+			}
+			header.Set("Strict-Transport-Security", hsts)
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		origin := r.Header.Get("Origin")
+		if len(policy.origins) > 0 {
+			header.Add("Vary", "Origin")
+		}
+		if origin == "" || !(policy.anyOrigin || policy.origins[origin]) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if policy.anyOrigin && !policy.Config.AllowCredentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if policy.Config.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			header.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(policy.Config.AllowedMethods, ", "))
+		header.Set("Access-Control-Allow-Headers", strings.Join(policy.Config.AllowedHeaders, ", "))
+		header.Set("Access-Control-Max-Age", strconv.Itoa(policy.Config.CORSMaxAgeSeconds))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// WithoutContentSecurityPolicy serves pages with their own scripts and styles, like the Swagger UI
+func WithoutContentSecurityPolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Del("Content-Security-Policy")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeHTMLPage writes an HTML page of the API: page gets the nonce its scripts must carry (<script nonce="...">)
+func writeHTMLPage(w http.ResponseWriter, page func(nonce string) string) {
+	nonce := randomToken(16)
+	w.Header().Set("Content-Security-Policy", strings.ReplaceAll(securityPolicy.Config.HTMLContentSecurityPolicy, "{nonce}", nonce))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(page(nonce)))
+}
+
+/* *** CSRF *** */
+
+// flowCookie is a cookie of a login flow: not readable by scripts, sent back on the redirect from the provider.
+// A negative maxAge deletes it.
+func flowCookie(r *http.Request, name string, value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(maxAge.Seconds()),
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// setCSRFCookie starts a double-submit check: it stores a random token in a cookie and returns it,
+// to be sent through the flow (the OAuth state) and compared with the cookie by checkCSRFCookie
+func setCSRFCookie(w http.ResponseWriter, r *http.Request, name string, maxAge time.Duration) string {
+	token := randomToken(24)
+	http.SetCookie(w, flowCookie(r, name, token, maxAge))
+	return token
+}
+
+// checkCSRFCookie tells whether the token sent back is the one of the cookie, and deletes the cookie:
+// every token is used once
+func checkCSRFCookie(w http.ResponseWriter, r *http.Request, name string, submitted string) bool {
+	cookie, err := r.Cookie(name)
+	http.SetCookie(w, flowCookie(r, name, "", -1))
+	return err == nil && submitted != "" && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(submitted)) == 1
+}
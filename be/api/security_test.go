@@ -0,0 +1,136 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"rprj/be/models"
+)
+
+// go test -v ./api -run TestSecurityMiddleware
+func TestSecurityMiddleware(t *testing.T) {
+	savedPolicy := securityPolicy
+	t.Cleanup(func() { securityPolicy = savedPolicy })
+	securityPolicy = NewSecurityPolicy(models.SecurityConfig{
+		AllowedOrigins:        []string{"https://app.example.com/"},
+		HSTSSeconds:           31536000,
+		HSTSIncludeSubdomains: true,
+	})
+	handler := SecurityMiddleware(http.HandlerFunc(PingHandler))
+	call := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/ping", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// 1. Security headers, HSTS only over https
+	rr := call(http.MethodGet, nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Content-Type-Options") != "nosniff" || rr.Header().Get("X-Frame-Options") != "DENY" ||
+		rr.Header().Get("Referrer-Policy") != "no-referrer" || rr.Header().Get("Content-Security-Policy") != defaultContentSecurityPolicy {
+		t.Fatalf("Unexpected headers %v", rr.Header())
+	}
+	if rr.Header().Get("Strict-Transport-Security") != "" || rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected no HSTS and no CORS, got %v", rr.Header())
+	}
+	rr = call(http.MethodGet, map[string]string{"X-Forwarded-Proto": "https"})
+	if rr.Header().Get("Strict-Transport-Security") != "max-age=31536000; includeSubDomains" {
+		t.Fatalf("Expected HSTS, got %v", rr.Header())
+	}
+
+	// 2. CORS for the allowed origins only
+	rr = call(http.MethodGet, map[string]string{"Origin": "https://app.example.com"})
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || rr.Header().Get("Vary") != "Origin" ||
+		!strings.Contains(rr.Header().Get("Access-Control-Expose-Headers"), "X-RateLimit-Remaining") {
+		t.Fatalf("Expected the origin allowed, got %v", rr.Header())
+	}
+	rr = call(http.MethodOptions, map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "DELETE"})
+	if rr.Code != http.StatusNoContent || !strings.Contains(rr.Header().Get("Access-Control-Allow-Methods"), "DELETE") ||
+		!strings.Contains(rr.Header().Get("Access-Control-Allow-Headers"), "Authorization") || rr.Body.Len() != 0 {
+		t.Fatalf("Expected the preflight answered, got %v %v", rr.Code, rr.Header())
+	}
+	rr = call(http.MethodGet, map[string]string{"Origin": "https://evil.example.com"})
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected no CORS for another origin, got %v", rr.Header())
+	}
+	if rr := call(http.MethodOptions, map[string]string{"Origin": "https://evil.example.com", "Access-Control-Request-Method": "POST"}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected the preflight refused, got %v", rr.Code)
+	}
+	securityPolicy = NewSecurityPolicy(models.SecurityConfig{AllowedOrigins: []string{"*"}})
+	if rr := call(http.MethodGet, map[string]string{"Origin": "https://any.example.com"}); rr.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("Expected any origin, got %v", rr.Header())
+	}
+
+	// 3. The HTML pages get a nonce for their scripts
+	rr = httptest.NewRecorder()
+	SecurityMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHTMLPage(w, func(nonce string) string { return `<script nonce="` + nonce + `">go()</script>` })
+	})).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oauth/telegram/callback", nil))
+	csp := rr.Header().Get("Content-Security-Policy")
+	_, nonce, _ := strings.Cut(csp, "'nonce-")
+	nonce, _, _ = strings.Cut(nonce, "'")
+	if nonce == "" || !strings.Contains(rr.Body.String(), `nonce="`+nonce+`"`) || strings.Contains(csp, "{nonce}") {
+		t.Fatalf("Expected the nonce of the page in its CSP, got %q %s", csp, rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	SecurityMiddleware(WithoutContentSecurityPolicy(http.HandlerFunc(PingHandler))).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/swagger/", nil))
+	if rr.Header().Get("Content-Security-Policy") != "" || rr.Header().Get("X-Frame-Options") != "DENY" {
+		t.Fatalf("Expected only the CSP removed, got %v", rr.Header())
+	}
+}
+
+// go test -v ./api -run TestOAuthStateCSRF
+func TestOAuthStateCSRF(t *testing.T) {
+	savedID, savedSecret, savedURL := GitHubClientID, GitHubClientSecret, GitHubRedirectURL
+	t.Cleanup(func() { GitHubClientID, GitHubClientSecret, GitHubRedirectURL = savedID, savedSecret, savedURL })
+	GitHubClientID, GitHubClientSecret, GitHubRedirectURL = "client", "secret", "https://app.example.com/api/oauth/github/callback"
+
+	start := func() (*http.Cookie, string) {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/github/start", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rr := httptest.NewRecorder()
+		GitHubOAuthStart(rr, req)
+		location, _ := url.Parse(rr.Header().Get("Location"))
+		cookies := rr.Result().Cookies()
+		if rr.Code != http.StatusFound || len(cookies) != 1 {
+			t.Fatalf("Expected the redirect with the state cookie, got %v %v", rr.Code, rr.Header())
+		}
+		return cookies[0], location.Query().Get("state")
+	}
+	callback := func(cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/github/callback?"+url.Values{"state": {state}}.Encode(), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		GitHubOAuthCallback(rr, req)
+		return rr
+	}
+
+	// The state is random, in a cookie only for this site and over https
+	cookie, state := start()
+	_, otherState := start()
+	if cookie.Value != state || len(state) < 32 || state == otherState || !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("Unexpected state %q and cookie %+v", state, cookie)
+	}
+	if rr := callback(cookie, otherState); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Invalid oauth state") {
+		t.Fatalf("Expected another state refused, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := callback(nil, state); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Invalid oauth state") {
+		t.Fatalf("Expected the state without cookie refused, got %v %s", rr.Code, rr.Body.String())
+	}
+	// The matching state goes on to the code, and the cookie is deleted
+	rr := callback(cookie, state)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "Missing code") {
+		t.Fatalf("Expected the state accepted, got %v %s", rr.Code, rr.Body.String())
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("Expected the state cookie deleted, got %+v", cookies)
+	}
+}
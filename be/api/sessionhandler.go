@@ -0,0 +1,410 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// SessionInfo godoc
+// @Description An active login session of a user
+type SessionInfo struct {
+	ID          string `json:"id"`
+	LoginMethod string `json:"login_method"`
+	IPAddress   string `json:"ip_address"`
+	UserAgent   string `json:"user_agent"`
+	CreatedAt   int64  `json:"created_at"`
+	LastUsedAt  int64  `json:"last_used_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+	Current     bool   `json:"current"` // the session of the request
+}
+
+// How often last_used_at is written while a session is used
+const sessionTouchInterval = 5 * time.Minute
+
+var sessionTouchedAt = map[string]time.Time{}
+var sessionTouchedAtMu sync.Mutex
+
+var errAccountDisabled = errors.New("account disabled")
+
+// Who disabled a user, in users_status.reason
+const (
+	disabledByAdmin        = "admin"
+	disabledByDirectory    = "directory"
+	disabledByRegistration = "unverified"
+)
+
+// getUserStatus returns the status of a user, nil for the users never disabled
+func getUserStatus(repo *dblayer.DBRepository, userID string) dblayer.DBEntityInterface {
+	search := repo.GetInstanceByTableName("users_status")
+	search.SetValue("user_id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return nil
+	}
+	return results[0]
+}
+
+// userEnabled tells whether a status lets the user log in, and who disabled it otherwise
+func userEnabled(status dblayer.DBEntityInterface) (bool, string) {
+	if status == nil || fmt.Sprint(status.GetValue("enabled")) != "0" {
+		return true, ""
+	}
+	reason, _ := status.GetValue("reason").(string)
+	return false, reason
+}
+
+// newUserStatus returns the switch of a user, on or off, recording who did it
+func newUserStatus(repo *dblayer.DBRepository, userID string, enabled bool, reason string) dblayer.DBEntityInterface {
+	status := repo.GetInstanceByTableName("users_status")
+	status.SetValue("user_id", userID)
+	if enabled {
+		status.SetValue("enabled", "1")
+		status.SetValue("reason", "")
+	} else {
+		status.SetValue("enabled", "0")
+		status.SetValue("reason", reason)
+	}
+	status.SetValue("changed_at", dbTime(time.Now()))
+	return status
+}
+
+// setUserEnabled turns the switch of a user on or off, recording who did it
+func setUserEnabled(repo *dblayer.DBRepository, userID string, enabled bool, reason string) error {
+	status := newUserStatus(repo, userID, enabled, reason)
+	var err error
+	if getUserStatus(repo, userID) == nil {
+		_, err = repo.Insert(status)
+	} else {
+		_, err = repo.Update(status)
+	}
+	return err
+}
+
+// checkAccountEnabled refuses the users whose switch is off
+func checkAccountEnabled(repo *dblayer.DBRepository, userID string) error {
+	if enabled, reason := userEnabled(getUserStatus(repo, userID)); !enabled {
+		if reason == disabledByRegistration {
+			return errEmailNotVerified
+		}
+		return errAccountDisabled
+	}
+	return nil
+}
+
+// StartSession issues the tokens of a new login and records where it comes from
+func StartSession(repo *dblayer.DBRepository, r *http.Request, userID string, login string, groups []string, method string) (*TokenResponse, error) {
+	if err := checkAccountEnabled(repo, userID); err != nil {
+		return nil, err
+	}
+	tokens, err := IssueTokens(repo, userID, login, groups, "")
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	now := time.Now()
+	session := repo.GetInstanceByTableName("oauth_sessions")
+	session.SetValue("session_id", sessionIDOf(tokens.RefreshToken))
+	session.SetValue("user_id", userID)
+	session.SetValue("login_method", method)
+	session.SetValue("ip_address", clientIP(r))
+	session.SetValue("user_agent", userAgent)
+	session.SetValue("created_at", dbTime(now))
+	session.SetValue("last_used_at", dbTime(now))
+	session.SetValue("expires_at", dbTime(now.Add(RefreshTokenDuration)))
+	if _, err := repo.Insert(session); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// respondSessionError answers a login whose session could not be started
+func respondSessionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errAccountDisabled) {
+		RespondSimpleError(w, ErrUserDisabled, "Account disabled", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errEmailNotVerified) {
+		RespondSimpleError(w, ErrEmailNotVerified, "Email not verified", http.StatusForbidden)
+		return
+	}
+	log.Print("Error saving token:", err)
+	RespondSimpleError(w, ErrInternalServer, "Could not generate token", http.StatusInternalServerError)
+}
+
+// sessionIDOf returns the session of a refresh token or of its stored hash
+func sessionIDOf(refreshToken string) string {
+	sessionID, _, _ := strings.Cut(refreshToken, ".")
+	sessionID, _, _ = strings.Cut(sessionID, ":")
+	return sessionID
+}
+
+// sessionExists tells whether a session is still active, i.e. not logged out, revoked or purged
+func sessionExists(repo *dblayer.DBRepository, sessionID string) bool {
+	search := repo.GetInstanceByTableName("oauth_sessions")
+	search.SetValue("session_id", sessionID)
+	results, err := repo.Search(search, false, false, "")
+	return err == nil && len(results) > 0
+}
+
+// touchSession records that the session is in use. When refreshed, the session lasts RefreshTokenDuration more.
+// It returns false when the session does not exist (anymore).
+func touchSession(repo *dblayer.DBRepository, sessionID string, refreshed bool) bool {
+	now := time.Now()
+	if !refreshed {
+		sessionTouchedAtMu.Lock()
+		last, ok := sessionTouchedAt[sessionID]
+		if ok && now.Sub(last) < sessionTouchInterval {
+			sessionTouchedAtMu.Unlock()
+			return true
+		}
+		sessionTouchedAt[sessionID] = now
+		sessionTouchedAtMu.Unlock()
+	}
+
+	search := repo.GetInstanceByTableName("oauth_sessions")
+	search.SetValue("session_id", sessionID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return true
+	}
+	if len(results) == 0 {
+		return false
+	}
+	session := results[0]
+	normalizeDBTimes(session, "created_at", "expires_at")
+	session.SetValue("last_used_at", dbTime(now))
+	if refreshed {
+		session.SetValue("expires_at", dbTime(now.Add(RefreshTokenDuration)))
+	}
+	if _, err := repo.Update(session); err != nil {
+		log.Println("touchSession:", err)
+	}
+	return true
+}
+
+// getSessions returns the sessions of a user, the most recently used first
+func getSessions(repo *dblayer.DBRepository, userID string) ([]dblayer.DBEntityInterface, error) {
+	search := repo.GetInstanceByTableName("oauth_sessions")
+	search.SetValue("user_id", userID)
+	return repo.Search(search, false, false, "last_used_at DESC")
+}
+
+// RevokeSession logs out a session: its tokens stop working and it disappears from the list
+func RevokeSession(repo *dblayer.DBRepository, sessionID string) {
+	// The session first: a refresh running meanwhile finds it gone after saving its tokens, and revokes them
+	session := repo.GetInstanceByTableName("oauth_sessions")
+	session.SetValue("session_id", sessionID)
+	if _, err := repo.Delete(session); err != nil {
+		log.Println("RevokeSession:", err)
+	}
+	RevokeTokenChain(repo, sessionID)
+	sessionTouchedAtMu.Lock()
+	delete(sessionTouchedAt, sessionID)
+	sessionTouchedAtMu.Unlock()
+}
+
+// currentSessionID returns the session of the access token of the request
+func currentSessionID(repo *dblayer.DBRepository, r *http.Request) string {
+	tokenString, err := GetTokenFromRequest(r)
+	if err != nil {
+		return ""
+	}
+	search := repo.GetInstanceByTableName("oauth_tokens")
+	search.SetValue("token_id", tokenString)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return ""
+	}
+	refreshTokenHash, _ := results[0].GetValue("refresh_token").(string)
+	return sessionIDOf(refreshTokenHash)
+}
+
+// selfOrAdminRequest checks that the user of the request is the user in the path or can manage the users (users.manage).
+// The account cannot be managed with an API key.
+// Returns the repository, the user in the path and if the request comes from the user itself.
+func selfOrAdminRequest(w http.ResponseWriter, r *http.Request) (*dblayer.DBRepository, string, bool, bool) {
+	principal := PrincipalFromRequest(r)
+	if principal.IsAnonymous() {
+		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+		return nil, "", false, false
+	}
+	if principal.IsAPIKey() {
+		RespondSimpleError(w, ErrForbidden, "The account cannot be managed with an API key", http.StatusForbidden)
+		return nil, "", false, false
+	}
+	userID := mux.Vars(r)["id"]
+	self := userID == principal.UserID
+	if !self && !principal.Can(dblayer.CapabilityUsersManage) {
+		RespondSimpleError(w, ErrForbidden, "You can only manage your own account", http.StatusForbidden)
+		return nil, "", false, false
+	}
+
+	repo := dblayer.NewSystemRepository("account of user "+userID, accountTables...).WithContext(r.Context())
+	return repo, userID, self, true
+}
+
+// GetUserSessionsHandler godoc
+// @Summary List the active sessions of a user
+// @Description Returns the login sessions of the user with creation time, expiry, IP, user agent and login method.
+// @Description Users can see their own sessions, admins the sessions of everybody.
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {array} SessionInfo
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/sessions [get]
+func GetUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, _, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := getSessions(repo, userID)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get sessions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	current := currentSessionID(repo, r)
+
+	response := []SessionInfo{}
+	for _, session := range sessions {
+		info := SessionInfo{ID: session.GetValue("session_id").(string)}
+		info.LoginMethod, _ = session.GetValue("login_method").(string)
+		info.IPAddress, _ = session.GetValue("ip_address").(string)
+		info.UserAgent, _ = session.GetValue("user_agent").(string)
+		if t, ok := parseDBTime(session.GetValue("created_at")); ok {
+			info.CreatedAt = t.Unix()
+		}
+		if t, ok := parseDBTime(session.GetValue("last_used_at")); ok {
+			info.LastUsedAt = t.Unix()
+		}
+		if t, ok := parseDBTime(session.GetValue("expires_at")); ok {
+			if t.Before(time.Now()) {
+				continue
+			}
+			info.ExpiresAt = t.Unix()
+		}
+		info.Current = info.ID == current
+		response = append(response, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteUserSessionHandler godoc
+// @Summary Revoke a session
+// @Description Logs out one session of the user: its access and refresh tokens stop working.
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Param sessionId path string true "Session ID"
+// @Success 200 {object} map[string]string "message"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Session not found"
+// @Security BearerAuth
+// @Router /users/{id}/sessions/{sessionId} [delete]
+func DeleteUserSessionHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, _, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	sessionID := mux.Vars(r)["sessionId"]
+
+	search := repo.GetInstanceByTableName("oauth_sessions")
+	search.SetValue("session_id", sessionID)
+	search.SetValue("user_id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		RespondSimpleError(w, ErrObjectNotFound, "Session not found", http.StatusNotFound)
+		return
+	}
+	RevokeSession(repo, sessionID)
+	log.Printf("DeleteUserSessionHandler: revoked session %s of user %s", sessionID, userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked"})
+}
+
+// DeleteUserSessionsHandler godoc
+// @Summary Log out everywhere
+// @Description Revokes all the sessions of the user, the current one too.
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} map[string]interface{} "message and number of revoked sessions"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/sessions [delete]
+func DeleteUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, _, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := getSessions(repo, userID)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get sessions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, session := range sessions {
+		RevokeSession(repo, session.GetValue("session_id").(string))
+	}
+	log.Printf("DeleteUserSessionsHandler: revoked %d sessions of user %s", len(sessions), userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Logged out everywhere", "revoked": len(sessions)})
+}
+
+// PurgeExpiredSessions deletes the expired sessions and the tokens that cannot be used or refreshed anymore
+func PurgeExpiredSessions(repo *dblayer.DBRepository) (int, error) {
+	now := time.Now()
+	purged := 0
+
+	search := repo.GetInstanceByTableName("oauth_sessions")
+	search.SetValue("expires_at", []string{"", dbTime(now)})
+	sessions, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return purged, err
+	}
+	for _, session := range sessions {
+		if _, err := repo.Delete(session); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	// Access tokens last AccessTokenDuration, their refresh tokens RefreshTokenDuration:
+	// after that nobody can use them, not even to detect a reuse
+	search = repo.GetInstanceByTableName("oauth_tokens")
+	search.SetValue("expires_at", []string{"", dbTime(now.Add(-RefreshTokenDuration))})
+	tokens, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return purged, err
+	}
+	for _, token := range tokens {
+		if _, err := repo.Delete(token); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestUserSessions
+func TestUserSessions(t *testing.T) {
+	// The tests come from 192.0.2.1, here a proxy
+	savedProxies := trustedProxies
+	trustedProxies = parseTrustedProxies([]string{"192.0.2.0/24"})
+	t.Cleanup(func() { trustedProxies = savedProxies })
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	login := "sessions" + Random4digits()
+	user, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    login,
+		"pwd":      "secret" + login,
+		"fullname": "Sessions test",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer adminRepo.Delete(user)
+	userID := user.GetValue("id").(string)
+
+	doLogin := func(userAgent string) TokenResponse {
+		body, _ := json.Marshal(Credentials{Login: login, Pwd: "secret" + login})
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(body))
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("X-Forwarded-For", "10.1.2.3")
+		rr := httptest.NewRecorder()
+		LoginHandler(rr, req)
+		var resp TokenResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.AccessToken == "" {
+			t.Fatalf("Login failed: %s", rr.Body.String())
+		}
+		return resp
+	}
+
+	router := mux.NewRouter()
+	router.Use(AuthMiddleware)
+	router.HandleFunc("/users/{id}/sessions", GetUserSessionsHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/sessions", DeleteUserSessionsHandler).Methods("DELETE")
+	router.HandleFunc("/users/{id}/sessions/{sessionId}", DeleteUserSessionHandler).Methods("DELETE")
+	call := func(method string, path string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	laptop := doLogin("laptop")
+	phone := doLogin("phone")
+
+	// 1. Both sessions are listed, the current one is marked
+	rr := call(http.MethodGet, "/users/"+userID+"/sessions", laptop.AccessToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	var sessions []SessionInfo
+	json.Unmarshal(rr.Body.Bytes(), &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d: %s", len(sessions), rr.Body.String())
+	}
+	var phoneSession SessionInfo
+	for _, session := range sessions {
+		if session.IPAddress != "10.1.2.3" || session.LoginMethod != "password" || session.ExpiresAt <= time.Now().Unix() {
+			t.Fatalf("Unexpected session %+v", session)
+		}
+		if session.UserAgent == "laptop" && !session.Current {
+			t.Fatalf("Expected the laptop session to be the current one")
+		}
+		if session.UserAgent == "phone" {
+			phoneSession = session
+		}
+	}
+
+	// 2. Other users cannot see them
+	other := ApiTestDoLogin(t, testAdminLogin, testAdminPwd)
+	if rr := call(http.MethodGet, "/users/"+userID+"/sessions", other); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected status Forbidden, got %v", rr.Code)
+	}
+
+	// 3. Revoking the phone session kills its tokens
+	if rr := call(http.MethodDelete, "/users/"+userID+"/sessions/"+phoneSession.ID, laptop.AccessToken); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(http.MethodGet, "/users/"+userID+"/sessions", phone.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the phone access token to be revoked, got %v", rr.Code)
+	}
+	if _, err := RefreshTokens(adminRepo, phone.RefreshToken); err == nil {
+		t.Fatalf("Expected the phone refresh token to be revoked")
+	}
+
+	// 4. Log out everywhere
+	doLogin("tablet")
+	if rr := call(http.MethodDelete, "/users/"+userID+"/sessions", laptop.AccessToken); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(http.MethodGet, "/users/"+userID+"/sessions", laptop.AccessToken); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the laptop access token to be revoked, got %v", rr.Code)
+	}
+	remaining, _ := getSessions(adminRepo, userID)
+	if len(remaining) != 0 {
+		t.Fatalf("Expected no sessions, got %d", len(remaining))
+	}
+}
+
+// go test -v ./api -run TestPurgeExpiredSessions
+func TestPurgeExpiredSessions(t *testing.T) {
+	repo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	userID := testUser.GetValue("id").(string)
+
+	expired := repo.GetInstanceByTableName("oauth_sessions")
+	expired.SetValue("session_id", "expired"+Random4digits())
+	expired.SetValue("user_id", userID)
+	expired.SetValue("expires_at", dbTime(time.Now().Add(-time.Hour)))
+	if _, err := repo.Insert(expired); err != nil {
+		t.Fatalf("Failed to insert session: %v", err)
+	}
+	oldTokenID := "old-token-" + Random4digits()
+	if err := SaveToken(repo, userID, oldTokenID, "", time.Now().Add(-RefreshTokenDuration-time.Hour).Unix()); err != nil {
+		t.Fatalf("Failed to insert token: %v", err)
+	}
+	valid := ApiTestDoLogin(t, testAdminLogin, testAdminPwd)
+
+	purged, err := PurgeExpiredSessions(repo)
+	if err != nil {
+		t.Fatalf("PurgeExpiredSessions failed: %v", err)
+	}
+	if purged < 2 {
+		t.Fatalf("Expected at least 2 purged rows, got %d", purged)
+	}
+	search := repo.GetInstanceByTableName("oauth_tokens")
+	search.SetValue("token_id", oldTokenID)
+	if found, _ := repo.Search(search, false, false, ""); len(found) != 0 {
+		t.Fatalf("Expected the old token to be purged")
+	}
+	if !IsTokenValid(repo, valid, userID) {
+		t.Fatalf("Expected the current token to survive")
+	}
+}
@@ -0,0 +1,427 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ShareLinkInfo godoc
+// @Description A share link of an object, without its token
+type ShareLinkInfo struct {
+	ID          string `json:"id"`
+	ObjectID    string `json:"object_id"`
+	UserID      string `json:"user_id"` // who created it: the link reads as this user
+	Prefix      string `json:"prefix"`  // the beginning of the token, to recognize it
+	Subtree     bool   `json:"subtree"`
+	HasPassword bool   `json:"has_password"`
+	MaxUses     int    `json:"max_uses"` // 0 for no limit
+	Uses        int    `json:"uses"`
+	CreatedAt   int64  `json:"created_at"`
+	LastUsedAt  int64  `json:"last_used_at,omitempty"`
+	ExpiresAt   int64  `json:"expires_at,omitempty"`
+}
+
+// CreateShareRequest godoc
+// @Description A new share link of an object
+type CreateShareRequest struct {
+	Subtree   bool   `json:"subtree"`    // also what is below the object
+	Password  string `json:"password"`   // optional, asked in the X-Share-Password header
+	MaxUses   int    `json:"max_uses"`   // visits of the link, 0 for no limit
+	ExpiresAt int64  `json:"expires_at"` // unix time, 0 for a link that does not expire
+}
+
+// CreateShareResponse godoc
+// @Description The new share link: the token is returned only here, the link is /share/{token}
+type CreateShareResponse struct {
+	ShareLinkInfo
+	Token string `json:"token"`
+}
+
+var errShareNotFound = errors.New("share link not found")
+var errShareExpired = errors.New("share link expired")
+var errSharePassword = errors.New("share link password required")
+
+// hashShareToken returns the value stored in share_links.token_hash
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// intValue reads an int column, 0 when it is empty
+func intValue(value any) int {
+	n, _ := strconv.Atoi(fmt.Sprint(value))
+	return n
+}
+
+// shareLinkInfoOf returns the description of a link
+func shareLinkInfoOf(link dblayer.DBEntityInterface) ShareLinkInfo {
+	info := ShareLinkInfo{
+		ID:      link.GetValue("id").(string),
+		Subtree: link.GetValue("subtree") == "1",
+		MaxUses: intValue(link.GetValue("max_uses")),
+		Uses:    intValue(link.GetValue("uses")),
+	}
+	info.ObjectID, _ = link.GetValue("object_id").(string)
+	info.UserID, _ = link.GetValue("user_id").(string)
+	info.Prefix, _ = link.GetValue("token_prefix").(string)
+	password, _ := link.GetValue("password").(string)
+	info.HasPassword = password != ""
+	if t, ok := parseDBTime(link.GetValue("created_at")); ok {
+		info.CreatedAt = t.Unix()
+	}
+	if t, ok := parseDBTime(link.GetValue("last_used_at")); ok {
+		info.LastUsedAt = t.Unix()
+	}
+	if t, ok := parseDBTime(link.GetValue("expires_at")); ok {
+		info.ExpiresAt = t.Unix()
+	}
+	return info
+}
+
+// shareVisitDuration is how long a visit of a share link lasts: its requests count as one use
+const shareVisitDuration = time.Hour
+
+// shareVisitKey signs the visit tokens: they are not valid as access tokens
+func shareVisitKey() []byte {
+	return append([]byte("share:"), JWTKey...)
+}
+
+// newShareVisitToken returns the token of a new visit of a link, sent back in X-Share-Visit
+func newShareVisitToken(shareID string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"share_id": shareID,
+		"exp":      time.Now().Add(shareVisitDuration).Unix(),
+	})
+	return token.SignedString(shareVisitKey())
+}
+
+// isShareVisit tells whether tokenString is a visit of the link still going on
+func isShareVisit(tokenString string, shareID string) bool {
+	if tokenString == "" {
+		return false
+	}
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return shareVisitKey(), nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	return err == nil && token.Valid && claims["share_id"] == shareID
+}
+
+// resolveShareLink returns the reader of a share link: its creator, read only, limited to the object of the link.
+// A request without the token of a visit of the link (X-Share-Visit) starts a new one, which counts as a use:
+// its token is returned, empty when the request belongs to a visit.
+func resolveShareLink(r *http.Request, token string, password string, visit string) (*Principal, string, error) {
+	repo := dblayer.NewSystemRepository("share link", shareTables...).WithContext(r.Context())
+
+	search := repo.GetInstanceByTableName("share_links")
+	search.SetValue("token_hash", hashShareToken(token))
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return nil, "", errShareNotFound
+	}
+	link := results[0]
+	shareID := link.GetValue("id").(string)
+	now := time.Now()
+	if t, ok := parseDBTime(link.GetValue("expires_at")); ok && t.Before(now) {
+		return nil, "", errShareExpired
+	}
+	if hash, _ := link.GetValue("password").(string); hash != "" {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return nil, "", errSharePassword
+		}
+	}
+
+	userID, _ := link.GetValue("user_id").(string)
+	user := repo.GetEntityByID("users", userID)
+	if user == nil || checkAccountEnabled(repo, userID) != nil {
+		return nil, "", errShareNotFound
+	}
+	primaryGroupID, _ := user.GetValue("group_id").(string)
+	groupIDs, err := GetUserGroupIDs(repo, userID, primaryGroupID)
+	if err != nil {
+		return nil, "", errShareNotFound
+	}
+
+	newVisit := ""
+	if !isShareVisit(visit, shareID) {
+		// Counted only while uses < max_uses: two visits taking the last use do not both get in
+		used, err := repo.UseShareLink(link, dbTime(now))
+		if err != nil {
+			log.Println("resolveShareLink:", err)
+			return nil, "", errShareNotFound
+		}
+		if !used {
+			return nil, "", errShareExpired
+		}
+		if newVisit, err = newShareVisitToken(shareID); err != nil {
+			log.Println("resolveShareLink:", err)
+		}
+	}
+
+	principal := &Principal{UserID: userID, GroupIDs: groupIDs, Token: token, ShareID: shareID}
+	principal.Login, _ = user.GetValue("login").(string)
+	principal.Scope = &dblayer.AccessScope{ReadOnly: true, RootID: link.GetValue("object_id").(string), Subtree: link.GetValue("subtree") == "1"}
+	return principal, newVisit, nil
+}
+
+// ShareMiddleware resolves the share link in the path: the navigation handlers behind it read as the creator
+// of the link, only what the link reaches. The password of the link is sent in the X-Share-Password header,
+// the token of the visit, returned by its first request, in X-Share-Visit.
+func ShareMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, visit, err := resolveShareLink(r, mux.Vars(r)["token"], r.Header.Get("X-Share-Password"), r.Header.Get("X-Share-Visit"))
+		switch err {
+		case nil:
+			if visit != "" {
+				w.Header().Set("X-Share-Visit", visit)
+			}
+			next.ServeHTTP(w, withPrincipal(r, principal))
+		case errShareExpired:
+			RespondSimpleError(w, ErrShareExpired, "Share link expired", http.StatusGone)
+		case errSharePassword:
+			RespondSimpleError(w, ErrSharePasswordRequired, "Password required", http.StatusUnauthorized)
+		default:
+			RespondSimpleError(w, ErrShareNotFound, "Share link not found", http.StatusNotFound)
+		}
+	})
+}
+
+// GetShareHandler godoc
+//
+//	@Summary opens a share link
+//	@Description Returns the shared object, as GET /content/{objectId}. Without login: the link reads as its creator.
+//	@Description The folders shared with their subtree are browsed with /share/{token}/children/{folderId},
+//	@Description /share/{token}/content/{objectId} and /share/{token}/breadcrumb/{objectId}.
+//	@Tags navigation
+//	@Produce json
+//	@Param token path string true "Share token"
+//	@Param X-Share-Password header string false "Password of the link"
+//	@Param X-Share-Visit header string false "Token of the visit, to browse the link without counting more uses"
+//	@Success 200 {object} map[string]interface{} "Navigation object data"
+//	@Header 200 {string} X-Share-Visit "Token of the new visit, when the request started one"
+//	@Failure 401 {object} ErrorResponse "Password required"
+//	@Failure 404 {object} ErrorResponse "Share link not found"
+//	@Failure 410 {object} ErrorResponse "Share link expired or used up"
+//	@Router /share/{token} [get]
+func GetShareHandler(w http.ResponseWriter, r *http.Request) {
+	principal := PrincipalFromRequest(r)
+	if principal.Scope == nil {
+		RespondSimpleError(w, ErrShareNotFound, "Share link not found", http.StatusNotFound)
+		return
+	}
+	GetNavigationHandler(w, mux.SetURLVars(r, map[string]string{"objectId": principal.Scope.RootID}))
+}
+
+// shareOwnerRequest returns the caller and the object in the path when the caller can share it:
+// its owner or a user with objects.chmod, logged in (not with an API key)
+func shareOwnerRequest(w http.ResponseWriter, r *http.Request) (*Principal, dblayer.DBEntityInterface, bool) {
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	if principal.Scope != nil {
+		RespondSimpleError(w, ErrForbidden, "Share links cannot be managed with an API key", http.StatusForbidden)
+		return nil, nil, false
+	}
+	object := aclObject(w, r, repo)
+	if object == nil {
+		return nil, nil, false
+	}
+	if object.GetValue("owner") != principal.UserID && !principal.Can(dblayer.CapabilityObjectsChmod) {
+		RespondSimpleError(w, ErrForbidden, "Only the owner can share this object", http.StatusForbidden)
+		return nil, nil, false
+	}
+	return principal, object, true
+}
+
+// respondShareLinks writes the links found by search
+func respondShareLinks(w http.ResponseWriter, repo *dblayer.DBRepository, search dblayer.DBEntityInterface) {
+	links, err := repo.Search(search, false, false, "created_at DESC")
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get the share links: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := []ShareLinkInfo{}
+	for _, link := range links {
+		response = append(response, shareLinkInfoOf(link))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateShareHandler godoc
+// @Summary Share an object
+// @Description Creates a link that opens the object without login, read only, at /share/{token}:
+// @Description optionally with its subtree, a password, an expiry and a maximum number of uses.
+// @Description Only the owner of the object and the users with objects.chmod can share it. The token is returned only once.
+// @Tags objects
+// @Accept json
+// @Produce json
+// @Param id path string true "Object ID"
+// @Param request body CreateShareRequest true "The link"
+// @Success 201 {object} CreateShareResponse
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Object not found"
+// @Security BearerAuth
+// @Router /objects/{id}/shares [post]
+func CreateShareHandler(w http.ResponseWriter, r *http.Request) {
+	principal, object, ok := shareOwnerRequest(w, r)
+	if !ok {
+		return
+	}
+	var req CreateShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if req.MaxUses < 0 {
+		RespondError(w, ErrInvalidField, "The maximum number of uses cannot be negative", map[string]string{"field": "max_uses"}, http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != 0 && time.Unix(req.ExpiresAt, 0).Before(time.Now()) {
+		RespondError(w, ErrInvalidField, "The expiry must be in the future", map[string]string{"field": "expires_at"}, http.StatusBadRequest)
+		return
+	}
+
+	token := randomToken(24)
+	link := dblayer.NewShareLink()
+	link.SetValue("object_id", object.GetValue("id"))
+	link.SetValue("user_id", principal.UserID)
+	link.SetValue("token_hash", hashShareToken(token))
+	link.SetValue("token_prefix", token[:8])
+	if req.Subtree {
+		link.SetValue("subtree", "1")
+	} else {
+		link.SetValue("subtree", "0")
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			RespondSimpleError(w, ErrInvalidField, "Invalid password", http.StatusBadRequest)
+			return
+		}
+		link.SetValue("password", string(hash))
+	}
+	link.SetValue("max_uses", strconv.Itoa(req.MaxUses))
+	link.SetValue("uses", "0")
+	if req.ExpiresAt > 0 {
+		link.SetValue("expires_at", dbTime(time.Unix(req.ExpiresAt, 0)))
+	}
+	link.SetValue("created_at", dbTime(time.Now()))
+
+	repo := dblayer.NewSystemRepository("share link of "+principal.UserID, shareTables...).WithContext(r.Context())
+	created, err := repo.Insert(link)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to create the share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := CreateShareResponse{ShareLinkInfo: shareLinkInfoOf(created), Token: token}
+	log.Printf("CreateShareHandler: user %s shared the object %s with the link %s", principal.UserID, response.ObjectID, response.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetObjectSharesHandler godoc
+// @Summary List the share links of an object
+// @Description Returns the share links of the object, without their tokens. Only for its owner and the users with objects.chmod.
+// @Tags objects
+// @Produce json
+// @Param id path string true "Object ID"
+// @Success 200 {array} ShareLinkInfo
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Object not found"
+// @Security BearerAuth
+// @Router /objects/{id}/shares [get]
+func GetObjectSharesHandler(w http.ResponseWriter, r *http.Request) {
+	principal, object, ok := shareOwnerRequest(w, r)
+	if !ok {
+		return
+	}
+	repo := dblayer.NewSystemRepository("share links of "+principal.UserID, shareTables...).WithContext(r.Context())
+	search := dblayer.NewShareLink()
+	search.SetValue("object_id", object.GetValue("id"))
+	respondShareLinks(w, repo, search)
+}
+
+// GetSharesHandler godoc
+// @Summary List my share links
+// @Description Returns the share links created by the current user, without their tokens.
+// @Tags objects
+// @Produce json
+// @Success 200 {array} ShareLinkInfo
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Security BearerAuth
+// @Router /shares [get]
+func GetSharesHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+	repo := dblayer.NewSystemRepository("share links of "+principal.UserID, shareTables...).WithContext(r.Context())
+	search := dblayer.NewShareLink()
+	search.SetValue("user_id", principal.UserID)
+	respondShareLinks(w, repo, search)
+}
+
+// DeleteShareHandler godoc
+// @Summary Revoke a share link
+// @Description Deletes a share link: it stops working at once. For who created it, the owner of the object and the users with objects.chmod.
+// @Tags objects
+// @Produce json
+// @Param id path string true "Share link ID"
+// @Success 200 {object} map[string]string "message"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Share link not found"
+// @Security BearerAuth
+// @Router /shares/{id} [delete]
+func DeleteShareHandler(w http.ResponseWriter, r *http.Request) {
+	principal, userRepo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+	if principal.Scope != nil {
+		RespondSimpleError(w, ErrForbidden, "Share links cannot be managed with an API key", http.StatusForbidden)
+		return
+	}
+	repo := dblayer.NewSystemRepository("share links of "+principal.UserID, shareTables...).WithContext(r.Context())
+	link := repo.GetEntityByID("share_links", mux.Vars(r)["id"])
+	if link == nil {
+		RespondSimpleError(w, ErrShareNotFound, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if link.GetValue("user_id") != principal.UserID && !principal.Can(dblayer.CapabilityObjectsChmod) {
+		object := userRepo.ObjectByID(link.GetValue("object_id").(string), false)
+		if object == nil || object.GetValue("owner") != principal.UserID {
+			RespondSimpleError(w, ErrForbidden, "Only who shared the object can revoke the link", http.StatusForbidden)
+			return
+		}
+	}
+	if _, err := repo.Delete(link); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to revoke the share link: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("DeleteShareHandler: user %s revoked the share link %s", principal.UserID, link.GetValue("id"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Share link revoked"})
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestShareLinks
+func TestShareLinks(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	newUser := func(name string) (dblayer.DBEntityInterface, string) {
+		login := name + Random4digits()
+		user, err := adminRepo.CreateObject("users", map[string]any{
+			"login":    login,
+			"pwd":      "share-password",
+			"fullname": name,
+		}, map[string]any{})
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		t.Cleanup(func() { adminRepo.Delete(user) })
+		return user, ApiTestDoLogin(t, login, "share-password")
+	}
+	owner, ownerToken := newUser("shareowner")
+	_, otherToken := newUser("shareother")
+	ownerRepo := SetupTestRepo(t, owner.GetValue("id").(string), []string{owner.GetValue("group_id").(string)}, AppConfig.TablePrefix)
+
+	newObject := func(tableName string, values map[string]any) string {
+		values["permissions"] = "rwx------"
+		object, err := ownerRepo.CreateObject(tableName, values, map[string]any{})
+		if err != nil {
+			t.Fatalf("Failed to create %s: %v", tableName, err)
+		}
+		t.Cleanup(func() { adminRepo.Delete(object) })
+		return object.GetValue("id").(string)
+	}
+	folderID := newObject("folders", map[string]any{"name": "Shared folder"})
+	pageID := newObject("pages", map[string]any{"name": "Shared page", "father_id": folderID})
+	subfolderID := newObject("folders", map[string]any{"name": "Shared subfolder", "father_id": folderID})
+	deepPageID := newObject("pages", map[string]any{"name": "Deep page", "father_id": subfolderID})
+	outsideID := newObject("pages", map[string]any{"name": "Not shared"})
+
+	router := mux.NewRouter()
+	router.Handle("/share/{token}", ShareMiddleware(http.HandlerFunc(GetShareHandler))).Methods("GET")
+	shareRoutes := router.PathPrefix("/share/{token}").Subrouter()
+	shareRoutes.Use(ShareMiddleware)
+	shareRoutes.HandleFunc("/content/{objectId}", GetNavigationHandler).Methods("GET")
+	shareRoutes.HandleFunc("/children/{folderId}", GetChildrenHandler).Methods("GET")
+	shareRoutes.HandleFunc("/breadcrumb/{objectId}", GetBreadcrumbHandler).Methods("GET")
+	router.Handle("/objects/{id}/shares", AuthMiddleware(http.HandlerFunc(GetObjectSharesHandler))).Methods("GET")
+	router.Handle("/objects/{id}/shares", AuthMiddleware(http.HandlerFunc(CreateShareHandler))).Methods("POST")
+	router.Handle("/shares", AuthMiddleware(http.HandlerFunc(GetSharesHandler))).Methods("GET")
+	router.Handle("/shares/{id}", AuthMiddleware(http.HandlerFunc(DeleteShareHandler))).Methods("DELETE")
+	call := func(method string, path string, header string, value string, payload any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	share := func(objectID string, req CreateShareRequest) CreateShareResponse {
+		rr := call(http.MethodPost, "/objects/"+objectID+"/shares", "Authorization", "Bearer "+ownerToken, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status Created, got %v %s", rr.Code, rr.Body.String())
+		}
+		var response CreateShareResponse
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return response
+	}
+
+	// 1. Only the owner shares
+	if rr := call(http.MethodPost, "/objects/"+folderID+"/shares", "Authorization", "Bearer "+otherToken, CreateShareRequest{}); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+	if rr := call(http.MethodPost, "/objects/"+folderID+"/shares", "Authorization", "Bearer "+ownerToken,
+		CreateShareRequest{ExpiresAt: time.Now().Add(-time.Hour).Unix()}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for an expiry in the past, got %v", rr.Code)
+	}
+
+	// 2. The folder with its subtree, with a password
+	folderShare := share(folderID, CreateShareRequest{Subtree: true, Password: "open sesame", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	sharePath := "/share/" + folderShare.Token
+	if rr := call(http.MethodGet, sharePath, "", "", nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the password to be required, got %v", rr.Code)
+	}
+	if rr := call(http.MethodGet, sharePath, "X-Share-Password", "wrong", nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong password to be refused, got %v", rr.Code)
+	}
+	rr := call(http.MethodGet, sharePath, "X-Share-Password", "open sesame", nil)
+	var object map[string]map[string]any
+	json.Unmarshal(rr.Body.Bytes(), &object)
+	if rr.Code != http.StatusOK || object["data"]["id"] != folderID || object["metadata"]["can_edit"] != false {
+		t.Fatalf("Expected the folder, read only, got %v %s", rr.Code, rr.Body.String())
+	}
+	rr = call(http.MethodGet, sharePath+"/children/"+folderID, "X-Share-Password", "open sesame", nil)
+	var children struct{ Count int }
+	json.Unmarshal(rr.Body.Bytes(), &children)
+	if rr.Code != http.StatusOK || children.Count != 2 {
+		t.Fatalf("Expected the page and the subfolder, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(http.MethodGet, sharePath+"/content/"+deepPageID, "X-Share-Password", "open sesame", nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the page below to be readable, got %v", rr.Code)
+	}
+	if rr := call(http.MethodGet, sharePath+"/content/"+outsideID, "X-Share-Password", "open sesame", nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected the page outside to be forbidden, got %v", rr.Code)
+	}
+	rr = call(http.MethodGet, sharePath+"/breadcrumb/"+deepPageID, "X-Share-Password", "open sesame", nil)
+	var breadcrumb struct{ Count int }
+	json.Unmarshal(rr.Body.Bytes(), &breadcrumb)
+	if breadcrumb.Count != 3 {
+		t.Fatalf("Expected the breadcrumb to start at the shared folder, got %s", rr.Body.String())
+	}
+
+	// 3. Only the page, at most twice: the requests of a visit count once
+	pageShare := share(pageID, CreateShareRequest{MaxUses: 2})
+	rr = call(http.MethodGet, "/share/"+pageShare.Token, "", "", nil)
+	visit := rr.Header().Get("X-Share-Visit")
+	if rr.Code != http.StatusOK || visit == "" {
+		t.Fatalf("Expected the page and a visit, got %v %s", rr.Code, rr.Body.String())
+	}
+	for i := 0; i < 3; i++ {
+		if rr := call(http.MethodGet, "/share/"+pageShare.Token, "X-Share-Visit", visit, nil); rr.Code != http.StatusOK || rr.Header().Get("X-Share-Visit") != "" {
+			t.Fatalf("Expected the page in the same visit, got %v", rr.Code)
+		}
+	}
+	if rr := call(http.MethodGet, "/share/"+folderShare.Token, "X-Share-Visit", visit, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the visit of another link not to skip its password, got %v", rr.Code)
+	}
+	if rr := call(http.MethodGet, "/share/"+pageShare.Token+"/content/"+folderID, "", "", nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected the folder to be forbidden, got %v", rr.Code)
+	}
+	if rr := call(http.MethodGet, "/share/"+pageShare.Token, "", "", nil); rr.Code != http.StatusGone {
+		t.Fatalf("Expected the link to be used up, got %v", rr.Code)
+	}
+	if rr := call(http.MethodGet, "/share/"+pageShare.Token, "X-Share-Visit", visit, nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the visit going on after the last use, got %v", rr.Code)
+	}
+
+	// 4. Listed and revoked by the owner
+	rr = call(http.MethodGet, "/objects/"+folderID+"/shares", "Authorization", "Bearer "+ownerToken, nil)
+	var links []ShareLinkInfo
+	json.Unmarshal(rr.Body.Bytes(), &links)
+	if rr.Code != http.StatusOK || len(links) != 1 || links[0].ID != folderShare.ID || !links[0].HasPassword || links[0].Uses != 5 {
+		t.Fatalf("Expected the link of the folder used 5 times, got %v %s", rr.Code, rr.Body.String())
+	}
+	rr = call(http.MethodGet, "/shares", "Authorization", "Bearer "+ownerToken, nil)
+	json.Unmarshal(rr.Body.Bytes(), &links)
+	if len(links) != 2 {
+		t.Fatalf("Expected the two links of the owner, got %s", rr.Body.String())
+	}
+	if rr := call(http.MethodDelete, "/shares/"+folderShare.ID, "Authorization", "Bearer "+otherToken, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected forbidden, got %v", rr.Code)
+	}
+	if rr := call(http.MethodDelete, "/shares/"+folderShare.ID, "Authorization", "Bearer "+ownerToken, nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v %s", rr.Code, rr.Body.String())
+	}
+	if rr := call(http.MethodGet, sharePath, "X-Share-Password", "open sesame", nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected the revoked link not to be found, got %v", rr.Code)
+	}
+}
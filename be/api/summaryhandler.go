@@ -0,0 +1,368 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// Max number of characters of content sent to the model
+const summaryMaxInput = 8000
+
+// Max number of bytes read from a text file
+const summaryMaxFileBytes = 64 * 1024
+
+// DescriptionSuggestion godoc
+// @Description Description and tags suggested by the model, to be accepted by the editor
+type DescriptionSuggestion struct {
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// SummaryResponse godoc
+// @Description Response structure for the summarize endpoint
+type SummaryResponse struct {
+	Success    bool                  `json:"success"`
+	ObjectID   string                `json:"object_id"`
+	Suggestion DescriptionSuggestion `json:"suggestion"`
+}
+
+// BackfillDescriptionsRequest godoc
+// @Description Request structure to start a description backfill
+type BackfillDescriptionsRequest struct {
+	FolderID  string `json:"folder_id"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// SummarizeObjectHandler godoc
+// @Summary Suggest a description for an object
+// @Description Asks Ollama a short summary and keyword tags for a page/news html or a text-like file content.
+// @Description Nothing is saved: the suggestion is returned for the editor to accept.
+// @Tags objects
+// @Produce json
+// @Param id path string true "Object ID"
+// @Success 200 {object} SummaryResponse "Suggested description and tags"
+// @Failure 400 {object} ErrorResponse "Object has no summarizable content"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Object not found"
+// @Failure 503 {object} ErrorResponse "Ollama service not configured"
+// @Security BearerAuth
+// @Router /objects/{id}/summarize [post]
+func SummarizeObjectHandler(w http.ResponseWriter, r *http.Request) {
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	objectID := mux.Vars(r)["id"]
+	if objectID == "" {
+		RespondSimpleError(w, ErrInvalidRequest, "Missing object ID", http.StatusBadRequest)
+		return
+	}
+	if len(objectID) == 18 {
+		objectID = strings.ReplaceAll(objectID, "-", "")
+	}
+
+	obj := repo.FullObjectById(objectID, true)
+	if obj == nil {
+		RespondSimpleError(w, ErrObjectNotFound, "Object not found", http.StatusNotFound)
+		return
+	}
+	if !repo.CheckReadPermission(obj) {
+		RespondSimpleError(w, ErrForbidden, "You don't have permission to view this object", http.StatusForbidden)
+		return
+	}
+
+	text := summarizableText(obj)
+	if text == "" {
+		RespondSimpleError(w, ErrInvalidRequest, "Object has no content to summarize", http.StatusBadRequest)
+		return
+	}
+
+	if !llmConfigured() {
+		RespondSimpleError(w, ErrServiceUnavailable, "Ollama service not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	name, _ := obj.GetValue("name").(string)
+	suggestion, err := SuggestDescription(name, text)
+	if err != nil {
+		log.Printf("SummarizeObjectHandler: failed to summarize %s: %v", objectID, err)
+		RespondSimpleError(w, ErrInternalServer, "Summarization failed", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SummaryResponse{
+		Success:    true,
+		ObjectID:   objectID,
+		Suggestion: *suggestion,
+	})
+}
+
+// BackfillDescriptionsHandler godoc
+// @Summary Backfill empty descriptions in a folder subtree
+// @Description Starts a background job that asks Ollama a description for every page, news and text file
+// @Description below the folder that has an empty description. Use /admin/jobs/{id} to follow the progress.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Param request body BackfillDescriptionsRequest true "Root folder and overwrite flag"
+// @Success 202 {object} JobProgress "Started job"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Folder not found"
+// @Failure 503 {object} ErrorResponse "Ollama service not configured"
+// @Security BearerAuth
+// @Router /admin/backfill-descriptions [post]
+func BackfillDescriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	principal, repo, ok := authorizedRequest(w, r, dblayer.CapabilityJobsRun)
+	if !ok {
+		return
+	}
+
+	var req BackfillDescriptionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.FolderID == "" {
+		RespondError(w, ErrMissingField, "Missing folder_id", map[string]string{"field": "folder_id"}, http.StatusBadRequest)
+		return
+	}
+	if len(req.FolderID) == 18 {
+		req.FolderID = strings.ReplaceAll(req.FolderID, "-", "")
+	}
+
+	folder := repo.ObjectByID(req.FolderID, true)
+	if folder == nil || !repo.CheckReadPermission(folder) {
+		RespondSimpleError(w, ErrObjectNotFound, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	if !llmConfigured() {
+		RespondSimpleError(w, ErrServiceUnavailable, "Ollama service not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	job := NewBackgroundJob("backfill-descriptions", principal.UserID)
+	// The job goes on after the response: its queries must not be cancelled with the request
+	go backfillDescriptions(repo.WithContext(context.Background()), job, req.FolderID, req.Overwrite)
+
+	log.Printf("BackfillDescriptionsHandler: started job %s on folder %s", job.ID, req.FolderID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.Snapshot())
+}
+
+// backfillDescriptions walks the subtree breadth first, updating one object at a time
+func backfillDescriptions(repo *dblayer.DBRepository, job *BackgroundJob, folderID string, overwrite bool) {
+	queue := []string{folderID}
+	visited := map[string]bool{folderID: true}
+	for len(queue) > 0 {
+		parentID := queue[0]
+		queue = queue[1:]
+
+		children := repo.GetChildren(parentID, true)
+		job.AddTotal(len(children))
+		for _, child := range children {
+			childID := child.GetValue("id").(string)
+			if !visited[childID] {
+				visited[childID] = true
+				queue = append(queue, childID)
+			}
+			updated, err := backfillDescription(repo, childID, overwrite)
+			job.Step(updated, err)
+		}
+	}
+	job.Finish(nil)
+	log.Printf("backfillDescriptions: job %s done", job.ID)
+}
+
+func backfillDescription(repo *dblayer.DBRepository, objectID string, overwrite bool) (bool, error) {
+	obj := repo.FullObjectById(objectID, true)
+	if obj == nil {
+		return false, nil
+	}
+	if description, _ := obj.GetValue("description").(string); strings.TrimSpace(description) != "" && !overwrite {
+		return false, nil
+	}
+	text := summarizableText(obj)
+	if text == "" {
+		return false, nil
+	}
+	if !repo.CheckWritePermission(obj) {
+		return false, fmt.Errorf("%s: permission denied", objectID)
+	}
+	name, _ := obj.GetValue("name").(string)
+	suggestion, err := SuggestDescription(name, text)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", objectID, err)
+	}
+	obj.SetValue("description", suggestion.Description)
+	if _, err := repo.Update(obj); err != nil {
+		return false, fmt.Errorf("%s: %v", objectID, err)
+	}
+	return true, nil
+}
+
+// Max number of descriptions suggested on save at the same time: the others are skipped
+const describeWorkers = 2
+
+var describeSlots = make(chan struct{}, describeWorkers)
+
+// suggestDescriptionOnSave starts a job suggesting a description for objects saved without one, whose result
+// is read with /admin/jobs/{id} by who saved it: the save does not wait for the model.
+// The call is charged to the Ollama quota of who saved the object.
+// It returns nil if the feature is disabled, there is nothing to suggest, all the workers are busy
+// or the quota is exhausted.
+func suggestDescriptionOnSave(obj dblayer.DBEntityInterface, owner string) *BackgroundJob {
+	if !ollamaAutoDescribe || !llmConfigured() {
+		return nil
+	}
+	if description, _ := obj.GetValue("description").(string); strings.TrimSpace(description) != "" {
+		return nil
+	}
+	text := summarizableText(obj)
+	if text == "" {
+		return nil
+	}
+	slots := describeSlots
+	select {
+	case slots <- struct{}{}:
+	default:
+		log.Printf("suggestDescriptionOnSave: all the workers are busy, skipped")
+		return nil
+	}
+	quotaKeys := []string{"user:" + owner}
+	if _, err := ollamaQuota.Acquire(quotaKeys); err != nil {
+		<-slots
+		log.Printf("suggestDescriptionOnSave: %v for %v, skipped", err, quotaKeys)
+		return nil
+	}
+	name, _ := obj.GetValue("name").(string)
+	job := NewBackgroundJob("describe", owner)
+	job.AddTotal(1)
+	go func() {
+		defer func() { <-slots }()
+		suggestion, err := suggestDescription(name, text, quotaKeys)
+		if err != nil {
+			log.Printf("suggestDescriptionOnSave: %v", err)
+		} else {
+			job.SetResult(suggestion)
+		}
+		job.Step(err == nil, err)
+		job.Finish(nil)
+	}()
+	return job
+}
+
+// SuggestDescription asks the model a one or two sentences description and a few keyword tags
+func SuggestDescription(name string, text string) (*DescriptionSuggestion, error) {
+	return suggestDescription(name, text, nil)
+}
+
+// suggestDescription is SuggestDescription charging the tokens used to the quota keys, if any
+func suggestDescription(name string, text string, quotaKeys []string) (*DescriptionSuggestion, error) {
+	if utf8.RuneCountInString(text) > summaryMaxInput {
+		text = string([]rune(text)[:summaryMaxInput])
+	}
+	prompt := "Write a short description (one or two sentences, in the same language of the content) " +
+		"and up to 5 lowercase keyword tags for the following content titled \"" + name + "\"." +
+		" Answer only with a JSON object like {\"description\": \"...\", \"tags\": [\"...\"]}.\n\n" + text
+
+	response, tokens, err := callLLM(LLMFeatureSummarize, prompt)
+	ollamaQuota.AddTokens(quotaKeys, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	suggestion := &DescriptionSuggestion{Tags: []string{}}
+	start := strings.Index(response, "{")
+	end := strings.LastIndex(response, "}")
+	if start >= 0 && end > start && json.Unmarshal([]byte(response[start:end+1]), suggestion) == nil && suggestion.Description != "" {
+		suggestion.Description = strings.TrimSpace(suggestion.Description)
+		if suggestion.Tags == nil {
+			suggestion.Tags = []string{}
+		}
+		return suggestion, nil
+	}
+
+	// The model did not follow the format: use the answer as it is
+	suggestion.Description = strings.TrimSpace(response)
+	if suggestion.Description == "" {
+		return nil, fmt.Errorf("empty summary")
+	}
+	return suggestion, nil
+}
+
+var htmlTagRegexp = regexp.MustCompile(`(?s)<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+
+// htmlToText removes tags and entities, collapsing white spaces
+func htmlToText(source string) string {
+	text := htmlTagRegexp.ReplaceAllString(source, " ")
+	text = html.UnescapeString(text)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// summarizableText returns the text content of pages, news and text-like files
+func summarizableText(obj dblayer.DBEntityInterface) string {
+	switch obj.GetTypeName() {
+	case "DBPage", "DBNews":
+		source, _ := obj.GetValue("html").(string)
+		return htmlToText(source)
+	case "DBFile":
+		dbFile, ok := obj.(*dblayer.DBFile)
+		if !ok || !isTextMime(dbFile) {
+			return ""
+		}
+		if filename, _ := dbFile.GetValue("filename").(string); filename == "" {
+			return ""
+		}
+		file, err := os.Open(dbFile.GetFullpath(nil))
+		if err != nil {
+			log.Printf("summarizableText: %v", err)
+			return ""
+		}
+		defer file.Close()
+		content, err := io.ReadAll(io.LimitReader(file, summaryMaxFileBytes))
+		if err != nil {
+			log.Printf("summarizableText: %v", err)
+			return ""
+		}
+		text := string(content)
+		if strings.Contains(dbFile.GetValue("mime").(string), "html") {
+			text = htmlToText(text)
+		}
+		return strings.TrimSpace(text)
+	}
+	return ""
+}
+
+func isTextMime(dbFile *dblayer.DBFile) bool {
+	mime, _ := dbFile.GetValue("mime").(string)
+	if strings.HasPrefix(mime, "text/") {
+		return true
+	}
+	for _, textLike := range []string{"json", "xml", "markdown", "yaml", "javascript"} {
+		if strings.Contains(mime, textLike) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestSummarizeObjectHandler
+func TestSummarizeObjectHandler(t *testing.T) {
+	useLLMProvider(t, &FakeLLMProvider{Prefix: "[tr] "})
+
+	token := ApiTestDoLogin(t, testAdminLogin, testAdminPwd)
+
+	repo := SetupTestRepo(t,
+		testUser.GetValue("id").(string),
+		[]string{testUser.GetValue("group_id").(string)},
+		AppConfig.TablePrefix)
+
+	page, err := repo.CreateObject("pages", map[string]any{
+		"name": "Summary",
+		"html": "<h2>Title</h2><p>Some &amp; content</p>",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create page: %v", err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/objects/{id}/summarize", SummarizeObjectHandler).Methods("POST")
+
+	req := httptest.NewRequest(http.MethodPost, "/objects/"+page.GetValue("id").(string)+"/summarize", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	log.Print("SummarizeObjectHandler response body:", rr.Body.String())
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v", rr.Code)
+	}
+	var response SummaryResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response JSON: %v", err)
+	}
+	// The fake model echoes the last line of the prompt, that is the text of the page
+	if response.Suggestion.Description != "[tr] Title Some & content" {
+		t.Fatalf("Unexpected description '%s'", response.Suggestion.Description)
+	}
+}
+
+// go test -v ./api -run TestBackfillDescriptions
+func TestBackfillDescriptions(t *testing.T) {
+	useLLMProvider(t, &FakeLLMProvider{Prefix: "[tr] "})
+
+	repo := SetupTestRepo(t,
+		testUser.GetValue("id").(string),
+		[]string{testUser.GetValue("group_id").(string)},
+		AppConfig.TablePrefix)
+
+	folder, err := repo.CreateObject("folders", map[string]any{"name": "backfill folder"}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	subfolder, err := repo.CreateObject("folders", map[string]any{"name": "backfill subfolder", "father_id": folder.GetValue("id")}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create subfolder: %v", err)
+	}
+	described, err := repo.CreateObject("pages", map[string]any{"name": "Described", "description": "keep me", "html": "<p>one</p>", "father_id": folder.GetValue("id")}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create page: %v", err)
+	}
+	empty, err := repo.CreateObject("pages", map[string]any{"name": "Empty", "html": "<p>two</p>", "father_id": subfolder.GetValue("id")}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create page: %v", err)
+	}
+
+	job := NewBackgroundJob("backfill-descriptions", testUser.GetValue("id").(string))
+	backfillDescriptions(repo, job, folder.GetValue("id").(string), false)
+
+	snapshot := job.Snapshot()
+	log.Printf("Job: %+v", snapshot)
+	if snapshot.Status != "done" || snapshot.Total != 3 || snapshot.Processed != 3 || snapshot.Updated != 1 {
+		t.Fatalf("Unexpected job progress: %+v", snapshot)
+	}
+	if got := repo.FullObjectById(empty.GetValue("id").(string), true).GetValue("description"); got != "[tr] two" {
+		t.Fatalf("Expected backfilled description, got '%v'", got)
+	}
+	if got := repo.FullObjectById(described.GetValue("id").(string), true).GetValue("description"); got != "keep me" {
+		t.Fatalf("Expected description to be kept, got '%v'", got)
+	}
+}
+
+// go test -v ./api -run TestSuggestDescriptionOnSave
+func TestSuggestDescriptionOnSave(t *testing.T) {
+	release := make(chan struct{})
+	prompts := make(chan string, 2)
+	useLLMProvider(t, &FakeLLMProvider{Reply: func(prompt string) string {
+		prompts <- prompt
+		<-release
+		return `{"description": "Suggested", "tags": ["later"]}`
+	}})
+	savedAutoDescribe, savedSlots, savedQuota := ollamaAutoDescribe, describeSlots, ollamaQuota
+	t.Cleanup(func() { ollamaAutoDescribe, describeSlots, ollamaQuota = savedAutoDescribe, savedSlots, savedQuota })
+	ollamaAutoDescribe = true
+	describeSlots = make(chan struct{}, 1)
+	ollamaQuota = NewQuota(1, 0)
+
+	repo := SetupTestRepo(t,
+		testUser.GetValue("id").(string),
+		[]string{testUser.GetValue("group_id").(string)},
+		AppConfig.TablePrefix)
+	owner := testUser.GetValue("id").(string)
+
+	// 1. Nothing to suggest for a described object
+	described := repo.GetInstanceByTableName("pages")
+	described.SetValue("description", "Already described")
+	described.SetValue("html", "<p>text</p>")
+	if job := suggestDescriptionOnSave(described, owner); job != nil {
+		t.Fatalf("Expected no job, got %+v", job.Snapshot())
+	}
+
+	// 2. The save does not wait for the model: the suggestion is the result of the job
+	page := repo.GetInstanceByTableName("pages")
+	page.SetValue("name", "To describe")
+	page.SetValue("html", "<p>"+strings.Repeat("è", summaryMaxInput+10)+"</p>")
+	job := suggestDescriptionOnSave(page, owner)
+	if job == nil {
+		t.Fatal("Expected a job")
+	}
+	if snapshot := job.Snapshot(); snapshot.Status != "running" || snapshot.Owner != owner || snapshot.Kind != "describe" {
+		t.Fatalf("Expected the job running while the model answers, got %+v", snapshot)
+	}
+	// The content is cut to summaryMaxInput characters, not bytes
+	if prompt := <-prompts; !utf8.ValidString(prompt) || strings.Count(prompt, "è") != summaryMaxInput {
+		t.Fatalf("Expected %d whole characters in the prompt, got %d", summaryMaxInput, strings.Count(prompt, "è"))
+	}
+	// 2b. No other job starts while the only worker is busy
+	if other := suggestDescriptionOnSave(page, owner); other != nil {
+		t.Fatalf("Expected no job while the worker is busy, got %+v", other.Snapshot())
+	}
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); job.Snapshot().Status == "running" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	snapshot := job.Snapshot()
+	if suggestion, _ := snapshot.Result.(*DescriptionSuggestion); snapshot.Status != "done" || suggestion == nil || suggestion.Description != "Suggested" {
+		t.Fatalf("Expected the suggestion as result, got %+v", snapshot)
+	}
+
+	// 2c. The suggestion is charged to the quota of who saved the object
+	describeSlots <- struct{}{} // waits for the worker to be free
+	<-describeSlots
+	if other := suggestDescriptionOnSave(page, owner); other != nil {
+		t.Fatalf("Expected no job over quota, got %+v", other.Snapshot())
+	}
+
+	// 3. Finished jobs are forgotten after a while
+	job.mu.Lock()
+	job.FinishedAt = time.Now().Add(-2 * jobRetention).Unix()
+	job.mu.Unlock()
+	running := NewBackgroundJob("describe", owner)
+	if GetBackgroundJob(job.ID) != nil || GetBackgroundJob(running.ID) == nil {
+		t.Fatal("Expected only the old finished job forgotten")
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+// Tables of the system repositories of the api, by what they are used for.
+// Creating objects needs also "users" (the current user) and the table of the father.
+var (
+	// Validation of the token of a request
+	tokenTables = []string{"oauth_tokens", "oauth_sessions"}
+	// A new session: the user still enabled, its groups, the tokens. Every login method uses them with its own tables
+	sessionTables = []string{"users", "users_groups", "users_status", "oauth_tokens", "oauth_sessions"}
+	// Login with the password, which may ask for a second factor; the LDAP password is checked with ldapLoginTables
+	passwordLoginTables = append([]string{"users_totp", "users_webauthn"}, sessionTables...)
+	ldapLoginTables     = []string{"users", "groups", "users_groups", "users_ldap"}
+	totpLoginTables     = append([]string{"users_totp"}, sessionTables...)
+	passkeyLoginTables  = append([]string{"users_webauthn"}, sessionTables...)
+	oauthLoginTables    = append([]string{"groups", "users_oauth", "users_registrations"}, sessionTables...)
+	// Rotation of the tokens of a session
+	refreshTables = []string{"users", "users_groups", "oauth_tokens", "oauth_sessions"}
+	// Sessions, second factor, passkeys and API keys of a user, managed by the user or an admin
+	accountTables = []string{"users", "users_groups", "users_totp", "users_webauthn", "oauth_tokens", "oauth_sessions", "api_keys"}
+	// Effective permissions of another user on an object: the user and its groups
+	permissionTables = []string{"users", "users_groups"}
+	// Validation of a personal API key: the key, its user and its groups, the account still enabled
+	apiKeyTables = []string{"api_keys", "users", "users_groups", "users_status"}
+	// Share links: the link, its creator and its groups
+	shareTables = []string{"share_links", "users", "users_groups", "users_status"}
+	// Capabilities of the groups of the caller
+	capabilityTables = []string{"groups_capabilities"}
+	// Self-service registration and password reset
+	registrationTables  = []string{"users", "users_registrations", "users_status"}
+	passwordResetTables = []string{"users", "users_ldap", "users_password_resets", "oauth_tokens", "oauth_sessions"}
+	// Shared store of the rate limits
+	rateLimitTables = []string{"rate_limits"}
+	// Purges of the maintenance loop, each with its own tables
+	expiredSessionTables       = []string{"oauth_tokens", "oauth_sessions"}
+	expiredRegistrationTables  = []string{"users", "users_registrations", "users_status"}
+	expiredPasswordResetTables = []string{"users_password_resets"}
+	auditLogTables             = []string{"audit_log"}
+	// Background jobs
+	ldapSyncTables   = []string{"users", "groups", "users_groups", "users_ldap", "users_status", "oauth_tokens", "oauth_sessions"}
+	digestTables     = []string{"users", "notifications", "notification_preferences"}
+	ollamaPageTables = []string{"users", "folders", "pages"}
+	mailQueueTables  = []string{"mail_queue"}
+)
@@ -4,7 +4,6 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,10 +11,6 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"rprj/be/dblayer"
-
-	"github.com/golang-jwt/jwt/v5"
 )
 
 // TelegramOAuthCallback godoc
@@ -42,7 +37,8 @@ func TelegramOAuthCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Initial callback: return HTML to decode fragment and call verify
-	html := `<!doctype html><html><head><meta charset="utf-8"></head><body><script>
+	writeHTMLPage(w, func(nonce string) string {
+		return `<!doctype html><html><head><meta charset="utf-8"></head><body><script nonce="` + nonce + `">
 	(function(){
 		try {
 			const hash = window.location.hash.substring(1);
@@ -73,10 +69,7 @@ func TelegramOAuthCallback(w http.ResponseWriter, r *http.Request) {
 		}
 	})();
 	</script></body></html>`
-
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(html))
+	})
 }
 
 // telegramVerifyAndLogin godoc
@@ -131,128 +124,8 @@ func telegramVerifyAndLogin(w http.ResponseWriter, r *http.Request) {
 		fullname = identifier
 	}
 
-	// Find or create user
-	dbContext := &dblayer.DBContext{UserID: "-1", GroupIDs: []string{"-2"}, Schema: dblayer.DbSchema}
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
-	userInst := repo.GetInstanceByTableName("users")
-	if userInst == nil {
-		RespondSimpleError(w, ErrInternalServer, "Users instance not available", http.StatusInternalServerError)
-		return
-	}
-
-	userInst.SetValue("login", identifier)
-	found, err := repo.Search(userInst, false, false, "")
-	if err != nil {
-		RespondSimpleError(w, ErrInternalServer, "Search failed", http.StatusInternalServerError)
-		return
-	}
-
-	var userID string
-	if len(found) > 0 {
-		userID = found[0].GetValue("id").(string)
-	} else {
-		userInst.SetValue("login", identifier)
-		userInst.SetValue("fullname", fullname)
-		userInst.SetValue("pwd", "")
-		// userInst.SetValue("group_id", "-4")
-		// userInst.SetValue("permissions", "rwx------")
-		userInst.SetMetadata("group_ids", []string{"-4"})
-		created, err := repo.Insert(userInst)
-		if err != nil {
-			log.Printf("TelegramOAuthCallback: failed to create user: %v", err)
-			RespondSimpleError(w, ErrInternalServer, "Failed to create user", http.StatusInternalServerError)
-			return
-		}
-		userID = created.GetValue("id").(string)
-	}
-
-	// Collect groups
-	userGroupsInstance := repo.GetInstanceByTableName("users_groups")
-	group_list := []string{}
-	if userGroupsInstance != nil {
-		userGroupsInstance.SetValue("user_id", userID)
-		ugs, _ := repo.Search(userGroupsInstance, false, false, "")
-		for _, ug := range ugs {
-			group_list = append(group_list, ug.GetValue("group_id").(string))
-		}
-	}
-
-	// Ensure primary group included
-	u := repo.GetInstanceByTableName("users")
-	u.SetValue("id", userID)
-	foundUsers, _ := repo.Search(u, false, false, "")
-	if len(foundUsers) > 0 {
-		if g := foundUsers[0].GetValue("group_id"); g != nil {
-			gp := g.(string)
-			present := false
-			for _, v := range group_list {
-				if v == gp {
-					present = true
-				}
-			}
-			if !present {
-				group_list = append(group_list, gp)
-			}
-		}
-	}
-
-	expiration := time.Now().Add(1 * time.Hour)
-	claims := &jwt.MapClaims{
-		"user_id": userID,
-		"login":   identifier,
-		"groups":  stringsJoin(group_list, ","),
-		"exp":     expiration.Unix(),
-	}
-	tokenJwt := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := tokenJwt.SignedString(JWTKey)
-	if err != nil {
-		RespondSimpleError(w, ErrInternalServer, "Could not generate token", http.StatusInternalServerError)
-		return
-	}
-
-	_ = SaveToken(repo, userID, tokenString, expiration.Unix())
-
-	// Build payload for frontend
-	groupsCSV := ""
-	for i, g := range group_list {
-		if i > 0 {
-			groupsCSV += ","
-		}
-		groupsCSV += g
-	}
-	payload := map[string]interface{}{
-		"provider":     "telegram",
-		"access_token": tokenString,
-		"expires_at":   expiration.Unix(),
-		"user_id":      userID,
-		"login":        identifier,
-		"groups":       groupsCSV,
-		"photo_url":    photoURL,
-	}
-	payloadJSON, _ := json.Marshal(payload)
-	html := fmt.Sprintf(`<!doctype html><html><head><meta charset="utf-8"></head><body><script>
-    (function(){
-      try {
-        var data = %s;
-        if (window.opener && window.opener !== window) {
-          window.opener.postMessage(data, "*");
-          window.close();
-        } else {
-          localStorage.setItem('token', data.access_token);
-          localStorage.setItem('expires_at', data.expires_at);
-          localStorage.setItem('user_id', data.user_id);
-          if (data.login) localStorage.setItem('username', data.login);
-          if (data.groups) localStorage.setItem('groups', JSON.stringify(data.groups.split(',')));
-          window.location.href = '/';
-        }
-      } catch(e) { console.error(e); window.location.href = '/'; }
-    })();
-    </script></body></html>`, payloadJSON)
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(html))
+	completeOAuthLogin(w, r, OAuthIdentity{Provider: "telegram", Issuer: "https://telegram.org", Subject: id,
+		Login: identifier, Fullname: fullname}, map[string]any{"photo_url": photoURL})
 }
 
 // verifyTelegramHash verifies Telegram Login Widget data hash
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"rprj/be/dblayer"
+)
+
+// TOTP parameters (RFC 6238 defaults, the ones every authenticator app supports)
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	// Codes of the previous and next time step are accepted too, to tolerate clock drift
+	totpSkew = 1
+	// Number of one-time recovery codes generated with the enrollment
+	totpRecoveryCodes = 10
+)
+
+// Groups whose members must use the second factor (set by InitAPI)
+var totpRequiredGroups []string
+
+// Issuer shown by the authenticator apps (set by InitAPI)
+var totpIssuer = "R-Project"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160 bit secret, base32 encoded
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpCode computes the code of a secret for a time step (RFC 4226 truncation)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// totpStep returns the time step of an instant
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// totpValidate checks a code against the secret at time t.
+// Returns the matching time step, that must be greater than lastStep so a code cannot be used twice.
+func totpValidate(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI returns the otpauth:// URI to show as a QR code to the authenticator app
+func totpProvisioningURI(secret string, account string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(totpIssuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// newRecoveryCodes returns the recovery codes to show to the user and their hashes to store
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, totpRecoveryCodes)
+	hashes := make([]string, totpRecoveryCodes)
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// getUserTOTP returns the second factor of the user, nil when there is none
+func getUserTOTP(repo *dblayer.DBRepository, userID string) dblayer.DBEntityInterface {
+	search := repo.GetInstanceByTableName("users_totp")
+	search.SetValue("user_id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return nil
+	}
+	return results[0]
+}
+
+// totpEnabled tells if the enrollment of the second factor was confirmed
+func totpEnabled(userTOTP dblayer.DBEntityInterface) bool {
+	if userTOTP == nil {
+		return false
+	}
+	_, ok := parseDBTime(userTOTP.GetValue("enabled_at"))
+	return ok
+}
+
+func totpRecoveryHashes(userTOTP dblayer.DBEntityInterface) []string {
+	value, _ := userTOTP.GetValue("recovery_codes").(string)
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+// verifySecondFactor checks a TOTP code or, when code is empty, a recovery code, and saves the
+// state of the second factor: the last time step used or the remaining recovery codes.
+func verifySecondFactor(repo *dblayer.DBRepository, userTOTP dblayer.DBEntityInterface, code string, recoveryCode string) bool {
+	normalizeDBTimes(userTOTP, "created_at", "enabled_at")
+	if code != "" {
+		secret, _ := userTOTP.GetValue("secret").(string)
+		lastStep, _ := strconv.ParseInt(fmt.Sprint(userTOTP.GetValue("last_step")), 10, 64)
+		step, ok := totpValidate(secret, code, time.Now(), lastStep)
+		if !ok {
+			return false
+		}
+		userTOTP.SetValue("last_step", step)
+	} else {
+		hashes := totpRecoveryHashes(userTOTP)
+		i := slices.Index(hashes, hashRecoveryCode(recoveryCode))
+		if recoveryCode == "" || i < 0 {
+			return false
+		}
+		userTOTP.SetValue("recovery_codes", strings.Join(slices.Delete(hashes, i, i+1), ","))
+	}
+	if _, err := repo.Update(userTOTP); err != nil {
+		return false
+	}
+	return true
+}
+
+// totpRequired tells if the policy requires the second factor to a user with these groups
+func totpRequired(groupIDs []string) bool {
+	for _, groupID := range groupIDs {
+		if slices.Contains(totpRequiredGroups, groupID) {
+			return true
+		}
+	}
+	return false
+}
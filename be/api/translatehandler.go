@@ -0,0 +1,310 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"rprj/be/dblayer"
+
+	"github.com/gorilla/mux"
+)
+
+// Languages supported by the UI (fe/src/locales)
+var translationLanguages = map[string]string{
+	"en": "English",
+	"it": "Italian",
+	"de": "German",
+	"fr": "French",
+}
+
+// Classes that can be translated: they have the html and language columns
+var translatableClasses = []string{"DBPage", "DBNews"}
+
+// TranslationInfo godoc
+// @Description Short description of a translation of an object
+type TranslationInfo struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Language string `json:"language"`
+	IsSource bool   `json:"is_source"`
+}
+
+// TranslationsResponse godoc
+// @Description Response structure for the list of translations of an object
+type TranslationsResponse struct {
+	Success      bool              `json:"success"`
+	SourceID     string            `json:"source_id"`
+	Translations []TranslationInfo `json:"translations"`
+}
+
+// sameLanguage tells whether the language of an object (e.g. "it" or "it_IT") is the target language
+func sameLanguage(language string, target string) bool {
+	return language != "" && strings.HasPrefix(strings.ToLower(language), target)
+}
+
+// TranslateObjectHandler godoc
+// @Summary Translate a page or news with AI
+// @Description Translates name, description and html of a DBPage/DBNews using the configured Ollama model.
+// @Description The translation is created as a sibling object in the same folder and linked to its source.
+// @Tags objects
+// @Produce json
+// @Param id path string true "Object ID"
+// @Param to query string true "Target language (en, it, de, fr)"
+// @Success 201 {object} ObjectResponse "Created translation"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Object not found"
+// @Failure 409 {object} ErrorResponse "Translation already exists"
+// @Failure 503 {object} ErrorResponse "Ollama service not configured"
+// @Security BearerAuth
+// @Router /objects/{id}/translate [post]
+func TranslateObjectHandler(w http.ResponseWriter, r *http.Request) {
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	objectID := mux.Vars(r)["id"]
+	if objectID == "" {
+		RespondSimpleError(w, ErrInvalidRequest, "Missing object ID", http.StatusBadRequest)
+		return
+	}
+	if len(objectID) == 18 {
+		objectID = strings.ReplaceAll(objectID, "-", "")
+	}
+
+	targetLanguage := strings.ToLower(r.URL.Query().Get("to"))
+	languageName, ok := translationLanguages[targetLanguage]
+	if !ok {
+		RespondError(w, ErrInvalidLanguage, "Unsupported target language", map[string]string{"language": targetLanguage}, http.StatusBadRequest)
+		return
+	}
+
+	source := repo.FullObjectById(objectID, true)
+	if source == nil {
+		RespondSimpleError(w, ErrObjectNotFound, "Object not found", http.StatusNotFound)
+		return
+	}
+	if !slices.Contains(translatableClasses, source.GetTypeName()) {
+		RespondSimpleError(w, ErrInvalidRequest, "Only pages and news can be translated", http.StatusBadRequest)
+		return
+	}
+	if !repo.CheckReadPermission(source) {
+		RespondSimpleError(w, ErrForbidden, "You don't have permission to view this object", http.StatusForbidden)
+		return
+	}
+
+	// The translation goes in the same folder: the user must be able to write there
+	fatherID, _ := source.GetValue("father_id").(string)
+	if fatherID != "" && fatherID != "0" {
+		father := repo.ObjectByID(fatherID, true)
+		if father == nil {
+			RespondSimpleError(w, ErrObjectNotFound, "Parent folder not found", http.StatusNotFound)
+			return
+		}
+		if !repo.CheckWritePermission(father) {
+			RespondSimpleError(w, ErrForbidden, "You don't have permission to create objects in this folder", http.StatusForbidden)
+			return
+		}
+	}
+
+	sourceLanguage, _ := source.GetValue("language").(string)
+	if sameLanguage(sourceLanguage, targetLanguage) {
+		RespondSimpleError(w, ErrInvalidRequest, "Object is already in the target language", http.StatusBadRequest)
+		return
+	}
+
+	// All translations are linked to the original object: neither it nor any of them may be in the target language
+	rootID := getTranslationSourceID(repo, objectID)
+	if rootID != objectID {
+		if root := repo.FullObjectById(rootID, true); root != nil {
+			if rootLanguage, _ := root.GetValue("language").(string); sameLanguage(rootLanguage, targetLanguage) {
+				RespondError(w, ErrTranslationExists, "The original is in this language", map[string]string{"id": rootID, "language": targetLanguage}, http.StatusConflict)
+				return
+			}
+		}
+	}
+	for _, existing := range getTranslationLinks(repo, rootID) {
+		existingID, _ := existing.GetValue("translation_id").(string)
+		translation := repo.FullObjectById(existingID, true)
+		if translation == nil {
+			continue
+		}
+		linkLanguage, _ := existing.GetValue("language").(string)
+		language, _ := translation.GetValue("language").(string)
+		if sameLanguage(linkLanguage, targetLanguage) || sameLanguage(language, targetLanguage) {
+			RespondError(w, ErrTranslationExists, "A translation in this language already exists", map[string]string{"id": existingID, "language": targetLanguage}, http.StatusConflict)
+			return
+		}
+	}
+
+	if !llmConfigured() {
+		RespondSimpleError(w, ErrServiceUnavailable, "Ollama service not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	values := map[string]any{
+		"father_id": source.GetValue("father_id"),
+		"language":  targetLanguage,
+	}
+	if fkObjID, ok := source.GetValue("fk_obj_id").(string); ok && fkObjID != "" {
+		values["fk_obj_id"] = fkObjID
+	}
+	for _, field := range []string{"name", "description", "html"} {
+		text, _ := source.GetValue(field).(string)
+		if strings.TrimSpace(text) == "" {
+			values[field] = text
+			continue
+		}
+		translated, err := translateText(text, languageName, field == "html")
+		if err != nil {
+			log.Printf("TranslateObjectHandler: failed to translate %s of %s: %v", field, objectID, err)
+			RespondSimpleError(w, ErrInternalServer, "Translation failed", http.StatusBadGateway)
+			return
+		}
+		values[field] = translated
+	}
+
+	created, err := repo.CreateObject(source.GetTableName(), values, nil)
+	if err != nil {
+		log.Printf("TranslateObjectHandler: Failed to create translation: %v", err)
+		RespondSimpleError(w, ErrInternalServer, "Failed to create translation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	createdID := created.GetValue("id").(string)
+
+	link := repo.GetInstanceByTableName("objects_translations")
+	link.SetValue("source_id", rootID)
+	link.SetValue("translation_id", createdID)
+	link.SetValue("language", targetLanguage)
+	link.SetValue("creation_date", dblayer.CurrentDateTimeString())
+	if _, err := repo.Insert(link); err != nil {
+		log.Printf("TranslateObjectHandler: Failed to link translation %s to %s: %v", createdID, rootID, err)
+		RespondSimpleError(w, ErrInternalServer, "Failed to link translation", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("TranslateObjectHandler: Created %s translation %s of %s", targetLanguage, createdID, rootID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ObjectResponse{
+		Success: true,
+		Data:    created.GetAllValues(),
+		Metadata: map[string]interface{}{
+			"classname": source.GetTypeName(),
+			"source_id": rootID,
+		},
+	})
+}
+
+// GetTranslationsHandler godoc
+// @Summary List the translations of an object
+// @Description Returns the original object and all its readable translations. Works from the source or from any translation.
+// @Tags objects
+// @Produce json
+// @Param id path string true "Object ID"
+// @Success 200 {object} TranslationsResponse "Translations"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 404 {object} ErrorResponse "Object not found"
+// @Security BearerAuth
+// @Router /objects/{id}/translations [get]
+func GetTranslationsHandler(w http.ResponseWriter, r *http.Request) {
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
+		return
+	}
+
+	objectID := mux.Vars(r)["id"]
+	if objectID == "" {
+		RespondSimpleError(w, ErrInvalidRequest, "Missing object ID", http.StatusBadRequest)
+		return
+	}
+	if len(objectID) == 18 {
+		objectID = strings.ReplaceAll(objectID, "-", "")
+	}
+
+	obj := repo.ObjectByID(objectID, true)
+	if obj == nil || !repo.CheckReadPermission(obj) {
+		RespondSimpleError(w, ErrObjectNotFound, "Object not found", http.StatusNotFound)
+		return
+	}
+
+	rootID := getTranslationSourceID(repo, objectID)
+	ids := []string{rootID}
+	for _, link := range getTranslationLinks(repo, rootID) {
+		ids = append(ids, link.GetValue("translation_id").(string))
+	}
+
+	translations := []TranslationInfo{}
+	for _, id := range ids {
+		translation := repo.FullObjectById(id, true)
+		if translation == nil || !repo.CheckReadPermission(translation) {
+			continue
+		}
+		language, _ := translation.GetValue("language").(string)
+		name, _ := translation.GetValue("name").(string)
+		translations = append(translations, TranslationInfo{
+			ID:       id,
+			Name:     name,
+			Language: language,
+			IsSource: id == rootID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TranslationsResponse{
+		Success:      true,
+		SourceID:     rootID,
+		Translations: translations,
+	})
+}
+
+// getTranslationSourceID returns the ID of the original object if objectID is a translation,
+// objectID itself otherwise
+func getTranslationSourceID(repo *dblayer.DBRepository, objectID string) string {
+	search := repo.GetInstanceByTableName("objects_translations")
+	search.SetValue("translation_id", objectID)
+	found, err := repo.Search(search, false, false, "")
+	if err != nil || len(found) == 0 {
+		return objectID
+	}
+	return found[0].GetValue("source_id").(string)
+}
+
+func getTranslationLinks(repo *dblayer.DBRepository, sourceID string) []dblayer.DBEntityInterface {
+	search := repo.GetInstanceByTableName("objects_translations")
+	search.SetValue("source_id", sourceID)
+	found, err := repo.Search(search, false, false, "language")
+	if err != nil {
+		log.Printf("getTranslationLinks: %v", err)
+		return nil
+	}
+	return found
+}
+
+// translateText asks the model to translate a single field
+func translateText(text string, languageName string, isHTML bool) (string, error) {
+	prompt := "Translate the following text to " + languageName + "."
+	if isHTML {
+		prompt += " The text is HTML: keep every tag, attribute, link and image exactly as it is and translate only the visible text."
+		prompt += " Output html code only."
+	}
+	prompt += " Do not add comments, explanations or quotes: output only the translation.\n\n" + text
+
+	translated, err := CallLLM(LLMFeatureTranslate, prompt)
+	if err != nil {
+		return "", err
+	}
+	translated = strings.TrimSpace(translated)
+	if translated == "" {
+		return "", fmt.Errorf("empty translation")
+	}
+	return translated, nil
+}
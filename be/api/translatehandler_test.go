@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestTranslateObjectHandler
+func TestTranslateObjectHandler(t *testing.T) {
+	useLLMProvider(t, &FakeLLMProvider{Prefix: "[tr] "})
+
+	token := ApiTestDoLogin(t, testAdminLogin, testAdminPwd)
+
+	repo := SetupTestRepo(t,
+		testUser.GetValue("id").(string),
+		[]string{testUser.GetValue("group_id").(string)},
+		AppConfig.TablePrefix)
+
+	folder, err := repo.CreateObject("folders", map[string]any{"name": "translations folder", "permissions": "rwxr-x---"}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	page, err := repo.CreateObject("pages", map[string]any{
+		"name":      "Hello",
+		"html":      "<p>Hello <b>world</b></p>",
+		"language":  "en",
+		"father_id": folder.GetValue("id"),
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create page: %v", err)
+	}
+	pageID := page.GetValue("id").(string)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/objects/{id}/translate", TranslateObjectHandler).Methods("POST")
+	router.HandleFunc("/objects/{id}/translations", GetTranslationsHandler).Methods("GET")
+
+	// 1. Translate to German
+	req := httptest.NewRequest(http.MethodPost, "/objects/"+pageID+"/translate?to=de", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	log.Print("TranslateObjectHandler response body:", rr.Body.String())
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status Created, got %v", rr.Code)
+	}
+	var response ObjectResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response JSON: %v", err)
+	}
+	if response.Data["language"] != "de" {
+		t.Fatalf("Expected language 'de', got '%v'", response.Data["language"])
+	}
+	if response.Data["father_id"] != folder.GetValue("id") {
+		t.Fatalf("Expected translation in folder %v, got '%v'", folder.GetValue("id"), response.Data["father_id"])
+	}
+	if response.Data["name"] != "[tr] Hello" {
+		t.Fatalf("Expected translated name, got '%v'", response.Data["name"])
+	}
+	translationID := response.Data["id"].(string)
+
+	// 2. A second German translation is refused
+	req = httptest.NewRequest(http.MethodPost, "/objects/"+pageID+"/translate?to=de", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("Expected status Conflict, got %v", rr.Code)
+	}
+
+	// 2b. Translating the translation back into the language of the original is refused too
+	req = httptest.NewRequest(http.MethodPost, "/objects/"+translationID+"/translate?to=en", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("Expected status Conflict for the language of the original, got %v", rr.Code)
+	}
+
+	// 3. Unsupported languages are refused
+	req = httptest.NewRequest(http.MethodPost, "/objects/"+pageID+"/translate?to=xx", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status BadRequest, got %v", rr.Code)
+	}
+
+	// 4. The translations are listed starting from the translation too
+	req = httptest.NewRequest(http.MethodGet, "/objects/"+translationID+"/translations", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	log.Print("GetTranslationsHandler response body:", rr.Body.String())
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v", rr.Code)
+	}
+	var translations TranslationsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &translations); err != nil {
+		t.Fatalf("Failed to parse response JSON: %v", err)
+	}
+	if translations.SourceID != pageID {
+		t.Fatalf("Expected source %s, got %s", pageID, translations.SourceID)
+	}
+	if len(translations.Translations) != 2 {
+		t.Fatalf("Expected 2 translations, got %d", len(translations.Translations))
+	}
+}
@@ -0,0 +1,558 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Lifetime of the challenge token returned by /login when the second factor is needed
+const challengeTokenDuration = 5 * time.Minute
+
+// Wrong codes accepted for one challenge token before it stops working
+const challengeMaxAttempts = 5
+
+// Purposes of the challenge tokens
+const (
+	challengeVerify = "2fa"       // the user has to enter a code
+	challengeSetup  = "2fa_setup" // the policy requires the second factor and the user has to enroll first
+)
+
+// LoginChallengeResponse godoc
+// @Description Returned by /login instead of the tokens when the second factor is needed
+type LoginChallengeResponse struct {
+	TwoFactorRequired bool     `json:"two_factor_required"`
+	SetupRequired     bool     `json:"setup_required,omitempty"`
+	Methods           []string `json:"methods,omitempty"` // totp, webauthn
+	ChallengeToken    string   `json:"challenge_token"`
+	ExpiresAt         int64    `json:"expires_at"`
+}
+
+// TwoFactorLoginRequest godoc
+// @Description Second step of the login: the challenge token and a TOTP code or a recovery code
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code,omitempty" example:"123456"`
+	RecoveryCode   string `json:"recovery_code,omitempty" example:"abcd-efgh"`
+}
+
+// TwoFactorLoginResponse godoc
+// @Description Tokens of the new session, plus the recovery codes when the login completed the enrollment
+type TwoFactorLoginResponse struct {
+	TokenResponse
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// TwoFactorCodeRequest godoc
+// @Description A TOTP code or a recovery code
+type TwoFactorCodeRequest struct {
+	Code         string `json:"code,omitempty" example:"123456"`
+	RecoveryCode string `json:"recovery_code,omitempty" example:"abcd-efgh"`
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+type TwoFactorEnrollResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// Failed attempts for each challenge token, by jti
+var challengeAttempts = map[string]challengeAttempt{}
+var challengeAttemptsMu sync.Mutex
+
+type challengeAttempt struct {
+	count     int
+	expiresAt time.Time
+}
+
+// challengeKey signs the challenge tokens: they are not valid as access tokens
+func challengeKey() []byte {
+	return append([]byte("2fa:"), JWTKey...)
+}
+
+func newChallengeToken(userID string, purpose string) (string, int64, error) {
+	expiresAt := time.Now().Add(challengeTokenDuration).Unix()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID,
+		"purpose": purpose,
+		"jti":     randomToken(16),
+		"exp":     expiresAt,
+	})
+	tokenString, err := token.SignedString(challengeKey())
+	return tokenString, expiresAt, err
+}
+
+// parseChallengeToken returns user ID, purpose and jti of a valid challenge token
+func parseChallengeToken(tokenString string) (string, string, string, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return challengeKey(), nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil || !token.Valid {
+		return "", "", "", fmt.Errorf("invalid or expired challenge token")
+	}
+	userID, _ := claims["user_id"].(string)
+	purpose, _ := claims["purpose"].(string)
+	jti, _ := claims["jti"].(string)
+	if userID == "" || jti == "" || (purpose != challengeVerify && purpose != challengeSetup) {
+		return "", "", "", fmt.Errorf("invalid challenge token")
+	}
+	if challengeExhausted(jti) {
+		return "", "", "", fmt.Errorf("too many attempts, log in again")
+	}
+	return userID, purpose, jti, nil
+}
+
+// twoFactorLockoutKey is the account of the rate limiter whose failed logins are the wrong codes of a user
+func twoFactorLockoutKey(userID string) string {
+	return "2fa:" + userID
+}
+
+func challengeExhausted(jti string) bool {
+	challengeAttemptsMu.Lock()
+	defer challengeAttemptsMu.Unlock()
+	return challengeAttempts[jti].count >= challengeMaxAttempts
+}
+
+// challengeFailed counts a wrong code, or burns the challenge token when failures is challengeMaxAttempts
+func challengeFailed(jti string, failures int) {
+	challengeAttemptsMu.Lock()
+	defer challengeAttemptsMu.Unlock()
+	now := time.Now()
+	for key, attempt := range challengeAttempts {
+		if attempt.expiresAt.Before(now) {
+			delete(challengeAttempts, key)
+		}
+	}
+	attempt := challengeAttempts[jti]
+	attempt.count += failures
+	attempt.expiresAt = now.Add(challengeTokenDuration)
+	challengeAttempts[jti] = attempt
+}
+
+// secondFactorMethods returns the second factors the user can use to complete the login
+func secondFactorMethods(repo *dblayer.DBRepository, userID string) []string {
+	methods := []string{}
+	if totpEnabled(getUserTOTP(repo, userID)) {
+		methods = append(methods, "totp")
+	}
+	if webAuthn != nil && len(getWebAuthnCredentials(repo, userID)) > 0 {
+		methods = append(methods, "webauthn")
+	}
+	return methods
+}
+
+// respondLoginChallenge answers /login when the user has to enter the second factor, with one of methods, or enroll it
+func respondLoginChallenge(w http.ResponseWriter, userID string, methods []string) {
+	purpose := challengeVerify
+	setup := len(methods) == 0
+	if setup {
+		purpose = challengeSetup
+	}
+	challenge, expiresAt, err := newChallengeToken(userID, purpose)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Could not generate challenge", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LoginChallengeResponse{
+		TwoFactorRequired: true,
+		SetupRequired:     setup,
+		Methods:           methods,
+		ChallengeToken:    challenge,
+		ExpiresAt:         expiresAt,
+	})
+}
+
+// enrollTOTP stores a new, not yet confirmed, secret for the user
+func enrollTOTP(repo *dblayer.DBRepository, userID string) (string, error) {
+	secret := newTOTPSecret()
+	userTOTP := getUserTOTP(repo, userID)
+	if userTOTP == nil {
+		userTOTP = repo.GetInstanceByTableName("users_totp")
+		userTOTP.SetValue("user_id", userID)
+		userTOTP.SetValue("secret", secret)
+		userTOTP.SetValue("last_step", 0)
+		userTOTP.SetValue("recovery_codes", "")
+		userTOTP.SetValue("created_at", dbTime(time.Now()))
+		_, err := repo.Insert(userTOTP)
+		return secret, err
+	}
+	userTOTP.SetValue("secret", secret)
+	userTOTP.SetValue("last_step", 0)
+	userTOTP.SetValue("recovery_codes", "")
+	userTOTP.SetValue("created_at", dbTime(time.Now()))
+	userTOTP.SetValue("enabled_at", nil)
+	_, err := repo.Update(userTOTP)
+	return secret, err
+}
+
+// confirmTOTP enables the pending second factor of the user when the code is valid; returns the recovery codes
+func confirmTOTP(repo *dblayer.DBRepository, userTOTP dblayer.DBEntityInterface, code string) ([]string, bool) {
+	secret, _ := userTOTP.GetValue("secret").(string)
+	step, ok := totpValidate(secret, code, time.Now(), 0)
+	if !ok {
+		return nil, false
+	}
+	codes, hashes := newRecoveryCodes()
+	normalizeDBTimes(userTOTP, "created_at")
+	userTOTP.SetValue("last_step", step)
+	userTOTP.SetValue("recovery_codes", strings.Join(hashes, ","))
+	userTOTP.SetValue("enabled_at", dbTime(time.Now()))
+	if _, err := repo.Update(userTOTP); err != nil {
+		log.Print("confirmTOTP:", err)
+		return nil, false
+	}
+	return codes, true
+}
+
+// getLogin returns the login of a user
+func getLogin(repo *dblayer.DBRepository, userID string) (string, string) {
+	search := repo.GetInstanceByTableName("users")
+	search.SetValue("id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return "", ""
+	}
+	login, _ := results[0].GetValue("login").(string)
+	groupID, _ := results[0].GetValue("group_id").(string)
+	return login, groupID
+}
+
+// LoginTwoFactorSetupHandler godoc
+// @Summary Enroll the second factor during the login
+// @Description When /login answers with setup_required the user has to enroll the second factor first:
+// @Description this returns the secret and the otpauth:// URI to show as QR code, then /login/2fa completes the login.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body TwoFactorLoginRequest true "Challenge token"
+// @Success 200 {object} TwoFactorEnrollResponse
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Invalid or expired challenge token"
+// @Router /login/2fa/setup [post]
+func LoginTwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	var req TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	userID, purpose, _, err := parseChallengeToken(req.ChallengeToken)
+	if err != nil || purpose != challengeSetup {
+		RespondSimpleError(w, ErrInvalidToken, "Invalid or expired challenge token", http.StatusUnauthorized)
+		return
+	}
+
+	repo := dblayer.NewSystemRepository("second factor login", totpLoginTables...)
+
+	if totpEnabled(getUserTOTP(repo, userID)) {
+		RespondSimpleError(w, ErrTwoFactorAlreadyEnabled, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	login, _ := getLogin(repo, userID)
+	secret, err := enrollTOTP(repo, userID)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to enroll: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TwoFactorEnrollResponse{Secret: secret, ProvisioningURI: totpProvisioningURI(secret, login)})
+}
+
+// LoginTwoFactorHandler godoc
+// @Summary Complete the login with the second factor
+// @Description Exchanges the challenge token returned by /login and a TOTP code (or a one-time recovery code) for the tokens.
+// @Description When the login required the enrollment, the code confirms it and the recovery codes are returned.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body TwoFactorLoginRequest true "Challenge token and code"
+// @Success 200 {object} TwoFactorLoginResponse "token and user info"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Invalid challenge token or code"
+// @Failure 429 {object} ErrorResponse "Too many wrong codes, the second factor is locked for a while"
+// @Router /login/2fa [post]
+func LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var req TwoFactorLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	userID, purpose, jti, err := parseChallengeToken(req.ChallengeToken)
+	if err != nil {
+		RespondSimpleError(w, ErrInvalidToken, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// A new challenge needs only the password: the wrong codes are counted for the account, across its challenges
+	lockoutLogin := twoFactorLockoutKey(userID)
+	if locked := rateLimiter.LoginLocked(lockoutLogin); locked > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(locked.Seconds())+1))
+		RespondSimpleError(w, ErrAccountLocked, "Too many failed codes, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	repo := dblayer.NewSystemRepository("second factor login", totpLoginTables...)
+
+	userTOTP := getUserTOTP(repo, userID)
+	var recoveryCodes []string
+	ok := false
+	switch {
+	case totpEnabled(userTOTP):
+		ok = verifySecondFactor(repo, userTOTP, req.Code, req.RecoveryCode)
+	case purpose == challengeSetup && userTOTP != nil:
+		recoveryCodes, ok = confirmTOTP(repo, userTOTP, req.Code)
+	default:
+		RespondSimpleError(w, ErrTwoFactorNotEnabled, "Two-factor authentication is not enrolled", http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		challengeFailed(jti, 1)
+		rateLimiter.LoginFailed(lockoutLogin)
+		RespondSimpleError(w, ErrTwoFactorInvalidCode, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	rateLimiter.LoginSucceeded(lockoutLogin)
+	// The challenge cannot be used again
+	challengeFailed(jti, challengeMaxAttempts)
+
+	login, primaryGroupID := getLogin(repo, userID)
+	groups, err := GetUserGroupIDs(repo, userID, primaryGroupID)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get user groups: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := StartSession(repo, r, userID, login, groups, "password+totp")
+	if err != nil {
+		respondSessionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TwoFactorLoginResponse{TokenResponse: *resp, RecoveryCodes: recoveryCodes})
+}
+
+// GetTwoFactorHandler godoc
+// @Summary Second factor status
+// @Description Tells if the user enabled the second factor, if the policy requires it and how many recovery codes are left.
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} TwoFactorStatus
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/2fa [get]
+func GetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, _, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	status := TwoFactorStatus{}
+	if userTOTP := getUserTOTP(repo, userID); totpEnabled(userTOTP) {
+		status.Enabled = true
+		status.RecoveryCodesLeft = len(totpRecoveryHashes(userTOTP))
+	}
+	_, primaryGroupID := getLogin(repo, userID)
+	if groups, err := GetUserGroupIDs(repo, userID, primaryGroupID); err == nil {
+		status.Required = totpRequired(groups)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// EnrollTwoFactorHandler godoc
+// @Summary Start the enrollment of the second factor
+// @Description Generates a new secret; it becomes active when confirmed with a code by /users/{id}/2fa/confirm.
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} TwoFactorEnrollResponse
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 409 {object} ErrorResponse "Already enabled"
+// @Security BearerAuth
+// @Router /users/{id}/2fa/enroll [post]
+func EnrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, self, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if !self {
+		RespondSimpleError(w, ErrForbidden, "Only the user can enroll the second factor", http.StatusForbidden)
+		return
+	}
+	if totpEnabled(getUserTOTP(repo, userID)) {
+		RespondSimpleError(w, ErrTwoFactorAlreadyEnabled, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	login, _ := getLogin(repo, userID)
+	secret, err := enrollTOTP(repo, userID)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to enroll: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TwoFactorEnrollResponse{Secret: secret, ProvisioningURI: totpProvisioningURI(secret, login)})
+}
+
+// ConfirmTwoFactorHandler godoc
+// @Summary Enable the second factor
+// @Description Confirms the enrollment with a code of the authenticator app and returns the one-time recovery codes.
+// @Description The recovery codes are shown only now.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param request body TwoFactorCodeRequest true "TOTP code"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 400 {object} ErrorResponse "Not enrolled or invalid code"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/2fa/confirm [post]
+func ConfirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, self, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if !self {
+		RespondSimpleError(w, ErrForbidden, "Only the user can enroll the second factor", http.StatusForbidden)
+		return
+	}
+	var req TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	userTOTP := getUserTOTP(repo, userID)
+	if userTOTP == nil {
+		RespondSimpleError(w, ErrTwoFactorNotEnabled, "Two-factor authentication is not enrolled", http.StatusBadRequest)
+		return
+	}
+	if totpEnabled(userTOTP) {
+		RespondSimpleError(w, ErrTwoFactorAlreadyEnabled, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	codes, ok := confirmTOTP(repo, userTOTP, req.Code)
+	if !ok {
+		RespondSimpleError(w, ErrTwoFactorInvalidCode, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	log.Printf("ConfirmTwoFactorHandler: two-factor authentication enabled for user %s", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodesHandler godoc
+// @Summary Generate new recovery codes
+// @Description Replaces the recovery codes, the old ones stop working. Requires a valid TOTP code.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param request body TwoFactorCodeRequest true "TOTP code"
+// @Success 200 {object} RecoveryCodesResponse
+// @Failure 400 {object} ErrorResponse "Not enabled or invalid code"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/2fa/recovery-codes [post]
+func RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, self, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if !self {
+		RespondSimpleError(w, ErrForbidden, "Only the user can generate recovery codes", http.StatusForbidden)
+		return
+	}
+	var req TwoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	userTOTP := getUserTOTP(repo, userID)
+	if !totpEnabled(userTOTP) {
+		RespondSimpleError(w, ErrTwoFactorNotEnabled, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if req.Code == "" || !verifySecondFactor(repo, userTOTP, req.Code, "") {
+		RespondSimpleError(w, ErrTwoFactorInvalidCode, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	normalizeDBTimes(userTOTP, "created_at", "enabled_at")
+	userTOTP.SetValue("recovery_codes", strings.Join(hashes, ","))
+	if _, err := repo.Update(userTOTP); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to save recovery codes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTwoFactorHandler godoc
+// @Summary Disable the second factor
+// @Description Users need a TOTP code or a recovery code; admins can reset the second factor of the other users without.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param request body TwoFactorCodeRequest false "TOTP code or recovery code"
+// @Success 200 {object} map[string]string "message"
+// @Failure 400 {object} ErrorResponse "Invalid code"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/2fa [delete]
+func DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, self, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	userTOTP := getUserTOTP(repo, userID)
+	if userTOTP == nil {
+		RespondSimpleError(w, ErrTwoFactorNotEnabled, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if self && totpEnabled(userTOTP) {
+		var req TwoFactorCodeRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if !verifySecondFactor(repo, userTOTP, req.Code, req.RecoveryCode) {
+			RespondSimpleError(w, ErrTwoFactorInvalidCode, "Invalid code", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := repo.Delete(userTOTP); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to disable: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("DisableTwoFactorHandler: two-factor authentication disabled for user %s", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
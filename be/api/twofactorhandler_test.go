@@ -0,0 +1,271 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rprj/be/models"
+
+	"github.com/gorilla/mux"
+)
+
+// go test -v ./api -run TestTOTPCode
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors (SHA1), truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := totpCode(secret, totpStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatalf("totpCode failed: %v", err)
+		}
+		if code != expected {
+			t.Errorf("At %d expected %s, got %s", unix, expected, code)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	step, ok := totpValidate(secret, "005924", now, 0)
+	if !ok {
+		t.Fatalf("Expected the code to be valid")
+	}
+	if _, ok := totpValidate(secret, "005924", now, step); ok {
+		t.Errorf("Expected a used code to be rejected")
+	}
+	if _, ok := totpValidate(secret, "005924", now.Add(5*time.Minute), 0); ok {
+		t.Errorf("Expected an old code to be rejected")
+	}
+
+	uri := totpProvisioningURI(secret, "john doe")
+	if !strings.HasPrefix(uri, "otpauth://totp/") || !strings.Contains(uri, "secret="+secret) || !strings.Contains(uri, ":john%20doe?") {
+		t.Errorf("Unexpected provisioning URI %s", uri)
+	}
+}
+
+// go test -v ./api -run TestTwoFactorLogin
+func TestTwoFactorLogin(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	login := "totp" + Random4digits()
+	user, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    login,
+		"pwd":      "secret" + login,
+		"fullname": "TOTP test",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer adminRepo.Delete(user)
+	userID := user.GetValue("id").(string)
+
+	post := func(handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(jsonBody))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	router := mux.NewRouter()
+	router.Use(AuthMiddleware)
+	router.HandleFunc("/users/{id}/2fa", GetTwoFactorHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/2fa", DisableTwoFactorHandler).Methods("DELETE")
+	router.HandleFunc("/users/{id}/2fa/enroll", EnrollTwoFactorHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/2fa/confirm", ConfirmTwoFactorHandler).Methods("POST")
+	call := func(method string, path string, token string, body any) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	credentials := Credentials{Login: login, Pwd: "secret" + login}
+
+	// 1. Without second factor the login returns the tokens
+	var tokens TokenResponse
+	json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &tokens)
+	if tokens.AccessToken == "" {
+		t.Fatalf("Expected the tokens")
+	}
+
+	// 2. Enrollment
+	rr := call(http.MethodPost, "/users/"+userID+"/2fa/enroll", tokens.AccessToken, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Enroll: expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	var enroll TwoFactorEnrollResponse
+	json.Unmarshal(rr.Body.Bytes(), &enroll)
+	if enroll.Secret == "" || !strings.Contains(enroll.ProvisioningURI, login) {
+		t.Fatalf("Unexpected enrollment %s", rr.Body.String())
+	}
+	if rr := call(http.MethodPost, "/users/"+userID+"/2fa/confirm", tokens.AccessToken, TwoFactorCodeRequest{Code: "000000"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Confirm with a wrong code: expected status 400, got %v", rr.Code)
+	}
+	now := time.Now()
+	code, _ := totpCode(enroll.Secret, totpStep(now))
+	rr = call(http.MethodPost, "/users/"+userID+"/2fa/confirm", tokens.AccessToken, TwoFactorCodeRequest{Code: code})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Confirm: expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	var recovery RecoveryCodesResponse
+	json.Unmarshal(rr.Body.Bytes(), &recovery)
+	if len(recovery.RecoveryCodes) != totpRecoveryCodes {
+		t.Fatalf("Expected %d recovery codes, got %s", totpRecoveryCodes, rr.Body.String())
+	}
+
+	// 3. Now the login returns a challenge, that is not an access token
+	var challenge LoginChallengeResponse
+	json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &challenge)
+	if !challenge.TwoFactorRequired || challenge.SetupRequired || challenge.ChallengeToken == "" {
+		t.Fatalf("Expected a challenge, got %+v", challenge)
+	}
+	if rr := call(http.MethodGet, "/users/"+userID+"/2fa", challenge.ChallengeToken, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the challenge token to be refused, got %v", rr.Code)
+	}
+	if _, err := GetClaimsFromRequest(func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+challenge.ChallengeToken)
+		return req
+	}()); err == nil {
+		t.Fatalf("Expected the challenge token to have no claims")
+	}
+
+	// 4. Wrong code, reused code, then the next code
+	if rr := post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, Code: "000000"}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong code to be refused, got %v", rr.Code)
+	}
+	if rr := post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, Code: code}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a used code to be refused, got %v", rr.Code)
+	}
+	nextCode, _ := totpCode(enroll.Secret, totpStep(now)+1)
+	rr = post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, Code: nextCode})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	json.Unmarshal(rr.Body.Bytes(), &tokens)
+	if tokens.AccessToken == "" || tokens.UserID != userID {
+		t.Fatalf("Expected the tokens, got %s", rr.Body.String())
+	}
+	// The challenge cannot be used twice
+	if rr := post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, RecoveryCode: recovery.RecoveryCodes[0]}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the used challenge to be refused, got %v", rr.Code)
+	}
+
+	// 5. Recovery codes work once
+	json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &challenge)
+	if rr := post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, RecoveryCode: strings.ToUpper(recovery.RecoveryCodes[0])}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the recovery code to work, got %v: %s", rr.Code, rr.Body.String())
+	}
+	json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &challenge)
+	if rr := post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, RecoveryCode: recovery.RecoveryCodes[0]}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the used recovery code to be refused, got %v", rr.Code)
+	}
+	rr = call(http.MethodGet, "/users/"+userID+"/2fa", tokens.AccessToken, nil)
+	var status TwoFactorStatus
+	json.Unmarshal(rr.Body.Bytes(), &status)
+	if !status.Enabled || status.Required || status.RecoveryCodesLeft != totpRecoveryCodes-1 {
+		t.Fatalf("Unexpected status %s", rr.Body.String())
+	}
+
+	// 5b. Too many wrong codes lock the second factor of the account, across its challenges
+	savedLimiter := rateLimiter
+	t.Cleanup(func() { rateLimiter = savedLimiter })
+	rateLimiter = NewRateLimiter(models.RateLimitConfig{LockoutThreshold: 2, LockoutSeconds: 60})
+	for i := 0; i < 2; i++ {
+		json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &challenge)
+		if rr := post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, Code: "000000"}); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected a wrong code to be refused, got %v", rr.Code)
+		}
+	}
+	json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &challenge)
+	if rr := post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, RecoveryCode: recovery.RecoveryCodes[1]}); rr.Code != http.StatusTooManyRequests ||
+		rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected the second factor locked, got %v", rr.Code)
+	}
+	rateLimiter = savedLimiter
+
+	// 6. Disable with a recovery code
+	if rr := call(http.MethodDelete, "/users/"+userID+"/2fa", tokens.AccessToken, TwoFactorCodeRequest{}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected disable without code to fail, got %v", rr.Code)
+	}
+	if rr := call(http.MethodDelete, "/users/"+userID+"/2fa", tokens.AccessToken, TwoFactorCodeRequest{RecoveryCode: recovery.RecoveryCodes[1]}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected disable to work, got %v: %s", rr.Code, rr.Body.String())
+	}
+	json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &tokens)
+	if tokens.AccessToken == "" {
+		t.Fatalf("Expected the tokens after disabling the second factor")
+	}
+}
+
+// go test -v ./api -run TestTwoFactorPolicy
+func TestTwoFactorPolicy(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	login := "totppolicy" + Random4digits()
+	user, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    login,
+		"pwd":      "secret" + login,
+		"fullname": "TOTP policy test",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer adminRepo.Delete(user)
+
+	previous := totpRequiredGroups
+	totpRequiredGroups = []string{user.GetValue("group_id").(string)}
+	t.Cleanup(func() { totpRequiredGroups = previous })
+
+	post := func(handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(jsonBody))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	var challenge LoginChallengeResponse
+	json.Unmarshal(post(LoginHandler, Credentials{Login: login, Pwd: "secret" + login}).Body.Bytes(), &challenge)
+	if !challenge.TwoFactorRequired || !challenge.SetupRequired {
+		t.Fatalf("Expected the setup to be required, got %+v", challenge)
+	}
+	// Nothing enrolled yet
+	if rr := post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, Code: "000000"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 before the setup, got %v", rr.Code)
+	}
+
+	rr := post(LoginTwoFactorSetupHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Setup: expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	var enroll TwoFactorEnrollResponse
+	json.Unmarshal(rr.Body.Bytes(), &enroll)
+	code, _ := totpCode(enroll.Secret, totpStep(time.Now()))
+	rr = post(LoginTwoFactorHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, Code: code})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	var resp TwoFactorLoginResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.AccessToken == "" || len(resp.RecoveryCodes) != totpRecoveryCodes {
+		t.Fatalf("Expected tokens and recovery codes, got %s", rr.Body.String())
+	}
+
+	// The next login asks for the code
+	challenge = LoginChallengeResponse{}
+	json.Unmarshal(post(LoginHandler, Credentials{Login: login, Pwd: "secret" + login}).Body.Bytes(), &challenge)
+	if !challenge.TwoFactorRequired || challenge.SetupRequired {
+		t.Fatalf("Expected a challenge, got %+v", challenge)
+	}
+	if rr := post(LoginTwoFactorSetupHandler, TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the setup to be refused once enabled, got %v", rr.Code)
+	}
+}
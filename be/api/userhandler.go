@@ -29,23 +29,11 @@ func GetAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 	searchBy := r.URL.Query().Get("search")
 	orderBy := r.URL.Query().Get("order_by")
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	search := repo.GetInstanceByTableName("users")
 	if search == nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to create user instance", http.StatusInternalServerError)
@@ -96,21 +84,11 @@ func GetUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	user := repo.GetInstanceByTableName("users")
 	if user == nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to create user instance", http.StatusInternalServerError)
@@ -147,12 +125,14 @@ func GetUserHandler(w http.ResponseWriter, r *http.Request) {
 		groupIDs[i] = ug.GetValue("group_id").(string)
 	}
 
+	enabled, _ := userEnabled(getUserStatus(repo, id))
 	response := map[string]interface{}{
 		"id":        user.GetValue("id"),
 		"login":     user.GetValue("login"),
 		"fullname":  user.GetValue("fullname"),
 		"group_id":  user.GetValue("group_id"),
 		"group_ids": groupIDs,
+		"enabled":   enabled,
 	}
 
 	json.NewEncoder(w).Encode(response)
@@ -197,22 +177,11 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authorizedRequest(w, r, dblayer.CapabilityUsersManage)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	// dblayer.InitDBConnection()
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	dbUser := repo.GetInstanceByTableName("users")
 	if dbUser == nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to create user instance", http.StatusInternalServerError)
@@ -289,20 +258,20 @@ func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
-
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
+	if principal.IsAPIKey() {
+		RespondSimpleError(w, ErrForbidden, "The account cannot be managed with an API key", http.StatusForbidden)
+		return
+	}
+	// Users can update their own profile, but not their groups
+	canManage := principal.Can(dblayer.CapabilityUsersManage)
+	if id != principal.UserID && !canManage {
+		RespondError(w, ErrForbidden, "You are not allowed to do this", map[string]string{"capability": dblayer.CapabilityUsersManage}, http.StatusForbidden)
+		return
 	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
 
 	user := repo.GetInstanceByTableName("users")
 	if user == nil {
@@ -316,10 +285,12 @@ func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 	if req.Pwd != "" {
 		user.SetValue("pwd", req.Pwd)
 	}
-	if req.GroupID != "" {
-		user.SetValue("group_id", req.GroupID)
+	if canManage {
+		if req.GroupID != "" {
+			user.SetValue("group_id", req.GroupID)
+		}
+		user.SetMetadata("group_ids", req.GroupIDs)
 	}
-	user.SetMetadata("group_ids", req.GroupIDs)
 
 	u, err := repo.Update(user)
 	if err != nil {
@@ -357,21 +328,11 @@ func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	_, repo, ok := authorizedRequest(w, r, dblayer.CapabilityUsersManage)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	user := repo.GetInstanceByTableName("users")
 	if user == nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to create user instance", http.StatusInternalServerError)
@@ -379,7 +340,7 @@ func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	user.SetValue("id", id)
 
-	_, err = repo.Delete(user)
+	_, err := repo.Delete(user)
 	if err != nil {
 		RespondSimpleError(w, ErrInternalServer, "Failed to delete user: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -388,6 +349,67 @@ func DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// SetUserEnabledRequest godoc
+// @Description The switch of a user
+type SetUserEnabledRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// SetUserEnabledHandler godoc
+//
+//	@Summary enables or disables a user
+//	@Description A disabled user cannot log in, use API keys or share links, and is logged out everywhere.
+//	@Description Enabling a user lifts also the switch of the LDAP sync and of an unverified registration.
+//	@Tags users
+//	@Accept json
+//	@Produce json
+//	@Param id path string true "User ID"
+//	@Param request body SetUserEnabledRequest true "The switch"
+//	@Success 200 {object} map[string]interface{} "The switch of the user"
+//	@Failure 400 {object} ErrorResponse "Invalid request"
+//	@Failure 401 {object} ErrorResponse "Unauthorized"
+//	@Failure 403 {object} ErrorResponse "Forbidden"
+//	@Failure 404 {object} ErrorResponse "User not found"
+//	@Failure 500 {object} ErrorResponse "Internal server error"
+//	@Security BearerAuth
+//	@Router /users/{id}/enabled [put]
+func SetUserEnabledHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var req SetUserEnabledRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	principal, repo, ok := authorizedRequest(w, r, dblayer.CapabilityUsersManage)
+	if !ok {
+		return
+	}
+	if !req.Enabled && id == principal.UserID {
+		RespondSimpleError(w, ErrInvalidRequest, "You cannot disable yourself", http.StatusBadRequest)
+		return
+	}
+	if login, _ := getLogin(repo, id); login == "" {
+		RespondError(w, ErrUserNotFound, "User not found", map[string]string{"id": id}, http.StatusNotFound)
+		return
+	}
+
+	if err := setUserEnabled(repo, id, req.Enabled, disabledByAdmin); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to update the user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !req.Enabled {
+		sessions, _ := getSessions(repo, id)
+		for _, session := range sessions {
+			RevokeSession(repo, session.GetValue("session_id").(string))
+		}
+	}
+	log.Printf("SetUserEnabledHandler: user %s enabled=%v by %s", id, req.Enabled, principal.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "enabled": req.Enabled})
+}
+
 // GetUserPersonHandler godoc
 //
 //	@Summary gets or creates a Person record linked to the user
@@ -406,21 +428,11 @@ func GetUserPersonHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userId := vars["userId"]
 
-	claims, err := GetClaimsFromRequest(r)
-	if err != nil {
-		RespondSimpleError(w, ErrUnauthorized, "Unauthorized", http.StatusUnauthorized)
+	principal, repo, ok := authenticatedRequest(w, r)
+	if !ok {
 		return
 	}
 
-	dbContext := &dblayer.DBContext{
-		UserID:   claims["user_id"],
-		GroupIDs: strings.Split(claims["groups"], ","),
-		Schema:   dblayer.DbSchema,
-	}
-
-	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
-	repo.Verbose = false
-
 	// Search for existing person with fk_users_id = userId
 	person := repo.GetInstanceByTableName("people")
 	if person == nil {
@@ -429,7 +441,7 @@ func GetUserPersonHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if userId == "" {
-		userId = claims["user_id"]
+		userId = principal.UserID
 		log.Print("UserId not provided, using claim user_id: ", userId)
 	}
 	person.SetValue("fk_users_id", userId)
@@ -478,9 +490,9 @@ func GetUserPersonHandler(w http.ResponseWriter, r *http.Request) {
 	newPerson := repo.GetInstanceByTableName("people")
 	newPerson.SetValue("name", fullname)
 	newPerson.SetValue("fk_users_id", userId)
-	newPerson.SetValue("owner", claims["user_id"])
+	newPerson.SetValue("owner", principal.UserID)
 	// Note: with this setting, only admins can see the person record
-	newPerson.SetValue("group_id", currentUser.GetValue("group_id")) //strings.Split(claims["groups"], ",")[0]) // First group
+	newPerson.SetValue("group_id", currentUser.GetValue("group_id")) //principal.GroupIDs[0]) // First group
 	newPerson.SetValue("permissions", "rwx------")                   // Private by default
 
 	createdPerson, err := repo.Insert(newPerson)
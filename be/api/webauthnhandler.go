@@ -0,0 +1,578 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"rprj/be/dblayer"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// WebAuthn relying party, nil when webauthn_rp_id is not configured (set by InitAPI)
+var webAuthn *webauthn.WebAuthn
+
+// Purposes of the ceremony tokens, that carry the WebAuthn session between begin and finish
+const (
+	ceremonyRegister = "webauthn_register"
+	ceremonyLogin    = "webauthn_login"
+)
+
+// NewWebAuthn builds the relying party: rpID is the domain of the site, origins the URLs of the frontend
+func NewWebAuthn(rpID string, displayName string, origins []string) (*webauthn.WebAuthn, error) {
+	if rpID == "" {
+		return nil, nil
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: displayName,
+		RPOrigins:     origins,
+	})
+}
+
+// WebAuthnBeginResponse godoc
+// @Description Options for navigator.credentials.create() or .get() and the token to send back with the result
+type WebAuthnBeginResponse struct {
+	Options       any    `json:"options"`
+	CeremonyToken string `json:"ceremony_token"`
+}
+
+// WebAuthnLoginBeginRequest godoc
+// @Description Start of a WebAuthn login: empty for a passkey, the login to use the security keys of a user,
+// @Description or the challenge token of /login to use a security key as second factor
+type WebAuthnLoginBeginRequest struct {
+	Login          string `json:"login,omitempty"`
+	ChallengeToken string `json:"challenge_token,omitempty"`
+}
+
+// WebAuthnFinishRequest godoc
+// @Description Result of navigator.credentials.create() or .get(), as JSON with base64url encoded binary fields
+type WebAuthnFinishRequest struct {
+	CeremonyToken  string          `json:"ceremony_token"`
+	ChallengeToken string          `json:"challenge_token,omitempty"`
+	Name           string          `json:"name,omitempty"`
+	Credential     json.RawMessage `json:"credential" swaggertype:"object"`
+}
+
+type WebAuthnCredentialInfo struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"created_at"`
+	LastUsedAt int64  `json:"last_used_at,omitempty"`
+}
+
+// webAuthnUser is a DBUser with its credentials, as seen by the WebAuthn library
+type webAuthnUser struct {
+	id          string
+	login       string
+	fullname    string
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(u.id)
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.login
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if u.fullname != "" {
+		return u.fullname
+	}
+	return u.login
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func (u *webAuthnUser) credentialDescriptors() []protocol.CredentialDescriptor {
+	descriptors := make([]protocol.CredentialDescriptor, len(u.credentials))
+	for i, credential := range u.credentials {
+		descriptors[i] = credential.Descriptor()
+	}
+	return descriptors
+}
+
+// getWebAuthnCredentials returns the stored credentials of a user
+func getWebAuthnCredentials(repo *dblayer.DBRepository, userID string) []dblayer.DBEntityInterface {
+	search := repo.GetInstanceByTableName("users_webauthn")
+	search.SetValue("user_id", userID)
+	results, err := repo.Search(search, false, false, "created_at")
+	if err != nil {
+		log.Print("getWebAuthnCredentials:", err)
+		return nil
+	}
+	return results
+}
+
+// loadWebAuthnUser loads a user and its credentials
+func loadWebAuthnUser(repo *dblayer.DBRepository, userID string) (*webAuthnUser, error) {
+	search := repo.GetInstanceByTableName("users")
+	search.SetValue("id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		return nil, fmt.Errorf("user not found")
+	}
+	user := &webAuthnUser{id: userID}
+	user.login, _ = results[0].GetValue("login").(string)
+	user.fullname, _ = results[0].GetValue("fullname").(string)
+	for _, stored := range getWebAuthnCredentials(repo, userID) {
+		var credential webauthn.Credential
+		if err := json.Unmarshal([]byte(stored.GetValue("credential").(string)), &credential); err != nil {
+			log.Printf("loadWebAuthnUser: invalid credential %v: %v", stored.GetValue("credential_id"), err)
+			continue
+		}
+		user.credentials = append(user.credentials, credential)
+	}
+	return user, nil
+}
+
+// saveWebAuthnCredential stores a new credential, or the new signature counter of a used one
+func saveWebAuthnCredential(repo *dblayer.DBRepository, userID string, credential *webauthn.Credential, name string) (dblayer.DBEntityInterface, error) {
+	credentialJSON, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+	credentialID := base64.RawURLEncoding.EncodeToString(credential.ID)
+	now := dbTime(time.Now())
+
+	search := repo.GetInstanceByTableName("users_webauthn")
+	search.SetValue("credential_id", credentialID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(results) > 0 {
+		stored := results[0]
+		normalizeDBTimes(stored, "created_at")
+		stored.SetValue("credential", string(credentialJSON))
+		stored.SetValue("last_used_at", now)
+		return repo.Update(stored)
+	}
+
+	stored := repo.GetInstanceByTableName("users_webauthn")
+	stored.SetValue("credential_id", credentialID)
+	stored.SetValue("user_id", userID)
+	stored.SetValue("name", name)
+	stored.SetValue("credential", string(credentialJSON))
+	stored.SetValue("created_at", now)
+	return repo.Insert(stored)
+}
+
+func webAuthnCredentialInfo(stored dblayer.DBEntityInterface) WebAuthnCredentialInfo {
+	info := WebAuthnCredentialInfo{ID: stored.GetValue("credential_id").(string)}
+	info.Name, _ = stored.GetValue("name").(string)
+	if t, ok := parseDBTime(stored.GetValue("created_at")); ok {
+		info.CreatedAt = t.Unix()
+	}
+	if t, ok := parseDBTime(stored.GetValue("last_used_at")); ok {
+		info.LastUsedAt = t.Unix()
+	}
+	return info
+}
+
+// newCeremonyToken signs the WebAuthn session data, so the server keeps no state between begin and finish
+func newCeremonyToken(purpose string, userID string, session *webauthn.SessionData) (string, error) {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"purpose": purpose,
+		"user_id": userID,
+		"session": string(sessionJSON),
+		"jti":     randomToken(16),
+		"exp":     time.Now().Add(challengeTokenDuration).Unix(),
+	})
+	return token.SignedString(challengeKey())
+}
+
+// parseCeremonyToken returns user ID (empty for a passkey login), session data and jti of a ceremony token
+func parseCeremonyToken(tokenString string, purpose string) (string, *webauthn.SessionData, string, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		return challengeKey(), nil
+	}, jwt.WithValidMethods([]string{"HS256"}))
+	if err != nil || !token.Valid || claims["purpose"] != purpose {
+		return "", nil, "", fmt.Errorf("invalid or expired ceremony token")
+	}
+	jti, _ := claims["jti"].(string)
+	if jti == "" || challengeExhausted(jti) {
+		return "", nil, "", fmt.Errorf("ceremony token already used")
+	}
+	userID, _ := claims["user_id"].(string)
+	sessionJSON, _ := claims["session"].(string)
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(sessionJSON), &session); err != nil {
+		return "", nil, "", fmt.Errorf("invalid ceremony token")
+	}
+	return userID, &session, jti, nil
+}
+
+// webAuthnRequest checks that WebAuthn is configured
+func webAuthnRequest(w http.ResponseWriter) bool {
+	if webAuthn == nil {
+		RespondSimpleError(w, ErrServiceUnavailable, "WebAuthn is not configured", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// GetWebAuthnCredentialsHandler godoc
+// @Summary List the WebAuthn credentials of a user
+// @Description Returns the passkeys and security keys registered by the user.
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {array} WebAuthnCredentialInfo
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/webauthn [get]
+func GetWebAuthnCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, _, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	response := []WebAuthnCredentialInfo{}
+	for _, stored := range getWebAuthnCredentials(repo, userID) {
+		response = append(response, webAuthnCredentialInfo(stored))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// BeginWebAuthnRegistrationHandler godoc
+// @Summary Start the registration of a passkey or security key
+// @Description Returns the options for navigator.credentials.create() and the ceremony token for /users/{id}/webauthn/register/finish.
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Success 200 {object} WebAuthnBeginResponse
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 503 {object} ErrorResponse "WebAuthn not configured"
+// @Security BearerAuth
+// @Router /users/{id}/webauthn/register/begin [post]
+func BeginWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !webAuthnRequest(w) {
+		return
+	}
+	repo, userID, self, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if !self {
+		RespondSimpleError(w, ErrForbidden, "Only the user can register a credential", http.StatusForbidden)
+		return
+	}
+	user, err := loadWebAuthnUser(repo, userID)
+	if err != nil {
+		RespondSimpleError(w, ErrUserNotFound, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	options, session, err := webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(user.credentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to begin registration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ceremonyToken, err := newCeremonyToken(ceremonyRegister, userID, session)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to begin registration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WebAuthnBeginResponse{Options: options, CeremonyToken: ceremonyToken})
+}
+
+// FinishWebAuthnRegistrationHandler godoc
+// @Summary Complete the registration of a passkey or security key
+// @Description Verifies the attestation returned by navigator.credentials.create() and stores the credential.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param id path string true "User ID"
+// @Param request body WebAuthnFinishRequest true "Ceremony token, name and credential"
+// @Success 200 {object} WebAuthnCredentialInfo
+// @Failure 400 {object} ErrorResponse "Invalid credential"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Security BearerAuth
+// @Router /users/{id}/webauthn/register/finish [post]
+func FinishWebAuthnRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if !webAuthnRequest(w) {
+		return
+	}
+	repo, userID, self, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if !self {
+		RespondSimpleError(w, ErrForbidden, "Only the user can register a credential", http.StatusForbidden)
+		return
+	}
+	var req WebAuthnFinishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	ceremonyUserID, session, jti, err := parseCeremonyToken(req.CeremonyToken, ceremonyRegister)
+	if err != nil || ceremonyUserID != userID {
+		RespondSimpleError(w, ErrInvalidToken, "Invalid or expired ceremony token", http.StatusBadRequest)
+		return
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		RespondSimpleError(w, ErrWebAuthnFailed, "Invalid credential: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := loadWebAuthnUser(repo, userID)
+	if err != nil {
+		RespondSimpleError(w, ErrUserNotFound, err.Error(), http.StatusNotFound)
+		return
+	}
+	credential, err := webAuthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		log.Printf("FinishWebAuthnRegistrationHandler: %v", err)
+		RespondSimpleError(w, ErrWebAuthnFailed, "Credential verification failed", http.StatusBadRequest)
+		return
+	}
+	challengeFailed(jti, challengeMaxAttempts)
+
+	name := req.Name
+	if name == "" {
+		name = "Passkey " + time.Now().Format("2006-01-02")
+	}
+	stored, err := saveWebAuthnCredential(repo, userID, credential, name)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to save the credential: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("FinishWebAuthnRegistrationHandler: credential registered for user %s", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webAuthnCredentialInfo(stored))
+}
+
+// DeleteWebAuthnCredentialHandler godoc
+// @Summary Remove a passkey or security key
+// @Tags users
+// @Produce json
+// @Param id path string true "User ID"
+// @Param credentialId path string true "Credential ID"
+// @Success 200 {object} map[string]string "message"
+// @Failure 401 {object} ErrorResponse "Unauthorized"
+// @Failure 403 {object} ErrorResponse "Forbidden"
+// @Failure 404 {object} ErrorResponse "Credential not found"
+// @Security BearerAuth
+// @Router /users/{id}/webauthn/{credentialId} [delete]
+func DeleteWebAuthnCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	repo, userID, _, ok := selfOrAdminRequest(w, r)
+	if !ok {
+		return
+	}
+
+	search := repo.GetInstanceByTableName("users_webauthn")
+	search.SetValue("credential_id", mux.Vars(r)["credentialId"])
+	search.SetValue("user_id", userID)
+	results, err := repo.Search(search, false, false, "")
+	if err != nil || len(results) == 0 {
+		RespondSimpleError(w, ErrObjectNotFound, "Credential not found", http.StatusNotFound)
+		return
+	}
+	if _, err := repo.Delete(results[0]); err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to delete the credential: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Credential removed"})
+}
+
+// BeginWebAuthnLoginHandler godoc
+// @Summary Start a WebAuthn login
+// @Description Without parameters any passkey of the site can be used; with the login only the credentials of that user.
+// @Description With the challenge token returned by /login the credential is the second factor of the password login.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body WebAuthnLoginBeginRequest false "Login or challenge token"
+// @Success 200 {object} WebAuthnBeginResponse
+// @Failure 401 {object} ErrorResponse "Invalid challenge token"
+// @Failure 503 {object} ErrorResponse "WebAuthn not configured"
+// @Router /login/webauthn/begin [post]
+func BeginWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !webAuthnRequest(w) {
+		return
+	}
+	var req WebAuthnLoginBeginRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	repo := dblayer.NewSystemRepository("passkey login", passkeyLoginTables...)
+
+	userID := ""
+	if req.ChallengeToken != "" {
+		challengeUserID, purpose, _, err := parseChallengeToken(req.ChallengeToken)
+		if err != nil || purpose != challengeVerify {
+			RespondSimpleError(w, ErrInvalidToken, "Invalid or expired challenge token", http.StatusUnauthorized)
+			return
+		}
+		userID = challengeUserID
+	} else if req.Login != "" {
+		search := repo.GetInstanceByTableName("users")
+		search.SetValue("login", req.Login)
+		if results, err := repo.Search(search, false, false, ""); err == nil && len(results) > 0 {
+			userID = results[0].GetValue("id").(string)
+		}
+	}
+
+	var user *webAuthnUser
+	if userID != "" {
+		user, _ = loadWebAuthnUser(repo, userID)
+	}
+	if req.ChallengeToken != "" && (user == nil || len(user.credentials) == 0) {
+		RespondSimpleError(w, ErrWebAuthnFailed, "No security key registered", http.StatusBadRequest)
+		return
+	}
+
+	var options *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	var err error
+	if user != nil && len(user.credentials) > 0 {
+		verification := protocol.VerificationRequired
+		if req.ChallengeToken != "" {
+			// Second factor: the password was already checked
+			verification = protocol.VerificationPreferred
+		}
+		options, session, err = webAuthn.BeginLogin(user, webauthn.WithUserVerification(verification))
+	} else {
+		// Unknown users get the same answer of a passkey login
+		userID = ""
+		options, session, err = webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	}
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to begin login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ceremonyToken, err := newCeremonyToken(ceremonyLogin, userID, session)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to begin login: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WebAuthnBeginResponse{Options: options, CeremonyToken: ceremonyToken})
+}
+
+// FinishWebAuthnLoginHandler godoc
+// @Summary Complete a WebAuthn login
+// @Description Verifies the assertion returned by navigator.credentials.get() and returns the tokens.
+// @Description For a second factor login the challenge token of /login is required too.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body WebAuthnFinishRequest true "Ceremony token and assertion"
+// @Success 200 {object} TokenResponse "token and user info"
+// @Failure 400 {object} ErrorResponse "Invalid request"
+// @Failure 401 {object} ErrorResponse "Verification failed"
+// @Router /login/webauthn/finish [post]
+func FinishWebAuthnLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !webAuthnRequest(w) {
+		return
+	}
+	var req WebAuthnFinishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		RespondSimpleError(w, ErrInvalidRequest, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	userID, session, jti, err := parseCeremonyToken(req.CeremonyToken, ceremonyLogin)
+	if err != nil {
+		RespondSimpleError(w, ErrInvalidToken, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	method := "webauthn"
+	challengeJTI := ""
+	if req.ChallengeToken != "" {
+		challengeUserID, purpose, challengeID, err := parseChallengeToken(req.ChallengeToken)
+		if err != nil || purpose != challengeVerify || challengeUserID != userID {
+			RespondSimpleError(w, ErrInvalidToken, "Invalid or expired challenge token", http.StatusUnauthorized)
+			return
+		}
+		method = "password+webauthn"
+		challengeJTI = challengeID
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(req.Credential)
+	if err != nil {
+		RespondSimpleError(w, ErrWebAuthnFailed, "Invalid assertion: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repo := dblayer.NewSystemRepository("passkey login", passkeyLoginTables...)
+
+	var user *webAuthnUser
+	var credential *webauthn.Credential
+	if userID != "" {
+		if user, err = loadWebAuthnUser(repo, userID); err == nil {
+			credential, err = webAuthn.ValidateLogin(user, *session, parsed)
+		}
+	} else {
+		var found webauthn.User
+		found, credential, err = webAuthn.ValidatePasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			return loadWebAuthnUser(repo, string(userHandle))
+		}, *session, parsed)
+		if err == nil {
+			user = found.(*webAuthnUser)
+		}
+	}
+	if err == nil && credential.Authenticator.CloneWarning {
+		err = fmt.Errorf("the signature counter went back, the authenticator may be cloned")
+	}
+	if err != nil {
+		log.Printf("FinishWebAuthnLoginHandler: %v", err)
+		challengeFailed(jti, 1)
+		if challengeJTI != "" {
+			challengeFailed(challengeJTI, 1)
+		}
+		RespondSimpleError(w, ErrWebAuthnFailed, "Verification failed", http.StatusUnauthorized)
+		return
+	}
+	challengeFailed(jti, challengeMaxAttempts)
+	if challengeJTI != "" {
+		challengeFailed(challengeJTI, challengeMaxAttempts)
+	}
+	if _, err := saveWebAuthnCredential(repo, user.id, credential, ""); err != nil {
+		log.Print("FinishWebAuthnLoginHandler: failed to update the credential:", err)
+	}
+
+	_, primaryGroupID := getLogin(repo, user.id)
+	groups, err := GetUserGroupIDs(repo, user.id, primaryGroupID)
+	if err != nil {
+		RespondSimpleError(w, ErrInternalServer, "Failed to get user groups: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := StartSession(repo, r, user.id, user.login, groups, method)
+	if err != nil {
+		respondSessionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
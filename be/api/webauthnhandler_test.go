@@ -0,0 +1,265 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/gorilla/mux"
+)
+
+const testWebAuthnOrigin = "http://localhost:3000"
+
+// softAuthenticator is a software WebAuthn authenticator with one ES256 credential
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate the key: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+func b64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// challengeOf returns the challenge and relying party of options returned by a begin handler
+func challengeOf(t *testing.T, begin WebAuthnBeginResponse) (string, string, []byte) {
+	var options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RPID      string `json:"rpId"`
+			RP        struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	optionsJSON, _ := json.Marshal(begin.Options)
+	if err := json.Unmarshal(optionsJSON, &options); err != nil {
+		t.Fatalf("Invalid options %s: %v", optionsJSON, err)
+	}
+	rpID := options.PublicKey.RPID
+	if rpID == "" {
+		rpID = options.PublicKey.RP.ID
+	}
+	userHandle, _ := base64.RawURLEncoding.DecodeString(options.PublicKey.User.ID)
+	return options.PublicKey.Challenge, rpID, userHandle
+}
+
+func (a *softAuthenticator) authData(rpID string, flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		coseKey, _ := webauthncbor.Marshal(map[int]any{
+			1:  2,  // kty: EC2
+			3:  -7, // alg: ES256
+			-1: 1,  // crv: P-256
+			-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+			-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+		})
+		data = append(data, coseKey...)
+	}
+	return data
+}
+
+// register answers navigator.credentials.create()
+func (a *softAuthenticator) register(t *testing.T, begin WebAuthnBeginResponse) json.RawMessage {
+	challenge, rpID, userHandle := challengeOf(t, begin)
+	a.userHandle = userHandle
+	clientData, _ := json.Marshal(map[string]string{"type": "webauthn.create", "challenge": challenge, "origin": testWebAuthnOrigin})
+	attestation, _ := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authData(rpID, 0x45, true), // UP, UV, AT
+	})
+	credential, _ := json.Marshal(map[string]any{
+		"id":    b64url(a.credentialID),
+		"rawId": b64url(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64url(clientData),
+			"attestationObject": b64url(attestation),
+		},
+	})
+	return credential
+}
+
+// assert answers navigator.credentials.get()
+func (a *softAuthenticator) assert(t *testing.T, begin WebAuthnBeginResponse, origin string) json.RawMessage {
+	challenge, rpID, _ := challengeOf(t, begin)
+	a.signCount++
+	clientData, _ := json.Marshal(map[string]string{"type": "webauthn.get", "challenge": challenge, "origin": origin})
+	authData := a.authData(rpID, 0x05, false) // UP, UV
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	credential, _ := json.Marshal(map[string]any{
+		"id":    b64url(a.credentialID),
+		"rawId": b64url(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64url(clientData),
+			"authenticatorData": b64url(authData),
+			"signature":         b64url(signature),
+			"userHandle":        b64url(a.userHandle),
+		},
+	})
+	return credential
+}
+
+// go test -v ./api -run TestWebAuthn
+func TestWebAuthn(t *testing.T) {
+	relyingParty, err := NewWebAuthn("localhost", "Test", []string{testWebAuthnOrigin})
+	if err != nil {
+		t.Fatalf("Failed to configure WebAuthn: %v", err)
+	}
+	previous := webAuthn
+	webAuthn = relyingParty
+	t.Cleanup(func() { webAuthn = previous })
+
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, AppConfig.TablePrefix)
+	login := "webauthn" + Random4digits()
+	user, err := adminRepo.CreateObject("users", map[string]any{
+		"login":    login,
+		"pwd":      "secret" + login,
+		"fullname": "WebAuthn test",
+	}, map[string]any{})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer adminRepo.Delete(user)
+	userID := user.GetValue("id").(string)
+
+	post := func(handler http.HandlerFunc, body any) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBuffer(jsonBody))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+	router := mux.NewRouter()
+	router.Use(AuthMiddleware)
+	router.HandleFunc("/users/{id}/webauthn", GetWebAuthnCredentialsHandler).Methods("GET")
+	router.HandleFunc("/users/{id}/webauthn/register/begin", BeginWebAuthnRegistrationHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/webauthn/register/finish", FinishWebAuthnRegistrationHandler).Methods("POST")
+	router.HandleFunc("/users/{id}/webauthn/{credentialId}", DeleteWebAuthnCredentialHandler).Methods("DELETE")
+	call := func(method string, path string, token string, body any) *httptest.ResponseRecorder {
+		jsonBody, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	credentials := Credentials{Login: login, Pwd: "secret" + login}
+	var tokens TokenResponse
+	json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &tokens)
+
+	// 1. Registration
+	authenticator := newSoftAuthenticator(t)
+	rr := call(http.MethodPost, "/users/"+userID+"/webauthn/register/begin", tokens.AccessToken, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Begin registration: expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	var begin WebAuthnBeginResponse
+	json.Unmarshal(rr.Body.Bytes(), &begin)
+	finish := WebAuthnFinishRequest{CeremonyToken: begin.CeremonyToken, Name: "Test key", Credential: authenticator.register(t, begin)}
+	rr = call(http.MethodPost, "/users/"+userID+"/webauthn/register/finish", tokens.AccessToken, finish)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Finish registration: expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	// The ceremony cannot be replayed
+	if rr := call(http.MethodPost, "/users/"+userID+"/webauthn/register/finish", tokens.AccessToken, finish); rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the replayed registration to fail, got %v", rr.Code)
+	}
+	rr = call(http.MethodGet, "/users/"+userID+"/webauthn", tokens.AccessToken, nil)
+	var list []WebAuthnCredentialInfo
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if len(list) != 1 || list[0].Name != "Test key" || list[0].ID != b64url(authenticator.credentialID) {
+		t.Fatalf("Unexpected credentials %s", rr.Body.String())
+	}
+
+	// 2. Passwordless login with the passkey
+	rr = post(BeginWebAuthnLoginHandler, WebAuthnLoginBeginRequest{})
+	json.Unmarshal(rr.Body.Bytes(), &begin)
+	rr = post(FinishWebAuthnLoginHandler, WebAuthnFinishRequest{CeremonyToken: begin.CeremonyToken, Credential: authenticator.assert(t, begin, testWebAuthnOrigin)})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Passkey login: expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	var passkeyTokens TokenResponse
+	json.Unmarshal(rr.Body.Bytes(), &passkeyTokens)
+	if passkeyTokens.AccessToken == "" || passkeyTokens.UserID != userID {
+		t.Fatalf("Expected the tokens of the user, got %s", rr.Body.String())
+	}
+
+	// 3. A different origin is refused (phishing)
+	rr = post(BeginWebAuthnLoginHandler, WebAuthnLoginBeginRequest{Login: login})
+	json.Unmarshal(rr.Body.Bytes(), &begin)
+	if rr := post(FinishWebAuthnLoginHandler, WebAuthnFinishRequest{CeremonyToken: begin.CeremonyToken, Credential: authenticator.assert(t, begin, "https://evil.example.com")}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a foreign origin to be refused, got %v", rr.Code)
+	}
+
+	// 4. Second factor of the password login
+	var challenge LoginChallengeResponse
+	json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &challenge)
+	if !challenge.TwoFactorRequired || len(challenge.Methods) != 1 || challenge.Methods[0] != "webauthn" {
+		t.Fatalf("Expected a WebAuthn challenge, got %+v", challenge)
+	}
+	rr = post(BeginWebAuthnLoginHandler, WebAuthnLoginBeginRequest{ChallengeToken: challenge.ChallengeToken})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Begin second factor: expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	json.Unmarshal(rr.Body.Bytes(), &begin)
+	assertion := authenticator.assert(t, begin, testWebAuthnOrigin)
+	// The challenge token is needed to complete the password login
+	if rr := post(FinishWebAuthnLoginHandler, WebAuthnFinishRequest{CeremonyToken: begin.CeremonyToken, ChallengeToken: "bad", Credential: assertion}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected an invalid challenge token to be refused, got %v", rr.Code)
+	}
+	rr = post(FinishWebAuthnLoginHandler, WebAuthnFinishRequest{CeremonyToken: begin.CeremonyToken, ChallengeToken: challenge.ChallengeToken, Credential: assertion})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Second factor: expected status OK, got %v: %s", rr.Code, rr.Body.String())
+	}
+	// A replayed assertion is refused
+	if rr := post(FinishWebAuthnLoginHandler, WebAuthnFinishRequest{CeremonyToken: begin.CeremonyToken, Credential: assertion}); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a replayed assertion to be refused, got %v", rr.Code)
+	}
+
+	// 5. Removal
+	if rr := call(http.MethodDelete, "/users/"+userID+"/webauthn/"+list[0].ID, tokens.AccessToken, nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the credential to be removed, got %v: %s", rr.Code, rr.Body.String())
+	}
+	tokens = TokenResponse{}
+	json.Unmarshal(post(LoginHandler, credentials).Body.Bytes(), &tokens)
+	if tokens.AccessToken == "" {
+		t.Fatalf("Expected the password login to work without second factor")
+	}
+}
@@ -0,0 +1,268 @@
+package dblayer
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Access control lists: on top of the permissions string (one owner, one group, the others), ACL entries grant
+// r, w and x on an object to more users and groups. The entries of a folder apply to everything under it: for each
+// principal the nearest entry wins, so "---" on a subfolder takes back what was granted on the folder above.
+// The ACLs only grant: what the permissions string allows cannot be denied by an entry.
+
+// ACLUser and ACLGroup are the principal types of the ACL entries
+const ACLUser = "user"
+const ACLGroup = "group"
+
+// NoPermissions are the permissions of an entry granting nothing
+const NoPermissions = "---"
+
+// maxACLDepth stops the walk up the folders on broken (looping) trees
+const maxACLDepth = 64
+
+var aclPermissionsRegexp = regexp.MustCompile(`^[r-][w-][x-]$`)
+
+// ValidACLPermissions tells whether permissions are in the form "rwx", "r--"...
+func ValidACLPermissions(permissions string) bool {
+	return aclPermissionsRegexp.MatchString(permissions)
+}
+
+// aclCache keeps, for the life of a repository (usually a request), the entries of its user and the fathers of the
+// objects already walked
+type aclCache struct {
+	mu      sync.Mutex
+	entries map[string][]DBEntityInterface // by object id, nil until loaded
+	fathers map[string]string
+}
+
+// userACLEntriesWithTx returns the entries of the user of the repository and of its groups, by object id
+func (dbr *DBRepository) userACLEntriesWithTx(tx *sql.Tx) map[string][]DBEntityInterface {
+	dbr.acl.mu.Lock()
+	defer dbr.acl.mu.Unlock()
+	if dbr.acl.entries != nil {
+		return dbr.acl.entries
+	}
+	entries := map[string][]DBEntityInterface{}
+	principals := [][2]string{{ACLUser, dbr.DbContext.UserID}}
+	for _, groupID := range dbr.DbContext.GroupIDs {
+		principals = append(principals, [2]string{ACLGroup, groupID})
+	}
+	for _, principal := range principals {
+		search := NewACLEntry()
+		search.SetValue("principal_type", principal[0])
+		search.SetValue("principal_id", principal[1])
+		results, err := dbr.searchWithTx(search, false, false, "", tx)
+		if err != nil {
+			// Not cached: the next check tries again
+			log.Print("DBRepository::userACLEntries: ", err)
+			return entries
+		}
+		for _, entry := range results {
+			objectID := entry.GetValue("object_id").(string)
+			entries[objectID] = append(entries[objectID], entry)
+		}
+	}
+	dbr.acl.entries = entries
+	return entries
+}
+
+// fatherOfWithTx returns the father of an object, empty at the root
+func (dbr *DBRepository) fatherOfWithTx(objectID string, tx *sql.Tx) string {
+	dbr.acl.mu.Lock()
+	fatherID, ok := dbr.acl.fathers[objectID]
+	dbr.acl.mu.Unlock()
+	if ok {
+		return fatherID
+	}
+	var object DBEntityInterface
+	if tx == nil {
+		object = dbr.ObjectByID(objectID, false)
+	} else {
+		object = objectByIDWithTx(dbr, objectID, tx)
+	}
+	if object != nil {
+		fatherID, _ = object.GetValue("father_id").(string)
+	}
+	dbr.acl.mu.Lock()
+	dbr.acl.fathers[objectID] = fatherID
+	dbr.acl.mu.Unlock()
+	return fatherID
+}
+
+// walkACLWithTx calls visit with the object and each of its fathers, up to the root, until visit returns false
+func (dbr *DBRepository) walkACLWithTx(dbe DBEntityInterface, tx *sql.Tx, visit func(objectID string) bool) {
+	objectID, _ := dbe.GetValue("id").(string)
+	fatherID, _ := dbe.GetValue("father_id").(string)
+	visited := map[string]bool{}
+	for depth := 0; objectID != "" && !visited[objectID] && depth < maxACLDepth; depth++ {
+		if !visit(objectID) {
+			return
+		}
+		visited[objectID] = true
+		objectID = fatherID
+		if objectID != "" {
+			fatherID = dbr.fatherOfWithTx(objectID, tx)
+		}
+	}
+}
+
+// aclPermissionsWithTx returns the permissions granted by the ACLs to the user of the repository on an object
+func (dbr *DBRepository) aclPermissionsWithTx(dbe DBEntityInterface, tx *sql.Tx) string {
+	if dbr.DbContext.IsSystem() || !dbe.IsDBObject() {
+		return NoPermissions
+	}
+	entries := dbr.userACLEntriesWithTx(tx)
+	if len(entries) == 0 {
+		return NoPermissions
+	}
+	granted := []byte(NoPermissions)
+	decided := map[string]bool{}
+	dbr.walkACLWithTx(dbe, tx, func(objectID string) bool {
+		for _, entry := range entries[objectID] {
+			principal := fmt.Sprint(entry.GetValue("principal_type"), ":", entry.GetValue("principal_id"))
+			if decided[principal] {
+				continue
+			}
+			decided[principal] = true
+			permissions, _ := entry.GetValue("permissions").(string)
+			if !ValidACLPermissions(permissions) {
+				continue
+			}
+			for i := range granted {
+				if permissions[i] != '-' {
+					granted[i] = permissions[i]
+				}
+			}
+		}
+		return true
+	})
+	return string(granted)
+}
+
+// GetACL returns the entries of an object, without the inherited ones
+func (dbr *DBRepository) GetACL(objectID string) ([]DBEntityInterface, error) {
+	search := NewACLEntry()
+	search.SetValue("object_id", objectID)
+	return dbr.Search(search, false, false, "principal_type,principal_id")
+}
+
+// GetEffectiveACL returns the entries that apply to an object: its own and, for the principals without one,
+// the nearest of its folders
+func (dbr *DBRepository) GetEffectiveACL(dbe DBEntityInterface) ([]DBEntityInterface, error) {
+	if err := dbr.DbContext.checkScope("acl_entries"); err != nil {
+		return nil, err
+	}
+	var effective []DBEntityInterface
+	var searchErr error
+	decided := map[string]bool{}
+	dbr.walkACLWithTx(dbe, nil, func(objectID string) bool {
+		entries, err := dbr.GetACL(objectID)
+		if err != nil {
+			searchErr = err
+			return false
+		}
+		for _, entry := range entries {
+			principal := fmt.Sprint(entry.GetValue("principal_type"), ":", entry.GetValue("principal_id"))
+			if !decided[principal] {
+				decided[principal] = true
+				effective = append(effective, entry)
+			}
+		}
+		return true
+	})
+	return effective, searchErr
+}
+
+// SetACL replaces the entries of an object, in one transaction; entries are principal_type, principal_id and permissions
+func (dbr *DBRepository) SetACL(objectID string, entries []map[string]string) ([]DBEntityInterface, error) {
+	for _, entry := range entries {
+		if entry["principal_type"] != ACLUser && entry["principal_type"] != ACLGroup {
+			return nil, fmt.Errorf("invalid principal_type %q", entry["principal_type"])
+		}
+		if entry["principal_id"] == "" {
+			return nil, fmt.Errorf("missing principal_id")
+		}
+		if !ValidACLPermissions(entry["permissions"]) {
+			return nil, fmt.Errorf("invalid permissions %q", entry["permissions"])
+		}
+	}
+	search := NewACLEntry()
+	search.SetValue("object_id", objectID)
+	if err := dbr.DbContext.checkScope(search.GetTableName()); err != nil {
+		return nil, err
+	}
+	if err := dbr.checkAccessScope(search); err != nil {
+		return nil, err
+	}
+	tx, err := dbr.DbConnection.BeginTx(dbr.Context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := dbr.searchWithTx(search, false, false, "", tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range current {
+		if _, err := dbr.deleteWithTx(entry, tx); err != nil {
+			return nil, err
+		}
+		if err := dbr.auditWithTx("delete", entry, tx); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now().UTC().Format("2006-01-02 15:04:05")
+	saved := []DBEntityInterface{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		principal := entry["principal_type"] + ":" + entry["principal_id"]
+		if seen[principal] {
+			continue
+		}
+		seen[principal] = true
+		aclEntry := NewACLEntry()
+		aclEntry.SetValue("object_id", objectID)
+		aclEntry.SetValue("principal_type", entry["principal_type"])
+		aclEntry.SetValue("principal_id", entry["principal_id"])
+		aclEntry.SetValue("permissions", entry["permissions"])
+		aclEntry.SetValue("created_by", dbr.DbContext.UserID)
+		aclEntry.SetValue("created_at", now)
+		created, err := dbr.insertWithTx(aclEntry, tx)
+		if err != nil {
+			return nil, err
+		}
+		if err := dbr.auditWithTx("insert", aclEntry, tx); err != nil {
+			return nil, err
+		}
+		saved = append(saved, created)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	dbr.acl.mu.Lock()
+	dbr.acl.entries = nil
+	dbr.acl.mu.Unlock()
+	return saved, nil
+}
+
+// deleteACLOfPrincipal deletes the entries of a user or a group being deleted
+func deleteACLOfPrincipal(dbr *DBRepository, principalType string, principalID any, tx *sql.Tx) error {
+	search := NewACLEntry()
+	search.SetValue("principal_type", principalType)
+	search.SetValue("principal_id", principalID)
+	results, err := dbr.searchWithTx(search, false, false, "", tx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range results {
+		if _, err := dbr.deleteWithTx(entry, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
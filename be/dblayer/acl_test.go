@@ -0,0 +1,89 @@
+package dblayer
+
+import (
+	"testing"
+)
+
+// go test -v ./dblayer -run TestACL
+func TestACL(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, DbSchema)
+	folder := createTestFolder(t, adminRepo, map[string]any{"name": "ACL Folder", "permissions": "rwx------"}, nil)
+	subfolder := createTestFolder(t, adminRepo, map[string]any{"name": "ACL Subfolder", "father_id": folder.GetValue("id"), "permissions": "rwx------"}, nil)
+	page := createTestObject(t, adminRepo, "pages", map[string]any{"name": "ACL Page", "father_id": subfolder.GetValue("id"), "permissions": "rwx------"}, nil)
+	defer func() {
+		for _, object := range []DBEntityInterface{folder, subfolder, page} {
+			adminRepo.SetACL(object.GetValue("id").(string), nil)
+			adminRepo.Delete(object)
+		}
+	}()
+
+	// A new repository for every check: the entries are cached for the life of a repository
+	userRepo := func() *DBRepository {
+		return SetupTestRepo(t, "acluser", []string{"aclgroup"}, DbSchema)
+	}
+	if userRepo().CheckReadPermission(page) {
+		t.Fatal("Expected the private page not to be readable")
+	}
+
+	// Granted to the group on the folder, inherited by the page
+	if _, err := adminRepo.SetACL(folder.GetValue("id").(string), []map[string]string{
+		{"principal_type": ACLGroup, "principal_id": "aclgroup", "permissions": "r--"},
+		{"principal_type": ACLUser, "principal_id": "otheruser", "permissions": "rw-"},
+	}); err != nil {
+		t.Fatalf("SetACL failed: %v", err)
+	}
+	repo := userRepo()
+	if !repo.CheckReadPermission(page) || repo.CheckWritePermission(page) {
+		t.Fatal("Expected the page to be readable, not writable, through the folder")
+	}
+	if children := repo.GetChildren(subfolder.GetValue("id").(string), true); len(children) != 1 {
+		t.Fatalf("Expected the page among the children, got %d", len(children))
+	}
+	if permissions, acl := repo.EffectivePermissions(page); permissions != "---" || acl != "r--" {
+		t.Fatalf("Expected --- and r--, got %s and %s", permissions, acl)
+	}
+
+	// Overridden on the subfolder for the group, granted to the user
+	if _, err := adminRepo.SetACL(subfolder.GetValue("id").(string), []map[string]string{
+		{"principal_type": ACLGroup, "principal_id": "aclgroup", "permissions": "---"},
+	}); err != nil {
+		t.Fatalf("SetACL failed: %v", err)
+	}
+	if userRepo().CheckReadPermission(page) {
+		t.Fatal("Expected the entry of the subfolder to take back the read")
+	}
+	if !userRepo().CheckReadPermission(folder) {
+		t.Fatal("Expected the folder to be still readable")
+	}
+	if _, err := adminRepo.SetACL(page.GetValue("id").(string), []map[string]string{
+		{"principal_type": ACLUser, "principal_id": "acluser", "permissions": "rw-"},
+	}); err != nil {
+		t.Fatalf("SetACL failed: %v", err)
+	}
+	repo = userRepo()
+	if !repo.CheckReadPermission(page) || !repo.CheckWritePermission(page) {
+		t.Fatal("Expected the page to be writable by the user")
+	}
+
+	// The effective entries: the nearest one of each principal
+	effective, err := adminRepo.GetEffectiveACL(page)
+	if err != nil || len(effective) != 3 {
+		t.Fatalf("Expected 3 effective entries, got %d %v", len(effective), err)
+	}
+	for _, entry := range effective {
+		if entry.GetValue("principal_id") == "aclgroup" && entry.GetValue("object_id") != subfolder.GetValue("id") {
+			t.Fatalf("Expected the entry of the group from the subfolder, got %s", entry.ToJSON())
+		}
+	}
+
+	if _, err := adminRepo.SetACL(page.GetValue("id").(string), []map[string]string{
+		{"principal_type": "role", "principal_id": "x", "permissions": "r--"},
+	}); err == nil {
+		t.Fatal("Expected an invalid principal type to be refused")
+	}
+	if _, err := adminRepo.SetACL(page.GetValue("id").(string), []map[string]string{
+		{"principal_type": ACLUser, "principal_id": "acluser", "permissions": "read"},
+	}); err == nil {
+		t.Fatal("Expected invalid permissions to be refused")
+	}
+}
@@ -0,0 +1,141 @@
+package dblayer
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+)
+
+// Capabilities: what the users of a group can administer, e.g. users.manage. A user has the capabilities of all
+// its groups. They replace the checks on the id of the Admin group: the Admin group has all of them at the
+// creation of the DB, and they can be given to (or taken from) any group.
+
+const CapabilityUsersManage = "users.manage"
+const CapabilityGroupsManage = "groups.manage"
+const CapabilityTrashViewAll = "trash.view_all"
+const CapabilityObjectsChmod = "objects.chmod"
+const CapabilityDashboardView = "dashboard.view"
+const CapabilityJobsRun = "jobs.run"
+const CapabilityDirectorySync = "directory.sync"
+const CapabilityAssistantUse = "assistant.use"
+
+// Capability is a capability and what it allows
+type Capability struct {
+	Name        string
+	Description string
+}
+
+// Capabilities are all the capabilities that can be given to a group
+var Capabilities = []Capability{
+	{CapabilityUsersManage, "Create, update and delete the users, manage their sessions and second factors"},
+	{CapabilityGroupsManage, "Create, update and delete the groups, give them capabilities"},
+	{CapabilityTrashViewAll, "See the deleted objects while browsing"},
+	{CapabilityObjectsChmod, "Change the owner, the group and the access control list of any object"},
+	{CapabilityDashboardView, "See the admin dashboard"},
+	{CapabilityJobsRun, "Run the batch jobs and follow the jobs of the other users"},
+	{CapabilityDirectorySync, "Synchronize the users with the LDAP directory"},
+	{CapabilityAssistantUse, "Use the AI assistant even when ollama_allowed_groups does not list any group of the user"},
+}
+
+// ValidCapability tells whether a capability exists
+func ValidCapability(capability string) bool {
+	return slices.ContainsFunc(Capabilities, func(c Capability) bool { return c.Name == capability })
+}
+
+// GetCapabilities returns the capabilities of the given groups, sorted and without duplicates
+func (dbr *DBRepository) GetCapabilities(groupIDs []string) ([]string, error) {
+	capabilities := []string{}
+	for _, groupID := range groupIDs {
+		groupCapabilities, err := dbr.GetGroupCapabilities(groupID)
+		if err != nil {
+			return nil, err
+		}
+		capabilities = append(capabilities, groupCapabilities...)
+	}
+	slices.Sort(capabilities)
+	return slices.Compact(capabilities), nil
+}
+
+// GetGroupCapabilities returns the capabilities of a group
+func (dbr *DBRepository) GetGroupCapabilities(groupID string) ([]string, error) {
+	search := NewGroupCapability()
+	search.SetValue("group_id", groupID)
+	results, err := dbr.Search(search, false, false, "capability")
+	if err != nil {
+		return nil, err
+	}
+	capabilities := []string{}
+	for _, result := range results {
+		capabilities = append(capabilities, result.GetValue("capability").(string))
+	}
+	return capabilities, nil
+}
+
+// SetGroupCapabilities replaces the capabilities of a group, in one transaction, and returns them
+func (dbr *DBRepository) SetGroupCapabilities(groupID string, capabilities []string) ([]string, error) {
+	for _, capability := range capabilities {
+		if !ValidCapability(capability) {
+			return nil, fmt.Errorf("unknown capability %q", capability)
+		}
+	}
+	search := NewGroupCapability()
+	search.SetValue("group_id", groupID)
+	if err := dbr.DbContext.checkScope(search.GetTableName()); err != nil {
+		return nil, err
+	}
+	if err := dbr.checkAccessScope(search); err != nil {
+		return nil, err
+	}
+	tx, err := dbr.DbConnection.BeginTx(dbr.Context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := dbr.searchWithTx(search, false, false, "", tx)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range current {
+		if _, err := dbr.deleteWithTx(entry, tx); err != nil {
+			return nil, err
+		}
+		if err := dbr.auditWithTx("delete", entry, tx); err != nil {
+			return nil, err
+		}
+	}
+	capabilities = slices.Clone(capabilities)
+	slices.Sort(capabilities)
+	capabilities = slices.Compact(capabilities)
+	for _, capability := range capabilities {
+		entry := NewGroupCapability()
+		entry.SetValue("group_id", groupID)
+		entry.SetValue("capability", capability)
+		if _, err := dbr.insertWithTx(entry, tx); err != nil {
+			return nil, err
+		}
+		if err := dbr.auditWithTx("insert", entry, tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return capabilities, nil
+}
+
+// deleteCapabilitiesOfGroup deletes the capabilities of a group being deleted
+func deleteCapabilitiesOfGroup(dbr *DBRepository, groupID any, tx *sql.Tx) error {
+	search := NewGroupCapability()
+	search.SetValue("group_id", groupID)
+	results, err := dbr.searchWithTx(search, false, false, "", tx)
+	if err != nil {
+		return err
+	}
+	for _, entry := range results {
+		if _, err := dbr.deleteWithTx(entry, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
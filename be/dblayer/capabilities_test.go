@@ -0,0 +1,55 @@
+package dblayer
+
+import (
+	"slices"
+	"testing"
+)
+
+// go test -v ./dblayer -run TestCapabilities
+func TestCapabilities(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, DbSchema)
+
+	// The Admin group has all of them from the initial data
+	capabilities, err := adminRepo.GetCapabilities([]string{"-2"})
+	if err != nil || len(capabilities) != len(Capabilities) {
+		t.Fatalf("Expected all the capabilities for the Admin group, got %v %v", capabilities, err)
+	}
+
+	group := NewDBGroup()
+	group.SetValue("name", "capabilities"+Random4digits())
+	created, err := adminRepo.Insert(group)
+	if err != nil {
+		t.Fatalf("Failed to create group: %v", err)
+	}
+	groupID := created.GetValue("id").(string)
+	defer adminRepo.Delete(created)
+
+	if _, err := adminRepo.SetGroupCapabilities(groupID, []string{CapabilityUsersManage, "root.everything"}); err == nil {
+		t.Fatal("Expected an unknown capability to be refused")
+	}
+	saved, err := adminRepo.SetGroupCapabilities(groupID, []string{CapabilityUsersManage, CapabilityDashboardView, CapabilityUsersManage})
+	if err != nil || !slices.Equal(saved, []string{CapabilityDashboardView, CapabilityUsersManage}) {
+		t.Fatalf("Expected the capabilities sorted and without duplicates, got %v %v", saved, err)
+	}
+
+	// A user has the capabilities of all its groups
+	capabilities, err = adminRepo.GetCapabilities([]string{"capabilitiesuser", groupID, "-6"})
+	if err != nil || !slices.Contains(capabilities, CapabilityUsersManage) || !slices.Contains(capabilities, CapabilityTrashViewAll) ||
+		slices.Contains(capabilities, CapabilityGroupsManage) {
+		t.Fatalf("Expected the capabilities of the group and of the Webmaster group, got %v %v", capabilities, err)
+	}
+
+	// Replaced, then deleted with the group
+	if _, err := adminRepo.SetGroupCapabilities(groupID, []string{CapabilityJobsRun}); err != nil {
+		t.Fatalf("SetGroupCapabilities failed: %v", err)
+	}
+	if capabilities, _ := adminRepo.GetGroupCapabilities(groupID); !slices.Equal(capabilities, []string{CapabilityJobsRun}) {
+		t.Fatalf("Expected only jobs.run, got %v", capabilities)
+	}
+	if _, err := adminRepo.Delete(created); err != nil {
+		t.Fatalf("Failed to delete group: %v", err)
+	}
+	if capabilities, _ := adminRepo.GetGroupCapabilities(groupID); len(capabilities) != 0 {
+		t.Fatalf("Expected the capabilities deleted with the group, got %v", capabilities)
+	}
+}
@@ -594,6 +594,7 @@ func (dbObject *DBObject) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
 		dbObject.SetValue("id", objectID)
 	}
 	dbObject.SetDefaultValues(dbr)
+	dbObject.sanitize()
 	if dbr.Verbose {
 		log.Println("DBObject.beforeInsert: values=", dbObject.ToJSON())
 	}
@@ -607,6 +608,7 @@ func (dbObject *DBObject) beforeUpdate(dbr *DBRepository, tx *sql.Tx) error {
 		dbObject.SetValue("last_modify", userID)
 	}
 	dbObject.SetValue("last_modify_date", CurrentDateTimeString())
+	dbObject.sanitize()
 	return nil
 }
 
@@ -32,12 +32,31 @@ func InitDBLayer(config models.Config) {
 	log.Print("DB Schema:", DbSchema)
 	dbFiles_root_directory = config.RootDirectory
 	dbFiles_dest_directory = config.FilesDirectory
+	htmlPolicy = NewHTMLPolicy(config.HTMLPolicy)
 
 	log.Print("Initializing DBEFactory...")
 
 	Factory = NewDBEFactory(false)
 	Factory.Register(NewDBVersion())
 	Factory.Register(NewOAuthToken())
+	Factory.Register(NewOAuthSession())
+	Factory.Register(NewUserTOTP())
+	Factory.Register(NewUserWebAuthnCredential())
+	Factory.Register(NewUserLDAP())
+	Factory.Register(NewUserOAuthLink())
+	Factory.Register(NewUserRegistration())
+	Factory.Register(NewUserStatus())
+	Factory.Register(NewPasswordReset())
+	Factory.Register(NewMailMessage())
+	Factory.Register(NewSubscription())
+	Factory.Register(NewNotification())
+	Factory.Register(NewNotificationPreference())
+	Factory.Register(NewAuditEntry())
+	Factory.Register(NewACLEntry())
+	Factory.Register(NewGroupCapability())
+	Factory.Register(NewAPIKey())
+	Factory.Register(NewShareLink())
+	Factory.Register(NewRateLimit())
 	Factory.Register(NewDBUser())
 	Factory.Register(NewUserGroup())
 	Factory.Register(NewDBGroup())
@@ -55,6 +74,7 @@ func InitDBLayer(config models.Config) {
 	Factory.Register(NewDBNote())
 	Factory.Register(NewDBPage())
 	Factory.Register(NewDBNews())
+	Factory.Register(NewObjectTranslation())
 	// Process foreign keys after all registrations
 	Factory.ProcessForeignKeys()
 
@@ -502,15 +522,7 @@ func InitDBData() {
 	log.Print("Initializing DB data...")
 
 	// Setup
-	dbContext := &DBContext{
-		UserID:   "-1",
-		GroupIDs: []string{"-2"},
-		Schema:   DbSchema,
-	}
-	log.Print("InitDBData: dbContext=", dbContext)
-
-	repo := NewDBRepository(dbContext, Factory, DbConnection)
-	repo.Verbose = false
+	repo := newBootstrapRepository()
 
 	// Load initial data from JSON
 	initialData, err := LoadInitialData()
@@ -587,6 +599,9 @@ func populateTable(repo *DBRepository, tablename string, listColumns []string, l
 				return nil, nil, true
 			}
 		}
+	} else if tablename == "groups_capabilities" {
+		// Only at the creation: the capabilities taken from a group by the admins must not come back
+		return results, nil, false
 	} else if tablename == "users_groups" && len(results) < len(listData) {
 		for _, entryData := range listData {
 			newEntry := repo.GetInstanceByTableName(tablename)
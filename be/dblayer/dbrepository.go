@@ -1,6 +1,7 @@
 package dblayer
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -13,6 +14,10 @@ type DBContext struct {
 	GroupIDs []string
 
 	Schema string // prefix to add to a table name
+
+	Scope *AccessScope // set when the user acts through an API key or a share link
+
+	system *systemScope // set only by NewSystemRepository
 }
 
 func (dbctx *DBContext) IsInGroup(groupID string) bool {
@@ -43,6 +48,10 @@ type DBRepository struct {
 
 	/* Can be a connection to mysql, postgresql, sqlite, etc. */
 	DbConnection *sql.DB
+
+	ctx context.Context // set by WithContext
+
+	acl *aclCache
 }
 
 func NewDBRepository(dbContext *DBContext, factory *DBEFactory, dbConnection *sql.DB) *DBRepository {
@@ -51,7 +60,27 @@ func NewDBRepository(dbContext *DBContext, factory *DBEFactory, dbConnection *sq
 		DbContext:    dbContext,
 		factory:      factory,
 		DbConnection: dbConnection,
+		acl:          &aclCache{fathers: map[string]string{}},
+	}
+}
+
+// WithContext returns a copy of the repository whose queries are cancelled with ctx,
+// e.g. the context of the HTTP request, cancelled when the client disconnects
+func (dbr *DBRepository) WithContext(ctx context.Context) *DBRepository {
+	if ctx == nil {
+		panic("dblayer: nil context")
+	}
+	repo := *dbr
+	repo.ctx = ctx
+	return &repo
+}
+
+// Context returns the context of the queries of the repository, context.Background() when not set
+func (dbr *DBRepository) Context() context.Context {
+	if dbr.ctx == nil {
+		return context.Background()
 	}
+	return dbr.ctx
 }
 
 // placeholder returns the correct SQL placeholder for the given parameter index
@@ -136,6 +165,10 @@ func (dbr *DBRepository) buildTableName(dbe DBEntityInterface) string {
 }
 
 func (dbr *DBRepository) Search(dbe DBEntityInterface, useLike bool, caseSensitive bool, orderBy string) ([]DBEntityInterface, error) {
+	if err := dbr.DbContext.checkScope(dbe.GetTableName()); err != nil {
+		return nil, err
+	}
+	dbr.auditReadWithTx(dbe, nil)
 	return dbr.searchWithTx(dbe, useLike, caseSensitive, orderBy, nil)
 }
 
@@ -251,6 +284,9 @@ func (dbr *DBRepository) searchWithTx(dbe DBEntityInterface, useLike bool, caseS
 	if orderBy != "" {
 		query += " ORDER BY " + orderBy
 	}
+	if limit, ok := dbe.GetMetadata("limit").(int); ok && limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
 
 	if dbr.Verbose {
 		log.Print("DBRepository::searchWithTx: query=", query, " args=", args)
@@ -260,9 +296,9 @@ func (dbr *DBRepository) searchWithTx(dbe DBEntityInterface, useLike bool, caseS
 	var rows *sql.Rows
 	var err error
 	if tx != nil {
-		rows, err = tx.Query(query, args...)
+		rows, err = tx.QueryContext(dbr.Context(), query, args...)
 	} else {
-		rows, err = dbr.DbConnection.Query(query, args...)
+		rows, err = dbr.DbConnection.QueryContext(dbr.Context(), query, args...)
 	}
 	if err != nil {
 		log.Print("DBRepository::searchWithTx: Query error:", err)
@@ -373,8 +409,14 @@ func (dbr *DBRepository) UpdateObject(tableName string, id string, values map[st
 
 // Insert inserts a new entity into the database within a transaction
 func (dbr *DBRepository) Insert(dbe DBEntityInterface) (DBEntityInterface, error) {
+	if err := dbr.DbContext.checkScope(dbe.GetTableName()); err != nil {
+		return nil, err
+	}
+	if err := dbr.checkAccessScope(dbe); err != nil {
+		return nil, err
+	}
 	// Start a transaction
-	tx, err := dbr.DbConnection.Begin()
+	tx, err := dbr.DbConnection.BeginTx(dbr.Context(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -385,6 +427,9 @@ func (dbr *DBRepository) Insert(dbe DBEntityInterface) (DBEntityInterface, error
 	if err != nil {
 		return nil, err
 	}
+	if err := dbr.auditWithTx("insert", dbe, tx); err != nil {
+		return nil, err
+	}
 
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
@@ -445,7 +490,7 @@ func (dbr *DBRepository) insertWithTx(dbe DBEntityInterface, tx *sql.Tx) (DBEnti
 	}
 
 	// 3. Execute the INSERT using the transaction
-	result, err := tx.Exec(query, args...)
+	result, err := tx.ExecContext(dbr.Context(), query, args...)
 	if err != nil {
 		log.Print("DBRepository::insertWithTx: Exec error:", err)
 		argsString := make([]string, len(args))
@@ -477,8 +522,14 @@ func (dbr *DBRepository) insertWithTx(dbe DBEntityInterface, tx *sql.Tx) (DBEnti
 }
 
 func (dbr *DBRepository) Delete(dbe DBEntityInterface) (DBEntityInterface, error) {
+	if err := dbr.DbContext.checkScope(dbe.GetTableName()); err != nil {
+		return nil, err
+	}
+	if err := dbr.checkAccessScope(dbe); err != nil {
+		return nil, err
+	}
 	// Start a transaction
-	tx, err := dbr.DbConnection.Begin()
+	tx, err := dbr.DbConnection.BeginTx(dbr.Context(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -489,6 +540,9 @@ func (dbr *DBRepository) Delete(dbe DBEntityInterface) (DBEntityInterface, error
 	if err != nil {
 		return nil, err
 	}
+	if err := dbr.auditWithTx("delete", dbe, tx); err != nil {
+		return nil, err
+	}
 
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
@@ -521,7 +575,7 @@ func (dbr *DBRepository) deleteWithTx(dbe DBEntityInterface, tx *sql.Tx) (DBEnti
 				log.Print("DBRepository::deleteWithTx: Soft delete query=", query)
 			}
 
-			_, err = tx.Exec(query, dbe.GetValue("deleted_date"), dbe.GetValue("deleted_by"))
+			_, err = tx.ExecContext(dbr.Context(), query, dbe.GetValue("deleted_date"), dbe.GetValue("deleted_by"))
 			if err != nil {
 				log.Print("DBRepository::deleteWithTx: Exec error:", err)
 				return nil, err
@@ -566,7 +620,7 @@ func (dbr *DBRepository) deleteWithTx(dbe DBEntityInterface, tx *sql.Tx) (DBEnti
 	}
 
 	// 3. Execute the DELETE using the transaction
-	result, err := tx.Exec(query, args...)
+	result, err := tx.ExecContext(dbr.Context(), query, args...)
 	if err != nil {
 		log.Print("DBRepository::deleteWithTx: Exec error:", err)
 		return nil, err
@@ -588,8 +642,14 @@ func (dbr *DBRepository) deleteWithTx(dbe DBEntityInterface, tx *sql.Tx) (DBEnti
 
 // Update updates an existing entity in the database within a transaction
 func (dbr *DBRepository) Update(dbe DBEntityInterface) (DBEntityInterface, error) {
+	if err := dbr.DbContext.checkScope(dbe.GetTableName()); err != nil {
+		return nil, err
+	}
+	if err := dbr.checkAccessScope(dbe); err != nil {
+		return nil, err
+	}
 	// Start a transaction
-	tx, err := dbr.DbConnection.Begin()
+	tx, err := dbr.DbConnection.BeginTx(dbr.Context(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -600,6 +660,9 @@ func (dbr *DBRepository) Update(dbe DBEntityInterface) (DBEntityInterface, error
 	if err != nil {
 		return nil, err
 	}
+	if err := dbr.auditWithTx("update", dbe, tx); err != nil {
+		return nil, err
+	}
 
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
@@ -609,6 +672,37 @@ func (dbr *DBRepository) Update(dbe DBEntityInterface) (DBEntityInterface, error
 	return result, nil
 }
 
+// conditionalUpdate runs "UPDATE <table of dbe> SET set WHERE where", for the changes that must check the current
+// values in the same statement (a counter, a token used once...), and audits it like Update when it changed rows.
+// It returns the rows changed: 0 when the condition no longer holds.
+func (dbr *DBRepository) conditionalUpdate(dbe DBEntityInterface, set string, where string, args ...any) (int64, error) {
+	if err := dbr.DbContext.checkScope(dbe.GetTableName()); err != nil {
+		return 0, err
+	}
+	tx, err := dbr.DbConnection.BeginTx(dbr.Context(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", dbr.buildTableName(dbe), set, where)
+	if dbr.Verbose {
+		log.Print("DBRepository::conditionalUpdate: query=", query, " args=", args)
+	}
+	result, err := tx.ExecContext(dbr.Context(), query, args...)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return 0, err
+	}
+	if err := dbr.auditWithTx("update", dbe, tx); err != nil {
+		return 0, err
+	}
+	return affected, tx.Commit()
+}
+
 // updateWithTx is an internal method that performs the update using an existing transaction
 func (dbr *DBRepository) updateWithTx(dbe DBEntityInterface, tx *sql.Tx) (DBEntityInterface, error) {
 	if dbr.Verbose {
@@ -667,7 +761,7 @@ func (dbr *DBRepository) updateWithTx(dbe DBEntityInterface, tx *sql.Tx) (DBEnti
 	}
 
 	// 4. Execute the UPDATE using the transaction
-	result, err := tx.Exec(query, args...)
+	result, err := tx.ExecContext(dbr.Context(), query, args...)
 	if err != nil {
 		log.Print("DBRepository::updateWithTx: Exec error:", err)
 		return nil, err
@@ -689,10 +783,13 @@ func (dbr *DBRepository) updateWithTx(dbe DBEntityInterface, tx *sql.Tx) (DBEnti
 }
 
 func (dbr *DBRepository) ExecuteSQL(sqlString string, args ...interface{}) (sql.Result, error) {
+	if err := dbr.DbContext.checkScope(allTables); err != nil {
+		return nil, err
+	}
 	if dbr.Verbose {
 		log.Print("DBRepository::ExecuteSQL: sqlString=", sqlString, " args=", args)
 	}
-	result, err := dbr.DbConnection.Exec(sqlString, args...)
+	result, err := dbr.DbConnection.ExecContext(dbr.Context(), sqlString, args...)
 	if err != nil {
 		log.Print("DBRepository::ExecuteSQL: Exec error:", err)
 		return nil, err
@@ -719,7 +816,10 @@ func (dbr *DBRepository) GetCurrentUser() DBEntityInterface {
 
 // **** Objects Management ****
 
+// ObjectByID returns the object with the given id, looking in the tables of all the types.
+// A system context without ObjectTables looks only in the object tables it was created for.
 func (dbr *DBRepository) ObjectByID(objectID string, ignoreDeleted bool) DBEntityInterface {
+	allObjects := dbr.DbContext.inScope(ObjectTables)
 	registeredTypes := dbr.factory.GetAllClassNames()
 	var queries []string
 
@@ -734,6 +834,9 @@ func (dbr *DBRepository) ObjectByID(objectID string, ignoreDeleted bool) DBEntit
 		if !dbe.IsDBObject() {
 			continue
 		}
+		if !allObjects && !dbr.DbContext.inScope(dbe.GetTableName()) {
+			continue
+		}
 		query := "SELECT '" + className + "' as classname, id,owner,group_id,permissions,creator," +
 			"creation_date,last_modify,last_modify_date," +
 			"deleted_by,deleted_date," +
@@ -745,11 +848,15 @@ func (dbr *DBRepository) ObjectByID(objectID string, ignoreDeleted bool) DBEntit
 		}
 		queries = append(queries, query)
 	}
+	if len(queries) == 0 {
+		dbr.DbContext.checkScope(ObjectTables)
+		return nil
+	}
 	searchString := strings.Join(queries, " UNION ")
 	if dbr.Verbose {
 		log.Print("DBRepository::ObjectByID: searchString=", searchString)
 	}
-	results := dbr.Select("DBObject", searchString)
+	results := dbr.selectSQL("DBObject", searchString)
 	if len(results) == 0 {
 		return nil
 	}
@@ -785,6 +892,9 @@ func (dbr *DBRepository) FullObjectById(objectID string, ignoreDeleted bool) DBE
 	return foundEntities[0]
 }
 func (dbr *DBRepository) SearchByName(name string, orderBy string, ignoreDeleted bool) []DBEntityInterface {
+	if dbr.DbContext.checkScope(ObjectTables) != nil {
+		return nil
+	}
 	registeredTypes := dbr.factory.GetAllClassNames()
 	var queries []string
 
@@ -814,13 +924,16 @@ func (dbr *DBRepository) SearchByName(name string, orderBy string, ignoreDeleted
 	if dbr.Verbose {
 		log.Print("DBRepository::SearchByName: searchString=", searchString)
 	}
-	results := dbr.Select("DBObject", searchString)
+	results := dbr.selectSQL("DBObject", searchString)
 	return results
 }
 
 // SearchByNameAndDescription searches for DBObjects by name or description
 // Returns all objects where name OR description contains the search text
 func (dbr *DBRepository) SearchByNameAndDescription(searchText string, orderBy string, ignoreDeleted bool) []DBEntityInterface {
+	if dbr.DbContext.checkScope(ObjectTables) != nil {
+		return nil
+	}
 	registeredTypes := dbr.factory.GetAllClassNames()
 	var queries []string
 
@@ -850,13 +963,16 @@ func (dbr *DBRepository) SearchByNameAndDescription(searchText string, orderBy s
 	if dbr.Verbose {
 		log.Print("DBRepository::SearchByNameAndDescription: searchString=", searchString)
 	}
-	results := dbr.Select("DBObject", searchString)
+	results := dbr.selectSQL("DBObject", searchString)
 	return results
 }
 
 // GetChildren returns all direct children of a folder (objects with father_id = parentID)
 // Filters results by read permissions
 func (dbr *DBRepository) GetChildren(parentID string, ignoreDeleted bool) []DBEntityInterface {
+	if dbr.DbContext.checkScope(ObjectTables) != nil {
+		return nil
+	}
 
 	// Get the container object
 	container := dbr.FullObjectById(parentID, true)
@@ -914,7 +1030,7 @@ func (dbr *DBRepository) GetChildren(parentID string, ignoreDeleted bool) []DBEn
 	if dbr.Verbose {
 		log.Print("DBRepository::GetChildren: searchString=", searchString)
 	}
-	results := dbr.Select("DBObject", searchString)
+	results := dbr.selectSQL("DBObject", searchString)
 
 	// If childs_sort_order is defined, sort results accordingly and append any missing items at the end
 	if len(childs_sort_order) > 0 {
@@ -947,6 +1063,9 @@ func (dbr *DBRepository) GetChildren(parentID string, ignoreDeleted bool) []DBEn
 // GetBreadcrumb returns the path from root to the specified object
 // Each element is a DBObject with id, name, and father_id
 func (dbr *DBRepository) GetBreadcrumb(objectID string, ignoreDeleted bool) []DBEntityInterface {
+	if dbr.DbContext.checkScope(ObjectTables) != nil {
+		return nil
+	}
 	breadcrumb := make([]DBEntityInterface, 0)
 	currentID := objectID
 
@@ -985,10 +1104,18 @@ func (dbr *DBRepository) GetBreadcrumb(objectID string, ignoreDeleted bool) []DB
 }
 
 func (dbr *DBRepository) Select(returnedClassName string, sqlString string, args ...interface{}) []DBEntityInterface {
+	if dbr.DbContext.checkScope(allTables) != nil {
+		return nil
+	}
+	return dbr.selectSQL(returnedClassName, sqlString, args...)
+}
+
+// selectSQL runs a query built by the repository itself
+func (dbr *DBRepository) selectSQL(returnedClassName string, sqlString string, args ...interface{}) []DBEntityInterface {
 	if dbr.Verbose {
 		log.Print("DBRepository::Select: sqlString=", sqlString, " args=", args)
 	}
-	rows, err := dbr.DbConnection.Query(sqlString, args...)
+	rows, err := dbr.DbConnection.QueryContext(dbr.Context(), sqlString, args...)
 	if err != nil {
 		log.Print("DBRepository::Select: Query error:", err)
 		return nil
@@ -1086,96 +1213,76 @@ func (dbr *DBRepository) Select(returnedClassName string, sqlString string, args
 	return results
 }
 
-// CheckReadPermission checks if the current user can read a DBObject
-// Returns true if:
-// - User is the owner
-// - User is in the object's group and group has read permission
-// - Object has public read permission
-func (dbr *DBRepository) CheckReadPermission(dbe DBEntityInterface) bool {
-	if !dbe.IsDBObject() {
-		return true // Non-DBObjects have no permission restrictions
-	}
-
+// permissionsOf returns the permissions of the current user on a DBObject from its permissions string,
+// e.g. "rwx": the ones of the owner, of the group if the user is in the object's group, of the others otherwise
+func (dbr *DBRepository) permissionsOf(dbe DBEntityInterface) string {
 	owner, ok := dbe.GetValue("owner").(string)
 	if !ok {
-		return false
+		return NoPermissions
+	}
+	permissions, ok := dbe.GetValue("permissions").(string)
+	if !ok || len(permissions) != 9 {
+		return NoPermissions
 	}
 
 	// User is owner
 	if dbr.DbContext.IsUser(owner) {
-		permissions, ok := dbe.GetValue("permissions").(string)
-		if !ok || len(permissions) != 9 {
-			return false
-		}
-		return permissions[0] == 'r' // User read permission
+		return permissions[0:3]
 	}
 
 	groupID, ok := dbe.GetValue("group_id").(string)
 	if !ok {
-		return false
+		return NoPermissions
 	}
 
 	// User is in group
 	if dbr.DbContext.IsInGroup(groupID) {
-		permissions, ok := dbe.GetValue("permissions").(string)
-		if !ok || len(permissions) != 9 {
-			return false
-		}
-		return permissions[3] == 'r' // Group read permission
+		return permissions[3:6]
 	}
 
-	// Check public read permission
-	permissions, ok := dbe.GetValue("permissions").(string)
-	if !ok || len(permissions) != 9 {
-		return false
-	}
-	return permissions[6] == 'r' // Others read permission
+	// Others
+	return permissions[6:9]
 }
 
-// CheckWritePermission checks if the current user can write (modify/delete) a DBObject
-// Returns true if:
-// - User is the owner and has write permission
-// - User is in the object's group and group has write permission
-// - Object has public write permission
-func (dbr *DBRepository) CheckWritePermission(dbe DBEntityInterface) bool {
+// EffectivePermissions returns the permissions of the current user on a DBObject: the ones of its permissions string
+// and the ones granted by the ACLs (see acl.go), e.g. "r--" and "rw-"
+func (dbr *DBRepository) EffectivePermissions(dbe DBEntityInterface) (string, string) {
+	return dbr.permissionsOf(dbe), dbr.aclPermissionsWithTx(dbe, nil)
+}
+
+// checkPermissionWithTx checks one of the permissions r, w and x of the current user on a DBObject:
+// granted by its permissions string or by its ACLs
+func (dbr *DBRepository) checkPermissionWithTx(dbe DBEntityInterface, index int, tx *sql.Tx) bool {
 	if !dbe.IsDBObject() {
 		return true // Non-DBObjects have no permission restrictions
 	}
-
-	owner, ok := dbe.GetValue("owner").(string)
-	if !ok {
+	if !dbr.DbContext.Scope.allowsWithTx(dbr, dbe, index, tx) {
 		return false
 	}
-
-	// User is owner
-	if dbr.DbContext.IsUser(owner) {
-		permissions, ok := dbe.GetValue("permissions").(string)
-		if !ok || len(permissions) != 9 {
-			return false
-		}
-		return permissions[1] == 'w' // User write permission
-	}
-
-	groupID, ok := dbe.GetValue("group_id").(string)
-	if !ok {
-		return false
+	if dbr.permissionsOf(dbe)[index] != '-' {
+		return true
 	}
+	return dbr.aclPermissionsWithTx(dbe, tx)[index] != '-'
+}
 
-	// User is in group
-	if dbr.DbContext.IsInGroup(groupID) {
-		permissions, ok := dbe.GetValue("permissions").(string)
-		if !ok || len(permissions) != 9 {
-			return false
-		}
-		return permissions[4] == 'w' // Group write permission
-	}
+// CheckReadPermission checks if the current user can read a DBObject
+// Returns true if:
+// - User is the owner and has read permission
+// - User is in the object's group and group has read permission
+// - Object has public read permission
+// - An ACL entry of the object or of a folder above grants read to the user or to one of its groups
+func (dbr *DBRepository) CheckReadPermission(dbe DBEntityInterface) bool {
+	return dbr.checkPermissionWithTx(dbe, 0, nil)
+}
 
-	// Check public write permission
-	permissions, ok := dbe.GetValue("permissions").(string)
-	if !ok || len(permissions) != 9 {
-		return false
-	}
-	return permissions[7] == 'w' // Others write permission
+// CheckWritePermission checks if the current user can write (modify/delete) a DBObject
+// Returns true if:
+// - User is the owner and has write permission
+// - User is in the object's group and group has write permission
+// - Object has public write permission
+// - An ACL entry of the object or of a folder above grants write to the user or to one of its groups
+func (dbr *DBRepository) CheckWritePermission(dbe DBEntityInterface) bool {
+	return dbr.checkPermissionWithTx(dbe, 1, nil)
 }
 
 // FilterByReadPermission filters a slice of DBEntityInterface, keeping only objects the user can read
@@ -1195,11 +1302,15 @@ func (dbr *DBRepository) GetEntityByID(tableName string, id string) DBEntityInte
 
 // GetEntityByID retrieves a generic entity (non-DBObject) by table name and ID
 func (dbr *DBRepository) GetEntityByIDWithTx(tableName string, id string, tx *sql.Tx) DBEntityInterface {
+	if dbr.DbContext.checkScope(tableName) != nil {
+		return nil
+	}
 	dbe := dbr.GetInstanceByTableName(tableName)
 	if dbe == nil {
 		return nil
 	}
 	dbe.SetValue("id", id)
+	dbr.auditReadWithTx(dbe, tx)
 	results, err := dbr.searchWithTx(dbe, false, false, "", tx)
 	if err != nil || len(results) == 0 {
 		return nil
@@ -1,6 +1,8 @@
 package dblayer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -54,6 +56,16 @@ func TestSearchUserByLogin(t *testing.T) {
 	for _, user := range results {
 		log.Printf("- %s\t%s\t%s\n", user.GetValue("id"), user.GetValue("login"), user.GetValue("fullname"))
 	}
+
+	// Step 7: The "limit" metadata caps the rows read
+	userEntity.SetMetadata("limit", 1)
+	results, err = repo.Search(userEntity, true, true, "login")
+	if err != nil {
+		t.Fatal("Failed to search for user:", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 user with the limit, got %d", len(results))
+	}
 }
 
 func TestInsertUser(t *testing.T) {
@@ -490,3 +502,37 @@ func TestCRUDMayhem(t *testing.T) {
 		t.Log("All mayhem groups successfully deleted.")
 	}
 }
+
+// go test -v ./dblayer -run TestRepositoryWithContext
+func TestRepositoryWithContext(t *testing.T) {
+	repo := SetupTestRepo(t, "-1", []string{"-2"}, DbSchema)
+	if repo.Context() != context.Background() {
+		t.Fatal("Expected the background context by default")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	withCtx := repo.WithContext(ctx)
+	if repo.Context() != context.Background() || withCtx.Context() != ctx {
+		t.Fatal("Expected WithContext to return a copy with the context")
+	}
+	if _, err := withCtx.Search(NewDBUser(), false, false, ""); err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+
+	// The client went away: the queries are not run
+	cancel()
+	if _, err := withCtx.Search(NewDBUser(), false, false, ""); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the search to be cancelled, got %v", err)
+	}
+	user := NewDBUser()
+	user.SetValue("login", "cancelled")
+	user.SetValue("pwd", "cancelled")
+	if _, err := withCtx.Insert(user); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the insert to be cancelled, got %v", err)
+	}
+	search := NewDBUser()
+	search.SetValue("login", "cancelled")
+	if found, _ := repo.Search(search, false, false, ""); len(found) != 0 {
+		t.Fatal("Expected the cancelled insert not to be written")
+	}
+}
@@ -88,6 +88,697 @@ func (oAuthToken *OAuthToken) NewInstance() DBEntityInterface {
 	return NewOAuthToken()
 }
 
+/*
+A login session: the chain of tokens obtained with one login and its refreshes.
+session_id is the chain prefix of the refresh tokens stored in oauth_tokens.
+*/
+type OAuthSession struct {
+	DBEntity
+}
+
+func NewOAuthSession() *OAuthSession {
+	columns := []Column{
+		{Name: "session_id", Type: "varchar(32)", Constraints: []string{"NOT NULL"}},
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "login_method", Type: "varchar(32)", Constraints: []string{}},
+		{Name: "ip_address", Type: "varchar(64)", Constraints: []string{}},
+		{Name: "user_agent", Type: "varchar(255)", Constraints: []string{}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+		{Name: "last_used_at", Type: "datetime", Constraints: []string{}},
+		{Name: "expires_at", Type: "datetime", Constraints: []string{"NOT NULL"}},
+	}
+	keys := []string{"session_id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &OAuthSession{
+		DBEntity: *NewDBEntity(
+			"OAuthSession",
+			"oauth_sessions",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (oAuthSession *OAuthSession) NewInstance() DBEntityInterface {
+	return NewOAuthSession()
+}
+
+/*
+TOTP second factor of a user (RFC 6238).
+enabled_at is empty until the enrollment is confirmed with a valid code,
+last_step is the time step of the last accepted code (codes cannot be replayed),
+recovery_codes are the SHA-256 hashes of the unused one-time recovery codes, comma separated.
+*/
+type UserTOTP struct {
+	DBEntity
+}
+
+func NewUserTOTP() *UserTOTP {
+	columns := []Column{
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "secret", Type: "varchar(64)", Constraints: []string{"NOT NULL"}},
+		{Name: "last_step", Type: "int", Constraints: []string{}},
+		{Name: "recovery_codes", Type: "text", Constraints: []string{}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+		{Name: "enabled_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"user_id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &UserTOTP{
+		DBEntity: *NewDBEntity(
+			"UserTOTP",
+			"users_totp",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (userTOTP *UserTOTP) NewInstance() DBEntityInterface {
+	return NewUserTOTP()
+}
+
+/*
+WebAuthn credential (passkey or security key) of a user.
+credential_id is the base64url encoded credential ID, credential the JSON of the
+public key, flags and signature counter as stored by the WebAuthn library.
+*/
+type UserWebAuthnCredential struct {
+	DBEntity
+}
+
+func NewUserWebAuthnCredential() *UserWebAuthnCredential {
+	columns := []Column{
+		{Name: "credential_id", Type: "varchar(255)", Constraints: []string{"NOT NULL"}},
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "name", Type: "varchar(255)", Constraints: []string{}},
+		{Name: "credential", Type: "text", Constraints: []string{"NOT NULL"}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+		{Name: "last_used_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"credential_id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &UserWebAuthnCredential{
+		DBEntity: *NewDBEntity(
+			"UserWebAuthnCredential",
+			"users_webauthn",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (userWebAuthnCredential *UserWebAuthnCredential) NewInstance() DBEntityInterface {
+	return NewUserWebAuthnCredential()
+}
+
+/*
+Link of a user to its LDAP entry: the user logs in with the LDAP password.
+synced_at is the last time the user was updated from the directory.
+*/
+type UserLDAP struct {
+	DBEntity
+}
+
+func NewUserLDAP() *UserLDAP {
+	columns := []Column{
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "dn", Type: "varchar(255)", Constraints: []string{"NOT NULL"}},
+		{Name: "synced_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"user_id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &UserLDAP{
+		DBEntity: *NewDBEntity(
+			"UserLDAP",
+			"users_ldap",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (userLDAP *UserLDAP) NewInstance() DBEntityInterface {
+	return NewUserLDAP()
+}
+
+/*
+Link of a user to an account of an external identity provider (Google, GitHub, Telegram, OpenID Connect):
+the account is the subject (sub) of the provider, named by its issuer. The OAuth logins find their user by this link.
+*/
+type UserOAuthLink struct {
+	DBEntity
+}
+
+func NewUserOAuthLink() *UserOAuthLink {
+	columns := []Column{
+		{Name: "issuer", Type: "varchar(255)", Constraints: []string{"NOT NULL"}},
+		{Name: "subject", Type: "varchar(255)", Constraints: []string{"NOT NULL"}},
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+		{Name: "last_login_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"issuer", "subject"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &UserOAuthLink{
+		DBEntity: *NewDBEntity(
+			"UserOAuthLink",
+			"users_oauth",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (userOAuthLink *UserOAuthLink) NewInstance() DBEntityInterface {
+	return NewUserOAuthLink()
+}
+
+/*
+Self-service registration of a user.
+The user cannot log in until verified_at is set by the link sent to email.
+*/
+type UserRegistration struct {
+	DBEntity
+}
+
+func NewUserRegistration() *UserRegistration {
+	columns := []Column{
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "email", Type: "varchar(255)", Constraints: []string{"NOT NULL"}},
+		{Name: "ip_address", Type: "varchar(64)", Constraints: []string{}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+		{Name: "verified_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"user_id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &UserRegistration{
+		DBEntity: *NewDBEntity(
+			"UserRegistration",
+			"users_registrations",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (userRegistration *UserRegistration) NewInstance() DBEntityInterface {
+	return NewUserRegistration()
+}
+
+/*
+Whether a user can log in: the only switch checked by the logins, the API keys and the share links.
+A user without a row is enabled. reason tells who disabled it: an admin, the LDAP sync (the entry left
+the directory) or the registration (the email is not verified yet).
+*/
+type UserStatus struct {
+	DBEntity
+}
+
+func NewUserStatus() *UserStatus {
+	columns := []Column{
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "enabled", Type: "int", Constraints: []string{"NOT NULL"}},
+		{Name: "reason", Type: "varchar(32)", Constraints: []string{}},
+		{Name: "changed_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"user_id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &UserStatus{
+		DBEntity: *NewDBEntity(
+			"UserStatus",
+			"users_status",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (userStatus *UserStatus) NewInstance() DBEntityInterface {
+	return NewUserStatus()
+}
+
+/*
+A password reset requested by a user.
+token_hash is the SHA-256 of the token sent by email: the token itself is never stored.
+*/
+type PasswordReset struct {
+	DBEntity
+}
+
+func NewPasswordReset() *PasswordReset {
+	columns := []Column{
+		{Name: "token_hash", Type: "varchar(64)", Constraints: []string{"NOT NULL"}},
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "ip_address", Type: "varchar(64)", Constraints: []string{}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+		{Name: "expires_at", Type: "datetime", Constraints: []string{"NOT NULL"}},
+		{Name: "used_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"token_hash"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &PasswordReset{
+		DBEntity: *NewDBEntity(
+			"PasswordReset",
+			"users_password_resets",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (passwordReset *PasswordReset) NewInstance() DBEntityInterface {
+	return NewPasswordReset()
+}
+
+/*
+An outbound email waiting in the queue, sent or given up.
+status is pending, sent or failed; pending messages are sent from next_attempt_at.
+*/
+type MailMessage struct {
+	DBEntity
+}
+
+func NewMailMessage() *MailMessage {
+	columns := []Column{
+		{Name: "id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "recipient", Type: "varchar(255)", Constraints: []string{"NOT NULL"}},
+		{Name: "subject", Type: "varchar(255)", Constraints: []string{}},
+		{Name: "body", Type: "text", Constraints: []string{}},
+		{Name: "status", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "attempts", Type: "int", Constraints: []string{}},
+		{Name: "last_error", Type: "text", Constraints: []string{}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+		{Name: "next_attempt_at", Type: "datetime", Constraints: []string{}},
+		{Name: "sent_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"id"}
+	foreignKeys := []ForeignKey{}
+	return &MailMessage{
+		DBEntity: *NewDBEntity(
+			"MailMessage",
+			"mail_queue",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (mailMessage *MailMessage) NewInstance() DBEntityInterface {
+	return NewMailMessage()
+}
+
+/*
+Subscription of a user to an object: a folder covers everything under it.
+*/
+type Subscription struct {
+	DBEntity
+}
+
+func NewSubscription() *Subscription {
+	columns := []Column{
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "object_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"user_id", "object_id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &Subscription{
+		DBEntity: *NewDBEntity(
+			"Subscription",
+			"subscriptions",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (subscription *Subscription) NewInstance() DBEntityInterface {
+	return NewSubscription()
+}
+
+/*
+Notification of a change to a subscribed object.
+event is created, updated or commented; read_at and emailed_at are empty until read or sent in a digest.
+*/
+type Notification struct {
+	DBEntity
+}
+
+func NewNotification() *Notification {
+	columns := []Column{
+		{Name: "id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "object_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "object_name", Type: "varchar(255)", Constraints: []string{}},
+		{Name: "subscription_id", Type: "varchar(16)", Constraints: []string{}},
+		{Name: "event", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "actor_id", Type: "varchar(16)", Constraints: []string{}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+		{Name: "read_at", Type: "datetime", Constraints: []string{}},
+		{Name: "emailed_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &Notification{
+		DBEntity: *NewDBEntity(
+			"Notification",
+			"notifications",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (notification *Notification) NewInstance() DBEntityInterface {
+	return NewNotification()
+}
+func (notification *Notification) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
+	if !notification.HasValue("id") {
+		notificationID, _ := uuid16HexGo()
+		notification.SetValue("id", notificationID)
+	}
+	return nil
+}
+
+/*
+How a user wants to be notified: in_app is 1 or 0, email_digest is never, daily or weekly.
+language is the UI language of the user, for the digest.
+*/
+type NotificationPreference struct {
+	DBEntity
+}
+
+func NewNotificationPreference() *NotificationPreference {
+	columns := []Column{
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "in_app", Type: "int", Constraints: []string{}},
+		{Name: "email_digest", Type: "varchar(16)", Constraints: []string{}},
+		{Name: "language", Type: "varchar(8)", Constraints: []string{}},
+		{Name: "last_digest_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"user_id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &NotificationPreference{
+		DBEntity: *NewDBEntity(
+			"NotificationPreference",
+			"notification_preferences",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (notificationPreference *NotificationPreference) NewInstance() DBEntityInterface {
+	return NewNotificationPreference()
+}
+
+/*
+Audit trail of the changes made by the system contexts (see NewSystemRepository).
+action is insert, update or delete; row_id are the keys of the changed row; reason is the one of the context.
+*/
+type AuditEntry struct {
+	DBEntity
+}
+
+func NewAuditEntry() *AuditEntry {
+	columns := []Column{
+		{Name: "id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{}},
+		{Name: "action", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "table_name", Type: "varchar(64)", Constraints: []string{"NOT NULL"}},
+		{Name: "row_id", Type: "varchar(255)", Constraints: []string{}},
+		{Name: "reason", Type: "varchar(255)", Constraints: []string{}},
+	}
+	keys := []string{"id"}
+	return &AuditEntry{
+		DBEntity: *NewDBEntity(
+			"AuditEntry",
+			"audit_log",
+			columns,
+			keys,
+			[]ForeignKey{},
+			make(map[string]any),
+		),
+	}
+}
+func (auditEntry *AuditEntry) NewInstance() DBEntityInterface {
+	return NewAuditEntry()
+}
+func (auditEntry *AuditEntry) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
+	if !auditEntry.HasValue("id") {
+		entryID, _ := uuid16HexGo()
+		auditEntry.SetValue("id", entryID)
+	}
+	return nil
+}
+
+/*
+Access control entry: grants a user or a group (principal_type user or group) the permissions r, w and x
+(e.g. "rw-") on an object and on everything under it, on top of its permissions string. See acl.go.
+*/
+type ACLEntry struct {
+	DBEntity
+}
+
+func NewACLEntry() *ACLEntry {
+	columns := []Column{
+		{Name: "id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "object_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "principal_type", Type: "varchar(8)", Constraints: []string{"NOT NULL"}},
+		{Name: "principal_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "permissions", Type: "char(3)", Constraints: []string{"NOT NULL"}},
+		{Name: "created_by", Type: "varchar(16)", Constraints: []string{}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"id"}
+	return &ACLEntry{
+		DBEntity: *NewDBEntity(
+			"ACLEntry",
+			"acl_entries",
+			columns,
+			keys,
+			[]ForeignKey{},
+			make(map[string]any),
+		),
+	}
+}
+func (aclEntry *ACLEntry) NewInstance() DBEntityInterface {
+	return NewACLEntry()
+}
+func (aclEntry *ACLEntry) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
+	if !aclEntry.HasValue("id") {
+		entryID, _ := uuid16HexGo()
+		aclEntry.SetValue("id", entryID)
+	}
+	return nil
+}
+
+/*
+Capability of a group, e.g. users.manage: what its users can administer. See capabilities.go.
+*/
+type GroupCapability struct {
+	DBEntity
+}
+
+func NewGroupCapability() *GroupCapability {
+	columns := []Column{
+		{Name: "group_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "capability", Type: "varchar(64)", Constraints: []string{"NOT NULL"}},
+	}
+	keys := []string{"group_id", "capability"}
+	return &GroupCapability{
+		DBEntity: *NewDBEntity(
+			"GroupCapability",
+			"groups_capabilities",
+			columns,
+			keys,
+			[]ForeignKey{},
+			make(map[string]any),
+		),
+	}
+}
+func (groupCapability *GroupCapability) NewInstance() DBEntityInterface {
+	return NewGroupCapability()
+}
+
+/*
+Personal API key of a user, for scripts and the CLI: sent as "Authorization: Bearer rbk_...".
+Only key_hash, the SHA-256 of the key, is stored; key_prefix is its beginning, to recognize it in a list.
+read_only, folder_id and classnames restrict what the key can do on top of the permissions of the user
+(see apikeys.go), expires_at is empty for the keys that do not expire.
+*/
+type APIKey struct {
+	DBEntity
+}
+
+func NewAPIKey() *APIKey {
+	columns := []Column{
+		{Name: "id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "name", Type: "varchar(255)", Constraints: []string{"NOT NULL"}},
+		{Name: "key_hash", Type: "varchar(64)", Constraints: []string{"NOT NULL"}},
+		{Name: "key_prefix", Type: "varchar(16)", Constraints: []string{}},
+		{Name: "read_only", Type: "int", Constraints: []string{}},
+		{Name: "folder_id", Type: "varchar(16)", Constraints: []string{}},
+		{Name: "classnames", Type: "varchar(255)", Constraints: []string{}},
+		{Name: "expires_at", Type: "datetime", Constraints: []string{}},
+		{Name: "last_used_at", Type: "datetime", Constraints: []string{}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"id"}
+	foreignKeys := []ForeignKey{
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &APIKey{
+		DBEntity: *NewDBEntity(
+			"APIKey",
+			"api_keys",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (apiKey *APIKey) NewInstance() DBEntityInterface {
+	return NewAPIKey()
+}
+func (apiKey *APIKey) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
+	if !apiKey.HasValue("id") {
+		keyID, _ := uuid16HexGo()
+		apiKey.SetValue("id", keyID)
+	}
+	return nil
+}
+
+/*
+Share link of an object, opened without logging in at /share/{token}: it reads as its creator, only the object
+(or the object and what is below it, with subtree), see scope.go.
+Only token_hash, the SHA-256 of the token, is stored. password is the bcrypt hash of the optional password,
+max_uses 0 means no limit, expires_at empty means no expiry.
+*/
+type ShareLink struct {
+	DBEntity
+}
+
+func NewShareLink() *ShareLink {
+	columns := []Column{
+		{Name: "id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "object_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "user_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "token_hash", Type: "varchar(64)", Constraints: []string{"NOT NULL"}},
+		{Name: "token_prefix", Type: "varchar(16)", Constraints: []string{}},
+		{Name: "subtree", Type: "int", Constraints: []string{}},
+		{Name: "password", Type: "varchar(255)", Constraints: []string{}},
+		{Name: "max_uses", Type: "int", Constraints: []string{}},
+		{Name: "uses", Type: "int", Constraints: []string{}},
+		{Name: "expires_at", Type: "datetime", Constraints: []string{}},
+		{Name: "last_used_at", Type: "datetime", Constraints: []string{}},
+		{Name: "created_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"id"}
+	foreignKeys := []ForeignKey{
+		{Column: "object_id", RefTable: "objects", RefColumn: "id"},
+		{Column: "user_id", RefTable: "users", RefColumn: "id"},
+	}
+	return &ShareLink{
+		DBEntity: *NewDBEntity(
+			"ShareLink",
+			"share_links",
+			columns,
+			keys,
+			foreignKeys,
+			make(map[string]any),
+		),
+	}
+}
+func (shareLink *ShareLink) NewInstance() DBEntityInterface {
+	return NewShareLink()
+}
+func (shareLink *ShareLink) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
+	if !shareLink.HasValue("id") {
+		shareID, _ := uuid16HexGo()
+		shareLink.SetValue("id", shareID)
+	}
+	return nil
+}
+
+/*
+State of a key of the rate limits shared by the instances (see ratelimits.go): the tokens left in its bucket
+or the failed logins of an account, and a time in unix milliseconds (last refill, or end of the lockout).
+*/
+type RateLimit struct {
+	DBEntity
+}
+
+func NewRateLimit() *RateLimit {
+	columns := []Column{
+		{Name: "rate_key", Type: "varchar(255)", Constraints: []string{"NOT NULL"}},
+		{Name: "tokens", Type: "varchar(32)", Constraints: []string{}},
+		{Name: "failures", Type: "int", Constraints: []string{}},
+		{Name: "stamp", Type: "varchar(32)", Constraints: []string{}},
+		{Name: "updated_at", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"rate_key"}
+	return &RateLimit{
+		DBEntity: *NewDBEntity(
+			"RateLimit",
+			"rate_limits",
+			columns,
+			keys,
+			[]ForeignKey{},
+			make(map[string]any),
+		),
+	}
+}
+func (rateLimit *RateLimit) NewInstance() DBEntityInterface {
+	return NewRateLimit()
+}
+
+func (mailMessage *MailMessage) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
+	if !mailMessage.HasValue("id") {
+		messageID, _ := uuid16HexGo()
+		mailMessage.SetValue("id", messageID)
+	}
+	return nil
+}
+
 /*
 CREATE TABLE `rprj_users` (
 
@@ -330,6 +1021,85 @@ func (dbUser *DBUser) beforeDelete(dbr *DBRepository, tx *sql.Tx) error {
 			return err
 		}
 	}
+	// Delete the second factor
+	userTOTP := NewUserTOTP()
+	userTOTP.SetValue("user_id", dbUser.GetValue("id"))
+	if _, err := dbr.deleteWithTx(userTOTP, tx); err != nil {
+		log.Print("DBUser::beforeDelete: error deleting TOTP:", err)
+		return err
+	}
+	webAuthnCredential := NewUserWebAuthnCredential()
+	webAuthnCredential.SetValue("user_id", dbUser.GetValue("id"))
+	results, err = dbr.searchWithTx(webAuthnCredential, false, false, "", tx)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if _, err := dbr.deleteWithTx(res, tx); err != nil {
+			log.Print("DBUser::beforeDelete: error deleting WebAuthn credential:", err)
+			return err
+		}
+	}
+	apiKey := NewAPIKey()
+	apiKey.SetValue("user_id", dbUser.GetValue("id"))
+	results, err = dbr.searchWithTx(apiKey, false, false, "", tx)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if _, err := dbr.deleteWithTx(res, tx); err != nil {
+			log.Print("DBUser::beforeDelete: error deleting API key:", err)
+			return err
+		}
+	}
+	shareLink := NewShareLink()
+	shareLink.SetValue("user_id", dbUser.GetValue("id"))
+	results, err = dbr.searchWithTx(shareLink, false, false, "", tx)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if _, err := dbr.deleteWithTx(res, tx); err != nil {
+			log.Print("DBUser::beforeDelete: error deleting share link:", err)
+			return err
+		}
+	}
+	userLDAP := NewUserLDAP()
+	userLDAP.SetValue("user_id", dbUser.GetValue("id"))
+	if _, err := dbr.deleteWithTx(userLDAP, tx); err != nil {
+		log.Print("DBUser::beforeDelete: error deleting LDAP link:", err)
+		return err
+	}
+	userRegistration := NewUserRegistration()
+	userRegistration.SetValue("user_id", dbUser.GetValue("id"))
+	if _, err := dbr.deleteWithTx(userRegistration, tx); err != nil {
+		log.Print("DBUser::beforeDelete: error deleting registration:", err)
+		return err
+	}
+	userStatus := NewUserStatus()
+	userStatus.SetValue("user_id", dbUser.GetValue("id"))
+	if _, err := dbr.deleteWithTx(userStatus, tx); err != nil {
+		log.Print("DBUser::beforeDelete: error deleting status:", err)
+		return err
+	}
+	// Tables keyed by other columns: the rows of the user are searched first
+	for _, entity := range []DBEntityInterface{NewUserOAuthLink(), NewPasswordReset(), NewSubscription(), NewNotification(), NewNotificationPreference()} {
+		entity.SetValue("user_id", dbUser.GetValue("id"))
+		results, err := dbr.searchWithTx(entity, false, false, "", tx)
+		if err != nil {
+			return err
+		}
+		for _, res := range results {
+			if _, err := dbr.deleteWithTx(res, tx); err != nil {
+				log.Print("DBUser::beforeDelete: error deleting ", entity.GetTableName(), ":", err)
+				return err
+			}
+		}
+	}
+	if err := deleteACLOfPrincipal(dbr, ACLUser, dbUser.GetValue("id"), tx); err != nil {
+		log.Print("DBUser::beforeDelete: error deleting ACL entries:", err)
+		return err
+	}
 	// Delete personal group
 	log.Print("DBUser::beforeDelete: deleting personal group for user:", dbUser.GetValue("id"), dbUser.GetValue("group_id"))
 	personalGroup := NewDBGroup()
@@ -380,7 +1150,7 @@ func (dbGroup *DBGroup) NewInstance() DBEntityInterface {
 }
 
 func (dbGroup *DBGroup) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
-	if dbGroup.GetValue("id") == "" {
+	if !dbGroup.HasValue("id") || dbGroup.GetValue("id") == "" {
 		groupID, _ := uuid16HexGo()
 		dbGroup.SetValue("id", groupID)
 	}
@@ -459,6 +1229,14 @@ func (dbGroup *DBGroup) beforeDelete(dbr *DBRepository, tx *sql.Tx) error {
 			return err
 		}
 	}
+	if err := deleteACLOfPrincipal(dbr, ACLGroup, dbGroup.GetValue("id"), tx); err != nil {
+		log.Print("DBGroup::beforeDelete: error deleting ACL entries:", err)
+		return err
+	}
+	if err := deleteCapabilitiesOfGroup(dbr, dbGroup.GetValue("id"), tx); err != nil {
+		log.Print("DBGroup::beforeDelete: error deleting capabilities:", err)
+		return err
+	}
 
 	return nil
 }
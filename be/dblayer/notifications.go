@@ -0,0 +1,245 @@
+package dblayer
+
+import (
+	"database/sql"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Events of the notifications
+const (
+	NotificationCreated   = "created"
+	NotificationUpdated   = "updated"
+	NotificationCommented = "commented"
+)
+
+// How many levels of folders are looked up for subscriptions
+const maxSubscriptionDepth = 32
+
+func notificationTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// userContext returns the context of a user as it would be after login: the user and its groups
+func userContext(dbr *DBRepository, userID string, tx *sql.Tx) (*DBContext, bool) {
+	user := NewDBUser()
+	user.SetValue("id", userID)
+	users, err := dbr.searchWithTx(user, false, false, "", tx)
+	if err != nil || len(users) == 0 {
+		return nil, false
+	}
+	groupIDs := []string{}
+	userGroup := NewUserGroup()
+	userGroup.SetValue("user_id", userID)
+	userGroups, err := dbr.searchWithTx(userGroup, false, false, "", tx)
+	if err != nil {
+		return nil, false
+	}
+	for _, ug := range userGroups {
+		groupIDs = append(groupIDs, ug.GetValue("group_id").(string))
+	}
+	if primary, _ := users[0].GetValue("group_id").(string); primary != "" && !slices.Contains(groupIDs, primary) {
+		groupIDs = append(groupIDs, primary)
+	}
+	return &DBContext{UserID: userID, GroupIDs: groupIDs, Schema: dbr.DbContext.Schema}, true
+}
+
+// objectByIDWithTx returns the object with the given id, not deleted, looking in the tables of all the types.
+// Unlike ObjectByID it reads inside the transaction, where the changes being notified are visible.
+func objectByIDWithTx(dbr *DBRepository, objectID string, tx *sql.Tx) DBEntityInterface {
+	for _, className := range dbr.factory.GetAllClassNames() {
+		if className == "DBObject" {
+			continue
+		}
+		search := dbr.GetInstanceByClassName(className)
+		if search == nil || !search.IsDBObject() {
+			continue
+		}
+		search.SetValue("id", objectID)
+		search.SetValue("deleted_date", nil)
+		results, err := dbr.searchWithTx(search, false, false, "", tx)
+		if err == nil && len(results) > 0 {
+			return results[0]
+		}
+	}
+	return nil
+}
+
+// objectFatherWithTx returns the class and the father of the object with the given id, not deleted,
+// with a single query on the columns common to the tables of all the types, as ObjectByID does.
+func objectFatherWithTx(dbr *DBRepository, objectID string, tx *sql.Tx) (string, string, bool) {
+	var queries []string
+	var args []any
+	for _, className := range dbr.factory.GetAllClassNames() {
+		if dbEngine == "postgres" && className == "DBObject" {
+			continue
+		}
+		dbe := dbr.GetInstanceByClassName(className)
+		if dbe == nil || !dbe.IsDBObject() {
+			continue
+		}
+		args = append(args, objectID)
+		queries = append(queries, "SELECT '"+className+"' AS classname, father_id FROM "+dbr.buildTableName(dbe)+
+			" WHERE id = "+dbr.placeholder(len(args))+" AND deleted_date IS NULL")
+	}
+	if len(queries) == 0 {
+		return "", "", false
+	}
+	var className string
+	var fatherID sql.NullString
+	if err := tx.QueryRowContext(dbr.Context(), strings.Join(queries, " UNION "), args...).Scan(&className, &fatherID); err != nil {
+		return "", "", false
+	}
+	return className, fatherID.String, true
+}
+
+// notificationPreference returns whether a user wants in-app notifications and its email digest frequency
+func notificationPreference(dbr *DBRepository, userID string, tx *sql.Tx) (bool, string) {
+	preference := NewNotificationPreference()
+	preference.SetValue("user_id", userID)
+	results, err := dbr.searchWithTx(preference, false, false, "", tx)
+	if err != nil || len(results) == 0 {
+		return true, "never"
+	}
+	inApp := results[0].GetValue("in_app") != "0" && results[0].GetValue("in_app") != 0
+	digest, _ := results[0].GetValue("email_digest").(string)
+	if digest == "" {
+		digest = "never"
+	}
+	return inApp, digest
+}
+
+// notifySubscribers notifies the users subscribed to an object or to a folder above it.
+// Every recipient must be able to read the object; the author of the change is not notified.
+func notifySubscribers(dbr *DBRepository, dbObject DBEntityInterface, event string, tx *sql.Tx) error {
+	objectID, _ := dbObject.GetValue("id").(string)
+	if objectID == "" {
+		return nil
+	}
+	// The stored object: an update may carry only the changed columns
+	stored := dbr.GetInstanceByTableName(dbObject.GetTableName())
+	if stored == nil {
+		return nil
+	}
+	stored.SetValue("id", objectID)
+	results, err := dbr.searchWithTx(stored, false, false, "", tx)
+	if err != nil || len(results) == 0 {
+		return err
+	}
+	object := results[0]
+	if deleted, _ := object.GetValue("deleted_date").(string); deleted != "" {
+		return nil
+	}
+
+	// The object and the folders above it
+	fatherID, _ := object.GetValue("father_id").(string)
+	fatherClassName := ""
+	chain := []string{objectID}
+	for depth := 0; fatherID != "" && fatherID != "0" && depth < maxSubscriptionDepth && !slices.Contains(chain, fatherID); depth++ {
+		chain = append(chain, fatherID)
+		className, nextID, ok := objectFatherWithTx(dbr, fatherID, tx)
+		if !ok {
+			break
+		}
+		if fatherClassName == "" {
+			fatherClassName = className
+		}
+		fatherID = nextID
+	}
+
+	// Their subscriptions: most changes have none, and nothing else is read
+	var subscriptions []DBEntityInterface
+	for _, subscribedID := range chain {
+		subscription := NewSubscription()
+		subscription.SetValue("object_id", subscribedID)
+		results, err := dbr.searchWithTx(subscription, false, false, "", tx)
+		if err != nil {
+			return err
+		}
+		subscriptions = append(subscriptions, results...)
+	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	if event == NotificationCreated && object.GetTypeName() == "DBNote" && fatherClassName != "" && fatherClassName != "DBFolder" {
+		// A note on a page, a file... is a comment: the subscribers of the commented object are notified
+		event = NotificationCommented
+	}
+
+	actorID := dbr.DbContext.UserID
+	notified := []string{actorID}
+	now := notificationTime(time.Now())
+	for _, sub := range subscriptions {
+		subscribedID := sub.GetValue("object_id").(string)
+		userID := sub.GetValue("user_id").(string)
+		if slices.Contains(notified, userID) {
+			continue
+		}
+		notified = append(notified, userID)
+		if inApp, digest := notificationPreference(dbr, userID, tx); !inApp && digest == "never" {
+			continue
+		}
+		recipientContext, ok := userContext(dbr, userID, tx)
+		if !ok {
+			continue
+		}
+		recipientRepo := NewDBRepository(recipientContext, dbr.factory, dbr.DbConnection)
+		if !recipientRepo.checkPermissionWithTx(object, 0, tx) {
+			continue
+		}
+		// Changes to an object not yet seen are notified once
+		if event == NotificationUpdated {
+			unread := NewNotification()
+			unread.SetValue("user_id", userID)
+			unread.SetValue("object_id", objectID)
+			unread.SetValue("event", event)
+			unread.SetValue("read_at", nil)
+			if pending, err := dbr.searchWithTx(unread, false, false, "", tx); err == nil && len(pending) > 0 {
+				continue
+			}
+		}
+		name, _ := object.GetValue("name").(string)
+		if len(name) > 255 {
+			name = name[:255]
+		}
+		notification := NewNotification()
+		notification.SetValue("user_id", userID)
+		notification.SetValue("object_id", objectID)
+		notification.SetValue("object_name", name)
+		notification.SetValue("subscription_id", subscribedID)
+		notification.SetValue("event", event)
+		notification.SetValue("actor_id", actorID)
+		notification.SetValue("created_at", now)
+		if _, err := dbr.insertWithTx(notification, tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyInSavepoint notifies the subscribers in a savepoint of the transaction of the change.
+// A failed notification does not stop the change, but on postgres a failed statement aborts
+// the whole transaction: the savepoint is rolled back and the change goes on.
+func notifyInSavepoint(dbr *DBRepository, dbObject DBEntityInterface, event string, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(dbr.Context(), "SAVEPOINT notify_subscribers"); err != nil {
+		return err
+	}
+	if err := notifySubscribers(dbr, dbObject, event, tx); err != nil {
+		log.Print("notifyInSavepoint: ", event, " notifications failed: ", err)
+		_, err := tx.ExecContext(dbr.Context(), "ROLLBACK TO SAVEPOINT notify_subscribers")
+		return err
+	}
+	_, err := tx.ExecContext(dbr.Context(), "RELEASE SAVEPOINT notify_subscribers")
+	return err
+}
+
+func (dbObject *DBObject) afterInsert(dbr *DBRepository, tx *sql.Tx) error {
+	return notifyInSavepoint(dbr, dbObject, NotificationCreated, tx)
+}
+
+func (dbObject *DBObject) afterUpdate(dbr *DBRepository, tx *sql.Tx) error {
+	return notifyInSavepoint(dbr, dbObject, NotificationUpdated, tx)
+}
@@ -0,0 +1,23 @@
+package dblayer
+
+import "fmt"
+
+// ConsumedRefreshToken is how a refresh token is stored once used: a replay still finds it, apart from
+// the access token, which is emptied also by a logout or a revocation
+func ConsumedRefreshToken(refreshToken string) string {
+	return refreshToken + ":used"
+}
+
+// ConsumeRefreshToken marks as used the refresh token of a stored token and invalidates its access token,
+// only if the refresh token is not used yet, in one statement: of two requests using the same refresh
+// token only one gets true.
+func (dbr *DBRepository) ConsumeRefreshToken(token DBEntityInterface) (bool, error) {
+	refreshToken, _ := token.GetValue("refresh_token").(string)
+	if refreshToken == "" {
+		return false, fmt.Errorf("missing refresh token")
+	}
+	affected, err := dbr.conditionalUpdate(token,
+		fmt.Sprintf("access_token = '', refresh_token = %s", dbr.placeholder(1)),
+		fmt.Sprintf("refresh_token = %s", dbr.placeholder(2)), ConsumedRefreshToken(refreshToken), refreshToken)
+	return affected == 1, err
+}
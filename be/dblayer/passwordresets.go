@@ -0,0 +1,17 @@
+package dblayer
+
+import "fmt"
+
+// UsePasswordReset marks a password reset link as used, only if it was not used yet, in one statement:
+// of two requests with the same link only one gets true.
+func (dbr *DBRepository) UsePasswordReset(reset DBEntityInterface, usedAt string) (bool, error) {
+	tokenHash, _ := reset.GetValue("token_hash").(string)
+	if tokenHash == "" {
+		return false, fmt.Errorf("missing password reset token")
+	}
+	affected, err := dbr.conditionalUpdate(reset,
+		fmt.Sprintf("used_at = %s", dbr.placeholder(1)),
+		fmt.Sprintf("token_hash = %s AND used_at IS NULL", dbr.placeholder(2)),
+		usedAt, tokenHash)
+	return affected == 1, err
+}
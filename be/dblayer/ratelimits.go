@@ -0,0 +1,129 @@
+package dblayer
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// The rate limits of the API are counted in memory by every instance, or in the rate_limits table
+// when several instances must share them. The api decides what the state means (see api/ratelimit.go):
+// here it is only read and written back atomically.
+
+// RateLimitState is the state of a key of the rate limits
+type RateLimitState struct {
+	Tokens float64
+	Count  int
+	At     time.Time
+	Found  bool // false for a new key
+}
+
+// rateLimitAttempts is how many times a key changed meanwhile by another request is read again
+const rateLimitAttempts = 8
+
+// UpdateRateLimit reads the state of a key, changes it with update and writes it back only if nobody
+// changed it meanwhile, reading it again otherwise: update may be called more than once.
+// Nothing is written when update returns a state not Found.
+func (dbr *DBRepository) UpdateRateLimit(key string, update func(state RateLimitState) RateLimitState) (RateLimitState, error) {
+	if err := dbr.DbContext.checkScope("rate_limits"); err != nil {
+		return RateLimitState{}, err
+	}
+	var lastErr error
+	for attempt := 0; attempt < rateLimitAttempts; attempt++ {
+		state, written, err := dbr.updateRateLimitOnce(key, update)
+		if written {
+			return state, err
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("rate limit %s changed by too many concurrent requests", key)
+	}
+	return RateLimitState{}, lastErr
+}
+
+// updateRateLimitOnce is an attempt of UpdateRateLimit: written is false when another request changed the key
+// (or created it) after it was read
+func (dbr *DBRepository) updateRateLimitOnce(key string, update func(state RateLimitState) RateLimitState) (RateLimitState, bool, error) {
+	search := NewRateLimit()
+	search.SetValue("rate_key", key)
+	results, err := dbr.searchWithTx(search, false, false, "", nil)
+	if err != nil {
+		return RateLimitState{}, true, err
+	}
+	state := RateLimitState{}
+	var previous []any
+	if len(results) > 0 {
+		tokens, _ := results[0].GetValue("tokens").(string)
+		failures, _ := results[0].GetValue("failures").(string)
+		stamp, _ := results[0].GetValue("stamp").(string)
+		previous = []any{tokens, failures, stamp}
+		state.Found = true
+		state.Tokens, _ = strconv.ParseFloat(tokens, 64)
+		state.Count, _ = strconv.Atoi(failures)
+		if millis, err := strconv.ParseInt(stamp, 10, 64); err == nil {
+			state.At = time.UnixMilli(millis)
+		}
+	}
+
+	state = update(state)
+	if !state.Found {
+		return state, true, nil
+	}
+	values := []any{
+		strconv.FormatFloat(state.Tokens, 'f', 3, 64),
+		strconv.Itoa(state.Count),
+		strconv.FormatInt(state.At.UnixMilli(), 10),
+		notificationTime(time.Now()),
+	}
+	if previous != nil && slices.Equal(values[:3], previous) {
+		// Unchanged: MySQL would count no affected row
+		return state, true, nil
+	}
+	tableName := dbr.buildTableName(search)
+	var query string
+	var args []any
+	if previous == nil {
+		// Two requests creating the key: the second fails on the primary key and reads it again
+		query = fmt.Sprintf("INSERT INTO %s (tokens, failures, stamp, updated_at, rate_key) VALUES (%s, %s, %s, %s, %s)",
+			tableName, dbr.placeholder(1), dbr.placeholder(2), dbr.placeholder(3), dbr.placeholder(4), dbr.placeholder(5))
+		args = append(values, key)
+	} else {
+		// Written only if the key is still as it was read
+		query = fmt.Sprintf("UPDATE %s SET tokens = %s, failures = %s, stamp = %s, updated_at = %s"+
+			" WHERE rate_key = %s AND tokens = %s AND failures = %s AND stamp = %s",
+			tableName, dbr.placeholder(1), dbr.placeholder(2), dbr.placeholder(3), dbr.placeholder(4),
+			dbr.placeholder(5), dbr.placeholder(6), dbr.placeholder(7), dbr.placeholder(8))
+		args = append(append(values, key), previous...)
+	}
+	result, err := dbr.DbConnection.ExecContext(dbr.Context(), query, args...)
+	if err != nil {
+		if previous == nil {
+			return RateLimitState{}, false, err
+		}
+		return RateLimitState{}, true, err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected != 1 {
+		return RateLimitState{}, false, err
+	}
+	return state, true, nil
+}
+
+// PurgeRateLimits deletes the keys not used since before
+func (dbr *DBRepository) PurgeRateLimits(before time.Time) (int, error) {
+	search := NewRateLimit()
+	search.SetValue("updated_at", []string{"", notificationTime(before)})
+	results, err := dbr.Search(search, false, false, "")
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, rateLimit := range results {
+		if _, err := dbr.Delete(rateLimit); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
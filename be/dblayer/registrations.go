@@ -0,0 +1,41 @@
+package dblayer
+
+// InsertRegisteredUser creates a self-registered user with its registration and its status in one
+// transaction: the user never exists without them, e.g. enabled before its email is verified.
+// The user_id of the registration and of the status is the id given to the new user.
+func (dbr *DBRepository) InsertRegisteredUser(user DBEntityInterface, registration DBEntityInterface, status DBEntityInterface) (DBEntityInterface, error) {
+	for _, dbe := range []DBEntityInterface{user, registration, status} {
+		if err := dbr.DbContext.checkScope(dbe.GetTableName()); err != nil {
+			return nil, err
+		}
+		if err := dbr.checkAccessScope(dbe); err != nil {
+			return nil, err
+		}
+	}
+	tx, err := dbr.DbConnection.BeginTx(dbr.Context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	created, err := dbr.insertWithTx(user, tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbr.auditWithTx("insert", user, tx); err != nil {
+		return nil, err
+	}
+	for _, dbe := range []DBEntityInterface{registration, status} {
+		dbe.SetValue("user_id", created.GetValue("id"))
+		if _, err := dbr.insertWithTx(dbe, tx); err != nil {
+			return nil, err
+		}
+		if err := dbr.auditWithTx("insert", dbe, tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
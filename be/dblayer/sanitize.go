@@ -0,0 +1,386 @@
+package dblayer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"rprj/be/models"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// The html of pages and news and the description of every object are shown to other users:
+// they are sanitized when saved. The html keeps what the HTMLPolicy allows, the descriptions are
+// plain text and lose all their tags. What was removed is in the "sanitized" metadata of the object.
+
+// Defaults of the HTMLPolicy: what the Quill editor of the frontend produces
+var (
+	defaultHTMLElements = map[string][]string{
+		"*":          {"class", "style", "title", "dir"},
+		"p":          nil,
+		"br":         nil,
+		"h1":         nil,
+		"h2":         nil,
+		"h3":         nil,
+		"h4":         nil,
+		"h5":         nil,
+		"h6":         nil,
+		"strong":     nil,
+		"b":          nil,
+		"em":         nil,
+		"i":          nil,
+		"u":          nil,
+		"s":          nil,
+		"strike":     nil,
+		"sub":        nil,
+		"sup":        nil,
+		"blockquote": nil,
+		"pre":        {"spellcheck"},
+		"code":       nil,
+		"span":       nil,
+		"div":        nil,
+		"hr":         nil,
+		"ol":         nil,
+		"ul":         nil,
+		"li":         {"data-list"},
+		"a":          {"href", "target", "rel", "data-dbfile-id"},
+		"img":        {"src", "alt", "width", "height", "data-dbfile-id"},
+		"table":      nil,
+		"thead":      nil,
+		"tbody":      nil,
+		"tfoot":      nil,
+		"tr":         nil,
+		"th":         {"colspan", "rowspan"},
+		"td":         {"colspan", "rowspan"},
+	}
+	defaultHTMLClasses = []string{"ql-align-*", "ql-indent-*", "ql-direction-*", "ql-size-*", "ql-font-*", "ql-syntax"}
+	defaultHTMLStyles  = []string{"color", "background-color", "text-align", "direction", "width", "height", "max-width",
+		"padding-left", "margin-left", "font-size", "font-weight", "font-style", "text-decoration"}
+	defaultURLSchemes = []string{"http", "https", "mailto", "tel", "data"}
+)
+
+// Elements removed with their content, never allowed
+var htmlDroppedElements = map[string]bool{
+	"script": true, "style": true, "iframe": true, "frame": true, "frameset": true, "object": true, "embed": true,
+	"applet": true, "noscript": true, "noembed": true, "noframes": true, "template": true, "svg": true, "math": true,
+	"head": true, "title": true, "meta": true, "link": true, "base": true, "textarea": true, "select": true, "xmp": true,
+	"plaintext": true,
+}
+
+// Values of the allowed styles: no functions but rgb() and the like, no escapes
+var styleValuePattern = regexp.MustCompile(`^[a-zA-Z0-9#%.,()\s+-]*$`)
+
+// Images embedded in the page
+var dataImagePattern = regexp.MustCompile(`^(?i)data:image/(png|jpeg|gif|webp);base64,[a-z0-9+/=\s]*$`)
+
+// HTMLPolicy is an allowlist of elements, attributes, classes, styles and URL schemes
+type HTMLPolicy struct {
+	elements map[string]map[string]bool
+	classes  []string // ending with * for the prefixes
+	styles   map[string]bool
+	schemes  map[string]bool
+}
+
+// htmlPolicy sanitizes the objects when they are saved (set by InitDBLayer)
+var htmlPolicy = NewHTMLPolicy(models.HTMLPolicyConfig{})
+
+func NewHTMLPolicy(config models.HTMLPolicyConfig) *HTMLPolicy {
+	if len(config.Elements) == 0 {
+		config.Elements = defaultHTMLElements
+	}
+	if len(config.Classes) == 0 {
+		config.Classes = defaultHTMLClasses
+	}
+	if len(config.Styles) == 0 {
+		config.Styles = defaultHTMLStyles
+	}
+	if len(config.URLSchemes) == 0 {
+		config.URLSchemes = defaultURLSchemes
+	}
+	policy := &HTMLPolicy{
+		elements: map[string]map[string]bool{},
+		classes:  config.Classes,
+		styles:   map[string]bool{},
+		schemes:  map[string]bool{},
+	}
+	for element, attributes := range config.Elements {
+		element = strings.ToLower(element)
+		if htmlDroppedElements[element] {
+			log.Printf("HTMLPolicy: <%s> cannot be allowed", element)
+			continue
+		}
+		policy.elements[element] = map[string]bool{}
+		for _, attribute := range attributes {
+			policy.elements[element][strings.ToLower(attribute)] = true
+		}
+	}
+	for _, style := range config.Styles {
+		policy.styles[strings.ToLower(style)] = true
+	}
+	for _, scheme := range config.URLSchemes {
+		policy.schemes[strings.ToLower(scheme)] = true
+	}
+	return policy
+}
+
+// htmlReport lists what was removed, once each
+type htmlReport struct {
+	items   []string
+	changed bool
+}
+
+func (report *htmlReport) add(format string, args ...any) {
+	report.changed = true
+	item := fmt.Sprintf(format, args...)
+	if !slices.Contains(report.items, item) {
+		report.items = append(report.items, item)
+	}
+}
+
+// SanitizeHTML returns the HTML with only what the policy allows, and what was removed.
+// Clean HTML is returned as it is.
+func (policy *HTMLPolicy) SanitizeHTML(source string) (string, []string) {
+	if !strings.Contains(source, "<") {
+		return source, nil
+	}
+	body := &html.Node{Type: html.ElementNode, Data: "body", DataAtom: atom.Body}
+	nodes, err := html.ParseFragment(strings.NewReader(source), body)
+	if err != nil {
+		return html.EscapeString(source), []string{"invalid HTML"}
+	}
+	for _, node := range nodes {
+		body.AppendChild(node)
+	}
+	report := &htmlReport{}
+	policy.sanitizeChildren(body, report)
+	if !report.changed {
+		return source, nil
+	}
+	var out strings.Builder
+	for child := body.FirstChild; child != nil; child = child.NextSibling {
+		html.Render(&out, child)
+	}
+	return out.String(), report.items
+}
+
+func (policy *HTMLPolicy) sanitizeChildren(parent *html.Node, report *htmlReport) {
+	for node := parent.FirstChild; node != nil; {
+		next := node.NextSibling
+		switch node.Type {
+		case html.TextNode:
+		case html.ElementNode:
+			allowed := policy.elements[node.Data]
+			switch {
+			case node.Namespace != "" || htmlDroppedElements[node.Data]:
+				report.add("<%s>", node.Data)
+				parent.RemoveChild(node)
+			case allowed == nil:
+				// Unknown elements are replaced by their content
+				report.add("<%s>", node.Data)
+				policy.sanitizeChildren(node, report)
+				for node.FirstChild != nil {
+					child := node.FirstChild
+					node.RemoveChild(child)
+					parent.InsertBefore(child, node)
+				}
+				parent.RemoveChild(node)
+			default:
+				policy.sanitizeAttributes(node, allowed, report)
+				policy.sanitizeChildren(node, report)
+			}
+		default:
+			// Comments and doctypes
+			report.add("comment")
+			parent.RemoveChild(node)
+		}
+		node = next
+	}
+}
+
+func (policy *HTMLPolicy) sanitizeAttributes(node *html.Node, allowed map[string]bool, report *htmlReport) {
+	attributes := []html.Attribute{}
+	blank := false
+	for _, attribute := range node.Attr {
+		key := attribute.Key
+		if attribute.Namespace != "" || !(allowed[key] || policy.elements["*"][key]) {
+			report.add("%s of <%s>", key, node.Data)
+			continue
+		}
+		switch key {
+		case "href", "src":
+			if !policy.allowedURL(node.Data, attribute.Val) {
+				report.add("%s of <%s>", key, node.Data)
+				continue
+			}
+		case "style":
+			attribute.Val = policy.sanitizeStyle(node.Data, attribute.Val, report)
+		case "class":
+			attribute.Val = policy.sanitizeClass(node.Data, attribute.Val, report)
+		case "target":
+			if attribute.Val != "_blank" {
+				report.add("target of <%s>", node.Data)
+				continue
+			}
+			blank = true
+		}
+		if attribute.Val == "" && (key == "style" || key == "class") {
+			continue
+		}
+		attributes = append(attributes, attribute)
+	}
+	// The pages opened by a link do not get this one
+	if blank {
+		attributes = slices.DeleteFunc(attributes, func(attribute html.Attribute) bool { return attribute.Key == "rel" })
+		attributes = append(attributes, html.Attribute{Key: "rel", Val: "noopener noreferrer"})
+	}
+	if !slices.Equal(attributes, node.Attr) {
+		report.changed = true
+	}
+	node.Attr = attributes
+}
+
+// allowedURL tells whether a link or a source is relative or of an allowed scheme
+func (policy *HTMLPolicy) allowedURL(element string, value string) bool {
+	value = strings.TrimSpace(value)
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	switch scheme {
+	case "":
+		return true
+	case "data":
+		return policy.schemes["data"] && element == "img" && dataImagePattern.MatchString(value)
+	}
+	return policy.schemes[scheme]
+}
+
+func (policy *HTMLPolicy) sanitizeStyle(element string, value string, report *htmlReport) string {
+	declarations := []string{}
+	removed := false
+	for _, declaration := range strings.Split(value, ";") {
+		if strings.TrimSpace(declaration) == "" {
+			continue
+		}
+		property, propertyValue, ok := strings.Cut(declaration, ":")
+		property = strings.ToLower(strings.TrimSpace(property))
+		propertyValue = strings.TrimSpace(propertyValue)
+		lowerValue := strings.ToLower(propertyValue)
+		if !ok || !policy.styles[property] || !styleValuePattern.MatchString(propertyValue) ||
+			strings.Contains(lowerValue, "url(") || strings.Contains(lowerValue, "expression(") {
+			report.add("style %s of <%s>", property, element)
+			removed = true
+			continue
+		}
+		declarations = append(declarations, property+": "+propertyValue)
+	}
+	if !removed {
+		return value
+	}
+	return strings.Join(declarations, "; ")
+}
+
+func (policy *HTMLPolicy) sanitizeClass(element string, value string, report *htmlReport) string {
+	classes := []string{}
+	removed := false
+	for _, class := range strings.Fields(value) {
+		if !policy.allowedClass(class) {
+			report.add("class %s of <%s>", class, element)
+			removed = true
+			continue
+		}
+		classes = append(classes, class)
+	}
+	if !removed {
+		return value
+	}
+	return strings.Join(classes, " ")
+}
+
+func (policy *HTMLPolicy) allowedClass(class string) bool {
+	for _, allowed := range policy.classes {
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasPrefix(class, prefix) || class == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// SanitizeText returns a plain text without its tags, and the tags removed.
+// The rest of the text is returned as it is, entities included.
+func (policy *HTMLPolicy) SanitizeText(source string) (string, []string) {
+	if !strings.Contains(source, "<") {
+		return source, nil
+	}
+	report := &htmlReport{}
+	var out strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(source))
+	dropped := 0 // inside elements removed with their content
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if tokenizer.Err() != io.EOF {
+				return html.EscapeString(source), []string{"invalid HTML"}
+			}
+			break
+		}
+		switch tokenType {
+		case html.TextToken:
+			if dropped == 0 {
+				out.Write(tokenizer.Raw())
+			}
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			report.add("<%s>", name)
+			if htmlDroppedElements[string(name)] {
+				if tokenType == html.StartTagToken {
+					dropped++
+				} else if tokenType == html.EndTagToken && dropped > 0 {
+					dropped--
+				}
+			}
+		default:
+			report.add("comment")
+		}
+	}
+	if !report.changed {
+		return source, nil
+	}
+	return out.String(), report.items
+}
+
+// sanitize cleans the description and the htmlColumns of an object before it is saved, adding what was removed
+// to its "sanitized" metadata, by column
+func (dbObject *DBObject) sanitize(htmlColumns ...string) {
+	clean := func(column string, sanitizer func(string) (string, []string)) {
+		value, ok := dbObject.GetValue(column).(string)
+		if !ok || value == "" {
+			return
+		}
+		sanitized, removed := sanitizer(value)
+		if sanitized != value {
+			dbObject.SetValue(column, sanitized)
+		}
+		if len(removed) == 0 {
+			return
+		}
+		report, ok := dbObject.GetMetadata("sanitized").(map[string][]string)
+		if !ok {
+			report = map[string][]string{}
+			dbObject.SetMetadata("sanitized", report)
+		}
+		report[column] = removed
+		log.Printf("%s %v: removed from %s: %s", dbObject.GetTypeName(), dbObject.GetValue("id"), column, strings.Join(removed, ", "))
+	}
+	clean("description", htmlPolicy.SanitizeText)
+	for _, column := range htmlColumns {
+		clean(column, htmlPolicy.SanitizeHTML)
+	}
+}
@@ -0,0 +1,154 @@
+package dblayer
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"rprj/be/models"
+)
+
+// go test -v ./dblayer -run TestSanitizeHTML
+func TestSanitizeHTML(t *testing.T) {
+	policy := NewHTMLPolicy(models.HTMLPolicyConfig{})
+
+	// 1. What the editor produces is kept as it is
+	for _, quill := range []string{
+		`<h1 class="ql-align-center">Title</h1><p><strong>bold</strong> <em>italic</em> <u>under</u> <s>strike</s></p>`,
+		`<p class="ql-indent-2"><span style="color: rgb(230, 0, 0); background-color: #ffff00;">colored</span></p>`,
+		`<ol><li data-list="bullet">one</li><li data-list="ordered" class="ql-indent-1">two</li></ol><blockquote>quote</blockquote>`,
+		`<pre class="ql-syntax" spellcheck="false">if a &lt; b {}</pre><p class="ql-direction-rtl ql-align-right">rtl</p>`,
+		`<p><img src="/api/files/0123456789abcdef/download" data-dbfile-id="0123456789abcdef" alt="" style="max-width: 100%;"></p>`,
+		`<p><a href="/f/0123456789abcdef/download" data-dbfile-id="0123456789abcdef">file</a> <a href="https://example.com" target="_blank" rel="noopener noreferrer">out</a> &#128512;</p>`,
+		`<p><img src="data:image/png;base64,iVBORw0KGgo="></p>`,
+		`plain text & more`,
+	} {
+		if sanitized, removed := policy.SanitizeHTML(quill); sanitized != quill || removed != nil {
+			t.Fatalf("Expected %q kept, got %q removing %v", quill, sanitized, removed)
+		}
+	}
+
+	// 2. Scripts, handlers and dangerous URLs are removed
+	for _, c := range []struct {
+		source    string
+		sanitized string
+		removed   []string
+	}{
+		{`<p>Hi<script>alert(1)</script></p>`, `<p>Hi</p>`, []string{"<script>"}},
+		{`<img src="x.png" onerror="alert(1)">`, `<img src="x.png"/>`, []string{"onerror of <img>"}},
+		{`<a href=" JavaScript:alert(1)">x</a>`, `<a>x</a>`, []string{"href of <a>"}},
+		{`<a href="/f/1/download" target="_top">x</a>`, `<a href="/f/1/download">x</a>`, []string{"target of <a>"}},
+		{`<a href="https://example.com" target="_blank">x</a>`, `<a href="https://example.com" target="_blank" rel="noopener noreferrer">x</a>`, nil},
+		{`<img src="data:image/svg+xml;base64,PHN2Zz4=">`, `<img/>`, []string{"src of <img>"}},
+		{`<a href="data:text/html,<script>alert(1)</script>">x</a>`, `<a>x</a>`, []string{"href of <a>"}},
+		{`<iframe src="https://evil.example.com"></iframe><svg><script>alert(1)</script></svg>ok`, `ok`, []string{"<iframe>", "<svg>"}},
+		{`<span style="position: fixed; color: red; background: url(x)">s</span>`, `<span style="color: red">s</span>`, []string{"style position of <span>", "style background of <span>"}},
+		{`<p class="ql-align-center evil">p</p>`, `<p class="ql-align-center">p</p>`, []string{"class evil of <p>"}},
+		{`<form action="/x"><input name="a"><p>in</p></form><!-- note -->`, `<p>in</p>`, []string{"<form>", "<input>", "comment"}},
+		{`<p onclick="x()" onmouseover="y()">p</p>`, `<p>p</p>`, []string{"onclick of <p>", "onmouseover of <p>"}},
+	} {
+		sanitized, removed := policy.SanitizeHTML(c.source)
+		if sanitized != c.sanitized || !slices.Equal(removed, c.removed) {
+			t.Fatalf("Expected %q to be %q removing %v, got %q removing %v", c.source, c.sanitized, c.removed, sanitized, removed)
+		}
+	}
+
+	// 3. A narrower policy
+	policy = NewHTMLPolicy(models.HTMLPolicyConfig{
+		Elements:   map[string][]string{"p": nil, "a": {"href"}, "script": nil},
+		URLSchemes: []string{"https"},
+	})
+	if sanitized, removed := policy.SanitizeHTML(`<p><b>b</b><a href="http://example.com">a</a><script>x</script></p>`); sanitized != `<p>b<a>a</a></p>` ||
+		!slices.Equal(removed, []string{"<b>", "href of <a>", "<script>"}) {
+		t.Fatalf("Unexpected %q removing %v", sanitized, removed)
+	}
+}
+
+// go test -v ./dblayer -run TestSanitizeText
+func TestSanitizeText(t *testing.T) {
+	policy := NewHTMLPolicy(models.HTMLPolicyConfig{})
+	for _, c := range []struct {
+		source    string
+		sanitized string
+		removed   []string
+	}{
+		{`A plain description, 1 < 2 & 3 > 2`, `A plain description, 1 < 2 & 3 > 2`, nil},
+		{`Tom &amp; Jerry`, `Tom &amp; Jerry`, nil},
+		{`Hello <b>world</b><script>alert(1)</script>!`, `Hello world!`, []string{"<b>", "<script>"}},
+		{`<img src=x onerror=alert(1)>photo`, `photo`, []string{"<img>"}},
+	} {
+		sanitized, removed := policy.SanitizeText(c.source)
+		if sanitized != c.sanitized || !slices.Equal(removed, c.removed) {
+			t.Fatalf("Expected %q to be %q removing %v, got %q removing %v", c.source, c.sanitized, c.removed, sanitized, removed)
+		}
+	}
+}
+
+// go test -v ./dblayer -run TestSanitizeOnSave
+func TestSanitizeOnSave(t *testing.T) {
+	dbContext := &DBContext{
+		UserID:   "-1",
+		GroupIDs: []string{"-2"},
+		Schema:   DbSchema,
+	}
+	repo := NewDBRepository(dbContext, Factory, DbConnection)
+	repo.Verbose = false
+
+	// 1. The page is saved without what the policy does not allow
+	page := repo.GetInstanceByTableName("pages")
+	page.SetValue("name", "Sanitized page")
+	page.SetValue("description", `Summary<script>alert(1)</script>`)
+	page.SetValue("html", `<p class="ql-align-center">Hello<img src="/api/files/1/download" onerror="alert(1)"></p>`)
+	created, err := repo.Insert(page)
+	if err != nil {
+		t.Fatalf("Failed to create the page: %v", err)
+	}
+	t.Cleanup(func() { hardDeleteForTests(repo, created.(DBObjectInterface)) })
+	stored := repo.GetEntityByID("pages", created.GetValue("id").(string))
+	if stored.GetValue("description") != "Summary" || stored.GetValue("html") != `<p class="ql-align-center">Hello<img src="/api/files/1/download"/></p>` {
+		t.Fatalf("Unexpected page %v", stored.ToString())
+	}
+	report, _ := created.GetMetadata("sanitized").(map[string][]string)
+	if !slices.Equal(report["description"], []string{"<script>"}) || !slices.Equal(report["html"], []string{"onerror of <img>"}) {
+		t.Fatalf("Unexpected report %v", created.GetMetadata("sanitized"))
+	}
+
+	// 2. The same on update, clean values are not reported
+	stored.SetValue("description", "Clean")
+	stored.SetValue("html", `<p>Updated</p><iframe src="https://evil.example.com"></iframe>`)
+	updated, err := repo.Update(stored)
+	if err != nil {
+		t.Fatalf("Failed to update the page: %v", err)
+	}
+	stored = repo.GetEntityByID("pages", created.GetValue("id").(string))
+	if stored.GetValue("html") != `<p>Updated</p>` {
+		t.Fatalf("Unexpected html %v", stored.GetValue("html"))
+	}
+	if report, _ := updated.GetMetadata("sanitized").(map[string][]string); len(report) != 1 || !slices.Equal(report["html"], []string{"<iframe>"}) {
+		t.Fatalf("Unexpected report %v", updated.GetMetadata("sanitized"))
+	}
+
+	// 3. News, and the descriptions of every object
+	news := repo.GetInstanceByTableName("news")
+	news.SetValue("name", "Sanitized news")
+	news.SetValue("html", `<p>News</p><object data="x"></object>`)
+	created, err = repo.Insert(news)
+	if err != nil {
+		t.Fatalf("Failed to create the news: %v", err)
+	}
+	t.Cleanup(func() { hardDeleteForTests(repo, created.(DBObjectInterface)) })
+	if created.GetValue("html") != `<p>News</p>` {
+		t.Fatalf("Unexpected news %v", created.ToString())
+	}
+	folder := repo.GetInstanceByTableName("folders")
+	folder.SetValue("name", "Sanitized folder")
+	folder.SetValue("description", `<a href="javascript:alert(1)">click</a>`)
+	created, err = repo.Insert(folder)
+	if err != nil {
+		t.Fatalf("Failed to create the folder: %v", err)
+	}
+	t.Cleanup(func() { hardDeleteForTests(repo, created.(DBObjectInterface)) })
+	if description, _ := created.GetValue("description").(string); description != "click" || strings.Contains(created.ToString(), "javascript") {
+		t.Fatalf("Unexpected folder %v", created.ToString())
+	}
+}
@@ -1372,6 +1372,23 @@ func (dbPage *DBPage) NewInstance() DBEntityInterface {
 	return NewDBPage()
 }
 
+// The html is sanitized with the description
+func (dbPage *DBPage) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
+	if err := dbPage.DBObject.beforeInsert(dbr, tx); err != nil {
+		return err
+	}
+	dbPage.sanitize("html")
+	return nil
+}
+
+func (dbPage *DBPage) beforeUpdate(dbr *DBRepository, tx *sql.Tx) error {
+	if err := dbPage.DBObject.beforeUpdate(dbr, tx); err != nil {
+		return err
+	}
+	dbPage.sanitize("html")
+	return nil
+}
+
 /*
 CREATE TABLE IF NOT EXISTS `rra_news` (
 
@@ -1458,3 +1475,60 @@ func NewDBNews() *DBNews {
 func (dbNews *DBNews) NewInstance() DBEntityInterface {
 	return NewDBNews()
 }
+
+// The html is sanitized with the description
+func (dbNews *DBNews) beforeInsert(dbr *DBRepository, tx *sql.Tx) error {
+	if err := dbNews.DBObject.beforeInsert(dbr, tx); err != nil {
+		return err
+	}
+	dbNews.sanitize("html")
+	return nil
+}
+
+func (dbNews *DBNews) beforeUpdate(dbr *DBRepository, tx *sql.Tx) error {
+	if err := dbNews.DBObject.beforeUpdate(dbr, tx); err != nil {
+		return err
+	}
+	dbNews.sanitize("html")
+	return nil
+}
+
+/*
+CREATE TABLE IF NOT EXISTS `rra_objects_translations` (
+
+	`source_id` varchar(16) NOT NULL DEFAULT '',
+	`translation_id` varchar(16) NOT NULL DEFAULT '',
+	`language` varchar(5) NOT NULL DEFAULT '',
+	`creation_date` datetime DEFAULT NULL,
+	PRIMARY KEY (`source_id`,`translation_id`)
+
+);
+*/
+// ObjectTranslation links a DBPage/DBNews to one of its translations.
+// All translations point to the original object, never to another translation.
+type ObjectTranslation struct {
+	DBEntity
+}
+
+func NewObjectTranslation() *ObjectTranslation {
+	columns := []Column{
+		{Name: "source_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "translation_id", Type: "varchar(16)", Constraints: []string{"NOT NULL"}},
+		{Name: "language", Type: "varchar(5)", Constraints: []string{"NOT NULL"}},
+		{Name: "creation_date", Type: "datetime", Constraints: []string{}},
+	}
+	keys := []string{"source_id", "translation_id"}
+	return &ObjectTranslation{
+		DBEntity: *NewDBEntity(
+			"ObjectTranslation",
+			"objects_translations",
+			columns,
+			keys,
+			[]ForeignKey{},
+			make(map[string]any),
+		),
+	}
+}
+func (objectTranslation *ObjectTranslation) NewInstance() DBEntityInterface {
+	return NewObjectTranslation()
+}
@@ -0,0 +1,81 @@
+package dblayer
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+)
+
+// The personal API keys (see APIKey) and the share links (see ShareLink) act as their user, restricted by their scope:
+// a read-only scope cannot change anything, a scope of a folder sees only the folder and what is below it,
+// a scope of some classnames sees only the objects of those classes.
+// The scope is set in the DBContext of the requests authenticated with a key or coming through a link.
+
+// AccessScope is what an API key or a share link is allowed to do, on top of the permissions of its user
+type AccessScope struct {
+	ReadOnly   bool
+	RootID     string   // empty: everywhere
+	Subtree    bool     // with RootID: also what is below it
+	ClassNames []string // empty: all the classes
+}
+
+// ErrOutOfScope is returned when an API key or a share link is used outside its scope
+var ErrOutOfScope = errors.New("not allowed by the scope of the API key or of the share link")
+
+// allowsWithTx tells whether the scope lets see (index 0) or change (index 1, 2) an entity
+func (scope *AccessScope) allowsWithTx(dbr *DBRepository, dbe DBEntityInterface, index int, tx *sql.Tx) bool {
+	if scope == nil {
+		return true
+	}
+	if scope.ReadOnly && index > 0 {
+		return false
+	}
+	if !dbe.IsDBObject() {
+		return true
+	}
+	if len(scope.ClassNames) > 0 && !slices.Contains(scope.ClassNames, classNameOf(dbe)) {
+		return false
+	}
+	if scope.RootID == "" || dbe.GetValue("id") == scope.RootID {
+		return true
+	}
+	return scope.Subtree && dbr.inFolderWithTx(dbe, scope.RootID, tx)
+}
+
+// classNameOf returns the class of an object, also for the generic rows returned by ObjectByID
+func classNameOf(dbe DBEntityInterface) string {
+	if className, ok := dbe.GetMetadata("classname").(string); ok && className != "" {
+		return className
+	}
+	return dbe.GetTypeName()
+}
+
+// inFolderWithTx tells whether an object is the folder or is below it.
+// A new object has no id yet: its father decides.
+func (dbr *DBRepository) inFolderWithTx(dbe DBEntityInterface, folderID string, tx *sql.Tx) bool {
+	objectID, _ := dbe.GetValue("id").(string)
+	if objectID == folderID {
+		return true
+	}
+	fatherID, hasFather := dbe.GetValue("father_id").(string)
+	if !hasFather && objectID != "" {
+		fatherID = dbr.fatherOfWithTx(objectID, tx)
+	}
+	visited := map[string]bool{}
+	for depth := 0; fatherID != "" && !visited[fatherID] && depth < maxACLDepth; depth++ {
+		if fatherID == folderID {
+			return true
+		}
+		visited[fatherID] = true
+		fatherID = dbr.fatherOfWithTx(fatherID, tx)
+	}
+	return false
+}
+
+// checkAccessScope returns ErrOutOfScope when the scope of the context does not let write the entity
+func (dbr *DBRepository) checkAccessScope(dbe DBEntityInterface) error {
+	if !dbr.DbContext.Scope.allowsWithTx(dbr, dbe, 1, nil) {
+		return ErrOutOfScope
+	}
+	return nil
+}
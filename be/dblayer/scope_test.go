@@ -0,0 +1,84 @@
+package dblayer
+
+import (
+	"errors"
+	"testing"
+)
+
+// go test -v ./dblayer -run TestAccessScope
+func TestAccessScope(t *testing.T) {
+	adminRepo := SetupTestRepo(t, "-1", []string{"-2"}, DbSchema)
+	folder := createTestFolder(t, adminRepo, map[string]any{"name": "Key Folder"}, nil)
+	subfolder := createTestFolder(t, adminRepo, map[string]any{"name": "Key Subfolder", "father_id": folder.GetValue("id")}, nil)
+	page := createTestObject(t, adminRepo, "pages", map[string]any{"name": "Key Page", "father_id": subfolder.GetValue("id")}, nil)
+	note := createTestObject(t, adminRepo, "notes", map[string]any{"name": "Key Note", "father_id": folder.GetValue("id")}, nil)
+	outside := createTestObject(t, adminRepo, "pages", map[string]any{"name": "Outside Page"}, nil)
+	defer func() {
+		for _, object := range []DBEntityInterface{page, note, outside, subfolder, folder} {
+			adminRepo.Delete(object)
+		}
+	}()
+
+	scopedRepo := func(scope *AccessScope) *DBRepository {
+		repo := SetupTestRepo(t, "-1", []string{"-2"}, DbSchema)
+		repo.DbContext.Scope = scope
+		return repo
+	}
+	newPage := func(fatherID any) DBEntityInterface {
+		dbe := adminRepo.GetInstanceByTableName("pages")
+		dbe.SetValue("name", "Key New Page")
+		dbe.SetValue("father_id", fatherID)
+		return dbe
+	}
+
+	// Read only: reads everything, writes nothing
+	repo := scopedRepo(&AccessScope{ReadOnly: true})
+	if !repo.CheckReadPermission(outside) || repo.CheckWritePermission(outside) {
+		t.Fatal("Expected a read-only key to read and not to write")
+	}
+	if _, err := repo.Insert(newPage(folder.GetValue("id"))); !errors.Is(err, ErrOutOfScope) {
+		t.Fatalf("Expected the insert to be refused, got %v", err)
+	}
+	subscription := NewSubscription()
+	subscription.SetValue("user_id", "-1")
+	subscription.SetValue("object_id", page.GetValue("id"))
+	if _, err := repo.Insert(subscription); !errors.Is(err, ErrOutOfScope) {
+		t.Fatalf("Expected the insert of any table to be refused, got %v", err)
+	}
+
+	// A folder: the folder and what is below it
+	repo = scopedRepo(&AccessScope{RootID: folder.GetValue("id").(string), Subtree: true})
+	if !repo.CheckReadPermission(folder) || !repo.CheckWritePermission(page) || repo.CheckReadPermission(outside) {
+		t.Fatal("Expected only the folder and below to be reachable")
+	}
+	if generic := repo.ObjectByID(page.GetValue("id").(string), true); generic == nil || !repo.CheckReadPermission(generic) {
+		t.Fatal("Expected the page found by id to be readable")
+	}
+	if _, err := repo.Insert(newPage(nil)); !errors.Is(err, ErrOutOfScope) {
+		t.Fatalf("Expected an insert at the root to be refused, got %v", err)
+	}
+	created, err := repo.Insert(newPage(subfolder.GetValue("id")))
+	if err != nil {
+		t.Fatalf("Expected an insert in the subfolder, got %v", err)
+	}
+	defer adminRepo.Delete(created)
+	created.SetValue("father_id", outside.GetValue("id"))
+	if _, err := repo.Update(created); !errors.Is(err, ErrOutOfScope) {
+		t.Fatalf("Expected moving the page out of the folder to be refused, got %v", err)
+	}
+
+	// Only the folder, not what is below it
+	repo = scopedRepo(&AccessScope{ReadOnly: true, RootID: folder.GetValue("id").(string)})
+	if !repo.CheckReadPermission(folder) || repo.CheckReadPermission(page) || repo.CheckWritePermission(folder) {
+		t.Fatal("Expected only the folder to be readable")
+	}
+
+	// Some classes
+	repo = scopedRepo(&AccessScope{ClassNames: []string{"DBPage"}})
+	if !repo.CheckReadPermission(outside) || repo.CheckReadPermission(note) {
+		t.Fatal("Expected only the pages to be reachable")
+	}
+	if generic := repo.ObjectByID(note.GetValue("id").(string), true); generic == nil || repo.CheckReadPermission(generic) {
+		t.Fatal("Expected the note found by id not to be readable")
+	}
+}
@@ -0,0 +1,17 @@
+package dblayer
+
+import "fmt"
+
+// UseShareLink counts a use of a share link, only if it is not used up, in one statement: of two requests
+// taking the last use only one gets true. usedAt is the new last_used_at.
+func (dbr *DBRepository) UseShareLink(link DBEntityInterface, usedAt string) (bool, error) {
+	id, _ := link.GetValue("id").(string)
+	if id == "" {
+		return false, fmt.Errorf("missing share link id")
+	}
+	affected, err := dbr.conditionalUpdate(link,
+		fmt.Sprintf("uses = COALESCE(uses, 0) + 1, last_used_at = %s", dbr.placeholder(1)),
+		fmt.Sprintf("id = %s AND (COALESCE(max_uses, 0) = 0 OR COALESCE(uses, 0) < max_uses)", dbr.placeholder(2)),
+		usedAt, id)
+	return affected == 1, err
+}
@@ -0,0 +1,165 @@
+package dblayer
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The system context is the server acting on its own behalf: looking up the token of a request,
+// logging a user in, purging expired sessions, sending the mail queue...
+// It acts as the administrator, but only on the tables it is created for, and every change it makes,
+// as its reads of the sensitive tables, is written to the audit log with the reason it was created for.
+// The only way to obtain one is NewSystemRepository: a DBContext built from the claims of a request
+// is always the one of its user.
+
+// SystemUserID and SystemGroupID are the user and the group of the system context
+const SystemUserID = "-1"
+const SystemGroupID = "-2"
+
+// allTables lets a system context use every table and raw SQL: only the bootstrap repository has it
+const allTables = "*"
+
+// ObjectTables lets a system context use the lookups across all the object tables (ObjectByID, GetChildren...):
+// without it ObjectByID looks only in the object tables of the context
+const ObjectTables = "objects"
+
+type systemScope struct {
+	reason string
+	tables []string
+}
+
+// NewSystemRepository returns a repository of the system context, for the given reason,
+// limited to the given tables.
+func NewSystemRepository(reason string, tables ...string) *DBRepository {
+	if reason == "" || len(tables) == 0 || slices.Contains(tables, allTables) {
+		panic("dblayer: a system context needs a reason and the tables it uses")
+	}
+	return newSystemRepository(reason, tables)
+}
+
+// newBootstrapRepository returns the repository of the system context filling a new DB (InitDBData),
+// the only one using every table and raw SQL
+func newBootstrapRepository() *DBRepository {
+	return newSystemRepository("initial data", []string{allTables})
+}
+
+func newSystemRepository(reason string, tables []string) *DBRepository {
+	dbContext := &DBContext{
+		UserID:   SystemUserID,
+		GroupIDs: []string{SystemGroupID},
+		Schema:   DbSchema,
+		system:   &systemScope{reason: reason, tables: tables},
+	}
+	repo := NewDBRepository(dbContext, Factory, DbConnection)
+	repo.Verbose = false
+	return repo
+}
+
+// IsSystem tells whether the context is a system context
+func (dbctx *DBContext) IsSystem() bool {
+	return dbctx.system != nil
+}
+
+// SystemReason returns the reason of a system context, empty for the contexts of the users
+func (dbctx *DBContext) SystemReason() string {
+	if dbctx.system == nil {
+		return ""
+	}
+	return dbctx.system.reason
+}
+
+// inScope tells whether the context may use a table
+func (dbctx *DBContext) inScope(tableName string) bool {
+	return dbctx.system == nil || slices.Contains(dbctx.system.tables, allTables) || slices.Contains(dbctx.system.tables, tableName)
+}
+
+// checkScope returns an error when a system context uses a table it was not created for
+func (dbctx *DBContext) checkScope(tableName string) error {
+	if dbctx.inScope(tableName) {
+		return nil
+	}
+	log.Printf("DBContext::checkScope: system context %q denied table %s", dbctx.system.reason, tableName)
+	return fmt.Errorf("system context %q may not use table %s", dbctx.system.reason, tableName)
+}
+
+// sensitiveTables are the tables whose reads by a system context are written to the audit log: the secrets of
+// the second factor, the reset and verification links, the external accounts and the notifications of the users.
+// The lookups of the tokens, the API keys and the accounts made for every request are not: they would flood it.
+var sensitiveTables = []string{"users_totp", "users_webauthn", "users_password_resets", "users_registrations", "users_oauth", "notifications"}
+
+// auditReadWithTx writes a read of a sensitive table by a system context to the audit log: it reads what no user
+// could, so it leaves a trace as its changes do. A failing audit does not stop the read.
+func (dbr *DBRepository) auditReadWithTx(dbe DBEntityInterface, tx *sql.Tx) {
+	if !dbr.DbContext.IsSystem() || !slices.Contains(sensitiveTables, dbe.GetTableName()) {
+		return
+	}
+	log.Printf("DBContext: system context %q read %s", dbr.DbContext.system.reason, dbe.GetTableName())
+	err := func() error {
+		if tx != nil {
+			return dbr.auditWithTx("read", dbe, tx)
+		}
+		tx, err := dbr.DbConnection.BeginTx(dbr.Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := dbr.auditWithTx("read", dbe, tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		log.Printf("DBContext: audit of the read of %s failed: %v", dbe.GetTableName(), err)
+	}
+}
+
+// auditWithTx writes a change, or a read, made by a system context to the audit log
+func (dbr *DBRepository) auditWithTx(action string, dbe DBEntityInterface, tx *sql.Tx) error {
+	if !dbr.DbContext.IsSystem() {
+		return nil
+	}
+	keys := []string{}
+	for _, key := range dbe.GetKeys() {
+		// The keys a search did not set are empty
+		if value := dbe.GetValue(key); value != nil {
+			keys = append(keys, fmt.Sprint(value))
+		} else {
+			keys = append(keys, "")
+		}
+	}
+	reason := dbr.DbContext.system.reason
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	rowID := strings.Join(keys, ",")
+	if len(rowID) > 255 {
+		rowID = rowID[:255]
+	}
+	entry := NewAuditEntry()
+	entry.SetValue("created_at", time.Now().UTC().Format("2006-01-02 15:04:05"))
+	entry.SetValue("user_id", dbr.DbContext.UserID)
+	entry.SetValue("action", action)
+	entry.SetValue("table_name", dbe.GetTableName())
+	entry.SetValue("row_id", rowID)
+	entry.SetValue("reason", reason)
+	_, err := dbr.insertWithTx(entry, tx)
+	return err
+}
+
+// PurgeAuditLog deletes the entries of the audit log written before, in one statement: the purge itself
+// is not audited
+func (dbr *DBRepository) PurgeAuditLog(before time.Time) (int64, error) {
+	if err := dbr.DbContext.checkScope("audit_log"); err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE created_at < %s", dbr.buildTableName(NewAuditEntry()), dbr.placeholder(1))
+	result, err := dbr.DbConnection.ExecContext(dbr.Context(), query, before.UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
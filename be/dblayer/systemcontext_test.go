@@ -0,0 +1,143 @@
+package dblayer
+
+import (
+	"testing"
+	"time"
+)
+
+// go test -v ./dblayer -run TestSystemRepository
+func TestSystemRepository(t *testing.T) {
+	repo := NewSystemRepository("system context test", "mail_queue")
+	if !repo.DbContext.IsSystem() || repo.DbContext.SystemReason() != "system context test" {
+		t.Fatalf("Expected a system context, got %+v", repo.DbContext)
+	}
+	// The same user and groups built by hand are not the system
+	if (&DBContext{UserID: SystemUserID, GroupIDs: []string{SystemGroupID}}).IsSystem() {
+		t.Fatal("Expected a context built by hand not to be the system")
+	}
+
+	// Only the tables of the scope
+	if _, err := repo.Search(NewDBUser(), false, false, ""); err == nil {
+		t.Fatal("Expected the users table to be denied")
+	}
+	if repo.GetEntityByID("users", SystemUserID) != nil {
+		t.Fatal("Expected the lookup of a user to be denied")
+	}
+	if repo.ObjectByID("-10", true) != nil || repo.GetChildren("0", true) != nil {
+		t.Fatal("Expected the object lookups to be denied")
+	}
+	if repo.Select("DBObject", "select count(*) as num from "+DbSchema+"_users") != nil {
+		t.Fatal("Expected raw SQL to be denied")
+	}
+
+	// The changes are audited with the reason
+	message := NewMailMessage()
+	message.SetValue("recipient", "audit@example.com")
+	message.SetValue("subject", "Audit")
+	message.SetValue("body", "Audit")
+	message.SetValue("status", "pending")
+	message.SetValue("attempts", 0)
+	created, err := repo.Insert(message)
+	if err != nil {
+		t.Fatalf("Failed to insert in the scope: %v", err)
+	}
+	if _, err := repo.Delete(created); err != nil {
+		t.Fatalf("Failed to delete in the scope: %v", err)
+	}
+	adminRepo := SetupTestRepo(t, SystemUserID, []string{SystemGroupID}, DbSchema)
+	search := NewAuditEntry()
+	search.SetValue("table_name", "mail_queue")
+	search.SetValue("row_id", created.GetValue("id"))
+	entries, err := adminRepo.Search(search, false, false, "created_at")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected the insert and the delete in the audit log, got %v %v", entries, err)
+	}
+	actions := map[any]bool{}
+	for _, entry := range entries {
+		actions[entry.GetValue("action")] = true
+		if entry.GetValue("reason") != "system context test" || entry.GetValue("user_id") != SystemUserID {
+			t.Fatalf("Unexpected audit entry %s", entry.ToJSON())
+		}
+		adminRepo.Delete(entry)
+	}
+	if !actions["insert"] || !actions["delete"] {
+		t.Fatalf("Expected insert and delete, got %v", actions)
+	}
+
+	// The reads of the sensitive tables are audited too, not the others
+	secrets := NewSystemRepository("system context test", "users_totp")
+	secret := NewUserTOTP()
+	secret.SetValue("user_id", "audit-read")
+	if _, err := secrets.Search(secret, false, false, ""); err != nil {
+		t.Fatalf("Failed to read in the scope: %v", err)
+	}
+	search.SetValue("table_name", "users_totp")
+	search.SetValue("row_id", "audit-read")
+	if entries, _ := adminRepo.Search(search, false, false, ""); len(entries) != 1 || entries[0].GetValue("action") != "read" {
+		t.Fatalf("Expected the read audited, got %v", entries)
+	} else {
+		adminRepo.Delete(entries[0])
+	}
+	repo.GetEntityByID("mail_queue", "audit-read")
+	search.SetValue("table_name", "mail_queue")
+	if entries, _ := adminRepo.Search(search, false, false, ""); len(entries) != 0 {
+		t.Fatalf("Expected no audit of the other reads, got %v", entries)
+	}
+
+	// The contexts of the users are not audited
+	message = NewMailMessage()
+	message.SetValue("recipient", "audit@example.com")
+	message.SetValue("subject", "No audit")
+	message.SetValue("body", "No audit")
+	message.SetValue("status", "pending")
+	message.SetValue("attempts", 0)
+	created, _ = adminRepo.Insert(message)
+	defer adminRepo.Delete(created)
+	search.SetValue("row_id", created.GetValue("id"))
+	if entries, _ := adminRepo.Search(search, false, false, ""); len(entries) != 0 {
+		t.Fatalf("Expected no audit of the user contexts, got %v", entries)
+	}
+
+	// Every table is only for the bootstrap
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Expected a system context on every table to be refused")
+			}
+		}()
+		NewSystemRepository("system context test", allTables)
+	}()
+
+	// Without ObjectTables the objects are looked up only in the tables of the scope
+	folder := NewDBFolder()
+	folder.SetValue("name", "System context folder")
+	createdFolder, err := adminRepo.Insert(folder)
+	if err != nil {
+		t.Fatalf("Failed to create the folder: %v", err)
+	}
+	t.Cleanup(func() { hardDeleteForTests(adminRepo, createdFolder.(DBObjectInterface)) })
+	folderID := createdFolder.GetValue("id").(string)
+	if NewSystemRepository("system context test", "folders").ObjectByID(folderID, true) == nil {
+		t.Fatal("Expected the folder found in the folders table")
+	}
+	if NewSystemRepository("system context test", "pages").ObjectByID(folderID, true) != nil {
+		t.Fatal("Expected the folder not found outside the scope")
+	}
+
+	// The old entries of the audit log are purged
+	old := NewAuditEntry()
+	old.SetValue("created_at", "2000-01-01 00:00:00")
+	old.SetValue("action", "insert")
+	old.SetValue("table_name", "mail_queue")
+	createdOld, err := adminRepo.Insert(old)
+	if err != nil {
+		t.Fatalf("Failed to insert the old audit entry: %v", err)
+	}
+	if _, err := repo.PurgeAuditLog(time.Now()); err == nil {
+		t.Fatal("Expected the purge denied outside the scope")
+	}
+	purged, err := NewSystemRepository("system context test", "audit_log").PurgeAuditLog(time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil || purged < 1 || adminRepo.GetEntityByID("audit_log", createdOld.GetValue("id").(string)) != nil {
+		t.Fatalf("Expected the old audit entry purged, got %d %v", purged, err)
+	}
+}
@@ -0,0 +1,51 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"rprj/be/models"
+)
+
+// FileDriver writes the messages in a maildir, to read them with a mail client during development and in tests
+type FileDriver struct {
+	From      string
+	Directory string
+}
+
+var fileDriverCounter atomic.Int64
+
+func NewFileDriver(config models.MailConfig) (*FileDriver, error) {
+	if config.Directory == "" {
+		return nil, fmt.Errorf("file driver needs a directory")
+	}
+	from := config.From
+	if from == "" {
+		from = "noreply@localhost"
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(config.Directory, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &FileDriver{From: from, Directory: config.Directory}, nil
+}
+
+func (d *FileDriver) Send(msg Message) error {
+	now := time.Now()
+	data, err := compose(d.From, msg, now)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	// Maildir: written in tmp, then moved in new when complete
+	name := fmt.Sprintf("%d.%d_%d.%s", now.Unix(), os.Getpid(), fileDriverCounter.Add(1), hostname)
+	tmpPath := filepath.Join(d.Directory, "tmp", name)
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(d.Directory, "new", name))
+}
@@ -0,0 +1,87 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"rprj/be/models"
+)
+
+// Message is an outbound email in plain text
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Driver delivers the messages
+type Driver interface {
+	Send(msg Message) error
+}
+
+// NewDriver returns the driver of the configuration, nil when no driver is configured
+func NewDriver(config models.MailConfig) (Driver, error) {
+	switch config.Driver {
+	case "":
+		return nil, nil
+	case "smtp":
+		driver, err := NewSMTPDriver(config)
+		if err != nil {
+			return nil, err
+		}
+		return driver, nil
+	case "file":
+		driver, err := NewFileDriver(config)
+		if err != nil {
+			return nil, err
+		}
+		return driver, nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", config.Driver)
+	}
+}
+
+// compose returns the message in RFC 5322 format, with the headers encoded for any charset
+func compose(from string, msg Message, now time.Time) ([]byte, error) {
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+	toAddress, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q: %w", msg.To, err)
+	}
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	domain := fromAddress.Address[strings.LastIndex(fromAddress.Address, "@")+1:]
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "From: %s\r\n", fromAddress.String())
+	fmt.Fprintf(&out, "To: %s\r\n", toAddress.String())
+	fmt.Fprintf(&out, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&out, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&out, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(buf), domain)
+	out.WriteString("MIME-Version: 1.0\r\n")
+	out.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	out.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	body := quotedprintable.NewWriter(&out)
+	body.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n")))
+	body.Close()
+	return out.Bytes(), nil
+}
+
+// addressOf returns the bare address of "Name <address>"
+func addressOf(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return parsed.Address, nil
+}
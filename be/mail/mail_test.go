@@ -0,0 +1,256 @@
+package mail
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"rprj/be/dblayer"
+	"rprj/be/models"
+)
+
+// go test -v ./mail -run TestRender
+func TestRender(t *testing.T) {
+	data := map[string]any{"Fullname": "Ada", "Link": "https://example.com/x", "Hours": 24}
+	for _, language := range Languages {
+		subject, body, err := Render("registration_verify", language, data)
+		if err != nil || subject == "" || !strings.Contains(body, "https://example.com/x") || !strings.Contains(body, "Ada") {
+			t.Fatalf("%s: unexpected template %q %q %v", language, subject, body, err)
+		}
+	}
+	italian, _, _ := Render("registration_verify", "it-IT,it;q=0.9,en;q=0.8", data)
+	english, _, _ := Render("registration_verify", "es-ES", data)
+	if italian != "Conferma la tua registrazione" || english != "Confirm your registration" {
+		t.Fatalf("Expected Italian and the English fallback, got %q %q", italian, english)
+	}
+	if _, _, err := Render("missing", "en", data); err == nil {
+		t.Fatalf("Expected a missing template to fail")
+	}
+}
+
+// readMessage parses a message and returns its decoded subject and body
+func readMessage(t *testing.T, r io.Reader) (*mail.Message, string, string) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		t.Fatalf("Invalid message: %v", err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	body, _ := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	return msg, subject, string(body)
+}
+
+// go test -v ./mail -run TestFileDriver
+func TestFileDriver(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := NewDriver(models.MailConfig{Driver: "file", Directory: dir, From: "R-Prj <noreply@example.com>"})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %v", err)
+	}
+	body := "Ciao Élodie,\nuna riga molto lunga " + strings.Repeat("abcdefghij", 10) + "\n"
+	if err := driver.Send(Message{To: "Élodie <elodie@example.com>", Subject: "Benvenuta è qui", Body: body}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	files, _ := os.ReadDir(filepath.Join(dir, "new"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one message in new, got %d", len(files))
+	}
+	file, _ := os.Open(filepath.Join(dir, "new", files[0].Name()))
+	defer file.Close()
+	msg, subject, decoded := readMessage(t, file)
+	if subject != "Benvenuta è qui" || strings.ReplaceAll(decoded, "\r\n", "\n") != body {
+		t.Fatalf("Unexpected message %q %q", subject, decoded)
+	}
+	if to, _ := msg.Header.AddressList("To"); len(to) != 1 || to[0].Address != "elodie@example.com" {
+		t.Fatalf("Unexpected recipient %v", to)
+	}
+	if err := driver.Send(Message{To: "not an address", Subject: "x"}); err == nil {
+		t.Fatalf("Expected an invalid recipient to be refused")
+	}
+}
+
+// fakeSMTPServer accepts one message without TLS and returns what it received
+func fakeSMTPServer(t *testing.T) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 fake ESMTP")
+		var transcript strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"):
+				reply("250-fake")
+				reply("250 AUTH PLAIN")
+			case strings.HasPrefix(command, "AUTH PLAIN"):
+				reply("235 ok")
+			case strings.HasPrefix(command, "DATA"):
+				reply("354 go on")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 queued")
+			case strings.HasPrefix(command, "QUIT"):
+				reply("221 bye")
+				received <- transcript.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+// go test -v ./mail -run TestSMTPDriver
+func TestSMTPDriver(t *testing.T) {
+	newDriver := func(address string, security string) Driver {
+		host, port, _ := net.SplitHostPort(address)
+		portNumber, _ := strconv.Atoi(port)
+		driver, err := NewDriver(models.MailConfig{Driver: "smtp", Host: host, Port: portNumber, Security: security,
+			Username: "user", Password: "secret", From: "noreply@example.com"})
+		if err != nil {
+			t.Fatalf("Failed to create driver: %v", err)
+		}
+		return driver
+	}
+
+	address, received := fakeSMTPServer(t)
+	if err := newDriver(address, "none").Send(Message{To: "someone@example.com", Subject: "Hello", Body: "Body text\n"}); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	select {
+	case transcript := <-received:
+		for _, expected := range []string{"AUTH PLAIN", "MAIL FROM:<noreply@example.com>", "RCPT TO:<someone@example.com>", "Subject: Hello", "Body text"} {
+			if !strings.Contains(transcript, expected) {
+				t.Fatalf("Expected %q in the transcript:\n%s", expected, transcript)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The server received nothing")
+	}
+
+	// STARTTLS is required unless disabled
+	address, _ = fakeSMTPServer(t)
+	if err := newDriver(address, "").Send(Message{To: "someone@example.com", Subject: "Hello"}); err == nil {
+		t.Fatalf("Expected a server without STARTTLS to be refused")
+	}
+}
+
+// flakyDriver fails the first failures messages
+type flakyDriver struct {
+	failures int
+	sent     []Message
+}
+
+func (d *flakyDriver) Send(msg Message) error {
+	if d.failures > 0 {
+		d.failures--
+		return errors.New("server unavailable")
+	}
+	d.sent = append(d.sent, msg)
+	return nil
+}
+
+// go test -v ./mail -run TestQueue
+func TestQueue(t *testing.T) {
+	dbContext := &dblayer.DBContext{UserID: "-1", GroupIDs: []string{"-2"}, Schema: dblayer.DbSchema}
+	repo := dblayer.NewDBRepository(dbContext, dblayer.Factory, dblayer.DbConnection)
+	repo.Verbose = false
+
+	recipient := "queue" + time.Now().Format("150405.000000") + "@example.com"
+	id, err := Enqueue(repo, Message{To: recipient, Subject: "Queued", Body: "Body"})
+	if err != nil {
+		t.Fatalf("Failed to enqueue: %v", err)
+	}
+	t.Cleanup(func() {
+		queued := repo.GetInstanceByTableName("mail_queue")
+		queued.SetValue("id", id)
+		repo.Delete(queued)
+	})
+	load := func() dblayer.DBEntityInterface {
+		return repo.GetEntityByID("mail_queue", id)
+	}
+	// Other tests may have left messages: only ours is looked at
+	makeDue := func() {
+		due := repo.GetInstanceByTableName("mail_queue")
+		due.SetValue("id", id)
+		due.SetValue("next_attempt_at", dbTime(time.Now().Add(-time.Second)))
+		repo.Update(due)
+	}
+
+	// 1. A failure is retried later
+	driver := &flakyDriver{failures: 1}
+	if _, _, err := ProcessQueue(repo, driver, 3); err != nil {
+		t.Fatalf("Failed to process: %v", err)
+	}
+	queued := load()
+	if queued.GetValue("status") != StatusPending || toInt(queued.GetValue("attempts")) != 1 || queued.GetValue("last_error") != "server unavailable" {
+		t.Fatalf("Expected a pending message with one attempt, got %v", queued)
+	}
+	ProcessQueue(repo, driver, 3)
+	if toInt(load().GetValue("attempts")) != 1 {
+		t.Fatalf("Expected no attempt before the retry delay")
+	}
+
+	// 2. Then sent
+	makeDue()
+	ProcessQueue(repo, driver, 3)
+	queued = load()
+	if queued.GetValue("status") != StatusSent || len(driver.sent) == 0 || driver.sent[len(driver.sent)-1].To != recipient {
+		t.Fatalf("Expected the message to be sent, got %v", queued)
+	}
+
+	// 3. Given up after max attempts
+	failing := &flakyDriver{failures: 100}
+	id2, _ := Enqueue(repo, Message{To: recipient, Subject: "Failing", Body: "Body"})
+	t.Cleanup(func() {
+		queued := repo.GetInstanceByTableName("mail_queue")
+		queued.SetValue("id", id2)
+		repo.Delete(queued)
+	})
+	id = id2
+	for range 2 {
+		makeDue()
+		ProcessQueue(repo, failing, 2)
+	}
+	if status := load().GetValue("status"); status != StatusFailed {
+		t.Fatalf("Expected the message to be given up, got %v", status)
+	}
+
+	if _, err := Enqueue(repo, Message{To: "not an address"}); err == nil {
+		t.Fatalf("Expected an invalid recipient to be refused")
+	}
+	if retryDelay(1) != time.Minute || retryDelay(3) != 4*time.Minute || retryDelay(20) != 6*time.Hour {
+		t.Fatalf("Unexpected retry delays %v %v %v", retryDelay(1), retryDelay(3), retryDelay(20))
+	}
+}
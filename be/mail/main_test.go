@@ -0,0 +1,40 @@
+package mail
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"rprj/be/dblayer"
+	"rprj/be/models"
+)
+
+// go test -v ./mail -run TestXXX -config ../config.json
+var (
+	configFile = flag.String("config", "../config.json", "Path to configuration file")
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	var config models.Config
+	if err := models.LoadConfig(*configFile, &config); err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	var err error
+	config.RootDirectory, err = filepath.Abs(config.RootDirectory)
+	if err != nil {
+		log.Fatalf("Error getting absolute path of root directory: %v", err)
+	}
+	config.FilesDirectory = "test_files"
+
+	dblayer.InitDBLayer(config)
+	dblayer.EnsureDBSchema(false)
+	dblayer.InitDBData()
+
+	exitCode := m.Run()
+
+	dblayer.CloseDBConnection()
+	os.Exit(exitCode)
+}
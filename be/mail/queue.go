@@ -0,0 +1,152 @@
+package mail
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"rprj/be/dblayer"
+)
+
+// Status of the messages in mail_queue
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+	StatusFailed  = "failed"
+)
+
+// DefaultMaxAttempts is used when the configuration does not set max_attempts
+const DefaultMaxAttempts = 8
+
+// How long the sent and failed messages are kept
+const QueueRetention = 7 * 24 * time.Hour
+
+// Delay before the next attempt: one minute, doubled at every failure, at most 6 hours
+func retryDelay(attempts int) time.Duration {
+	delay := time.Minute << min(attempts-1, 9)
+	return min(delay, 6*time.Hour)
+}
+
+func dbTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// Enqueue stores a message to be sent by ProcessQueue. Returns the id of the message.
+func Enqueue(repo *dblayer.DBRepository, msg Message) (string, error) {
+	if _, err := addressOf(msg.To); err != nil {
+		return "", fmt.Errorf("invalid recipient %q: %w", msg.To, err)
+	}
+	subject := msg.Subject
+	if len(subject) > 255 {
+		subject = subject[:255]
+	}
+	now := time.Now()
+	queued := repo.GetInstanceByTableName("mail_queue")
+	queued.SetValue("recipient", msg.To)
+	queued.SetValue("subject", subject)
+	queued.SetValue("body", msg.Body)
+	queued.SetValue("status", StatusPending)
+	queued.SetValue("attempts", 0)
+	queued.SetValue("created_at", dbTime(now))
+	queued.SetValue("next_attempt_at", dbTime(now))
+	created, err := repo.Insert(queued)
+	if err != nil {
+		return "", err
+	}
+	return created.GetValue("id").(string), nil
+}
+
+// ProcessQueue sends the pending messages whose time has come.
+// A failed message is tried again later, up to maxAttempts times.
+func ProcessQueue(repo *dblayer.DBRepository, driver Driver, maxAttempts int) (sent int, failed int, err error) {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+	now := time.Now()
+	search := repo.GetInstanceByTableName("mail_queue")
+	search.SetValue("status", StatusPending)
+	search.SetValue("next_attempt_at", []string{"", dbTime(now)})
+	messages, err := repo.Search(search, false, false, "next_attempt_at")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, queued := range messages {
+		update := repo.GetInstanceByTableName("mail_queue")
+		update.SetValue("id", queued.GetValue("id"))
+		attempts := toInt(queued.GetValue("attempts")) + 1
+		update.SetValue("attempts", attempts)
+
+		sendErr := driver.Send(Message{
+			To:      fmt.Sprint(queued.GetValue("recipient")),
+			Subject: fmt.Sprint(queued.GetValue("subject")),
+			Body:    fmt.Sprint(queued.GetValue("body")),
+		})
+		if sendErr == nil {
+			update.SetValue("status", StatusSent)
+			update.SetValue("sent_at", dbTime(time.Now()))
+			update.SetValue("last_error", "")
+			sent++
+		} else {
+			log.Printf("Mail: attempt %d to %s failed: %v", attempts, queued.GetValue("recipient"), sendErr)
+			errorText := sendErr.Error()
+			if len(errorText) > 1000 {
+				errorText = errorText[:1000]
+			}
+			update.SetValue("last_error", errorText)
+			if attempts >= maxAttempts {
+				update.SetValue("status", StatusFailed)
+				failed++
+			} else {
+				update.SetValue("next_attempt_at", dbTime(time.Now().Add(retryDelay(attempts))))
+			}
+		}
+		if _, err := repo.Update(update); err != nil {
+			return sent, failed, err
+		}
+	}
+	return sent, failed, nil
+}
+
+// PurgeQueue deletes the messages sent or given up before QueueRetention
+func PurgeQueue(repo *dblayer.DBRepository) (int, error) {
+	purged := 0
+	for _, status := range []string{StatusSent, StatusFailed} {
+		search := repo.GetInstanceByTableName("mail_queue")
+		search.SetValue("status", status)
+		search.SetValue("created_at", []string{"", dbTime(time.Now().Add(-QueueRetention))})
+		messages, err := repo.Search(search, false, false, "")
+		if err != nil {
+			return purged, err
+		}
+		for _, queued := range messages {
+			if _, err := repo.Delete(queued); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// toInt reads an int column as returned by the different database drivers
+func toInt(value any) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case []byte:
+		var n int
+		fmt.Sscan(string(v), &n)
+		return n
+	case string:
+		var n int
+		fmt.Sscan(v, &n)
+		return n
+	}
+	return 0
+}
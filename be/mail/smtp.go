@@ -0,0 +1,123 @@
+package mail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"rprj/be/models"
+)
+
+// SMTPDriver sends the messages to a mail server, with STARTTLS or TLS and authentication
+type SMTPDriver struct {
+	From               string
+	Host               string
+	Port               int
+	Username           string
+	Password           string
+	Security           string // starttls, tls or none
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+}
+
+func NewSMTPDriver(config models.MailConfig) (*SMTPDriver, error) {
+	if config.Host == "" || config.From == "" {
+		return nil, fmt.Errorf("smtp driver needs host and from")
+	}
+	if _, err := addressOf(config.From); err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", config.From, err)
+	}
+	driver := &SMTPDriver{
+		From:               config.From,
+		Host:               config.Host,
+		Port:               config.Port,
+		Username:           config.Username,
+		Password:           config.Password,
+		Security:           config.Security,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		Timeout:            30 * time.Second,
+	}
+	if driver.Security == "" {
+		driver.Security = "starttls"
+	}
+	switch driver.Security {
+	case "starttls", "none":
+		if driver.Port == 0 {
+			driver.Port = 587
+		}
+	case "tls":
+		if driver.Port == 0 {
+			driver.Port = 465
+		}
+	default:
+		return nil, fmt.Errorf("unknown smtp security %q", driver.Security)
+	}
+	return driver, nil
+}
+
+func (d *SMTPDriver) Send(msg Message) error {
+	data, err := compose(d.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	from, _ := addressOf(d.From)
+	to, err := addressOf(msg.To)
+	if err != nil {
+		return err
+	}
+
+	address := net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+	tlsConfig := &tls.Config{ServerName: d.Host, InsecureSkipVerify: d.InsecureSkipVerify}
+	var conn net.Conn
+	if d.Security == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: d.Timeout}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, d.Timeout)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(d.Timeout))
+	client, err := smtp.NewClient(conn, d.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if d.Security == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", d.Host)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if d.Username != "" {
+		// PlainAuth refuses to send the password on a connection without TLS, except to localhost
+		if err := client.Auth(smtp.PlainAuth("", d.Username, d.Password, d.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
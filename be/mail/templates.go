@@ -0,0 +1,62 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// The templates of every language are in templates/<language>/<name>.txt:
+// the first line is "Subject: ...", then an empty line and the body
+//
+//go:embed templates
+var templateFiles embed.FS
+
+// Languages are the languages of the templates, as in the UI; the first is the default
+var Languages = []string{"en", "it", "de", "fr"}
+
+// templates by language: ParseFS names the templates after the file, without the directory
+var templates = map[string]*template.Template{}
+
+func init() {
+	for _, language := range Languages {
+		templates[language] = template.Must(template.New("").ParseFS(templateFiles, "templates/"+language+"/*.txt"))
+	}
+}
+
+// Language returns the supported language of an Accept-Language header or a language code, the default otherwise
+func Language(acceptLanguage string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		for _, language := range Languages {
+			if base == language {
+				return language
+			}
+		}
+	}
+	return Languages[0]
+}
+
+// Render returns the subject and the body of a template in a language, in the default one when missing
+func Render(name string, language string, data any) (string, string, error) {
+	tmpl := templates[Language(language)].Lookup(name + ".txt")
+	if tmpl == nil {
+		tmpl = templates[Languages[0]].Lookup(name + ".txt")
+	}
+	if tmpl == nil {
+		return "", "", fmt.Errorf("mail template %q not found", name)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", "", err
+	}
+	header, body, found := strings.Cut(out.String(), "\n\n")
+	subject, ok := strings.CutPrefix(header, "Subject: ")
+	if !found || !ok {
+		return "", "", fmt.Errorf("mail template %q must start with the subject", name)
+	}
+	return strings.TrimSpace(subject), strings.TrimLeft(body, "\n"), nil
+}
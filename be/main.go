@@ -102,6 +102,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"rprj/be/api"
 	"rprj/be/dblayer"
@@ -127,7 +128,8 @@ func main() {
 		log.Fatalf("Error loading configuration: %v", err)
 	}
 
-	fmt.Printf("Loaded config: %+v\n", AppConfig)
+	// The config holds passwords and secrets: only what identifies the instance is printed
+	log.Printf("Loaded config %s: app=%q db=%s", configFile, AppConfig.AppName, AppConfig.DBEngine)
 
 	if appName := os.Getenv("APP_NAME"); appName != "" {
 		AppConfig.AppName = appName
@@ -151,6 +153,12 @@ func main() {
 	if ollamaModel := os.Getenv("OLLAMA_MODEL"); ollamaModel != "" {
 		AppConfig.OllamaModel = strings.ReplaceAll(ollamaModel, "\"", "")
 	}
+	if llmProvider := os.Getenv("LLM_PROVIDER"); llmProvider != "" {
+		AppConfig.LLMProvider = llmProvider
+	}
+	if llmAPIKey := os.Getenv("LLM_API_KEY"); llmAPIKey != "" {
+		AppConfig.LLMAPIKey = llmAPIKey
+	}
 
 	// File system directories
 	AppConfig.RootDirectory = "."
@@ -192,49 +200,82 @@ func main() {
 		}
 	}
 
+	if err := api.CheckJWTSecret(AppConfig.JWTSecret); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
 	dblayer.InitDBLayer(AppConfig)
 	dblayer.EnsureDBSchema(true)
 	dblayer.InitDBData()
 
 	api.InitAPI(AppConfig)
-	api.OllamaInit(AppConfig.AppName, AppConfig.OllamaURL, AppConfig.OllamaModel)
+	api.StartMaintenance(1 * time.Hour)
+	api.StartLDAPSync(time.Duration(AppConfig.LDAP.SyncMinutes) * time.Minute)
+	api.StartMailQueue(time.Duration(AppConfig.Mail.QueueSeconds) * time.Second)
+	api.StartNotificationDigest(1 * time.Hour)
+	api.OllamaInit(AppConfig.AppName, api.NewLLMProvider(AppConfig.LLMProvider, AppConfig.OllamaURL, AppConfig.LLMAPIKey), AppConfig.OllamaModel)
 
 	// Routing
 	r := mux.NewRouter()
-	// remove cors
-	r.Use(mux.CORSMethodMiddleware(r))
-
-	// Endpoints navigation
-	r.HandleFunc("/content/{objectId}", api.GetNavigationHandler).Methods("GET")
-	r.HandleFunc("/content/country/{countryId}", api.GetCountryHandler).Methods("GET")
-	r.HandleFunc("/nav/children/{folderId}", api.GetChildrenHandler).Methods("GET")
-	r.HandleFunc("/nav/breadcrumb/{objectId}", api.GetBreadcrumbHandler).Methods("GET")
-	r.HandleFunc("/nav/{objectId}/indexes", api.GetIndexesHandler).Methods("GET")
-	r.HandleFunc("/nav/search", api.NavigationSearchHandler).Methods("GET")
-
-	// Public Endpoints: login, logout
+	r.Use(api.RateLimitMiddleware)
+
+	// Endpoints navigation: anonymous users see the public content
+	contentRoutes := r.PathPrefix("/content").Subrouter()
+	contentRoutes.Use(api.OptionalAuthMiddleware)
+	contentRoutes.HandleFunc("/{objectId}", api.GetNavigationHandler).Methods("GET")
+	contentRoutes.HandleFunc("/country/{countryId}", api.GetCountryHandler).Methods("GET")
+	navRoutes := r.PathPrefix("/nav").Subrouter()
+	navRoutes.Use(api.OptionalAuthMiddleware)
+	navRoutes.HandleFunc("/children/{folderId}", api.GetChildrenHandler).Methods("GET")
+	navRoutes.HandleFunc("/breadcrumb/{objectId}", api.GetBreadcrumbHandler).Methods("GET")
+	navRoutes.HandleFunc("/{objectId}/indexes", api.GetIndexesHandler).Methods("GET")
+	navRoutes.HandleFunc("/search", api.NavigationSearchHandler).Methods("GET")
+	// Share links: the shared object, and what is below it when shared with its subtree
+	r.Handle("/share/{token}", api.ShareMiddleware(http.HandlerFunc(api.GetShareHandler))).Methods("GET")
+	shareRoutes := r.PathPrefix("/share/{token}").Subrouter()
+	shareRoutes.Use(api.ShareMiddleware)
+	shareRoutes.HandleFunc("/content/{objectId}", api.GetNavigationHandler).Methods("GET")
+	shareRoutes.HandleFunc("/children/{folderId}", api.GetChildrenHandler).Methods("GET")
+	shareRoutes.HandleFunc("/breadcrumb/{objectId}", api.GetBreadcrumbHandler).Methods("GET")
+
+	// Public Endpoints: login, logout, public keys of the tokens
 	r.HandleFunc("/login", api.LoginHandler).Methods("POST")
-	r.HandleFunc("/logout", api.LogoutHandler).Methods("POST")
-
-	// OAuth endpoints (Google, GitHub, Telegram)
+	r.Handle("/logout", api.AuthMiddleware(http.HandlerFunc(api.LogoutHandler))).Methods("POST")
+	r.HandleFunc("/token/refresh", api.RefreshTokenHandler).Methods("POST")
+	r.HandleFunc("/.well-known/jwks.json", api.JWKSHandler).Methods("GET")
+	r.HandleFunc("/login/2fa", api.LoginTwoFactorHandler).Methods("POST")
+	r.HandleFunc("/login/2fa/setup", api.LoginTwoFactorSetupHandler).Methods("POST")
+	r.HandleFunc("/login/webauthn/begin", api.BeginWebAuthnLoginHandler).Methods("POST")
+	r.HandleFunc("/login/webauthn/finish", api.FinishWebAuthnLoginHandler).Methods("POST")
+	r.HandleFunc("/register", api.RegisterHandler).Methods("POST")
+	r.HandleFunc("/register/verify", api.VerifyRegistrationHandler).Methods("POST")
+	r.HandleFunc("/password/forgot", api.ForgotPasswordHandler).Methods("POST")
+	r.HandleFunc("/password/reset", api.ResetPasswordHandler).Methods("POST")
+
+	// OAuth endpoints (Google, GitHub, Telegram, OpenID Connect)
 	r.HandleFunc("/oauth/google/start", api.GoogleOAuthStart).Methods("GET")
 	r.HandleFunc("/oauth/google/callback", api.GoogleOAuthCallback).Methods("GET")
 	r.HandleFunc("/oauth/github/start", api.GitHubOAuthStart).Methods("GET")
 	r.HandleFunc("/oauth/github/callback", api.GitHubOAuthCallback).Methods("GET")
 	r.HandleFunc("/oauth/telegram/callback", api.TelegramOAuthCallback).Methods("GET")
+	r.HandleFunc("/oauth/oidc/providers", api.GetOIDCProvidersHandler).Methods("GET")
+	r.HandleFunc("/oauth/oidc/{provider}/start", api.OIDCStartHandler).Methods("GET")
+	r.HandleFunc("/oauth/oidc/{provider}/callback", api.OIDCCallbackHandler).Methods("GET")
 
 	// Public Endpoint: hello
 	r.HandleFunc("/ping", api.PingHandler).Methods("GET")
 
-	// Public Endpoint: Ollama
-	// curl -X POST http://localhost:8080/api/ollama -H "Content-Type: application/json" -d '{"prompt":"Hello Ollama!"}'
-	r.HandleFunc("/ollama", api.OllamaHandler).Methods("POST")
+	// Ollama proxy, authenticated users only
+	// curl -N -X POST http://localhost:8080/api/ollama -H "Authorization: Bearer $TOKEN" -H "Content-Type: application/json" -d '{"prompt":"Hello Ollama!","stream":true}'
+	r.Handle("/ollama", api.AuthMiddleware(http.HandlerFunc(api.OllamaHandler))).Methods("POST")
 	// Public Endpoint: Ollama default page response
 	// curl -X GET http://localhost:8080/api/ollama/defaultpage
 	r.HandleFunc("/ollama/defaultpage", api.DefaultPageOllamaHandler).Methods("GET")
+	// Q&A over the content readable by the current user
+	r.Handle("/ollama/ask", api.AuthMiddleware(http.HandlerFunc(api.AskHandler))).Methods("POST")
 
 	// Public Endpoint: Get all countries
-	r.HandleFunc("/countries", api.GetCountriesHandler).Methods("GET")
+	r.Handle("/countries", api.OptionalAuthMiddleware(http.HandlerFunc(api.GetCountriesHandler))).Methods("GET")
 
 	// Protected Endpoint: CRUD users
 	userRoutes := r.PathPrefix("/users").Subrouter()
@@ -242,6 +283,22 @@ func main() {
 
 	userRoutes.HandleFunc("/{id}", api.GetUserHandler).Methods("GET")
 	userRoutes.HandleFunc("/{id}/person", api.GetUserPersonHandler).Methods("GET")
+	userRoutes.HandleFunc("/{id}/enabled", api.SetUserEnabledHandler).Methods("PUT")
+	userRoutes.HandleFunc("/{id}/sessions", api.GetUserSessionsHandler).Methods("GET")
+	userRoutes.HandleFunc("/{id}/sessions", api.DeleteUserSessionsHandler).Methods("DELETE")
+	userRoutes.HandleFunc("/{id}/sessions/{sessionId}", api.DeleteUserSessionHandler).Methods("DELETE")
+	userRoutes.HandleFunc("/{id}/api-keys", api.GetAPIKeysHandler).Methods("GET")
+	userRoutes.HandleFunc("/{id}/api-keys", api.CreateAPIKeyHandler).Methods("POST")
+	userRoutes.HandleFunc("/{id}/api-keys/{keyId}", api.DeleteAPIKeyHandler).Methods("DELETE")
+	userRoutes.HandleFunc("/{id}/2fa", api.GetTwoFactorHandler).Methods("GET")
+	userRoutes.HandleFunc("/{id}/2fa", api.DisableTwoFactorHandler).Methods("DELETE")
+	userRoutes.HandleFunc("/{id}/2fa/enroll", api.EnrollTwoFactorHandler).Methods("POST")
+	userRoutes.HandleFunc("/{id}/2fa/confirm", api.ConfirmTwoFactorHandler).Methods("POST")
+	userRoutes.HandleFunc("/{id}/2fa/recovery-codes", api.RegenerateRecoveryCodesHandler).Methods("POST")
+	userRoutes.HandleFunc("/{id}/webauthn", api.GetWebAuthnCredentialsHandler).Methods("GET")
+	userRoutes.HandleFunc("/{id}/webauthn/register/begin", api.BeginWebAuthnRegistrationHandler).Methods("POST")
+	userRoutes.HandleFunc("/{id}/webauthn/register/finish", api.FinishWebAuthnRegistrationHandler).Methods("POST")
+	userRoutes.HandleFunc("/{id}/webauthn/{credentialId}", api.DeleteWebAuthnCredentialHandler).Methods("DELETE")
 	userRoutes.HandleFunc("", api.GetAllUsersHandler).Methods("GET")
 	userRoutes.HandleFunc("", api.CreateUserHandler).Methods("POST")
 	userRoutes.HandleFunc("/{id}", api.UpdateUserHandler).Methods("PUT")
@@ -256,6 +313,9 @@ func main() {
 	groupRoutes.HandleFunc("", api.CreateGroupHandler).Methods("POST")
 	groupRoutes.HandleFunc("/{id}", api.UpdateGroupHandler).Methods("PUT")
 	groupRoutes.HandleFunc("/{id}", api.DeleteGroupHandler).Methods("DELETE")
+	groupRoutes.HandleFunc("/{id}/capabilities", api.GetGroupCapabilitiesHandler).Methods("GET")
+	groupRoutes.HandleFunc("/{id}/capabilities", api.UpdateGroupCapabilitiesHandler).Methods("PUT")
+	r.Handle("/capabilities", api.AuthMiddleware(http.HandlerFunc(api.GetCapabilitiesHandler))).Methods("GET")
 
 	// Protected Endpoint: CRUD objects (generic DBObject operations)
 	objectRoutes := r.PathPrefix("/objects").Subrouter()
@@ -266,6 +326,31 @@ func main() {
 	objectRoutes.HandleFunc("", api.CreateObjectHandler).Methods("POST")
 	objectRoutes.HandleFunc("/{id}", api.UpdateObjectHandler).Methods("PUT")
 	objectRoutes.HandleFunc("/{id}", api.DeleteObjectHandler).Methods("DELETE")
+	objectRoutes.HandleFunc("/{id}/translate", api.TranslateObjectHandler).Methods("POST")
+	objectRoutes.HandleFunc("/{id}/translations", api.GetTranslationsHandler).Methods("GET")
+	objectRoutes.HandleFunc("/{id}/summarize", api.SummarizeObjectHandler).Methods("POST")
+	objectRoutes.HandleFunc("/{id}/shares", api.GetObjectSharesHandler).Methods("GET")
+	objectRoutes.HandleFunc("/{id}/shares", api.CreateShareHandler).Methods("POST")
+	r.Handle("/shares", api.AuthMiddleware(http.HandlerFunc(api.GetSharesHandler))).Methods("GET")
+	r.Handle("/shares/{id}", api.AuthMiddleware(http.HandlerFunc(api.DeleteShareHandler))).Methods("DELETE")
+	objectRoutes.HandleFunc("/{id}/acl", api.GetACLHandler).Methods("GET")
+	objectRoutes.HandleFunc("/{id}/acl", api.UpdateACLHandler).Methods("PUT")
+	objectRoutes.HandleFunc("/{id}/permissions", api.GetEffectivePermissionsHandler).Methods("GET")
+
+	// Protected Endpoint: Notifications and subscriptions
+	notificationRoutes := r.PathPrefix("/notifications").Subrouter()
+	notificationRoutes.Use(api.AuthMiddleware)
+	notificationRoutes.HandleFunc("", api.GetNotificationsHandler).Methods("GET")
+	notificationRoutes.HandleFunc("/read-all", api.MarkAllNotificationsReadHandler).Methods("POST")
+	notificationRoutes.HandleFunc("/preferences", api.GetNotificationPreferencesHandler).Methods("GET")
+	notificationRoutes.HandleFunc("/preferences", api.UpdateNotificationPreferencesHandler).Methods("PUT")
+	notificationRoutes.HandleFunc("/{id}/read", api.MarkNotificationReadHandler).Methods("POST")
+	subscriptionRoutes := r.PathPrefix("/subscriptions").Subrouter()
+	subscriptionRoutes.Use(api.AuthMiddleware)
+	subscriptionRoutes.HandleFunc("", api.GetSubscriptionsHandler).Methods("GET")
+	subscriptionRoutes.HandleFunc("/{objectId}", api.GetSubscriptionHandler).Methods("GET")
+	subscriptionRoutes.HandleFunc("/{objectId}", api.SubscribeHandler).Methods("PUT")
+	subscriptionRoutes.HandleFunc("/{objectId}", api.UnsubscribeHandler).Methods("DELETE")
 
 	// Protected Endpoint: File download
 	fileRoutes := r.PathPrefix("/files").Subrouter()
@@ -273,23 +358,27 @@ func main() {
 	fileRoutes.HandleFunc("/preview-tokens", api.GenerateFileTokensHandler).Methods("POST")
 
 	// File download without auth middleware (uses token or permission check)
-	r.HandleFunc("/files/{id}/download", api.DownloadFileHandler).Methods("GET")
-	r.HandleFunc("/objects/search", api.SearchObjectsHandler).Methods("GET")
+	r.Handle("/files/{id}/download", api.OptionalAuthMiddleware(http.HandlerFunc(api.DownloadFileHandler))).Methods("GET")
+	r.Handle("/objects/search", api.OptionalAuthMiddleware(http.HandlerFunc(api.SearchObjectsHandler))).Methods("GET")
 
 	// Protected Endpoint: Admin
 	adminRoutes := r.PathPrefix("/admin").Subrouter()
 	adminRoutes.Use(api.AuthMiddleware)
 	adminRoutes.HandleFunc("/dashboard", api.DashboardHandler).Methods("GET")
+	adminRoutes.HandleFunc("/backfill-descriptions", api.BackfillDescriptionsHandler).Methods("POST")
+	adminRoutes.HandleFunc("/jobs/{id}", api.GetJobHandler).Methods("GET")
+	adminRoutes.HandleFunc("/ldap/sync", api.SyncLDAPHandler).Methods("POST")
 
 	// Swagger documentation - only in development
 	enableSwagger := os.Getenv("ENABLE_SWAGGER")
 	if enableSwagger == "true" || enableSwagger == "1" {
-		r.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
+		r.PathPrefix("/swagger/").Handler(api.WithoutContentSecurityPolicy(httpSwagger.WrapHandler))
 		log.Println("Swagger UI disponibile su: http://localhost:" + fmt.Sprintf("%d", AppConfig.ServerPort) + "/swagger/index.html")
 	} else {
 		log.Println("Swagger UI disabilitato (set ENABLE_SWAGGER=true per abilitare)")
 	}
 
 	log.Println("Server in ascolto su :", AppConfig.ServerPort)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", AppConfig.ServerPort), r))
+	// Security headers and CORS preflights, before the routes
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", AppConfig.ServerPort), api.SecurityMiddleware(r)))
 }
@@ -28,6 +28,176 @@ type Config struct {
 	GitHubRedirectURL  string `json:"github_redirect_url"`
 	TelegramBotToken   string `json:"telegram_bot_token"`
 	TelegramBotID      string `json:"telegram_bot_id"`
+	// Ollama: suggest a description when saving pages and text files without one, in a background job
+	OllamaAutoDescribe bool `json:"ollama_auto_describe"`
+	// Ollama proxy: allowed groups (empty = any authenticated user), allowed models besides ollama_model,
+	// system prompt and quotas per user and per IP (0 = unlimited)
+	OllamaAllowedGroups   []string `json:"ollama_allowed_groups"`
+	OllamaModels          []string `json:"ollama_models"`
+	OllamaSystemPrompt    string   `json:"ollama_system_prompt"`
+	OllamaRequestsPerHour int      `json:"ollama_requests_per_hour"`
+	OllamaTokensPerDay    int      `json:"ollama_tokens_per_day"`
+	// LLM provider: ollama (default), openai for OpenAI compatible servers, fake for tests.
+	// ollama_url is its endpoint, ollama_model the default model, llm_models the model of each feature
+	// (chat, default_page, translate, summarize, ask)
+	LLMProvider string            `json:"llm_provider"`
+	LLMAPIKey   string            `json:"llm_api_key"`
+	LLMModels   map[string]string `json:"llm_models"`
+	// Two-factor authentication: members of these groups must use TOTP to log in with the password
+	// (OAuth logins rely on the second factor of the provider)
+	TOTPRequiredGroups []string `json:"totp_required_groups"`
+	// WebAuthn (passkeys and security keys): the domain of the site and the URLs of the frontend,
+	// e.g. "example.com" and ["https://example.com"]. Empty rp id = disabled
+	WebAuthnRPID    string   `json:"webauthn_rp_id"`
+	WebAuthnOrigins []string `json:"webauthn_origins"`
+	// OpenID Connect providers (e.g. Keycloak), logging in with /oauth/oidc/{name}/start
+	OIDCProviders []OIDCProvider `json:"oidc_providers"`
+	// LDAP / Active Directory authentication. Empty url = disabled
+	LDAP LDAPConfig `json:"ldap"`
+	// Public URL of the frontend, used in the links sent by email, e.g. "https://example.com"
+	PublicURL string `json:"public_url"`
+	// Self-service registration with email verification, and the registrations allowed per hour
+	// from one IP address and to one email address (0 = unlimited)
+	RegistrationEnabled  bool `json:"registration_enabled"`
+	RegistrationsPerHour int  `json:"registrations_per_hour"`
+	// Password reset requests allowed per hour from one IP address and for one account (0 = unlimited)
+	PasswordResetsPerHour int `json:"password_resets_per_hour"`
+	// Outbound email
+	Mail MailConfig `json:"mail"`
+	// Rate limits of the API and lockout of the accounts after failed logins
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	// Proxies in front of the server, IP addresses or CIDR ranges: only their X-Forwarded-For is trusted
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Days the audit log of the system contexts is kept (0 = 365)
+	AuditRetentionDays int `json:"audit_retention_days"`
+	// Keys of the access and file tokens besides jwt_secret
+	JWTKeys []JWTKeyConfig `json:"jwt_keys"`
+	// Security headers and CORS
+	Security SecurityConfig `json:"security"`
+	// HTML allowed in pages and news
+	HTMLPolicy HTMLPolicyConfig `json:"html_policy"`
+}
+
+// Allowlist of the HTML of pages and news, applied when they are saved; the empty fields get the defaults,
+// which cover what the editor produces. Elements maps every element to its attributes ("*": those of any element),
+// classes ending with * are prefixes, url_schemes are those of href and src (relative URLs are always allowed;
+// data only for images).
+type HTMLPolicyConfig struct {
+	Elements   map[string][]string `json:"elements"`
+	Classes    []string            `json:"classes"`
+	Styles     []string            `json:"styles"`
+	URLSchemes []string            `json:"url_schemes"`
+}
+
+// Security headers of every response and CORS policy. Empty allowed_origins = only the same origin;
+// "*" = any origin. Empty values get the defaults documented in the README.
+// The HTML pages of the API (OAuth callbacks) get html_content_security_policy, with {nonce} replaced
+// by the nonce of their scripts.
+type SecurityConfig struct {
+	AllowedOrigins            []string `json:"allowed_origins"`
+	AllowedMethods            []string `json:"allowed_methods"`
+	AllowedHeaders            []string `json:"allowed_headers"`
+	AllowCredentials          bool     `json:"allow_credentials"`
+	CORSMaxAgeSeconds         int      `json:"cors_max_age_seconds"`
+	ContentSecurityPolicy     string   `json:"content_security_policy"`
+	HTMLContentSecurityPolicy string   `json:"html_content_security_policy"`
+	HSTSSeconds               int      `json:"hsts_seconds"` // Strict-Transport-Security over https (0 = not sent)
+	HSTSIncludeSubdomains     bool     `json:"hsts_include_subdomains"`
+	ReferrerPolicy            string   `json:"referrer_policy"`
+	FrameOptions              string   `json:"frame_options"`
+}
+
+// A key of the tokens, named in their kid header. HS256 (default) keys have a secret, RS256 and EdDSA keys a PEM
+// private key, or only the public one to keep verifying the tokens of a key that no longer signs.
+// The key signing is the last one with the latest not_before (unix time) already passed: a key with a future
+// not_before is a scheduled rollover, verified and published before it signs. Its tokens are refused after
+// not_after (0 = never). A key with an empty kid replaces jwt_secret for the tokens without kid.
+type JWTKeyConfig struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
+	NotBefore      int64  `json:"not_before"`
+	NotAfter       int64  `json:"not_after"`
+}
+
+// Rate limits: a budget for every kind of endpoint, each with a bucket per IP address and per user.
+// Store is memory (default, per instance) or sql (shared by the instances using the same DB).
+// After lockout_threshold failed logins an account is locked for lockout_seconds, doubled at every
+// further failure up to lockout_max_seconds (0 threshold = never locked)
+type RateLimitConfig struct {
+	Store             string          `json:"store"`
+	Default           RateLimitBudget `json:"default"`
+	Login             RateLimitBudget `json:"login"`
+	OAuth             RateLimitBudget `json:"oauth"`
+	Ollama            RateLimitBudget `json:"ollama"`
+	Download          RateLimitBudget `json:"download"`
+	Share             RateLimitBudget `json:"share"`
+	LockoutThreshold  int             `json:"lockout_threshold"`
+	LockoutSeconds    int             `json:"lockout_seconds"`
+	LockoutMaxSeconds int             `json:"lockout_max_seconds"`
+}
+
+// RateLimitBudget is the bucket of every IP address and of every user
+type RateLimitBudget struct {
+	IP   RateLimitBucket `json:"ip"`
+	User RateLimitBucket `json:"user"`
+}
+
+// RateLimitBucket is a token bucket: up to burst requests at once, refilled at per_minute requests per minute
+// (0 per_minute = unlimited, 0 burst = per_minute)
+type RateLimitBucket struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+}
+
+// Outbound email: driver smtp, file (a maildir, for development and tests) or empty to only log the messages
+type MailConfig struct {
+	Driver             string `json:"driver"`
+	From               string `json:"from"`
+	Host               string `json:"host"`
+	Port               int    `json:"port"`
+	Username           string `json:"username"`
+	Password           string `json:"password"`
+	Security           string `json:"security"` // starttls (default), tls or none
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	Directory          string `json:"directory"` // maildir of the file driver
+	MaxAttempts        int    `json:"max_attempts"`
+	QueueSeconds       int    `json:"queue_seconds"`
+}
+
+// OIDCProvider is an OpenID Connect identity provider.
+// The claims default to preferred_username, email and name
+type OIDCProvider struct {
+	Name          string   `json:"name"`
+	DisplayName   string   `json:"display_name"`
+	Issuer        string   `json:"issuer"`
+	ClientID      string   `json:"client_id"`
+	ClientSecret  string   `json:"client_secret"`
+	RedirectURL   string   `json:"redirect_url"`
+	Scopes        []string `json:"scopes"`
+	LoginClaim    string   `json:"login_claim"`
+	EmailClaim    string   `json:"email_claim"`
+	FullnameClaim string   `json:"fullname_claim"`
+}
+
+// LDAPConfig is the directory used to log in; user_filter finds the entry of a login (%s),
+// group_map maps the DN of LDAP groups to the names of the groups of the users
+type LDAPConfig struct {
+	URL                string            `json:"url"`
+	StartTLS           bool              `json:"start_tls"`
+	InsecureSkipVerify bool              `json:"insecure_skip_verify"`
+	BindDN             string            `json:"bind_dn"`
+	BindPassword       string            `json:"bind_password"`
+	BaseDN             string            `json:"base_dn"`
+	UserFilter         string            `json:"user_filter"`
+	LoginAttribute     string            `json:"login_attribute"`
+	EmailAttribute     string            `json:"email_attribute"`
+	FullnameAttribute  string            `json:"fullname_attribute"`
+	GroupAttribute     string            `json:"group_attribute"`
+	GroupMap           map[string]string `json:"group_map"`
+	SyncMinutes        int               `json:"sync_minutes"`
 }
 
 func LoadConfig(filename string, config *Config) error {
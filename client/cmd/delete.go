@@ -6,7 +6,6 @@ import (
 	"os"
 	"strings"
 
-	"github.com/echoes1971/r-prj-ng/client/pkg/api"
 	"github.com/echoes1971/r-prj-ng/client/pkg/auth"
 	"github.com/spf13/cobra"
 )
@@ -50,7 +49,7 @@ func runDelete(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create API client
-	client := api.NewClient(url, token)
+	client := newClient(tokenManager, instance, url, token)
 
 	// Get object details first (to show what we're deleting)
 	obj, err := client.Get(objectID)
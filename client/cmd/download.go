@@ -5,7 +5,6 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/echoes1971/r-prj-ng/client/pkg/api"
 	"github.com/echoes1971/r-prj-ng/client/pkg/auth"
 	"github.com/spf13/cobra"
 )
@@ -56,7 +55,7 @@ func runDownload(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create API client
-	client := api.NewClient(url, token)
+	client := newClient(tokenManager, instance, url, token)
 
 	// Get object metadata to find filename
 	obj, err := client.Get(objectID)
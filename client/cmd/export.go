@@ -75,7 +75,7 @@ func runExport(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create API client
-	client := api.NewClient(url, token)
+	client := newClient(tokenManager, instance, url, token)
 
 	// Create output directories
 	if err := os.MkdirAll(filepath.Join(exportOutput, "objects"), 0755); err != nil {
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/echoes1971/r-prj-ng/client/pkg/api"
 	"github.com/echoes1971/r-prj-ng/client/pkg/auth"
 	"github.com/spf13/cobra"
 )
@@ -49,7 +48,7 @@ func runGet(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create API client
-	client := api.NewClient(url, token)
+	client := newClient(tokenManager, instance, url, token)
 
 	// Get object
 	obj, err := client.Get(objectID)
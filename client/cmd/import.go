@@ -6,7 +6,6 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/echoes1971/r-prj-ng/client/pkg/api"
 	"github.com/echoes1971/r-prj-ng/client/pkg/auth"
 	"github.com/echoes1971/r-prj-ng/client/pkg/models"
 	"github.com/spf13/cobra"
@@ -78,7 +77,7 @@ func runImport(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create API client
-	client := api.NewClient(url, token)
+	client := newClient(tokenManager, instance, url, token)
 
 	fmt.Printf("Importing %d objects from %s...\n", manifest.TotalObjects, importDir)
 	if importPreserveIDs {
@@ -57,7 +57,7 @@ func runList(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create API client
-	client := api.NewClient(url, token)
+	client := newClient(tokenManager, instance, url, token)
 
 	// Get children
 	var allChildren []models.DBObject
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -17,6 +18,8 @@ var (
 	loginURL      string
 	loginUser     string
 	loginPassword string
+	loginCode     string
+	loginAPIKey   string
 )
 
 var loginCmd = &cobra.Command{
@@ -31,8 +34,14 @@ Examples:
   # Non-interactive login
   rhobee login --url https://mybee.com --user admin --password secret
 
+  # Login with two-factor authentication
+  rhobee login --url https://mybee.com --user admin --password secret --code 123456
+
   # Login to specific instance
-  rhobee login --instance prod --url https://mybee.com`,
+  rhobee login --instance prod --url https://mybee.com
+
+  # Use a personal API key (created in the profile page) instead of a login
+  rhobee login --url https://mybee.com --api-key rbk_...`,
 	RunE: runLogin,
 }
 
@@ -42,6 +51,8 @@ func init() {
 	loginCmd.Flags().StringVar(&loginURL, "url", "", "ρBee instance URL")
 	loginCmd.Flags().StringVar(&loginUser, "user", "", "Username")
 	loginCmd.Flags().StringVar(&loginPassword, "password", "", "Password")
+	loginCmd.Flags().StringVar(&loginCode, "code", "", "Two-factor authentication code or recovery code")
+	loginCmd.Flags().StringVar(&loginAPIKey, "api-key", "", "Personal API key (rbk_...), used instead of username and password")
 }
 
 func runLogin(cmd *cobra.Command, args []string) error {
@@ -58,6 +69,10 @@ func runLogin(cmd *cobra.Command, args []string) error {
 		url = strings.TrimSpace(input)
 	}
 
+	if loginAPIKey != "" {
+		return saveAPIKey(cmd, url, loginAPIKey)
+	}
+
 	// Get username
 	user := loginUser
 	if user == "" {
@@ -84,6 +99,18 @@ func runLogin(cmd *cobra.Command, args []string) error {
 	// Login
 	client := api.NewClient(url, "")
 	token, err := client.Login(user, password)
+	if errors.Is(err, api.ErrTwoFactorRequired) {
+		code := loginCode
+		if code == "" {
+			fmt.Print("Authentication code: ")
+			input, err := reader.ReadString('\n')
+			if err != nil {
+				return fmt.Errorf("failed to read code: %w", err)
+			}
+			code = strings.TrimSpace(input)
+		}
+		token, err = client.LoginTwoFactor(code)
+	}
 	if err != nil {
 		return fmt.Errorf("login failed: %w", err)
 	}
@@ -99,7 +126,7 @@ func runLogin(cmd *cobra.Command, args []string) error {
 		instance = "prod"
 	}
 
-	if err := tokenManager.SaveToken(instance, url, user, token); err != nil {
+	if err := tokenManager.SaveToken(instance, url, user, token, client.RefreshToken); err != nil {
 		return fmt.Errorf("failed to save token: %w", err)
 	}
 
@@ -108,3 +135,28 @@ func runLogin(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+// saveAPIKey configures the instance with a personal API key: no login, no refresh
+func saveAPIKey(cmd *cobra.Command, url, apiKey string) error {
+	if !strings.HasPrefix(apiKey, "rbk_") {
+		return fmt.Errorf("invalid API key: it must start with rbk_")
+	}
+
+	tokenManager, err := auth.NewTokenManager()
+	if err != nil {
+		return fmt.Errorf("failed to create token manager: %w", err)
+	}
+
+	instance, _ := cmd.Flags().GetString("instance")
+	if instance == "" {
+		instance = "prod"
+	}
+
+	if err := tokenManager.SaveAPIKey(instance, url, apiKey); err != nil {
+		return fmt.Errorf("failed to save API key: %w", err)
+	}
+
+	fmt.Printf("✓ API key saved to ~/.rhobee/config.yaml\n")
+
+	return nil
+}
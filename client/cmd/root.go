@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/echoes1971/r-prj-ng/client/pkg/api"
+	"github.com/echoes1971/r-prj-ng/client/pkg/auth"
 	"github.com/spf13/cobra"
 )
 
@@ -26,3 +28,15 @@ func Execute() {
 func init() {
 	rootCmd.PersistentFlags().String("instance", "", "Instance name (default: use default_instance from config)")
 }
+
+// newClient creates an API client that refreshes the expired token by itself and saves the new one
+func newClient(tokenManager *auth.TokenManager, instance, url, token string) *api.Client {
+	client := api.NewClient(url, token)
+	client.RefreshToken = tokenManager.GetRefreshToken(instance)
+	client.OnTokenRefresh = func(token, refreshToken string) {
+		if err := tokenManager.UpdateToken(instance, token, refreshToken); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to save the refreshed token: %v\n", err)
+		}
+	}
+	return client
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/echoes1971/r-prj-ng/client/pkg/api"
 	"github.com/echoes1971/r-prj-ng/client/pkg/auth"
 	"github.com/echoes1971/r-prj-ng/client/pkg/models"
 	"github.com/spf13/cobra"
@@ -62,7 +61,7 @@ func runSearch(cmd *cobra.Command, args []string) error {
 	}
 
 	// Create API client
-	client := api.NewClient(url, token)
+	client := newClient(tokenManager, instance, url, token)
 
 	// Determine classname
 	classname := searchType
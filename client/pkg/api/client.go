@@ -17,11 +17,20 @@ import (
 
 // Client is an HTTP client for the ρBee API
 type Client struct {
-	BaseURL    string
-	Token      string
-	HTTPClient *http.Client
+	BaseURL      string
+	Token        string
+	RefreshToken string
+	HTTPClient   *http.Client
+	// OnTokenRefresh is called with the new tokens after an automatic refresh
+	OnTokenRefresh func(token, refreshToken string)
+
+	challengeToken string
 }
 
+// ErrTwoFactorRequired is returned by Login when the account uses two-factor authentication:
+// the login continues with LoginTwoFactor
+var ErrTwoFactorRequired = fmt.Errorf("two-factor authentication code required")
+
 // NewClient creates a new API client
 func NewClient(baseURL, token string) *Client {
 	return &Client{
@@ -67,9 +76,127 @@ func (c *Client) Login(username, password string) (string, error) {
 		return "", fmt.Errorf("failed to decode response: %w", err)
 	}
 
+	if loginResp.TwoFactorRequired {
+		if loginResp.SetupRequired {
+			return "", fmt.Errorf("two-factor authentication must be enabled for this account: log in from the web interface first")
+		}
+		c.challengeToken = loginResp.ChallengeToken
+		return "", ErrTwoFactorRequired
+	}
+
+	c.Token = loginResp.AccessToken
+	c.RefreshToken = loginResp.RefreshToken
 	return loginResp.AccessToken, nil
 }
 
+// LoginTwoFactor completes a login that returned ErrTwoFactorRequired with a TOTP code or a recovery code
+func (c *Client) LoginTwoFactor(code string) (string, error) {
+	twoFactorReq := models.TwoFactorLoginRequest{ChallengeToken: c.challengeToken}
+	if len(code) == 6 {
+		twoFactorReq.Code = code
+	} else {
+		twoFactorReq.RecoveryCode = code
+	}
+
+	body, err := json.Marshal(twoFactorReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal login request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", c.BaseURL+"/login/2fa", bytes.NewBuffer(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("login failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var loginResp models.LoginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&loginResp); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	c.Token = loginResp.AccessToken
+	c.RefreshToken = loginResp.RefreshToken
+	return loginResp.AccessToken, nil
+}
+
+// Refresh exchanges the refresh token for a new access token and a new refresh token
+func (c *Client) Refresh() error {
+	if c.RefreshToken == "" {
+		return fmt.Errorf("no refresh token, run 'rhobee login' again")
+	}
+
+	body, err := json.Marshal(models.RefreshRequest{RefreshToken: c.RefreshToken})
+	if err != nil {
+		return fmt.Errorf("failed to marshal refresh request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", c.BaseURL+"/token/refresh", bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("refresh failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("refresh failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var loginResp models.LoginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&loginResp); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	c.Token = loginResp.AccessToken
+	c.RefreshToken = loginResp.RefreshToken
+	if c.OnTokenRefresh != nil {
+		c.OnTokenRefresh(c.Token, c.RefreshToken)
+	}
+	return nil
+}
+
+// do sends an authenticated request. When the access token has expired it is refreshed
+// and the request is sent again, if its body can be replayed.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.RefreshToken == "" {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+c.Token)
+	return c.HTTPClient.Do(retry)
+}
+
 // Get retrieves an object by ID
 func (c *Client) Get(objectID string) (*models.DBObject, error) {
 	req, err := http.NewRequest("GET", fmt.Sprintf("%s/content/%s", c.BaseURL, objectID), nil)
@@ -78,7 +205,7 @@ func (c *Client) Get(objectID string) (*models.DBObject, error) {
 	}
 	req.Header.Set("Authorization", "Bearer "+c.Token)
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -122,7 +249,7 @@ func (c *Client) Create(obj *models.DBObject) (*models.DBObject, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+c.Token)
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -180,7 +307,7 @@ func (c *Client) Update(objectID string, obj *models.DBObject) error {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+c.Token)
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -202,7 +329,7 @@ func (c *Client) Delete(objectID string) error {
 	}
 	req.Header.Set("Authorization", "Bearer "+c.Token)
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -283,7 +410,7 @@ func (c *Client) UploadFile(filePath, folderID, name, description, permissions s
 	// Increase timeout for large files
 	c.HTTPClient.Timeout = 5 * time.Minute
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -385,7 +512,7 @@ func (c *Client) UpdateFile(obj *models.DBObject, filePath string, showProgress
 	// Increase timeout for large files
 	c.HTTPClient.Timeout = 5 * time.Minute
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -423,7 +550,7 @@ func (c *Client) DownloadFile(fileID, outputPath string, showProgress bool) erro
 	}
 	req.Header.Set("Authorization", "Bearer "+c.Token)
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
@@ -472,7 +599,7 @@ func (c *Client) Search(classname, query string) ([]models.DBObject, error) {
 	}
 	req.Header.Set("Authorization", "Bearer "+c.Token)
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -508,7 +635,7 @@ func (c *Client) SearchWithAllFields(classname, query string) ([]models.DBObject
 	}
 	req.Header.Set("Authorization", "Bearer "+c.Token)
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -538,7 +665,7 @@ func (c *Client) GetChildren(folderID string) ([]models.DBObject, error) {
 	}
 	req.Header.Set("Authorization", "Bearer "+c.Token)
 
-	resp, err := c.HTTPClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, fmt.Errorf("request failed: %w", err)
 	}
@@ -595,7 +722,7 @@ func (c *Client) GetAllChildren(folderID string) ([]models.DBObject, error) {
 		}
 		req.Header.Set("Authorization", "Bearer "+c.Token)
 
-		resp, err := c.HTTPClient.Do(req)
+		resp, err := c.do(req)
 		if err != nil {
 			continue
 		}
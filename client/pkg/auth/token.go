@@ -30,8 +30,8 @@ func NewTokenManager() (*TokenManager, error) {
 	}, nil
 }
 
-// SaveToken saves a token for an instance
-func (tm *TokenManager) SaveToken(instance, url, user, token string) error {
+// SaveToken saves a token and its refresh token for an instance
+func (tm *TokenManager) SaveToken(instance, url, user, token, refreshToken string) error {
 	configFile := filepath.Join(tm.configDir, "config.yaml")
 
 	viper.SetConfigFile(configFile)
@@ -49,6 +49,8 @@ func (tm *TokenManager) SaveToken(instance, url, user, token string) error {
 	viper.Set(fmt.Sprintf("instances.%s.url", instance), url)
 	viper.Set(fmt.Sprintf("instances.%s.user", instance), user)
 	viper.Set(fmt.Sprintf("instances.%s.token", instance), token)
+	viper.Set(fmt.Sprintf("instances.%s.refresh_token", instance), refreshToken)
+	viper.Set(fmt.Sprintf("instances.%s.api_key", instance), "")
 
 	// Set default instance if not set
 	if !viper.IsSet("default_instance") {
@@ -75,7 +77,48 @@ func (tm *TokenManager) SaveToken(instance, url, user, token string) error {
 	return nil
 }
 
-// GetToken retrieves token for an instance
+// SaveAPIKey configures an instance with a personal API key instead of a login:
+// the key is sent as the token, and never refreshed
+func (tm *TokenManager) SaveAPIKey(instance, url, apiKey string) error {
+	configFile := filepath.Join(tm.configDir, "config.yaml")
+
+	viper.SetConfigFile(configFile)
+	viper.SetConfigType("yaml")
+
+	if err := viper.ReadInConfig(); err != nil {
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read config: %w", err)
+		}
+	}
+
+	viper.Set(fmt.Sprintf("instances.%s.url", instance), url)
+	viper.Set(fmt.Sprintf("instances.%s.user", instance), "")
+	viper.Set(fmt.Sprintf("instances.%s.token", instance), "")
+	viper.Set(fmt.Sprintf("instances.%s.refresh_token", instance), "")
+	viper.Set(fmt.Sprintf("instances.%s.api_key", instance), apiKey)
+
+	if !viper.IsSet("default_instance") {
+		viper.Set("default_instance", instance)
+	}
+
+	if err := viper.WriteConfig(); err != nil {
+		if os.IsNotExist(err) {
+			if err := viper.SafeWriteConfig(); err != nil {
+				return fmt.Errorf("failed to write config: %w", err)
+			}
+		} else {
+			return fmt.Errorf("failed to write config: %w", err)
+		}
+	}
+
+	if err := os.Chmod(configFile, 0600); err != nil {
+		return fmt.Errorf("failed to set config file permissions: %w", err)
+	}
+
+	return nil
+}
+
+// GetToken retrieves token for an instance: the API key when it is configured with one
 func (tm *TokenManager) GetToken(instance string) (url, user, token string, err error) {
 	configFile := filepath.Join(tm.configDir, "config.yaml")
 
@@ -97,6 +140,12 @@ func (tm *TokenManager) GetToken(instance string) (url, user, token string, err
 	url = viper.GetString(fmt.Sprintf("instances.%s.url", instance))
 	user = viper.GetString(fmt.Sprintf("instances.%s.user", instance))
 	token = viper.GetString(fmt.Sprintf("instances.%s.token", instance))
+	if apiKey := viper.GetString(fmt.Sprintf("instances.%s.api_key", instance)); apiKey != "" {
+		if url == "" {
+			return "", "", "", fmt.Errorf("instance '%s' not configured. Run 'rhobee login --instance %s' first", instance, instance)
+		}
+		return url, user, apiKey, nil
+	}
 
 	if url == "" || user == "" || token == "" {
 		return "", "", "", fmt.Errorf("instance '%s' not configured. Run 'rhobee login --instance %s' first", instance, instance)
@@ -105,6 +154,47 @@ func (tm *TokenManager) GetToken(instance string) (url, user, token string, err
 	return url, user, token, nil
 }
 
+// GetRefreshToken retrieves the refresh token for an instance, empty if there is none
+func (tm *TokenManager) GetRefreshToken(instance string) string {
+	configFile := filepath.Join(tm.configDir, "config.yaml")
+
+	viper.SetConfigFile(configFile)
+	viper.SetConfigType("yaml")
+
+	if err := viper.ReadInConfig(); err != nil {
+		return ""
+	}
+
+	if instance == "" {
+		instance = viper.GetString("default_instance")
+	}
+	return viper.GetString(fmt.Sprintf("instances.%s.refresh_token", instance))
+}
+
+// UpdateToken replaces the tokens of an instance after a refresh
+func (tm *TokenManager) UpdateToken(instance, token, refreshToken string) error {
+	configFile := filepath.Join(tm.configDir, "config.yaml")
+
+	viper.SetConfigFile(configFile)
+	viper.SetConfigType("yaml")
+
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("config file not found: %w", err)
+	}
+
+	if instance == "" {
+		instance = viper.GetString("default_instance")
+	}
+	viper.Set(fmt.Sprintf("instances.%s.token", instance), token)
+	viper.Set(fmt.Sprintf("instances.%s.refresh_token", instance), refreshToken)
+
+	if err := viper.WriteConfig(); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+
+	return nil
+}
+
 // GetDefaultInstance returns the default instance name
 func (tm *TokenManager) GetDefaultInstance() string {
 	configFile := filepath.Join(tm.configDir, "config.yaml")
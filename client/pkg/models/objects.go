@@ -97,10 +97,27 @@ type LoginRequest struct {
 
 // LoginResponse is the response from login
 type LoginResponse struct {
-	AccessToken string   `json:"access_token"`
-	ExpiresAt   int64    `json:"expires_at"`
-	UserID      string   `json:"user_id"`
-	Groups      []string `json:"groups"`
+	AccessToken  string   `json:"access_token"`
+	RefreshToken string   `json:"refresh_token"`
+	ExpiresAt    int64    `json:"expires_at"`
+	UserID       string   `json:"user_id"`
+	Groups       []string `json:"groups"`
+	// Set instead of the tokens when the second factor is needed
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	SetupRequired     bool   `json:"setup_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+// TwoFactorLoginRequest is the request body of the second step of the login
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code,omitempty"`
+	RecoveryCode   string `json:"recovery_code,omitempty"`
+}
+
+// RefreshRequest is the request body for refreshing the tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 // SearchResponse is the response from search
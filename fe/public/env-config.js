@@ -12,4 +12,6 @@ window.env = {
   ,REACT_APP_ENABLE_GITHUB_OAUTH: '${REACT_APP_ENABLE_GITHUB_OAUTH}'
   ,REACT_APP_ENABLE_TELEGRAM_OAUTH: '${REACT_APP_ENABLE_TELEGRAM_OAUTH}'
   ,REACT_APP_TELEGRAM_BOT_ID: '${REACT_APP_TELEGRAM_BOT_ID}'
+  ,REACT_APP_ENABLE_WEBAUTHN: '${REACT_APP_ENABLE_WEBAUTHN}'
+  ,REACT_APP_ENABLE_REGISTRATION: '${REACT_APP_ENABLE_REGISTRATION}'
 };
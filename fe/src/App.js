@@ -8,6 +8,8 @@ import { app_cfg } from './app.cfg';
 import DefaultPage from "./DefaultPage";
 import { AdminDashboard } from './admin/Dashboard';
 import Login from "./Login";
+import { Register, VerifyRegistration } from "./Register";
+import { ForgotPassword, ResetPassword } from "./PasswordReset";
 import Users from "./Users";
 import UserProfile from "./UserProfile";
 import Groups from './Groups';
@@ -25,15 +27,15 @@ import { People } from './dbobjects/DBPeople';
 import SiteNavigation from './SiteNavigation';
 import ContentEdit from './ContentEdit';
 import Search from './Search';
+import { Notifications } from './Notifications';
 import { AppFooter } from './Footer';
-import { isAdminUser, isWebmasterUser, isGuestUser, isTokenValid } from './sitenavigation_utils';
+import { hasCapability, isWebmasterUser, isGuestUser, isTokenValid } from './sitenavigation_utils';
 
 function App() {
   // const token = localStorage.getItem("token");
   const isValidToken = isTokenValid();
   // console.log("App: token present: " + (token ? "yes" : "no") + ", valid: " + (validToken ? "yes" : "no"));
   const groups = localStorage.getItem("groups") ? JSON.parse(localStorage.getItem("groups")) : [];
-  const isAdmin = isAdminUser();
   const isWebmaster = isWebmasterUser();
   
   return (
@@ -45,6 +47,10 @@ function App() {
             <Route path="/" element={<SiteNavigation />} />
             <Route path="/default" element={<DefaultPage />} />
             <Route path="/login" element={<Login />} />
+            <Route path="/register" element={app_cfg.enable_registration === 'true' ? <Register /> : <Navigate to="/login" />} />
+            <Route path="/register/verify" element={<VerifyRegistration />} />
+            <Route path="/password/forgot" element={<ForgotPassword />} />
+            <Route path="/password/reset" element={<ResetPassword />} />
 
             {/* Site Navigation - content by object ID */}
             <Route path="/c/:objectId" element={<SiteNavigation />} />
@@ -60,6 +66,7 @@ function App() {
             <Route path="/e/:id" element={isValidToken ? <ContentEdit /> : <Navigate to={`/c/${window.location.pathname.split('/').pop()}`} replace />} />
 
             {/* User profile - accessible by the user themselves or admins */}
+            <Route path="/notifications" element={isValidToken ? <Notifications /> : <Navigate to="/login" />} />
             <Route path="/users/:userId" element={isValidToken ? <UserProfile /> : <Navigate to="/login" />} />
 
             {/* Group profile - only for admins */}
@@ -82,10 +89,10 @@ function App() {
             {/* **** Admin **** */}
 
             {/* Protected routes - only for admins (group -2) */}
-            <Route path="/admin/dashboard" element={isValidToken && isAdmin ? <AdminDashboard /> : <Navigate to="/" />} />
+            <Route path="/admin/dashboard" element={isValidToken && hasCapability("dashboard.view") ? <AdminDashboard /> : <Navigate to="/" />} />
 
-            <Route path="/users" element={isValidToken && isAdmin ? <Users /> : <Navigate to="/" />} />
-            <Route path="/groups" element={isValidToken && isAdmin ? <Groups /> : <Navigate to="/" />} />
+            <Route path="/users" element={isValidToken && hasCapability("users.manage") ? <Users /> : <Navigate to="/" />} />
+            <Route path="/groups" element={isValidToken && hasCapability("groups.manage") ? <Groups /> : <Navigate to="/" />} />
 
             <Route path="/objects"    element={isValidToken ?    <Objects /> : <Navigate to="/" />} />
 
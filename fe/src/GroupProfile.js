@@ -6,6 +6,7 @@ import { ThemeContext } from "./ThemeContext";
 import { useTranslation } from "react-i18next";
 import AssociationManager from "./AssociationManager";
 import { getErrorMessage } from "./errorHandler";
+import { hasCapability } from "./sitenavigation_utils";
 
 function GroupProfile() {
   const { t } = useTranslation();
@@ -19,8 +20,7 @@ function GroupProfile() {
   const { dark, themeClass } = useContext(ThemeContext);
 
   const currentUserId = localStorage.getItem("user_id");
-  const userGroups = localStorage.getItem("groups") ? JSON.parse(localStorage.getItem("groups")) : [];
-  const isAdmin = userGroups.includes("-2");
+  const isAdmin = hasCapability("groups.manage");
 
   useEffect(() => {
     // Check permissions: must be admin
@@ -1,17 +1,25 @@
 import React, { useContext, useState, useEffect } from "react";
-import { useNavigate } from "react-router-dom";
+import { Link, useNavigate } from "react-router-dom";
 import api from "./axios";
 import { useTranslation } from "react-i18next";
 import { ThemeContext } from "./ThemeContext";
 import { getErrorMessage } from "./errorHandler";
 import { app_cfg } from "./app.cfg";
-import { isAdminUser } from "./sitenavigation_utils";
+import { hasCapability } from "./sitenavigation_utils";
+import { TwoFactorEnrollment, RecoveryCodes } from "./TwoFactor";
+import { webAuthnEnabled, loginWithCredential } from "./webauthn";
 
 function Login() {
   const { t } = useTranslation();
   const [login, setLogin] = useState("");
   const [pwd, setPwd] = useState("");
   const [errorMessage, setErrorMessage] = useState("");
+  // Second factor: challenge returned by /login, code, enrollment when required by the policy
+  const [challenge, setChallenge] = useState(null);
+  const [code, setCode] = useState("");
+  const [enrollment, setEnrollment] = useState(null);
+  const [recoveryCodes, setRecoveryCodes] = useState([]);
+  const [oidcProviders, setOidcProviders] = useState([]);
   const { dark, themeClass } = useContext(ThemeContext);
   const navigate = useNavigate();
 
@@ -21,10 +29,12 @@ function Login() {
         const data = ev.data;
         if (!data || !data.access_token) return;
         localStorage.setItem('token', data.access_token);
+        if (data.refresh_token) localStorage.setItem('refresh_token', data.refresh_token);
         localStorage.setItem('expires_at', data.expires_at);
         if (data.user_id) localStorage.setItem('user_id', data.user_id);
         if (data.login) localStorage.setItem('username', data.login);
         if (data.groups) localStorage.setItem('groups', JSON.stringify((data.groups+"").split(',')));
+        localStorage.setItem('capabilities', JSON.stringify(data.capabilities ? (data.capabilities+"").split(',') : []));
         navigate('/');
       } catch (e) {
         // ignore
@@ -34,33 +44,143 @@ function Login() {
     return () => { window.removeEventListener('message', onMessage); };
   }, [navigate]);
 
+  useEffect(() => {
+    api.get("/oauth/oidc/providers")
+      .then((res) => setOidcProviders(res.data || []))
+      .catch(() => setOidcProviders([]));
+  }, []);
+
+  const storeSession = (data) => {
+    localStorage.setItem("token", data.access_token);
+    localStorage.setItem("refresh_token", data.refresh_token);
+    localStorage.setItem("expires_at", data.expires_at);
+    // store username for Navbar display
+    localStorage.setItem("username", login);
+    localStorage.setItem("user_id", data.user_id);
+    localStorage.setItem("groups", JSON.stringify(data.groups));
+    localStorage.setItem("capabilities", JSON.stringify(data.capabilities || []));
+  };
+
+  const goHome = () => {
+    // go to the main page and refresh to load user-specific data
+    if (hasCapability("dashboard.view")) {
+      navigate('/admin/dashboard');
+    } else {
+      navigate("/");
+    }
+    window.location.reload();
+  };
+
   const handleSubmit = async (e) => {
     e.preventDefault();
     try {
       const res = await api.post("/login", { login, pwd });
-      localStorage.setItem("token", res.data.access_token);
-      localStorage.setItem("expires_at", res.data.expires_at);
-      const expiryDate = new Date(Number(res.data.expires_at)*1000);
-      const now = new Date();
-      const timeDiff = new Date(145*1000); //new Date(expiryDate - now);
-      // console.log("Expires at: " + expiryDate.toString()+"\nNow: " + now.toString()+"\nTime remaining (ms): " + timeDiff.getUTCHours()+":" + timeDiff.getUTCMinutes()+":" + timeDiff.getUTCSeconds() );
-      // store username for Navbar display
-      localStorage.setItem("username", login);
-      localStorage.setItem("user_id", res.data.user_id);
-      localStorage.setItem("groups", JSON.stringify(res.data.groups));
-      // go to the main page and refresh to load user-specific data
-      if (isAdminUser()) {
-        navigate('/admin/dashboard');
-      } else {
-        navigate("/");
+      if (res.data.two_factor_required) {
+        setErrorMessage("");
+        setChallenge(res.data);
+        if (res.data.setup_required) {
+          const setup = await api.post("/login/2fa/setup", { challenge_token: res.data.challenge_token });
+          setEnrollment(setup.data);
+        }
+        return;
       }
-      window.location.reload();
+      storeSession(res.data);
+      goHome();
     } catch (err) {
       const errorMsg = getErrorMessage(err, t("common.login_failed") || "Login failed");
       setErrorMessage(errorMsg);
     }
   };
 
+  // Passkey as the only factor, or security key as the second factor of the challenge
+  const handleWebAuthn = async () => {
+    setErrorMessage("");
+    try {
+      const res = await loginWithCredential({ login: login || undefined, challengeToken: challenge?.challenge_token });
+      storeSession(res.data);
+      goHome();
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t("common.login_failed") || "Login failed"));
+    }
+  };
+
+  const handleSubmitCode = async (e) => {
+    e.preventDefault();
+    const trimmed = code.trim();
+    const body = { challenge_token: challenge.challenge_token };
+    if (/^\d{6}$/.test(trimmed)) {
+      body.code = trimmed;
+    } else {
+      body.recovery_code = trimmed;
+    }
+    try {
+      const res = await api.post("/login/2fa", body);
+      storeSession(res.data);
+      if (res.data.recovery_codes && res.data.recovery_codes.length > 0) {
+        // The codes are shown only now: the user continues after saving them
+        setRecoveryCodes(res.data.recovery_codes);
+        return;
+      }
+      goHome();
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t("common.login_failed") || "Login failed"));
+    }
+  };
+
+  if (recoveryCodes.length > 0) {
+    return (
+      <div className={`container mt-2 mt-md-5 ${themeClass}`}>
+        <RecoveryCodes codes={recoveryCodes} />
+        <button className="btn btn-primary" onClick={goHome}>{t("twofactor.continue")}</button>
+      </div>
+    );
+  }
+
+  if (challenge) {
+    const useCode = challenge.setup_required || (challenge.methods || []).includes("totp");
+    const useKey = !challenge.setup_required && (challenge.methods || []).includes("webauthn") && !!window.PublicKeyCredential;
+    return (
+      <div className={`container mt-2 mt-md-5 d-flex justify-content-center align-items-center ${themeClass}`}>
+        <form onSubmit={handleSubmitCode} className="p-3">
+          {errorMessage && (
+            <div className="alert alert-danger" role="alert">
+              {errorMessage}
+            </div>
+          )}
+          {challenge.setup_required && (
+            <>
+              <div className="alert alert-info">{t("twofactor.required")}</div>
+              <TwoFactorEnrollment enrollment={enrollment} />
+            </>
+          )}
+          {useKey && (
+            <div className="form-group row mb-3">
+              <div className="col-md-4"></div>
+              <div className="col-md-8">
+                <button type="button" className="btn btn-primary" onClick={handleWebAuthn}>{t("webauthn.use_security_key")}</button>
+              </div>
+            </div>
+          )}
+          {useCode && (<>
+          <div className="form-group row">
+            <label className="col-md-4 col-form-label text-md-end">{t("twofactor.code")}</label>
+            <div className="col-md-8">
+              <input className="form-control mb-2" autoComplete="one-time-code" autoFocus value={code} onChange={e => setCode(e.target.value)} />
+              {!challenge.setup_required && <small className="text-secondary">{t("twofactor.code_help")}</small>}
+            </div>
+          </div>
+          <div className="form-group row mt-2">
+            <div className="col-md-4"></div>
+            <div className="col-md-8">
+              <button className="btn btn-primary" disabled={!code}>{t("twofactor.verify")}</button>
+            </div>
+          </div>
+          </>)}
+        </form>
+      </div>
+    );
+  }
+
   return (
     // Center horizontally and vertically, expand fields to reasonable size
     <div className={`container mt-2 mt-md-5 d-flex justify-content-center align-items-center ${themeClass}`}>
@@ -86,6 +206,13 @@ function Login() {
           <div className="col-md-4"></div>
           <div className="col-md-8">
             <button className="btn btn-primary">{t("common.login")}</button>
+            {webAuthnEnabled() && (
+              <button type="button" className="btn btn-outline-primary ms-2" onClick={handleWebAuthn}>{t("webauthn.sign_in_with_passkey")}</button>
+            )}
+            {app_cfg.enable_registration === 'true' && (
+              <Link className="btn btn-link" to="/register">{t("register.create_account")}</Link>
+            )}
+            <Link className="btn btn-link" to="/password/forgot">{t("password_reset.forgot")}</Link>
             </div>
         </div>
             { (app_cfg.enable_google_oauth === 'true' || app_cfg.enable_google_oauth === true || app_cfg.enable_google_oauth === '1') && (
@@ -128,6 +255,17 @@ function Login() {
                 </div>
               </div>
             ) }
+            { oidcProviders.map((provider) => (
+              <div key={provider.name} className="form-group row mt-3 m-auto">
+                <div className="col-md-12 text-center">
+                    <button type="button" className="btn btn-outline-secondary" onClick={() => {
+                        window.location.href = `${app_cfg.endpoint}/oauth/oidc/${encodeURIComponent(provider.name)}/start`;
+                      }}>
+                      {t("auth.sign_in_with", { name: provider.display_name })}
+                    </button>
+                </div>
+              </div>
+            )) }
       </form>
     </div>
   );
@@ -4,7 +4,9 @@ import { Navbar, Nav, NavDropdown, Container, Button, Dropdown, NavItem } from "
 import { ThemeContext } from "./ThemeContext";
 import { useTranslation } from "react-i18next";
 import { app_cfg } from "./app.cfg";
+import { hasCapability, isAdminUser } from "./sitenavigation_utils";
 import axios from "./axios";
+import { NotificationBell } from "./Notifications";
 
 function AppNavbar() {
   const navigate = useNavigate();
@@ -17,7 +19,7 @@ function AppNavbar() {
   const site_root = app_cfg.app_home_object_id;
   const [children, setChildren] = useState([]);
   const groups = localStorage.getItem("groups") ? JSON.parse(localStorage.getItem("groups")) : [];
-  const isAdmin = groups.includes("-2");
+  const isAdmin = isAdminUser();
   const isWebmaster = groups.includes(app_cfg.webmaster_group_id);
 
   const changeLanguage = (lng) => {
@@ -53,7 +55,9 @@ function AppNavbar() {
       const response = await axios.post("/logout");
       console.log("Logout response:", response.data);
       localStorage.removeItem("token");
+      localStorage.removeItem("refresh_token");
       localStorage.removeItem("username");
+      localStorage.removeItem("capabilities");
       setUsername(null);
       setChildren([]);
       loadChildren();
@@ -137,10 +141,10 @@ function AppNavbar() {
             )}
             {username && isAdmin ? (
               <NavDropdown title="Admin ⚙️" id="admin-nav-dropdown" align="end" {...(dark ? { menuVariant: 'dark' } : {})}>
-                <NavDropdown.Item as={Link} to="/admin/dashboard">{t("common.dashboard")}</NavDropdown.Item>
+                {hasCapability("dashboard.view") && <NavDropdown.Item as={Link} to="/admin/dashboard">{t("common.dashboard")}</NavDropdown.Item>}
                 <NavDropdown.Divider />
-                <NavDropdown.Item as={Link} to="/users">{t("users.users")}</NavDropdown.Item>
-                <NavDropdown.Item as={Link} to="/groups">{t("groups.groups")}</NavDropdown.Item>
+                {hasCapability("users.manage") && <NavDropdown.Item as={Link} to="/users">{t("users.users")}</NavDropdown.Item>}
+                {hasCapability("groups.manage") && <NavDropdown.Item as={Link} to="/groups">{t("groups.groups")}</NavDropdown.Item>}
                 <NavDropdown.Divider />
                 <NavDropdown.Item as={Link} to="/objects">{t("object.objects")}</NavDropdown.Item>
                 <NavDropdown.Divider />
@@ -185,6 +189,8 @@ function AppNavbar() {
             )}
 
           
+            {username && <NotificationBell dark={dark} />}
+
             {!username ? (
               <Button as={Link} to="/login" variant={dark ? "secondary" : "outline-secondary"}>
                 {t("common.login")}
@@ -202,6 +208,7 @@ function AppNavbar() {
                 </NavDropdown.Item>
                 <NavDropdown.Divider />
                 <NavDropdown.Item as={Link} to="/notes">{t("note.notes")}</NavDropdown.Item>
+                <NavDropdown.Item as={Link} to="/notifications">{t("notifications.notifications")}</NavDropdown.Item>
                 <NavDropdown.Divider />
                 <NavDropdown.Item onClick={handleLogout}>{t("common.logout")}</NavDropdown.Item>
               </NavDropdown>
@@ -0,0 +1,268 @@
+import React, { useContext, useEffect, useState } from "react";
+import { Link, useNavigate } from "react-router-dom";
+import { Container, Card, Form, Button, Alert, ListGroup, Badge, NavDropdown } from "react-bootstrap";
+import { useTranslation } from "react-i18next";
+import api from "./axios";
+import { getErrorMessage } from "./errorHandler";
+import { ThemeContext } from "./ThemeContext";
+
+// How often the bell asks for new notifications
+const POLL_INTERVAL_MS = 60 * 1000;
+
+// "Created by author, 2 hours ago" of a notification
+function NotificationText({ notification }) {
+  const { t } = useTranslation();
+  return (
+    <>
+      <div className={notification.read ? "" : "fw-bold"}>{notification.object_name}</div>
+      <small className="text-muted">
+        {t(`notifications.event_${notification.event}`, { actor: notification.actor_login || "?" })}
+        {" · "}
+        {new Date(notification.created_at * 1000).toLocaleString()}
+      </small>
+    </>
+  );
+}
+
+// Bell of the navbar with the count of the unread notifications and the latest ones
+export function NotificationBell({ dark }) {
+  const { t } = useTranslation();
+  const navigate = useNavigate();
+  const [list, setList] = useState({ notifications: [], unread: 0 });
+
+  const fetchNotifications = async () => {
+    try {
+      const res = await api.get("/notifications", { params: { limit: 10 } });
+      setList(res.data);
+    } catch (err) {
+      console.error("Error loading notifications:", err);
+    }
+  };
+
+  useEffect(() => {
+    fetchNotifications();
+    const timer = setInterval(fetchNotifications, POLL_INTERVAL_MS);
+    return () => clearInterval(timer);
+  }, []);
+
+  const open = async (notification) => {
+    if (!notification.read) {
+      try {
+        await api.post(`/notifications/${notification.id}/read`);
+      } catch (err) {
+        console.error("Error marking notification read:", err);
+      }
+      fetchNotifications();
+    }
+    navigate(`/c/${notification.object_id}`);
+  };
+
+  const title = (
+    <>
+      <i className="bi bi-bell"></i>
+      {list.unread > 0 && <Badge bg="danger" pill className="ms-1">{list.unread}</Badge>}
+    </>
+  );
+
+  return (
+    <NavDropdown title={title} id="notifications-nav-dropdown" align="end" className="me-2" {...(dark ? { menuVariant: "dark" } : {})}>
+      {list.notifications.length === 0 && (
+        <NavDropdown.ItemText className="text-muted">{t("notifications.empty")}</NavDropdown.ItemText>
+      )}
+      {list.notifications.map((notification) => (
+        <NavDropdown.Item key={notification.id} onClick={() => open(notification)} style={{ minWidth: "18rem" }}>
+          <NotificationText notification={notification} />
+        </NavDropdown.Item>
+      ))}
+      <NavDropdown.Divider />
+      <NavDropdown.Item as={Link} to="/notifications">{t("notifications.all")}</NavDropdown.Item>
+    </NavDropdown>
+  );
+}
+
+// Subscribe to an object or a folder, to be notified of its changes
+export function SubscribeButton({ objectId }) {
+  const { t } = useTranslation();
+  const [subscribed, setSubscribed] = useState(false);
+
+  useEffect(() => {
+    api.get(`/subscriptions/${objectId}`)
+      .then((res) => setSubscribed(res.data.subscribed))
+      .catch((err) => console.error("Error loading subscription:", err));
+  }, [objectId]);
+
+  const toggle = async () => {
+    try {
+      const res = subscribed
+        ? await api.delete(`/subscriptions/${objectId}`)
+        : await api.put(`/subscriptions/${objectId}`);
+      setSubscribed(res.data.subscribed);
+    } catch (err) {
+      alert(getErrorMessage(err, t));
+    }
+  };
+
+  return (
+    <Button variant={subscribed ? "primary" : "outline-primary"} size="sm" onClick={toggle} title={t(subscribed ? "notifications.unsubscribe" : "notifications.subscribe")}>
+      <i className={subscribed ? "bi bi-bell-fill me-1" : "bi bi-bell me-1"}></i>
+      {t(subscribed ? "notifications.subscribed" : "notifications.subscribe")}
+    </Button>
+  );
+}
+
+// In-app and email digest preferences of the current user
+export function NotificationPreferences({ dark }) {
+  const { t, i18n } = useTranslation();
+  const [preferences, setPreferences] = useState(null);
+  const [message, setMessage] = useState("");
+  const [errorMessage, setErrorMessage] = useState("");
+
+  useEffect(() => {
+    api.get("/notifications/preferences")
+      .then((res) => setPreferences(res.data))
+      .catch((err) => setErrorMessage(getErrorMessage(err, t)));
+  }, []);
+
+  const handleSave = async () => {
+    setMessage("");
+    setErrorMessage("");
+    try {
+      const res = await api.put("/notifications/preferences", { ...preferences, language: preferences.language || i18n.language });
+      setPreferences(res.data);
+      setMessage(t("common.saved"));
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t));
+    }
+  };
+
+  if (!preferences) return null;
+  return (
+    <Card bg={dark ? "dark" : "light"} text={dark ? "light" : "dark"} className="mt-3">
+      <Card.Header className={dark ? 'bg-secondary bg-opacity-25' : ''}>
+        <h4 className="mb-0">{t("notifications.preferences")}</h4>
+      </Card.Header>
+      <Card.Body className={dark ? 'bg-secondary bg-opacity-25' : ''}>
+        {message && <Alert variant="success">{message}</Alert>}
+        {errorMessage && <Alert variant="danger">{errorMessage}</Alert>}
+        <Form.Check
+          type="switch"
+          id="notifications-in-app"
+          className="mb-3"
+          label={t("notifications.in_app")}
+          checked={preferences.in_app}
+          onChange={(e) => setPreferences({ ...preferences, in_app: e.target.checked })}
+        />
+        <Form.Group className="mb-3">
+          <Form.Label>{t("notifications.email_digest")}</Form.Label>
+          <Form.Select value={preferences.email_digest} onChange={(e) => setPreferences({ ...preferences, email_digest: e.target.value })}>
+            <option value="never">{t("notifications.digest_never")}</option>
+            <option value="daily">{t("notifications.digest_daily")}</option>
+            <option value="weekly">{t("notifications.digest_weekly")}</option>
+          </Form.Select>
+        </Form.Group>
+        <Button variant="primary" onClick={handleSave}>{t("common.save")}</Button>
+      </Card.Body>
+    </Card>
+  );
+}
+
+// Page of all the notifications and the subscriptions
+export function Notifications() {
+  const { t } = useTranslation();
+  const navigate = useNavigate();
+  const { dark, themeClass } = useContext(ThemeContext);
+  const [list, setList] = useState({ notifications: [], unread: 0 });
+  const [subscriptions, setSubscriptions] = useState([]);
+  const [errorMessage, setErrorMessage] = useState("");
+
+  const fetchAll = async () => {
+    try {
+      const [notifications, subs] = await Promise.all([
+        api.get("/notifications", { params: { limit: 200 } }),
+        api.get("/subscriptions"),
+      ]);
+      setList(notifications.data);
+      setSubscriptions(subs.data || []);
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t));
+    }
+  };
+
+  useEffect(() => {
+    fetchAll();
+  }, []);
+
+  const open = async (notification) => {
+    if (!notification.read) {
+      await api.post(`/notifications/${notification.id}/read`).catch(() => {});
+    }
+    navigate(`/c/${notification.object_id}`);
+  };
+
+  const handleReadAll = async () => {
+    try {
+      await api.post("/notifications/read-all");
+      fetchAll();
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t));
+    }
+  };
+
+  const handleUnsubscribe = async (objectId) => {
+    try {
+      await api.delete(`/subscriptions/${objectId}`);
+      fetchAll();
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t));
+    }
+  };
+
+  return (
+    <Container className={`mt-3 ${themeClass}`}>
+      {errorMessage && <Alert variant="danger">{errorMessage}</Alert>}
+      <Card bg={dark ? "dark" : "light"} text={dark ? "light" : "dark"}>
+        <Card.Header className={`d-flex justify-content-between align-items-center ${dark ? 'bg-secondary bg-opacity-25' : ''}`}>
+          <h2 className="mb-0">{t("notifications.notifications")}</h2>
+          <Button variant="outline-secondary" size="sm" onClick={handleReadAll} disabled={list.unread === 0}>
+            {t("notifications.mark_all_read")}
+          </Button>
+        </Card.Header>
+        <ListGroup variant="flush">
+          {list.notifications.length === 0 && (
+            <ListGroup.Item className="text-muted">{t("notifications.empty")}</ListGroup.Item>
+          )}
+          {list.notifications.map((notification) => (
+            <ListGroup.Item key={notification.id} action onClick={() => open(notification)} variant={dark ? "dark" : undefined}>
+              <NotificationText notification={notification} />
+            </ListGroup.Item>
+          ))}
+        </ListGroup>
+      </Card>
+
+      <Card bg={dark ? "dark" : "light"} text={dark ? "light" : "dark"} className="mt-3">
+        <Card.Header className={dark ? 'bg-secondary bg-opacity-25' : ''}>
+          <h4 className="mb-0">{t("notifications.subscriptions")}</h4>
+        </Card.Header>
+        <ListGroup variant="flush">
+          {subscriptions.length === 0 && (
+            <ListGroup.Item className="text-muted">{t("notifications.no_subscriptions")}</ListGroup.Item>
+          )}
+          {subscriptions.map((subscription) => (
+            <ListGroup.Item key={subscription.object_id} className="d-flex justify-content-between align-items-center" variant={dark ? "dark" : undefined}>
+              {subscription.object_name
+                ? <Link to={`/c/${subscription.object_id}`}>{subscription.object_name}</Link>
+                : <span className="text-muted">{t("notifications.not_available")}</span>}
+              <Button variant="outline-danger" size="sm" onClick={() => handleUnsubscribe(subscription.object_id)}>
+                {t("notifications.unsubscribe")}
+              </Button>
+            </ListGroup.Item>
+          ))}
+        </ListGroup>
+      </Card>
+
+      <NotificationPreferences dark={dark} />
+    </Container>
+  );
+}
+
+export default Notifications;
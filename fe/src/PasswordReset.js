@@ -0,0 +1,124 @@
+import React, { useContext, useState } from "react";
+import { Link, useSearchParams } from "react-router-dom";
+import api from "./axios";
+import { useTranslation } from "react-i18next";
+import { ThemeContext } from "./ThemeContext";
+import { getErrorMessage } from "./errorHandler";
+
+export function ForgotPassword() {
+  const { t } = useTranslation();
+  const [login, setLogin] = useState("");
+  const [errorMessage, setErrorMessage] = useState("");
+  const [sent, setSent] = useState(false);
+  const { themeClass } = useContext(ThemeContext);
+
+  const handleSubmit = async (e) => {
+    e.preventDefault();
+    try {
+      await api.post("/password/forgot", { login });
+      setErrorMessage("");
+      setSent(true);
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t("password_reset.failed")));
+    }
+  };
+
+  if (sent) {
+    return (
+      <div className={`container mt-2 mt-md-5 ${themeClass}`}>
+        <div className="alert alert-success">{t("password_reset.check_email")}</div>
+      </div>
+    );
+  }
+
+  return (
+    <div className={`container mt-2 mt-md-5 d-flex justify-content-center align-items-center ${themeClass}`}>
+      <form onSubmit={handleSubmit} className="p-3">
+        {errorMessage && (
+          <div className="alert alert-danger" role="alert">
+            {errorMessage}
+          </div>
+        )}
+        <p>{t("password_reset.help")}</p>
+        <div className="form-group row">
+          <label className="col-md-4 col-form-label text-md-end">{t("password_reset.login_or_email")}</label>
+          <div className="col-md-8">
+            <input className="form-control mb-2" autoComplete="username" required value={login} onChange={e => setLogin(e.target.value)} />
+          </div>
+        </div>
+        <div className="form-group row">
+          <div className="col-md-4"></div>
+          <div className="col-md-8">
+            <button className="btn btn-primary">{t("password_reset.send")}</button>
+            <Link className="btn btn-link" to="/login">{t("common.login")}</Link>
+          </div>
+        </div>
+      </form>
+    </div>
+  );
+}
+
+export function ResetPassword() {
+  const { t } = useTranslation();
+  const [searchParams] = useSearchParams();
+  const [pwd, setPwd] = useState("");
+  const [confirmPwd, setConfirmPwd] = useState("");
+  const [errorMessage, setErrorMessage] = useState("");
+  const [done, setDone] = useState(false);
+  const { themeClass } = useContext(ThemeContext);
+
+  const handleSubmit = async (e) => {
+    e.preventDefault();
+    if (pwd !== confirmPwd) {
+      setErrorMessage(t("register.passwords_differ"));
+      return;
+    }
+    try {
+      await api.post("/password/reset", { token: searchParams.get("token") || "", pwd });
+      setErrorMessage("");
+      setDone(true);
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t("password_reset.failed")));
+    }
+  };
+
+  if (done) {
+    return (
+      <div className={`container mt-2 mt-md-5 ${themeClass}`}>
+        <div className="alert alert-success">
+          {t("password_reset.done")} <Link to="/login">{t("common.login")}</Link>
+        </div>
+      </div>
+    );
+  }
+
+  return (
+    <div className={`container mt-2 mt-md-5 d-flex justify-content-center align-items-center ${themeClass}`}>
+      <form onSubmit={handleSubmit} className="p-3">
+        {errorMessage && (
+          <div className="alert alert-danger" role="alert">
+            {errorMessage}
+          </div>
+        )}
+        <div className="form-group row">
+          <label className="col-md-4 col-form-label text-md-end">{t("password_reset.new_password")}</label>
+          <div className="col-md-8">
+            <input className="form-control mb-2" type="password" autoComplete="new-password" required value={pwd} onChange={e => setPwd(e.target.value)} />
+          </div>
+        </div>
+        <div className="form-group row">
+          <label className="col-md-4 col-form-label text-md-end">{t("register.confirm_password")}</label>
+          <div className="col-md-8">
+            <input className="form-control mb-2" type="password" autoComplete="new-password" required value={confirmPwd} onChange={e => setConfirmPwd(e.target.value)} />
+          </div>
+        </div>
+        <div className="form-group row">
+          <div className="col-md-4"></div>
+          <div className="col-md-8">
+            <button className="btn btn-primary">{t("password_reset.submit")}</button>
+          </div>
+        </div>
+      </form>
+    </div>
+  );
+}
@@ -0,0 +1,126 @@
+import React, { useContext, useEffect, useRef, useState } from "react";
+import { Link, useSearchParams } from "react-router-dom";
+import api from "./axios";
+import { useTranslation } from "react-i18next";
+import { ThemeContext } from "./ThemeContext";
+import { getErrorMessage } from "./errorHandler";
+
+export function Register() {
+  const { t } = useTranslation();
+  const [form, setForm] = useState({ login: "", fullname: "", email: "", pwd: "", website: "" });
+  const [confirmPwd, setConfirmPwd] = useState("");
+  const [errorMessage, setErrorMessage] = useState("");
+  const [sent, setSent] = useState(false);
+  const { themeClass } = useContext(ThemeContext);
+
+  const setField = (field) => (e) => setForm({ ...form, [field]: e.target.value });
+
+  const handleSubmit = async (e) => {
+    e.preventDefault();
+    if (form.pwd !== confirmPwd) {
+      setErrorMessage(t("register.passwords_differ"));
+      return;
+    }
+    try {
+      await api.post("/register", form);
+      setErrorMessage("");
+      setSent(true);
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t("register.failed")));
+    }
+  };
+
+  if (sent) {
+    return (
+      <div className={`container mt-2 mt-md-5 ${themeClass}`}>
+        <div className="alert alert-success">{t("register.check_email", { email: form.email })}</div>
+      </div>
+    );
+  }
+
+  return (
+    <div className={`container mt-2 mt-md-5 d-flex justify-content-center align-items-center ${themeClass}`}>
+      <form onSubmit={handleSubmit} className="p-3">
+        {errorMessage && (
+          <div className="alert alert-danger" role="alert">
+            {errorMessage}
+          </div>
+        )}
+        <div className="form-group row">
+          <label className="col-md-4 col-form-label text-md-end">Login</label>
+          <div className="col-md-8">
+            <input className="form-control mb-2" autoComplete="username" required value={form.login} onChange={setField("login")} />
+          </div>
+        </div>
+        <div className="form-group row">
+          <label className="col-md-4 col-form-label text-md-end">{t("register.fullname")}</label>
+          <div className="col-md-8">
+            <input className="form-control mb-2" autoComplete="name" value={form.fullname} onChange={setField("fullname")} />
+          </div>
+        </div>
+        <div className="form-group row">
+          <label className="col-md-4 col-form-label text-md-end">Email</label>
+          <div className="col-md-8">
+            <input className="form-control mb-2" type="email" autoComplete="email" required value={form.email} onChange={setField("email")} />
+          </div>
+        </div>
+        <div className="form-group row">
+          <label className="col-md-4 col-form-label text-md-end">Password</label>
+          <div className="col-md-8">
+            <input className="form-control mb-2" type="password" autoComplete="new-password" required value={form.pwd} onChange={setField("pwd")} />
+          </div>
+        </div>
+        <div className="form-group row">
+          <label className="col-md-4 col-form-label text-md-end">{t("register.confirm_password")}</label>
+          <div className="col-md-8">
+            <input className="form-control mb-2" type="password" autoComplete="new-password" required value={confirmPwd} onChange={e => setConfirmPwd(e.target.value)} />
+          </div>
+        </div>
+        {/* Hidden to people: only bots fill it */}
+        <div style={{ position: "absolute", left: "-10000px" }} aria-hidden="true">
+          <input tabIndex="-1" autoComplete="off" value={form.website} onChange={setField("website")} />
+        </div>
+        <div className="form-group row">
+          <div className="col-md-4"></div>
+          <div className="col-md-8">
+            <button className="btn btn-primary">{t("register.submit")}</button>
+            <Link className="btn btn-link" to="/login">{t("register.have_account")}</Link>
+          </div>
+        </div>
+      </form>
+    </div>
+  );
+}
+
+export function VerifyRegistration() {
+  const { t } = useTranslation();
+  const [searchParams] = useSearchParams();
+  const [status, setStatus] = useState("pending");
+  const [errorMessage, setErrorMessage] = useState("");
+  const { themeClass } = useContext(ThemeContext);
+  const requested = useRef(false);
+
+  useEffect(() => {
+    // The link is confirmed once, even when the effect runs twice
+    if (requested.current) return;
+    requested.current = true;
+    api.post("/register/verify", { token: searchParams.get("token") || "" })
+      .then(() => setStatus("verified"))
+      .catch((err) => {
+        setErrorMessage(getErrorMessage(err, t("register.verify_failed")));
+        setStatus("failed");
+      });
+  }, [searchParams, t]);
+
+  return (
+    <div className={`container mt-2 mt-md-5 ${themeClass}`}>
+      {status === "pending" && <div className="alert alert-info">{t("register.verifying")}</div>}
+      {status === "verified" && (
+        <div className="alert alert-success">
+          {t("register.verified")} <Link to="/login">{t("common.login")}</Link>
+        </div>
+      )}
+      {status === "failed" && <div className="alert alert-danger">{errorMessage}</div>}
+    </div>
+  );
+}
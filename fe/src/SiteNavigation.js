@@ -6,6 +6,7 @@ import { useTranslation } from 'react-i18next';
 import { app_cfg } from './app.cfg';
 import { ContentView } from './ContentView';
 import NewObjectButton from './NewObjectButton';
+import { SubscribeButton } from './Notifications';
 import ObjectList from './ObjectList';
 import { getErrorMessage } from './errorHandler';
 import { ThemeContext } from './ThemeContext';
@@ -118,8 +119,10 @@ function SiteNavigation() {
                                         </Breadcrumb.Item>
                                     ))}
                                 </Breadcrumb>
-                            {!loading && content && content.metadata && content.metadata.can_edit && (
+                            {!loading && content && content.metadata && (
                                 <div className="d-flex gap-2">
+                                    {localStorage.getItem("token") && <SubscribeButton objectId={content.data.id} />}
+                                    {content.metadata.can_edit && (<>
                                     <Button 
                                         variant="outline-primary" 
                                         size="sm"
@@ -134,6 +137,7 @@ function SiteNavigation() {
                                             loadChildren(); // Refresh children list
                                         }}
                                     />
+                                    </>)}
                                 </div>
                             )}
                         </div>
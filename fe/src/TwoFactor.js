@@ -0,0 +1,223 @@
+import React, { useEffect, useState } from "react";
+import { Card, Form, Button, Alert, ListGroup } from "react-bootstrap";
+import { useTranslation } from "react-i18next";
+import api from "./axios";
+import { getErrorMessage } from "./errorHandler";
+import { webAuthnEnabled, registerCredential } from "./webauthn";
+
+// Secret and provisioning URI of a new enrollment, to be added to the authenticator app
+export function TwoFactorEnrollment({ enrollment }) {
+  const { t } = useTranslation();
+  if (!enrollment) return null;
+  return (
+    <div className="mb-3">
+      <p>{t("twofactor.enroll_help")}</p>
+      <p>
+        <code className="fs-5" style={{ wordBreak: "break-all" }}>{enrollment.secret.match(/.{1,4}/g).join(" ")}</code>
+      </p>
+      <p>
+        <a href={enrollment.provisioning_uri}>{t("twofactor.open_in_app")}</a>
+      </p>
+    </div>
+  );
+}
+
+// One-time recovery codes, shown only once
+export function RecoveryCodes({ codes }) {
+  const { t } = useTranslation();
+  if (!codes || codes.length === 0) return null;
+  return (
+    <Alert variant="warning">
+      <p>{t("twofactor.recovery_codes_help")}</p>
+      <pre className="mb-0">{codes.join("\n")}</pre>
+    </Alert>
+  );
+}
+
+// Passkeys and security keys registered by the user
+function SecurityKeys({ userId, isOwnProfile, dark }) {
+  const { t } = useTranslation();
+  const [credentials, setCredentials] = useState([]);
+  const [name, setName] = useState("");
+  const [errorMessage, setErrorMessage] = useState("");
+
+  const fetchCredentials = async () => {
+    try {
+      const res = await api.get(`/users/${userId}/webauthn`);
+      setCredentials(res.data || []);
+    } catch (err) {
+      console.error("Error loading security keys:", err);
+    }
+  };
+
+  useEffect(() => {
+    fetchCredentials();
+  }, [userId]);
+
+  const handleAdd = async () => {
+    setErrorMessage("");
+    try {
+      await registerCredential(userId, name);
+      setName("");
+      fetchCredentials();
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t));
+    }
+  };
+
+  const handleDelete = async (credential) => {
+    if (!window.confirm(t("webauthn.delete_confirm", { name: credential.name }))) return;
+    setErrorMessage("");
+    try {
+      await api.delete(`/users/${userId}/webauthn/${credential.id}`);
+      fetchCredentials();
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t));
+    }
+  };
+
+  return (
+    <div className="mt-4">
+      <h5>{t("webauthn.title")}</h5>
+      {errorMessage && <Alert variant="danger">{errorMessage}</Alert>}
+      {credentials.length === 0 && <p>{t("webauthn.none")}</p>}
+      {credentials.length > 0 && (
+        <ListGroup className="mb-3">
+          {credentials.map((c) => (
+            <ListGroup.Item key={c.id} variant={dark ? "dark" : undefined} className="d-flex justify-content-between align-items-center">
+              <span>
+                {c.name}
+                <small className="text-secondary ms-2">
+                  {t("webauthn.created", { date: new Date(c.created_at * 1000).toLocaleDateString() })}
+                  {c.last_used_at ? " - " + t("webauthn.last_used", { date: new Date(c.last_used_at * 1000).toLocaleString() }) : ""}
+                </small>
+              </span>
+              <Button variant="outline-danger" size="sm" onClick={() => handleDelete(c)}>{t("webauthn.delete")}</Button>
+            </ListGroup.Item>
+          ))}
+        </ListGroup>
+      )}
+      {isOwnProfile && (
+        <div className="d-flex gap-2">
+          <Form.Control
+            type="text"
+            placeholder={t("webauthn.name")}
+            value={name}
+            onChange={(e) => setName(e.target.value)}
+          />
+          <Button variant="primary" className="text-nowrap" onClick={handleAdd}>{t("webauthn.add")}</Button>
+        </div>
+      )}
+    </div>
+  );
+}
+
+// Two-factor authentication section of the user profile
+function TwoFactorSettings({ userId, isOwnProfile, dark }) {
+  const { t } = useTranslation();
+  const [status, setStatus] = useState(null);
+  const [enrollment, setEnrollment] = useState(null);
+  const [recoveryCodes, setRecoveryCodes] = useState([]);
+  const [code, setCode] = useState("");
+  const [errorMessage, setErrorMessage] = useState("");
+
+  const fetchStatus = async () => {
+    try {
+      const res = await api.get(`/users/${userId}/2fa`);
+      setStatus(res.data);
+    } catch (err) {
+      console.error("Error loading two-factor status:", err);
+    }
+  };
+
+  useEffect(() => {
+    fetchStatus();
+  }, [userId]);
+
+  const run = async (request) => {
+    setErrorMessage("");
+    try {
+      await request();
+      setCode("");
+      fetchStatus();
+    } catch (err) {
+      setErrorMessage(getErrorMessage(err, t));
+    }
+  };
+
+  const handleEnroll = () => run(async () => {
+    const res = await api.post(`/users/${userId}/2fa/enroll`);
+    setRecoveryCodes([]);
+    setEnrollment(res.data);
+  });
+
+  const handleConfirm = () => run(async () => {
+    const res = await api.post(`/users/${userId}/2fa/confirm`, { code });
+    setEnrollment(null);
+    setRecoveryCodes(res.data.recovery_codes);
+  });
+
+  const handleRegenerate = () => run(async () => {
+    const res = await api.post(`/users/${userId}/2fa/recovery-codes`, { code });
+    setRecoveryCodes(res.data.recovery_codes);
+  });
+
+  const handleDisable = () => run(async () => {
+    if (!window.confirm(t("twofactor.disable_confirm"))) return;
+    const body = code.length === 6 ? { code } : { recovery_code: code };
+    await api.delete(`/users/${userId}/2fa`, { data: isOwnProfile ? body : {} });
+    setRecoveryCodes([]);
+  });
+
+  if (!status) return null;
+
+  return (
+    <Card bg={dark ? "dark" : "light"} text={dark ? "light" : "dark"} className="mt-3">
+      <Card.Header className={dark ? 'bg-secondary bg-opacity-25' : ''}>
+        <h4 className="mb-0">{t("twofactor.title")}</h4>
+      </Card.Header>
+      <Card.Body className={dark ? 'bg-secondary bg-opacity-25' : ''}>
+        {errorMessage && <Alert variant="danger">{errorMessage}</Alert>}
+        <p>
+          {status.enabled
+            ? t("twofactor.enabled", { count: status.recovery_codes_left })
+            : t("twofactor.disabled")}
+        </p>
+        {status.required && !status.enabled && <Alert variant="info">{t("twofactor.required")}</Alert>}
+        <RecoveryCodes codes={recoveryCodes} />
+        <TwoFactorEnrollment enrollment={enrollment} />
+
+        {isOwnProfile && (enrollment || status.enabled) && (
+          <Form.Group className="mb-3">
+            <Form.Label>{t("twofactor.code")}</Form.Label>
+            <Form.Control
+              type="text"
+              autoComplete="one-time-code"
+              value={code}
+              onChange={(e) => setCode(e.target.value)}
+            />
+          </Form.Group>
+        )}
+
+        <div className="d-flex gap-2">
+          {isOwnProfile && !status.enabled && !enrollment && (
+            <Button variant="primary" onClick={handleEnroll}>{t("twofactor.enable")}</Button>
+          )}
+          {isOwnProfile && enrollment && (
+            <Button variant="primary" onClick={handleConfirm} disabled={!code}>{t("twofactor.confirm")}</Button>
+          )}
+          {isOwnProfile && status.enabled && (
+            <Button variant="secondary" onClick={handleRegenerate} disabled={code.length !== 6}>{t("twofactor.new_recovery_codes")}</Button>
+          )}
+          {status.enabled && (
+            <Button variant="danger" onClick={handleDisable} disabled={isOwnProfile && !code}>{t("twofactor.disable")}</Button>
+          )}
+        </div>
+
+        {webAuthnEnabled() && <SecurityKeys userId={userId} isOwnProfile={isOwnProfile} dark={dark} />}
+      </Card.Body>
+    </Card>
+  );
+}
+
+export default TwoFactorSettings;
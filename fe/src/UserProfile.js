@@ -6,7 +6,10 @@ import { ThemeContext } from "./ThemeContext";
 import { useTranslation } from "react-i18next";
 import AssociationManager from "./AssociationManager";
 import { getErrorMessage } from "./errorHandler";
+import { hasCapability } from "./sitenavigation_utils";
 import {GroupLinkView} from "./ContentWidgets";
+import TwoFactorSettings from "./TwoFactor";
+import { NotificationPreferences } from "./Notifications";
 
 function UserProfile() {
   const { t } = useTranslation();
@@ -21,8 +24,7 @@ function UserProfile() {
   const { dark, themeClass } = useContext(ThemeContext);
 
   const currentUserId = localStorage.getItem("user_id");
-  const userGroups = localStorage.getItem("groups") ? JSON.parse(localStorage.getItem("groups")) : [];
-  const isAdmin = userGroups.includes("-2");
+  const isAdmin = hasCapability("users.manage");
   const isOwnProfile = userId === currentUserId;
 
   useEffect(() => {
@@ -154,9 +156,11 @@ function UserProfile() {
       // If user deleted their own account, logout
       if (isOwnProfile) {
         localStorage.removeItem("token");
+        localStorage.removeItem("refresh_token");
         localStorage.removeItem("username");
         localStorage.removeItem("user_id");
         localStorage.removeItem("groups");
+        localStorage.removeItem("capabilities");
         navigate("/login");
       } else {
         navigate("/users");
@@ -266,6 +270,8 @@ function UserProfile() {
           </Form>
         </Card.Body>
       </Card>
+      <TwoFactorSettings userId={userId} isOwnProfile={isOwnProfile} dark={dark} />
+      {isOwnProfile && <NotificationPreferences dark={dark} />}
     </Container>
   );
 }
@@ -20,4 +20,6 @@ export const app_cfg = {
     enable_github_oauth: getRuntimeConfig('REACT_APP_ENABLE_GITHUB_OAUTH', 'false'),
     enable_telegram_oauth: getRuntimeConfig('REACT_APP_ENABLE_TELEGRAM_OAUTH', 'false'),
     telegram_bot_id: getRuntimeConfig('REACT_APP_TELEGRAM_BOT_ID', ''),
+    enable_webauthn: getRuntimeConfig('REACT_APP_ENABLE_WEBAUTHN', 'false'),
+    enable_registration: getRuntimeConfig('REACT_APP_ENABLE_REGISTRATION', 'false'),
 };
@@ -22,19 +22,59 @@ api.interceptors.request.use(
   }
 );
 
+// rinnovo silenzioso della sessione: una sola richiesta di refresh alla volta
+let refreshPromise = null;
+
+function refreshSession() {
+  if (!refreshPromise) {
+    const refreshToken = localStorage.getItem("refresh_token");
+    refreshPromise = (refreshToken
+      ? axios.post(endpoint + "/token/refresh", { refresh_token: refreshToken })
+      : Promise.reject(new Error("no refresh token"))
+    )
+      .then((res) => {
+        localStorage.setItem("token", res.data.access_token);
+        localStorage.setItem("refresh_token", res.data.refresh_token);
+        localStorage.setItem("expires_at", res.data.expires_at);
+        localStorage.setItem("groups", JSON.stringify(res.data.groups));
+        localStorage.setItem("capabilities", JSON.stringify(res.data.capabilities || []));
+        return res.data.access_token;
+      })
+      .finally(() => {
+        refreshPromise = null;
+      });
+  }
+  return refreshPromise;
+}
+
 // interceptor di risposta
 api.interceptors.response.use(
   (response) => response,
-  (error) => {
+  async (error) => {
     if (error.response && error.response.status === 401) {
       const token = localStorage.getItem("token");
-      
+      const original = error.config;
+
+      // Session expired: try once with a new access token
+      if (token && original && !original._retried) {
+        original._retried = true;
+        try {
+          const newToken = await refreshSession();
+          original.headers.Authorization = `Bearer ${newToken}`;
+          return api(original);
+        } catch (refreshError) {
+          // fall through to the logout
+        }
+      }
+
       // Only redirect if we actually had a token (session expired)
       // If no token, the 401 is expected for protected resources
       if (token) {
         localStorage.removeItem("token");
+        localStorage.removeItem("refresh_token");
         localStorage.removeItem("username");
         localStorage.removeItem("groups");
+        localStorage.removeItem("capabilities");
         
         // Redirect to login page instead of home
         window.location.href = "/login";
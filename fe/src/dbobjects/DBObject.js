@@ -6,6 +6,7 @@ import {
     formateDateTimeString, 
     formatDescription, 
     classname2bootstrapIcon,
+    hasCapability,
 } from '../sitenavigation_utils';
 import {
   CountryView,
@@ -373,8 +374,7 @@ export function ObjectSearch({searchClassname, searchColumns, resultsColumns, or
   const [limit, setLimit] = useState(20); // Change to 20 for production
   const [offset, setOffset] = useState(0);
 
-  const groups = localStorage.getItem("groups") ? JSON.parse(localStorage.getItem("groups")) : [];
-  const isAdmin = groups.includes("-2");
+  const isAdmin = hasCapability("trash.view_all");
   // const isWebmaster = groups.includes(app_cfg.webmaster_group_id);
 
   // Load folders on start
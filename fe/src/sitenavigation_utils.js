@@ -80,9 +80,14 @@ export function isTokenValid() {
     return true;
 }
 
+// Capabilities of the groups of the user, e.g. users.manage: given by the server at login and refresh
+export function hasCapability(capability) {
+    const capabilities = localStorage.getItem("capabilities") ? JSON.parse(localStorage.getItem("capabilities")) : [];
+    return capabilities.includes(capability);
+}
+
 export function isAdminUser() {
-    const groups = localStorage.getItem("groups") ? JSON.parse(localStorage.getItem("groups")) : [];
-    return groups.includes("-2");
+    return hasCapability("dashboard.view") || hasCapability("users.manage") || hasCapability("groups.manage");
 }
 
 export function isWebmasterUser() {
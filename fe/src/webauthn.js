@@ -0,0 +1,74 @@
+import api from "./axios";
+import { app_cfg } from "./app.cfg";
+
+// The server exchanges binary fields as base64url strings, the browser API wants ArrayBuffers
+
+const toBuffer = (value) => {
+  const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+  const padded = base64 + "=".repeat((4 - (base64.length % 4)) % 4);
+  return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer;
+};
+
+const toBase64url = (buffer) => {
+  if (!buffer) return undefined;
+  let binary = "";
+  new Uint8Array(buffer).forEach((b) => { binary += String.fromCharCode(b); });
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+};
+
+const decodeDescriptors = (list) =>
+  (list || []).map((c) => ({ ...c, id: toBuffer(c.id) }));
+
+const decodeOptions = (options) => {
+  const publicKey = { ...options.publicKey, challenge: toBuffer(options.publicKey.challenge) };
+  if (publicKey.user) publicKey.user = { ...publicKey.user, id: toBuffer(publicKey.user.id) };
+  if (publicKey.excludeCredentials) publicKey.excludeCredentials = decodeDescriptors(publicKey.excludeCredentials);
+  if (publicKey.allowCredentials) publicKey.allowCredentials = decodeDescriptors(publicKey.allowCredentials);
+  return { ...options, publicKey };
+};
+
+const encodeCredential = (credential) => {
+  const response = {
+    clientDataJSON: toBase64url(credential.response.clientDataJSON),
+  };
+  if (credential.response.attestationObject) {
+    response.attestationObject = toBase64url(credential.response.attestationObject);
+    if (credential.response.getTransports) response.transports = credential.response.getTransports();
+  } else {
+    response.authenticatorData = toBase64url(credential.response.authenticatorData);
+    response.signature = toBase64url(credential.response.signature);
+    response.userHandle = toBase64url(credential.response.userHandle);
+  }
+  return {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    response,
+  };
+};
+
+export const webAuthnEnabled = () =>
+  !!window.PublicKeyCredential &&
+  (app_cfg.enable_webauthn === 'true' || app_cfg.enable_webauthn === true || app_cfg.enable_webauthn === '1');
+
+// Registers a new passkey or security key for the user
+export async function registerCredential(userId, name) {
+  const begin = await api.post(`/users/${userId}/webauthn/register/begin`);
+  const credential = await navigator.credentials.create(decodeOptions(begin.data.options));
+  return api.post(`/users/${userId}/webauthn/register/finish`, {
+    ceremony_token: begin.data.ceremony_token,
+    name,
+    credential: encodeCredential(credential),
+  });
+}
+
+// Logs in with a passkey; with a challenge token it is the second factor of a password login
+export async function loginWithCredential({ login, challengeToken } = {}) {
+  const begin = await api.post("/login/webauthn/begin", { login, challenge_token: challengeToken });
+  const credential = await navigator.credentials.get(decodeOptions(begin.data.options));
+  return api.post("/login/webauthn/finish", {
+    ceremony_token: begin.data.ceremony_token,
+    challenge_token: challengeToken,
+    credential: encodeCredential(credential),
+  });
+}